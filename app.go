@@ -4,10 +4,13 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"path"
+	"sync/atomic"
 	"time"
 
 	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
 	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/gorilla/mux"
+	"github.com/kandoo/beehive/Godeps/_workspace/src/golang.org/x/net/context"
 	"github.com/kandoo/beehive/bucket"
 	"github.com/kandoo/beehive/state"
 )
@@ -30,6 +33,17 @@ type App interface {
 	// the qualified name of msgType's reflection type.
 	HandleFunc(msgType interface{}, m MapFunc, r RcvFunc) error
 
+	// Subscribe subscribes the app to the topics that match pattern, and handles
+	// the messages emitted on those topics using the handler. In patterns, "*"
+	// matches one segment of the topic, and "#" matches the remaining segments.
+	// msgs are instances of the message types emitted on those topics, which
+	// are registered so that they can be received from other hives.
+	Subscribe(pattern string, h Handler, msgs ...interface{}) error
+	// SubscribeFunc subscribes the app to the topics that match pattern using
+	// the map and receive functions.
+	SubscribeFunc(pattern string, m MapFunc, r RcvFunc,
+		msgs ...interface{}) error
+
 	// Regsiters the app's detached handler.
 	Detached(h DetachedHandler)
 	// Registers the detached handler using functions.
@@ -91,6 +105,66 @@ func NonTransactional() AppOption {
 	}
 }
 
+// OnDisk is an application option that stores the dictionaries of the
+// application's bees on disk, under the state path of the hive, instead of
+// keeping them in memory. This is useful for applications whose state does not
+// fit in memory.
+func OnDisk() AppOption {
+	return func(a *app) {
+		a.flags |= appFlagOnDisk
+	}
+}
+
+// Expiry is an application option that makes the bees of the application
+// delete their expired keys (i.e., the keys put using state.PutWithTTL) every
+// tick. Expirations are committed as transactions and are replicated like any
+// other deletion. If the application handles Expired, the bee also receives an
+// Expired message for each expired key.
+func Expiry(tick time.Duration) AppOption {
+	return func(a *app) {
+		a.expiryTick = tick
+	}
+}
+
+// Index is an application option that declares a secondary index on a
+// dictionary of the application's bees. f extracts the index keys of each
+// entry. Indexes are maintained in the transactions of the bee, and can be
+// queried using RcvContext.Lookup. This option also makes the application
+// transactional.
+func Index(dict, name string, f state.IndexFn) AppOption {
+	return func(a *app) {
+		a.flags |= appFlagTransactional
+		a.indexes = append(a.indexes, appIndex{dict: dict, name: name, fn: f})
+	}
+}
+
+// Watch is an application option that watches the given dictionaries of the
+// application's bees. After a bee commits a transaction, it receives a
+// DictChanged message for each key modified in the watched dictionaries. The
+// application must handle DictChanged to receive the changes. This option also
+// makes the application transactional.
+func Watch(dicts ...string) AppOption {
+	return func(a *app) {
+		a.flags |= appFlagTransactional
+		if a.watches == nil {
+			a.watches = make(map[string]bool)
+		}
+		for _, d := range dicts {
+			a.watches[d] = true
+		}
+	}
+}
+
+// Optimistic is an application option that tracks the keys read in the
+// transactions of the application's bees. CommitTx fails with a
+// *state.ConflictError if a key read in the transaction is modified before the
+// transaction commits. This option also makes the application transactional.
+func Optimistic() AppOption {
+	return func(a *app) {
+		a.flags |= appFlagOptimistic | appFlagTransactional
+	}
+}
+
 // Placement is an application option that customizes the default
 // placement strategy for the application.
 func Placement(m PlacementMethod) AppOption {
@@ -142,6 +216,15 @@ type Handler interface {
 	Map(m Msg, c MapContext) MappedCells
 }
 
+// DictScoper is an optional interface of handlers that access the
+// dictionaries of the bee under prefixes, such as composed handlers that
+// isolate their dictionaries. The indexes declared using Index are maintained
+// on the dictionaries under each of the prefixes as well.
+type DictScoper interface {
+	// DictPrefixes returns the prefixes of the dictionaries used by the handler.
+	DictPrefixes() []string
+}
+
 // DetachedHandler in contrast to normal Handlers with Map and Rcv, starts in
 // their own go-routine and emit messages. They do not listen on a particular
 // message and only recv replys in their receive functions.
@@ -202,16 +285,42 @@ func (c runtimeRcvContext) ID() uint64 {
 	return 0
 }
 
+func (c runtimeRcvContext) Attempt() int {
+	return 1
+}
+
 func (c runtimeRcvContext) Printf(format string, a ...interface{}) {}
 
-func (c runtimeRcvContext) Emit(msgData interface{}) {}
+func (c runtimeRcvContext) Emit(msgData interface{}, opts ...EmitOption) {}
+
+func (c runtimeRcvContext) EmitTo(topic string, msgData interface{},
+	opts ...EmitOption) {
+}
 
 func (c runtimeRcvContext) SendToCell(msgData interface{}, app string,
-	cell CellKey) {
+	cell CellKey, opts ...EmitOption) {
 }
 
 func (c runtimeRcvContext) SendToBee(msgData interface{}, to uint64) {}
 
+func (c runtimeRcvContext) Ask(req interface{}, opts ...EmitOption) (Future,
+	error) {
+
+	return Future{}, nil
+}
+
+func (c runtimeRcvContext) Gather(ctx context.Context, app string,
+	cells []CellKey, req interface{}) []GatherResult {
+
+	return nil
+}
+
+func (c runtimeRcvContext) SyncAll(ctx context.Context, app string,
+	req interface{}) []GatherResult {
+
+	return nil
+}
+
 func (c runtimeRcvContext) Reply(msg Msg, replyData interface{}) error {
 	return nil
 }
@@ -246,6 +355,12 @@ func (c runtimeRcvContext) Dict(name string) state.Dict {
 	return c.state.Dict(name)
 }
 
+func (c runtimeRcvContext) Lookup(dict, index, key string,
+	f state.IterFn) error {
+
+	return c.state.Lookup(dict, index, key, f)
+}
+
 func (c runtimeRcvContext) BeginTx() error {
 	return c.state.BeginTx()
 }
@@ -258,6 +373,18 @@ func (c runtimeRcvContext) CommitTx() error {
 	return c.state.CommitTx()
 }
 
+func (c runtimeRcvContext) Savepoint(name string) error {
+	return c.state.Savepoint(name)
+}
+
+func (c runtimeRcvContext) RollbackTo(name string) error {
+	return c.state.RollbackTo(name)
+}
+
+func (c runtimeRcvContext) ReleaseSavepoint(name string) error {
+	return c.state.ReleaseSavepoint(name)
+}
+
 // RuntimeMap generates an automatic runtime map function based on the given
 // rcv function.
 //
@@ -275,7 +402,7 @@ func RuntimeMap(rcv RcvFunc) MapFunc {
 		q := ctx.(*qee)
 		rCtx := runtimeRcvContext{
 			qee:   q,
-			state: state.NewTransactional(q.app.newState()),
+			state: q.app.newTransactional(q.app.newState()),
 		}
 
 		if err := rcv(msg, rCtx); err != nil {
@@ -303,6 +430,8 @@ const (
 	appFlagSticky appFlag = 1 << iota
 	appFlagPersistent
 	appFlagTransactional
+	appFlagOnDisk
+	appFlagOptimistic
 )
 
 type appRate struct {
@@ -313,15 +442,31 @@ type appRate struct {
 }
 
 type app struct {
-	name       string
-	hive       *hive
-	qee        *qee
-	handlers   map[string]Handler
-	flags      appFlag
-	replFactor int
-	placement  PlacementMethod
-	router     *mux.Router
-	rate       appRate
+	name        string
+	hive        *hive
+	qee         *qee
+	handlers    map[string]Handler
+	flags       appFlag
+	replFactor  int
+	placement   PlacementMethod
+	constraints constraints
+	router      *mux.Router
+	rate        appRate
+	expiryTick  time.Duration
+	indexes     []appIndex
+	watches     map[string]bool
+	retry       *RetryPolicy
+	dedup       time.Duration
+	askTimeout  time.Duration
+	subs        []topicSub
+	bp          *backpressure
+	counters    appCounters
+}
+
+type appIndex struct {
+	dict string
+	name string
+	fn   state.IndexFn
 }
 
 func (a *app) String() string {
@@ -417,6 +562,54 @@ func (a *app) newState() state.State {
 	return state.NewInMem()
 }
 
+// newBeeState creates the state of a local bee whose data is stored in dir.
+func (a *app) newBeeState(dir string) (state.State, error) {
+	if !a.onDisk() {
+		return a.newState(), nil
+	}
+	return state.NewOnDisk(path.Join(dir, "dicts"))
+}
+
+// newTransactional wraps s in a transactional state with the indexes of the
+// app.
+func (a *app) newTransactional(s state.State) *state.Transactional {
+	t := state.NewTransactional(s)
+	t.TrackReads(a.optimistic())
+	if len(a.indexes) == 0 {
+		return t
+	}
+	prefixes := a.dictPrefixes()
+	for _, i := range a.indexes {
+		for _, p := range prefixes {
+			if err := t.AddIndex(p+i.dict, i.name, i.fn); err != nil {
+				glog.Errorf("%v cannot add index %v on %v: %v", a, i.name, p+i.dict,
+					err)
+			}
+		}
+	}
+	return t
+}
+
+// dictPrefixes returns the prefixes of the dictionaries used by the handlers
+// of the app, including the empty prefix.
+func (a *app) dictPrefixes() []string {
+	prefixes := []string{""}
+	seen := map[string]bool{"": true}
+	for _, h := range a.handlers {
+		s, ok := h.(DictScoper)
+		if !ok {
+			continue
+		}
+		for _, p := range s.DictPrefixes() {
+			if !seen[p] {
+				seen[p] = true
+				prefixes = append(prefixes, p)
+			}
+		}
+	}
+	return prefixes
+}
+
 func (a *app) persistent() bool {
 	return a.flags&appFlagPersistent != 0
 }
@@ -425,6 +618,66 @@ func (a *app) transactional() bool {
 	return a.flags&appFlagTransactional != 0
 }
 
+func (a *app) onDisk() bool {
+	return a.flags&appFlagOnDisk != 0
+}
+
+func (a *app) optimistic() bool {
+	return a.flags&appFlagOptimistic != 0
+}
+
 func (a *app) sticky() bool {
 	return a.flags&appFlagSticky != 0
 }
+
+// AppStats represents the message statistics of an application on a hive.
+type AppStats struct {
+	Expired    uint64 // Messages dropped because their deadline had passed.
+	Duplicates uint64 // Messages dropped because they were already received.
+
+	Queue          int    // Messages in the queue of the application.
+	Overloaded     bool   // Whether the queue of the application is overloaded.
+	OverloadedBees int    // Local bees whose queue is overloaded.
+	Blocked        uint64 // Emitters blocked on overloaded queues.
+	Shed           uint64 // Messages shed because of overloaded queues.
+	Rejected       uint64 // Messages rejected because of overloaded queues.
+}
+
+// appCounters are the counters of an application. They are updated atomically.
+type appCounters struct {
+	expired    uint64
+	duplicates uint64
+	blocked    uint64
+	shed       uint64
+	rejected   uint64
+}
+
+func (a *app) stats() AppStats {
+	s := AppStats{
+		Expired:    atomic.LoadUint64(&a.counters.expired),
+		Duplicates: atomic.LoadUint64(&a.counters.duplicates),
+		Queue:      a.qee.dataCh.size(),
+		Overloaded: a.qee.dataCh.isOverloaded(),
+		Blocked:    atomic.LoadUint64(&a.counters.blocked),
+		Shed:       atomic.LoadUint64(&a.counters.shed),
+		Rejected:   atomic.LoadUint64(&a.counters.rejected),
+	}
+	a.qee.RLock()
+	for _, b := range a.qee.bees {
+		if b.dataCh.isOverloaded() {
+			s.OverloadedBees++
+		}
+	}
+	a.qee.RUnlock()
+	return s
+}
+
+// appStats returns the statistics of the applications on this hive.
+func (h *hive) appStats() map[string]AppStats {
+	apps := h.appList()
+	stats := make(map[string]AppStats, len(apps))
+	for _, a := range apps {
+		stats[a.Name()] = a.stats()
+	}
+	return stats
+}
@@ -5,6 +5,8 @@ import (
 	"net/http"
 	"testing"
 	"time"
+
+	"github.com/kandoo/beehive/state"
 )
 
 type AppTestMsg int
@@ -34,6 +36,149 @@ func TestPersistentApp(t *testing.T) {
 	h.Stop()
 }
 
+func TestOnDiskApp(t *testing.T) {
+	h := newHiveForTest()
+	a := h.NewApp("ondisk", Persistent(1), OnDisk())
+	mf := func(msg Msg, ctx MapContext) MappedCells {
+		return ctx.LocalMappedCells()
+	}
+	ch := make(chan int)
+	rf := func(msg Msg, ctx RcvContext) error {
+		d := ctx.Dict("Test")
+		n := 0
+		if v, err := d.Get("K"); err == nil {
+			n = v.(int)
+		}
+		n++
+		ch <- n
+		return d.Put("K", n)
+	}
+	a.HandleFunc(AppTestMsg(0), mf, rf)
+
+	go h.Start()
+	waitTilStareted(h)
+
+	for i := 1; i <= 3; i++ {
+		h.Emit(AppTestMsg(0))
+		if n := <-ch; n != i {
+			t.Errorf("invalid value read from disk: actual=%v want=%v", n, i)
+		}
+	}
+
+	h.Stop()
+	for _, b := range a.(*app).qee.bees {
+		if b.detached {
+			continue
+		}
+		if err := b.stateL1.Dict("Test").Put("K", 0); err != state.ErrClosed {
+			t.Errorf("the state of %v is not closed: %v", b, err)
+		}
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	h := newHiveForTest()
+	app := h.NewApp("expiry", Persistent(1), Expiry(10*time.Millisecond))
+	mf := func(msg Msg, ctx MapContext) MappedCells {
+		return MappedCells{{"D", "0"}}
+	}
+	rf := func(msg Msg, ctx RcvContext) error {
+		return state.PutWithTTL(ctx.Dict("D"), "0", "v", time.Millisecond)
+	}
+	app.HandleFunc(AppTestMsg(0), mf, rf)
+
+	ch := make(chan Expired)
+	erf := func(msg Msg, ctx RcvContext) error {
+		e := msg.Data().(Expired)
+		if _, err := ctx.Dict(e.Dict).Get(e.Key); err == nil {
+			t.Errorf("expired key %v is not deleted", e.Key)
+		}
+		ch <- e
+		return nil
+	}
+	app.HandleFunc(Expired{}, mf, erf)
+
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	h.Emit(AppTestMsg(0))
+	e := <-ch
+	if e.Dict != "D" || e.Key != "0" || e.Value.(string) != "v" {
+		t.Errorf("invalid expiration: actual=%#v want={D 0 v}", e)
+	}
+}
+
+func TestIndexApp(t *testing.T) {
+	h := newHiveForTest()
+	byParity := func(k string, v interface{}) []string {
+		return []string{fmt.Sprint(v.(int) % 2)}
+	}
+	app := h.NewApp("index", Index("D", "parity", byParity))
+	mf := func(msg Msg, ctx MapContext) MappedCells {
+		return MappedCells{{"D", "0"}}
+	}
+	ch := make(chan []string)
+	rf := func(msg Msg, ctx RcvContext) error {
+		n := int(msg.Data().(AppTestMsg))
+		ctx.Dict("D").Put(fmt.Sprint(n), n)
+		var keys []string
+		err := ctx.Lookup("D", "parity", "1", func(k string, v interface{}) bool {
+			keys = append(keys, k)
+			return true
+		})
+		ch <- keys
+		return err
+	}
+	app.HandleFunc(AppTestMsg(0), mf, rf)
+
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	h.Emit(AppTestMsg(1))
+	<-ch
+	h.Emit(AppTestMsg(2))
+	<-ch
+	h.Emit(AppTestMsg(3))
+	if keys := <-ch; len(keys) != 2 || keys[0] != "1" || keys[1] != "3" {
+		t.Errorf("invalid lookup result: actual=%v want=[1 3]", keys)
+	}
+}
+
+type scopedHandler struct {
+	Handler
+	prefixes []string
+}
+
+func (h scopedHandler) DictPrefixes() []string { return h.prefixes }
+
+func TestIndexScopedHandler(t *testing.T) {
+	h := newHiveForTest()
+	byValue := func(k string, v interface{}) []string {
+		return []string{v.(string)}
+	}
+	a := h.NewApp("index", Index("D", "value", byValue)).(*app)
+	a.Handle(AppTestMsg(0), scopedHandler{prefixes: []string{"0", "1"}})
+
+	tx := a.newTransactional(state.NewInMem())
+	tx.BeginTx()
+	tx.Dict("1D").Put("k", "v")
+	tx.CommitTx()
+
+	var keys []string
+	err := tx.Lookup("1D", "value", "v", func(k string, v interface{}) bool {
+		keys = append(keys, k)
+		return true
+	})
+	if err != nil {
+		t.Fatalf("cannot lookup the prefixed dictionary: %v", err)
+	}
+	if len(keys) != 1 || keys[0] != "k" {
+		t.Errorf("invalid lookup result: actual=%v want=[k]", keys)
+	}
+}
+
 type hiveAndBeeID struct {
 	Hive uint64
 	Bee  uint64
@@ -0,0 +1,145 @@
+package beehive
+
+import (
+	"encoding/gob"
+	"errors"
+	"math/rand"
+	"strconv"
+	"time"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
+	"github.com/kandoo/beehive/state"
+)
+
+// dictFutures is the dictionary in which bees record their pending futures.
+const dictFutures = "bh_futures"
+
+// defaultAskTimeout is the default time for which the futures of requests
+// without a deadline are kept.
+const defaultAskTimeout = time.Minute
+
+var (
+	// ErrNoAnswerHandler is returned by Ask when the application of the bee does
+	// not handle Answer.
+	ErrNoAnswerHandler = errors.New("ask: application does not handle answers")
+)
+
+// Future represents the response of a request sent using RcvContext.Ask. The
+// response is delivered to the bee that has asked, in an Answer message.
+type Future struct {
+	ID uint64
+}
+
+// Answer is the message delivered to a bee when the request it has asked is
+// responded. Applications that use RcvContext.Ask must handle Answer.
+type Answer struct {
+	Future Future      // The future of the request.
+	Data   interface{} // The response.
+	Err    error       // The error returned by the handler of the request.
+	Origin msg         // The message the bee was receiving when it asked.
+}
+
+func (f Future) key() string {
+	return strconv.FormatUint(f.ID, 16)
+}
+
+// AskTimeout is an application option that sets for how long the bees of the
+// application wait for the answers to the requests they ask without a
+// deadline. The futures of unanswered requests are removed afterwards, and
+// their late answers are dropped. By default, the timeout is one minute.
+func AskTimeout(d time.Duration) AppOption {
+	return func(a *app) {
+		a.askTimeout = d
+	}
+}
+
+// isFuturesDict returns whether d is the dictionary of futures.
+func isFuturesDict(d string) bool {
+	return d == dictFutures
+}
+
+func (b *bee) Ask(req interface{}, opts ...EmitOption) (Future, error) {
+	if b.app.handler(MsgType(Answer{})) == nil {
+		return Future{}, ErrNoAnswerHandler
+	}
+
+	f := Future{ID: uint64(rand.Int63())}
+	m := b.newMsg(syncReq{ID: f.ID, Data: req}, b.ID(), 0, opts)
+
+	var origin msg
+	if b.rcvMsg != nil {
+		origin = *b.rcvMsg
+		// Requests asked while receiving an answer keep the origin of that
+		// answer, instead of nesting it.
+		if a, ok := origin.Data().(Answer); ok {
+			origin = a.Origin
+		}
+	}
+
+	// The future is removed when the request expires or, if the request has
+	// no deadline, after the ask timeout of the application.
+	deadline := m.MsgDeadline
+	if deadline.IsZero() {
+		deadline = time.Now().Add(b.app.askTimeout)
+	}
+	d := b.Dict(dictFutures)
+	var err error
+	if ed, ok := d.(state.ExpiringDict); ok {
+		err = ed.PutWithDeadline(f.key(), origin, deadline)
+	} else {
+		err = d.Put(f.key(), origin)
+	}
+	if err != nil {
+		return Future{}, err
+	}
+
+	b.bufferOrEmit(m)
+	return f, nil
+}
+
+// answerMsg converts a response to a request asked by a bee into an Answer.
+func answerMsg(m *msg) *msg {
+	r, ok := m.Data().(syncRes)
+	if !ok {
+		return m
+	}
+	a := *m
+	a.MsgData = Answer{
+		Future: Future{ID: r.ID},
+		Data:   r.Data,
+		Err:    r.Err,
+	}
+	return &a
+}
+
+// resolveAnswer sets the origin of m if it is an answer. It returns false if
+// the bee has no such future, which happens when the future is already answered
+// or has expired.
+func (b *bee) resolveAnswer(m *msg) (*msg, bool) {
+	a, ok := m.Data().(Answer)
+	if !ok {
+		return m, true
+	}
+
+	v, err := b.Dict(dictFutures).Get(a.Future.key())
+	if err != nil {
+		glog.V(2).Infof("%v drops answer to unknown future %v", b, a.Future.ID)
+		return nil, false
+	}
+	a.Origin = v.(msg)
+	resolved := *m
+	resolved.MsgData = a
+	return &resolved, true
+}
+
+// completeAnswer removes the future of m, if m is an answer.
+func (b *bee) completeAnswer(m *msg) {
+	if a, ok := m.Data().(Answer); ok {
+		b.Dict(dictFutures).Del(a.Future.key())
+	}
+}
+
+func init() {
+	gob.Register(Answer{})
+	gob.Register(Future{})
+}
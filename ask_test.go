@@ -0,0 +1,172 @@
+package beehive
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+type askTestMsg int
+
+type askTestReq int
+
+func TestAsk(t *testing.T) {
+	h := newHiveForTest()
+	app := h.NewApp("ask")
+	mf := func(msg Msg, ctx MapContext) MappedCells {
+		return MappedCells{{"D", "0"}}
+	}
+	ch := make(chan Answer, 10)
+	rf := func(msg Msg, ctx RcvContext) error {
+		switch d := msg.Data().(type) {
+		case askTestMsg:
+			_, err := ctx.Ask(askTestReq(d))
+			return err
+		case askTestReq:
+			if d < 0 {
+				return errors.New("negative")
+			}
+			return ctx.Reply(msg, int(d)*2)
+		case Answer:
+			ch <- d
+		}
+		return nil
+	}
+	app.HandleFunc(askTestMsg(0), mf, rf)
+	app.HandleFunc(askTestReq(0), mf, rf)
+	app.HandleFunc(Answer{}, mf, rf)
+
+	noAnswer := h.NewApp("noAnswer")
+	errCh := make(chan error, 1)
+	noAnswer.HandleFunc(askTestMsg(0), mf, func(msg Msg, ctx RcvContext) error {
+		_, err := ctx.Ask(askTestReq(0))
+		select {
+		case errCh <- err:
+		default:
+		}
+		return nil
+	})
+
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	h.Emit(askTestMsg(2))
+	select {
+	case a := <-ch:
+		if a.Err != nil || a.Data != 4 {
+			t.Errorf("invalid answer: %v", a)
+		}
+		if a.Origin.Data() != askTestMsg(2) {
+			t.Errorf("invalid origin: actual=%v want=%v", a.Origin.Data(),
+				askTestMsg(2))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no answer")
+	}
+
+	h.Emit(askTestMsg(-1))
+	select {
+	case a := <-ch:
+		if a.Err == nil || a.Err.Error() != "negative" {
+			t.Errorf("invalid error in answer: %v", a.Err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no answer")
+	}
+
+	if err := <-errCh; err != ErrNoAnswerHandler {
+		t.Errorf("invalid error for an app without answer handler: %v", err)
+	}
+}
+
+func TestAskFromAnswer(t *testing.T) {
+	h := newHiveForTest()
+	app := h.NewApp("ask")
+	mf := func(msg Msg, ctx MapContext) MappedCells {
+		return MappedCells{{"D", "0"}}
+	}
+	ch := make(chan Answer, 10)
+	rf := func(msg Msg, ctx RcvContext) error {
+		switch d := msg.Data().(type) {
+		case askTestMsg:
+			_, err := ctx.Ask(askTestReq(d))
+			return err
+		case askTestReq:
+			return ctx.Reply(msg, int(d)+1)
+		case Answer:
+			if d.Data.(int) < 3 {
+				_, err := ctx.Ask(askTestReq(d.Data.(int)))
+				return err
+			}
+			ch <- d
+		}
+		return nil
+	}
+	app.HandleFunc(askTestMsg(0), mf, rf)
+	app.HandleFunc(askTestReq(0), mf, rf)
+	app.HandleFunc(Answer{}, mf, rf)
+
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	h.Emit(askTestMsg(1))
+	select {
+	case a := <-ch:
+		if a.Origin.Data() != askTestMsg(1) {
+			t.Errorf("invalid origin: actual=%v want=%v", a.Origin.Data(),
+				askTestMsg(1))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no answer")
+	}
+}
+
+type askTestProbe struct{}
+
+func TestAskTimeout(t *testing.T) {
+	timeout := 20 * time.Millisecond
+	h := newHiveForTest()
+	app := h.NewApp("ask", AskTimeout(timeout))
+	mf := func(msg Msg, ctx MapContext) MappedCells {
+		return MappedCells{{"D", "0"}}
+	}
+	ch := make(chan int, 10)
+	rf := func(msg Msg, ctx RcvContext) error {
+		switch d := msg.Data().(type) {
+		case askTestMsg:
+			// No application handles askTestReq, so the request is never
+			// answered.
+			_, err := ctx.Ask(askTestReq(d))
+			return err
+		case askTestProbe:
+			n := 0
+			ctx.Dict(dictFutures).ForEach(func(k string, v interface{}) bool {
+				n++
+				return true
+			})
+			ch <- n
+		}
+		return nil
+	}
+	app.HandleFunc(askTestMsg(0), mf, rf)
+	app.HandleFunc(askTestProbe{}, mf, rf)
+	app.HandleFunc(Answer{}, mf, rf)
+
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	h.Emit(askTestMsg(1))
+	h.Emit(askTestProbe{})
+	if n := <-ch; n != 1 {
+		t.Errorf("invalid number of futures: actual=%v want=1", n)
+	}
+
+	time.Sleep(3 * timeout)
+	h.Emit(askTestProbe{})
+	if n := <-ch; n != 0 {
+		t.Errorf("unanswered future is not removed: actual=%v want=0", n)
+	}
+}
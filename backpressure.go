@@ -0,0 +1,334 @@
+package beehive
+
+import (
+	"errors"
+	"sync/atomic"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
+)
+
+// ErrOverloaded is returned when a message is emitted to an overloaded
+// application whose overload policy is FailWhenOverloaded.
+var ErrOverloaded = errors.New("beehive: application is overloaded")
+
+// errShed is used internally when a message is shed.
+var errShed = errors.New("beehive: message is shed")
+
+// isOverloadedError returns whether err is ErrOverloaded, possibly returned
+// by a remote hive.
+func isOverloadedError(err error) bool {
+	return err != nil && err.Error() == ErrOverloaded.Error()
+}
+
+// Watermarks are the thresholds of a queue. A queue becomes overloaded when it
+// has High messages, and remains overloaded until it has at most Low messages.
+// Watermarks with a non-positive High are disabled.
+type Watermarks struct {
+	High int
+	Low  int
+}
+
+func (w Watermarks) enabled() bool {
+	return w.High > 0
+}
+
+// OverloadPolicy is the behavior of emitters when the queue of the receiving
+// application, or of the receiving bee, is overloaded.
+type OverloadPolicy int
+
+const (
+	// BlockWhenOverloaded blocks the emitter until the queue drains below its
+	// low watermark. The queen of the application is never blocked: the
+	// messages it cannot enqueue on an overloaded bee are dead-lettered with
+	// ErrOverloaded. A bee is not blocked if that would close a cycle of
+	// applications blocked on each other, e.g., when two applications emit to
+	// each other: the message is rejected as in FailWhenOverloaded. Remote hives
+	// are never blocked either: they reject the messages, and the sending hive
+	// retries them for a bounded time before dead-lettering them.
+	BlockWhenOverloaded OverloadPolicy = iota
+	// ShedWhenOverloaded drops the message.
+	ShedWhenOverloaded
+	// FailWhenOverloaded drops the message and returns ErrOverloaded to the
+	// emitter. For bees, the message being received fails with ErrOverloaded, as
+	// if its handler had returned it, and can be retried using the Retry option.
+	// For remote hives, the rejected messages are returned to the sending hive,
+	// which dead-letters them.
+	FailWhenOverloaded
+)
+
+func (p OverloadPolicy) String() string {
+	switch p {
+	case BlockWhenOverloaded:
+		return "block"
+	case ShedWhenOverloaded:
+		return "shed"
+	case FailWhenOverloaded:
+		return "fail"
+	}
+	return "unknown"
+}
+
+type backpressure struct {
+	app    Watermarks
+	bee    Watermarks
+	policy OverloadPolicy
+}
+
+// Backpressure is an application option that limits the queue of the
+// application and the queue of each of its bees using the given watermarks.
+// When a queue is overloaded, emitters behave according to the policy. Note
+// that bees are never blocked on the queues of their own application.
+func Backpressure(appMarks, beeMarks Watermarks, p OverloadPolicy) AppOption {
+	return func(a *app) {
+		a.bp = &backpressure{app: appMarks, bee: beeMarks, policy: p}
+		a.qee.dataCh.marks = appMarks
+		a.hive.backpressure = true
+	}
+}
+
+func (q *msgChannel) size() int {
+	return len(q.chin) + int(atomic.LoadInt64(&q.queued)) + len(q.chout)
+}
+
+// overloaded returns whether the channel is overloaded according to its
+// watermarks.
+func (q *msgChannel) overloaded() bool {
+	if !q.marks.enabled() {
+		return false
+	}
+
+	n := q.size()
+	if atomic.LoadInt32(&q.over) == 0 {
+		if n < q.marks.High {
+			return false
+		}
+		atomic.StoreInt32(&q.over, 1)
+		return true
+	}
+
+	if n > q.marks.Low {
+		return true
+	}
+	atomic.StoreInt32(&q.over, 0)
+	return false
+}
+
+func (q *msgChannel) isOverloaded() bool {
+	return atomic.LoadInt32(&q.over) == 1
+}
+
+// waitForLow blocks until the channel is not overloaded.
+func (q *msgChannel) waitForLow() {
+	for {
+		q.lowMu.Lock()
+		if !q.overloaded() {
+			q.lowMu.Unlock()
+			return
+		}
+		if q.low == nil {
+			q.low = make(chan struct{})
+		}
+		low := q.low
+		q.lowMu.Unlock()
+		atomic.AddInt32(&q.waiters, 1)
+		<-low
+		atomic.AddInt32(&q.waiters, -1)
+	}
+}
+
+// drained wakes up the emitters blocked on the channel, if the channel is no
+// longer overloaded. It must be called whenever messages are removed from the
+// channel.
+func (q *msgChannel) drained() {
+	if !q.isOverloaded() || q.overloaded() {
+		return
+	}
+	q.lowMu.Lock()
+	if q.low != nil {
+		close(q.low)
+		q.low = nil
+	}
+	q.lowMu.Unlock()
+}
+
+// admit applies the overload policy of the application, if ch is overloaded.
+// It returns nil if the message can be enqueued on ch. from is the application
+// of the emitting bee, if any. If block is false, or if blocking from on the
+// application would close a cycle, BlockWhenOverloaded rejects the message with
+// ErrOverloaded instead of blocking.
+func (a *app) admit(ch *msgChannel, from *app, block bool) error {
+	if a.bp == nil || !ch.overloaded() {
+		return nil
+	}
+
+	switch a.bp.policy {
+	case BlockWhenOverloaded:
+		if !block || !a.hive.waitFor(from, a) {
+			break
+		}
+		atomic.AddUint64(&a.counters.blocked, 1)
+		ch.waitForLow()
+		a.hive.doneWaiting(from, a)
+		return nil
+	case ShedWhenOverloaded:
+		atomic.AddUint64(&a.counters.shed, 1)
+		return errShed
+	}
+	atomic.AddUint64(&a.counters.rejected, 1)
+	return ErrOverloaded
+}
+
+// admit applies the overload policies of the applications that receive m. from
+// is the application of the emitting bee, if any, whose queues are not checked.
+// If block is false, the emitter is never blocked.
+func (h *hive) admit(m *msg, from *app, block bool) error {
+	if !h.backpressure {
+		return nil
+	}
+
+	if m.IsUnicast() {
+		bi, err := h.registry.bee(m.To())
+		if err != nil {
+			return nil
+		}
+		a, ok := h.app(bi.App)
+		if !ok || a == from {
+			return nil
+		}
+		if err := a.admit(a.qee.dataCh, from, block); err != nil {
+			return err
+		}
+		if b, ok := a.qee.beeByID(m.To()); ok {
+			return a.admit(b.dataCh, from, block)
+		}
+		return nil
+	}
+
+	// The receivers are collected first, so that the emitter is not blocked
+	// while holding the lock of the hive's applications.
+	var qs []*qee
+	h.appsM.RLock()
+	if m.Topic() != "" {
+		for _, s := range h.subs {
+			if s.q.app != from && matchTopic(s.pattern, m.Topic()) {
+				qs = append(qs, s.q)
+			}
+		}
+	} else {
+		for _, qh := range h.qees[m.Type()] {
+			if qh.q.app != from {
+				qs = append(qs, qh.q)
+			}
+		}
+	}
+	h.appsM.RUnlock()
+
+	for _, q := range qs {
+		if err := q.app.admit(q.dataCh, from, block); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// waitFor records that a bee of from is about to block on the queues of to. It
+// returns false, without recording anything, if to is already blocked on from,
+// directly or through other applications. Emitters that are not bees, i.e.,
+// from is nil, can always block.
+func (h *hive) waitFor(from, to *app) bool {
+	if from == nil {
+		return true
+	}
+
+	h.waitsM.Lock()
+	defer h.waitsM.Unlock()
+	if h.waitsOn(to, from, make(map[*app]bool)) {
+		return false
+	}
+	if h.waits == nil {
+		h.waits = make(map[*app]map[*app]int)
+	}
+	if h.waits[from] == nil {
+		h.waits[from] = make(map[*app]int)
+	}
+	h.waits[from][to]++
+	return true
+}
+
+// doneWaiting records that a bee of from is no longer blocked on to.
+func (h *hive) doneWaiting(from, to *app) {
+	if from == nil {
+		return
+	}
+
+	h.waitsM.Lock()
+	defer h.waitsM.Unlock()
+	if h.waits[from][to]--; h.waits[from][to] == 0 {
+		delete(h.waits[from], to)
+	}
+}
+
+// waitsOn returns whether from is blocked on to, directly or through other
+// applications.
+func (h *hive) waitsOn(from, to *app, visited map[*app]bool) bool {
+	if from == to {
+		return true
+	}
+	visited[from] = true
+	for a := range h.waits[from] {
+		if !visited[a] && h.waitsOn(a, to, visited) {
+			return true
+		}
+	}
+	return false
+}
+
+// emitMsg enqueues a message emitted on the hive, if admitted by the receiving
+// applications.
+func (h *hive) emitMsg(m *msg) {
+	if err := h.admit(m, nil, true); err != nil {
+		glog.V(2).Infof("%v drops message %v: %v", h, m, err)
+		return
+	}
+	h.stamp(m)
+	h.enqueMsg(m)
+}
+
+// admitEmit applies the overload policies of the applications that receive a
+// message emitted by the bee. If the message is rejected while the bee is
+// receiving a message, the message being received fails with ErrOverloaded.
+func (b *bee) admitEmit(m *msg) bool {
+	if b.hive == nil || !b.hive.backpressure {
+		return true
+	}
+
+	err := b.hive.admit(m, b.app, true)
+	if err == nil {
+		return true
+	}
+	if err == ErrOverloaded && b.rcvMsg != nil {
+		b.emitErr = err
+	}
+	glog.V(2).Infof("%v drops message %v: %v", b, m, err)
+	return false
+}
+
+// admitToBee applies the overload policy of the application when the queen
+// enqueues a message on a bee. It returns whether the message can be enqueued.
+// The queen is never blocked on the bee, since that would block all the other
+// bees of the application.
+func (q *qee) admitToBee(b *bee, mh msgAndHandler) bool {
+	if b.detached {
+		return true
+	}
+
+	switch err := q.app.admit(b.dataCh, nil, false); err {
+	case nil:
+		return true
+	case ErrOverloaded:
+		q.hive.deadLetter(q.app.Name(), b.ID(), mh.msg, err, 0)
+	default:
+		glog.V(2).Infof("%v sheds message %v for %v", q, mh.msg, b)
+	}
+	return false
+}
@@ -0,0 +1,270 @@
+package beehive
+
+import (
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// waitForSize waits until the pipe of the channel has accounted n messages.
+func waitForSize(ch *msgChannel, n int) {
+	for i := 0; i < 1000 && ch.size() != n; i++ {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestMsgChannelWatermarks(t *testing.T) {
+	ch := newMsgChannel(16)
+	ch.marks = Watermarks{High: 4, Low: 2}
+	for i := 0; i < 3; i++ {
+		ch.in() <- msgAndHandler{msg: &msg{}}
+	}
+	waitForSize(ch, 3)
+	if ch.overloaded() {
+		t.Errorf("channel is overloaded with 3 messages")
+	}
+	ch.in() <- msgAndHandler{msg: &msg{}}
+	waitForSize(ch, 4)
+	if !ch.overloaded() {
+		t.Errorf("channel is not overloaded with 4 messages")
+	}
+	<-ch.out()
+	waitForSize(ch, 3)
+	if !ch.overloaded() {
+		t.Errorf("channel is not overloaded above the low watermark")
+	}
+	<-ch.out()
+	waitForSize(ch, 2)
+	if ch.overloaded() {
+		t.Errorf("channel is overloaded at the low watermark")
+	}
+}
+
+type bpTestMsg int
+
+func TestBackpressureShed(t *testing.T) {
+	h := newHiveForTest()
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var rcvd int32
+	app := h.NewApp("backpressure",
+		Backpressure(Watermarks{}, Watermarks{High: 4, Low: 2},
+			ShedWhenOverloaded))
+	app.HandleFunc(bpTestMsg(0),
+		func(msg Msg, ctx MapContext) MappedCells {
+			return MappedCells{{"D", "0"}}
+		},
+		func(msg Msg, ctx RcvContext) error {
+			if msg.Data().(bpTestMsg) == 0 {
+				close(started)
+				<-release
+			}
+			atomic.AddInt32(&rcvd, 1)
+			return nil
+		})
+
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	n := 20
+	h.Emit(bpTestMsg(0))
+	<-started
+	for i := 1; i < n; i++ {
+		h.Emit(bpTestMsg(i))
+	}
+
+	var stats AppStats
+	for i := 0; ; i++ {
+		stats = h.(*hive).appStats()["backpressure"]
+		if stats.Shed != 0 {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("no message is shed: %+v", stats)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if stats.OverloadedBees != 1 {
+		t.Errorf("invalid number of overloaded bees: %+v", stats)
+	}
+
+	close(release)
+	for i := 0; ; i++ {
+		stats = h.(*hive).appStats()["backpressure"]
+		if int(atomic.LoadInt32(&rcvd))+int(stats.Shed) == n {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("invalid number of received messages: actual=%v shed=%v",
+				atomic.LoadInt32(&rcvd), stats.Shed)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMsgChannelWaitForLow(t *testing.T) {
+	ch := newMsgChannel(16)
+	ch.marks = Watermarks{High: 4, Low: 2}
+	for i := 0; i < 4; i++ {
+		ch.in() <- msgAndHandler{msg: &msg{}}
+	}
+	waitForSize(ch, 4)
+
+	done := make(chan struct{})
+	go func() {
+		ch.waitForLow()
+		close(done)
+	}()
+	for atomic.LoadInt32(&ch.waiters) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	<-ch.out()
+	ch.drained()
+	select {
+	case <-done:
+		t.Fatal("emitter is released above the low watermark")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	<-ch.out()
+	ch.drained()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("emitter is not released at the low watermark")
+	}
+}
+
+func TestBackpressureBlockDoesNotBlockQueen(t *testing.T) {
+	h := newHiveForTest()
+	started := make(chan struct{})
+	release := make(chan struct{})
+	rcvd := make(chan bpTestMsg, 10)
+	app := h.NewApp("backpressure",
+		Backpressure(Watermarks{}, Watermarks{High: 4, Low: 2},
+			BlockWhenOverloaded))
+	app.HandleFunc(bpTestMsg(0),
+		func(msg Msg, ctx MapContext) MappedCells {
+			if msg.Data().(bpTestMsg) < 0 {
+				return MappedCells{{"D", "1"}}
+			}
+			return MappedCells{{"D", "0"}}
+		},
+		func(msg Msg, ctx RcvContext) error {
+			switch d := msg.Data().(bpTestMsg); {
+			case d == 0:
+				close(started)
+				<-release
+			case d < 0:
+				rcvd <- d
+			}
+			return nil
+		})
+
+	go h.Start()
+	defer h.Stop()
+	defer close(release)
+	waitTilStareted(h)
+
+	h.Emit(bpTestMsg(0))
+	<-started
+	for i := 1; i < 20; i++ {
+		h.Emit(bpTestMsg(i))
+	}
+
+	// The queen rejects the messages of the blocked bee, instead of blocking on
+	// it, and keeps handling the messages of other bees.
+	h.Emit(bpTestMsg(-1))
+	select {
+	case <-rcvd:
+	case <-time.After(5 * time.Second):
+		t.Fatal("queen is blocked on an overloaded bee")
+	}
+	if s := h.(*hive).appStats()["backpressure"]; s.Rejected == 0 {
+		t.Errorf("no message is rejected: %+v", s)
+	}
+}
+
+func TestEnqueMsgRejected(t *testing.T) {
+	h := newHiveForTest().(*hive)
+	a := h.NewApp("backpressure",
+		Backpressure(Watermarks{High: 1, Low: 0}, Watermarks{},
+			FailWhenOverloaded))
+	a.HandleFunc(bpTestMsg(0),
+		func(msg Msg, ctx MapContext) MappedCells { return nil },
+		func(msg Msg, ctx RcvContext) error { return nil })
+
+	// The hive is not started, so the queue of the application is not drained.
+	q := a.(*app).qee
+	q.dataCh.in() <- msgAndHandler{msg: &msg{}}
+	waitForSize(q.dataCh, 1)
+
+	msgs := []msg{
+		*newMsgFromData(AppTestMsg(0), 0, 0),
+		*newMsgFromData(bpTestMsg(1), 0, 0),
+		*newMsgFromData(AppTestMsg(2), 0, 0),
+		*newMsgFromData(bpTestMsg(3), 0, 0),
+	}
+	var rejected []int
+	s := rpcServer{h: h}
+	if err := s.EnqueMsg(msgs, &rejected); err != nil {
+		t.Fatalf("cannot enqueue messages: %v", err)
+	}
+	if want := []int{1, 3}; !reflect.DeepEqual(rejected, want) {
+		t.Errorf("invalid rejected messages: actual=%v want=%v", rejected, want)
+	}
+}
+
+func TestEnqueMsgDoesNotBlock(t *testing.T) {
+	h := newHiveForTest().(*hive)
+	a := h.NewApp("backpressure",
+		Backpressure(Watermarks{High: 1, Low: 0}, Watermarks{},
+			BlockWhenOverloaded))
+	a.HandleFunc(bpTestMsg(0),
+		func(msg Msg, ctx MapContext) MappedCells { return nil },
+		func(msg Msg, ctx RcvContext) error { return nil })
+
+	q := a.(*app).qee
+	q.dataCh.in() <- msgAndHandler{msg: &msg{}}
+	waitForSize(q.dataCh, 1)
+
+	var rejected []int
+	s := rpcServer{h: h}
+	done := make(chan struct{})
+	go func() {
+		s.EnqueMsg([]msg{*newMsgFromData(bpTestMsg(1), 0, 0)}, &rejected)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("EnqueMsg is blocked on an overloaded application")
+	}
+	if want := []int{0}; !reflect.DeepEqual(rejected, want) {
+		t.Errorf("invalid rejected messages: actual=%v want=%v", rejected, want)
+	}
+}
+
+func TestWaitForCycle(t *testing.T) {
+	h := newHiveForTest().(*hive)
+	a := h.NewApp("a").(*app)
+	b := h.NewApp("b").(*app)
+	c := h.NewApp("c").(*app)
+
+	if !h.waitFor(a, b) || !h.waitFor(b, c) {
+		t.Fatal("cannot block without a cycle")
+	}
+	if h.waitFor(c, a) {
+		t.Error("c is blocked on a while a is blocked on c through b")
+	}
+	if !h.waitFor(nil, a) {
+		t.Error("the hive cannot block on a")
+	}
+	h.doneWaiting(b, c)
+	if !h.waitFor(c, a) {
+		t.Error("c cannot block on a after b is released")
+	}
+}
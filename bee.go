@@ -4,6 +4,7 @@ import (
 	"encoding/gob"
 	"errors"
 	"fmt"
+	"io"
 	"path"
 	"runtime/debug"
 	"sync"
@@ -16,6 +17,7 @@ import (
 	"github.com/kandoo/beehive/Godeps/_workspace/src/golang.org/x/net/context"
 
 	"github.com/kandoo/beehive/bucket"
+	bhgob "github.com/kandoo/beehive/gob"
 	"github.com/kandoo/beehive/raft"
 	"github.com/kandoo/beehive/state"
 )
@@ -46,6 +48,12 @@ type bee struct {
 	hive      *hive
 	timers    []*time.Timer
 	cells     map[CellKey]bool
+	moved     map[CellKey]uint64       // Cells moved to other bees by splits.
+	staged    map[uint64][]state.Chunk // Chunks of bees being merged.
+
+	// Cells mapped together in the current and in the previous splitCooldown.
+	coaccess      [2]coaccess
+	coaccessSince time.Time
 
 	dataCh    *msgChannel
 	outCh     chan []*msg
@@ -61,11 +69,17 @@ type bee struct {
 	emitInRaft bool
 	raftTerm   uint64
 	txTerm     uint64
-
-	stateL1  *state.Transactional
-	stateL2  *state.Transactional
-	msgBufL1 []*msg
-	msgBufL2 []*msg
+	snapVer    uint64
+	attempt    int
+	rcvMsg     *msg                // The message being received.
+	dedupKeys  map[string]struct{} // The keys recorded but not written yet.
+	emitErr    error               // The error of the messages rejected while receiving.
+
+	stateL1    *state.Transactional
+	stateL2    *state.Transactional
+	msgBufL1   []*msg
+	msgBufL2   []*msg
+	savepoints []beeSavepoint
 
 	local interface{}
 }
@@ -328,7 +342,51 @@ func (b *bee) addFollower(bid uint64, hid uint64) error {
 }
 
 func (b *bee) setState(s state.State) {
-	b.stateL1 = state.NewTransactional(s)
+	b.stateL1 = b.app.newTransactional(s)
+}
+
+// releaseState removes the raft group of the bee, if any, and closes its state
+// when the bee no longer uses its state, i.e., when the bee is stopped or
+// becomes a proxy.
+func (b *bee) releaseState() {
+	if !b.proxy && !b.detached && !b.isColonyNil() && b.app.persistent() {
+		b.removeGroup()
+	}
+
+	if b.stateL1 == nil {
+		return
+	}
+	c, ok := b.stateL1.State.(io.Closer)
+	if !ok {
+		return
+	}
+	if err := c.Close(); err != nil && err != state.ErrClosed {
+		glog.Errorf("%v cannot close its state: %v", b, err)
+	}
+}
+
+// removeGroup removes the raft group of the bee from the raft node of the
+// hive. The messages the bee emits while its group is being removed are
+// dropped, since the bee is no longer processing its messages.
+func (b *bee) removeGroup() {
+	ch := make(chan error, 1)
+	go func() {
+		ctx, cnl := context.WithTimeout(context.Background(),
+			10*b.hive.config.RaftElectTimeout())
+		defer cnl()
+		ch <- b.hive.node.RemoveGroup(ctx, b.group())
+	}()
+
+	for {
+		select {
+		case err := <-ch:
+			if err != nil && err != raft.ErrNoSuchGroup && err != raft.ErrStopped {
+				glog.Errorf("%v cannot remove its raft group: %v", b, err)
+			}
+			return
+		case <-b.outCh:
+		}
+	}
 }
 
 func (b *bee) startDetached(h DetachedHandler) {
@@ -374,6 +432,29 @@ func (b *bee) start() {
 	var inT <-chan time.Time
 	var outT <-chan time.Time
 
+	var expT <-chan time.Time
+	if t := b.app.expiryTick; t > 0 && !b.detached && !b.proxy {
+		ticker := time.NewTicker(t)
+		defer ticker.Stop()
+		expT = ticker.C
+	}
+
+	var dedupT <-chan time.Time
+	if t := b.app.dedup; t > 0 && !b.detached && !b.proxy {
+		ticker := time.NewTicker(t)
+		defer ticker.Stop()
+		dedupT = ticker.C
+	}
+
+	var futT <-chan time.Time
+	if t := b.app.askTimeout; t > 0 && !b.detached && !b.proxy &&
+		b.app.handler(MsgType(Answer{})) != nil {
+
+		ticker := time.NewTicker(t)
+		defer ticker.Stop()
+		futT = ticker.C
+	}
+
 	for b.status == beeStatusStarted {
 		select {
 		case mh := <-dataCh:
@@ -388,6 +469,8 @@ func (b *bee) start() {
 				}
 			}
 
+			b.dataCh.drained()
+			prioritize(batch)
 			t := uint64(len(batch))
 			if !b.inBucket.Get(t) {
 				dataCh = nil
@@ -425,6 +508,21 @@ func (b *bee) start() {
 			outM = nil
 			outT = nil
 
+		case <-expT:
+			if b.colony().Leader == b.ID() {
+				b.expire(isAppDict)
+			}
+
+		case <-dedupT:
+			if b.colony().Leader == b.ID() {
+				b.expire(isDedupDict)
+			}
+
+		case <-futT:
+			if b.colony().Leader == b.ID() {
+				b.expire(isFuturesDict)
+			}
+
 		case c := <-b.ctrlCh:
 			b.handleCmd(c)
 		}
@@ -440,7 +538,7 @@ func clearBatch(batch []msgAndHandler) []msgAndHandler {
 
 func (b *bee) recoverFromError(mh msgAndHandler, err interface{},
 	stack bool) {
-	b.AbortTx()
+	b.abortTx()
 
 	if d, ok := err.(time.Duration); ok {
 		b.snooze(mh, d)
@@ -451,6 +549,16 @@ func (b *bee) recoverFromError(mh msgAndHandler, err interface{},
 	if stack {
 		glog.Errorf("%s", debug.Stack())
 	}
+	b.hive.deadLetter(b.app.Name(), b.ID(), mh.msg, err, mh.attempt)
+}
+
+// handleRcvError retries the message if the retry policy allows. Otherwise, it
+// recovers from the error.
+func (b *bee) handleRcvError(mh msgAndHandler, err interface{}, stack bool) {
+	if _, ok := err.(time.Duration); !ok && b.retry(mh, err) {
+		return
+	}
+	b.recoverFromError(mh, err, stack)
 }
 
 var (
@@ -458,17 +566,36 @@ var (
 )
 
 func (b *bee) callRcv(mh msgAndHandler) (err error) {
+	if b.dropExpired(mh) || b.dropDuplicate(mh) {
+		return nil
+	}
+	m, ok := b.resolveAnswer(mh.msg)
+	if !ok {
+		return nil
+	}
+
+	b.attempt = mh.attempt + 1
+	b.rcvMsg = m
+	b.emitErr = nil
 	defer func() {
+		b.rcvMsg = nil
+		b.emitErr = nil
 		if r := recover(); r != nil {
-			b.recoverFromError(mh, r, true)
+			b.handleRcvError(mh, r, true)
+			err = errRcv
 		}
-		err = errRcv
 	}()
 
-	if err := mh.handler.Rcv(mh.msg, b); err != nil {
-		b.recoverFromError(mh, err, false)
+	err = mh.handler.Rcv(m, b)
+	if err == nil {
+		err = b.emitErr
+	}
+	if err != nil {
+		b.handleRcvError(mh, err, false)
 		return errRcv
 	}
+	b.recordKey(mh)
+	b.completeAnswer(m)
 
 	// FIXME(soheil): Provenence works only when the application is transactional.
 	var msgs []*msg
@@ -482,6 +609,10 @@ func (b *bee) callRcv(mh msgAndHandler) (err error) {
 }
 
 func (b *bee) handleMsgLeader(mhs []msgAndHandler) {
+	if mhs = b.relayMoved(mhs); len(mhs) == 0 {
+		return
+	}
+	b.recordCoaccess(mhs)
 
 	usetx := b.app.transactional()
 	if usetx && len(mhs) > 1 {
@@ -501,12 +632,16 @@ func (b *bee) handleMsgLeader(mhs []msgAndHandler) {
 		b.callRcv(mh)
 
 		if usetx {
+			b.releaseNested()
 			var err error
 			if b.stateL2 == nil {
+				b.writeKeys()
 				err = b.CommitTx()
-			} else if len(b.msgBufL1) == 0 && b.stateL2.HasEmptyTx() {
-				// If there is no pending L1 message and there is no state change,
-				// emit the buffered messages in L2 as a shortcut.
+			} else if len(b.msgBufL1) == 0 && len(b.dedupKeys) == 0 &&
+				b.stateL2.HasEmptyTx() {
+
+				// If there is no pending L1 message, no key to record, and no state
+				// change, emit the buffered messages in L2 as a shortcut.
 				b.throttle(b.msgBufL2)
 				b.resetTx(b.stateL2, &b.msgBufL2)
 			} else {
@@ -515,6 +650,7 @@ func (b *bee) handleMsgLeader(mhs []msgAndHandler) {
 
 			if err != nil && err != state.ErrNoTx {
 				glog.Errorf("%v cannot commit a transaction: %v", b, err)
+				b.forgetKey(mh)
 			}
 		}
 	}
@@ -524,6 +660,7 @@ func (b *bee) handleMsgLeader(mhs []msgAndHandler) {
 	}
 
 	b.stateL2 = nil
+	b.writeKeys()
 	if err := b.CommitTx(); err != nil && err != state.ErrNoTx {
 		glog.Errorf("%v cannot commit a transaction: %v", b, err)
 	}
@@ -544,6 +681,7 @@ func (b *bee) handleCmdLocal(cc cmdAndChannel) {
 	case cmdStop:
 		b.status = beeStatusStopped
 		b.disableEmit()
+		b.releaseState()
 		glog.V(2).Infof("%v stopped", b)
 
 	case cmdStart:
@@ -565,6 +703,24 @@ func (b *bee) handleCmdLocal(cc cmdAndChannel) {
 	case cmdHandoff:
 		err = b.handoff(cmd.To)
 
+	case cmdMergeColony:
+		err = b.mergeInto(cmd.To)
+
+	case cmdMergeChunk:
+		b.stageChunk(cmd)
+
+	case cmdMergeState:
+		err = b.mergeState(cmd)
+
+	case cmdDrained:
+		data = b.dataCh.size() == 0
+
+	case cmdSplitCells:
+		err = b.splitInto(cmd.To, cmd.Cells)
+
+	case cmdForgetMoved:
+		b.forgetMoved(cmd.Cells, cmd.To)
+
 	case cmdJoinColony:
 		if !cmd.Colony.Contains(b.ID()) {
 			err = fmt.Errorf("%v is not in this colony %v", b, cmd.Colony)
@@ -656,8 +812,15 @@ func (b *bee) followerHandlers() (func(mhs []msgAndHandler),
 }
 
 func (b *bee) becomeProxy() {
+	b.becomeProxyTo(b.ID())
+}
+
+// becomeProxyTo turns the bee into a proxy that relays its messages and
+// commands to the given bee.
+func (b *bee) becomeProxyTo(to uint64) {
+	b.releaseState()
 	b.proxy = true
-	b.handleMsg, b.handleCmd = b.proxyHandlers(b.ID())
+	b.handleMsg, b.handleCmd = b.proxyHandlers(to)
 }
 
 func (b *bee) proxyHandlers(to uint64) (func(mhs []msgAndHandler),
@@ -695,8 +858,31 @@ func (b *bee) proxyHandlers(to uint64) (func(mhs []msgAndHandler),
 			msgs = append(msgs, msg)
 		}
 
+		var retryUntil time.Time
 		for {
-			if err := b.prxClient.client.sendMsg(msgs); err == nil {
+			unsent, err := b.prxClient.client.sendMsg(msgs)
+			if err == nil {
+				return
+			}
+			// Only the messages that are not sent are retried.
+			msgs = unsent
+			if isOverloadedError(err) {
+				// The remote hive does not block on the overloaded application, so
+				// we block here instead, for a bounded time.
+				if b.app.bp != nil && b.app.bp.policy == BlockWhenOverloaded {
+					if retryUntil.IsZero() {
+						atomic.AddUint64(&b.app.counters.blocked, 1)
+						retryUntil = time.Now().Add(10 * b.hive.config.RaftElectTimeout())
+					}
+					if time.Now().Before(retryUntil) {
+						time.Sleep(b.hive.config.RaftTick)
+						continue
+					}
+				}
+				glog.Errorf("%v cannot send %v messages: %v", b, len(msgs), err)
+				for i := range msgs {
+					b.hive.deadLetter(b.app.Name(), b.ID(), &msgs[i], err, 0)
+				}
 				return
 			}
 
@@ -712,7 +898,7 @@ func (b *bee) proxyHandlers(to uint64) (func(mhs []msgAndHandler),
 
 	cfn := func(cc cmdAndChannel) {
 		switch cc.cmd.Data.(type) {
-		case cmdStop, cmdStart:
+		case cmdStop, cmdStart, cmdDrained:
 			b.handleCmdLocal(cc)
 		default:
 			cc.cmd.Hive = bi.Hive
@@ -771,6 +957,16 @@ func (b *bee) mappedCells() MappedCells {
 	return mc
 }
 
+func (b *bee) removeMappedCells(cells MappedCells) {
+	b.Lock()
+	defer b.Unlock()
+
+	for _, c := range cells {
+		glog.V(2).Infof("Removing cell %v from %v", c, b)
+		delete(b.cells, c)
+	}
+}
+
 func (b *bee) addMappedCells(cells MappedCells) {
 	b.Lock()
 	defer b.Unlock()
@@ -782,6 +978,7 @@ func (b *bee) addMappedCells(cells MappedCells) {
 	for _, c := range cells {
 		glog.V(2).Infof("Adding cell %v to %v", c, b)
 		b.cells[c] = true
+		delete(b.moved, c)
 	}
 }
 
@@ -819,6 +1016,13 @@ func (b *bee) Hive() Hive {
 	return b.hive
 }
 
+func (b *bee) Attempt() int {
+	if b.attempt == 0 {
+		return 1
+	}
+	return b.attempt
+}
+
 func (b *bee) Dict(n string) state.Dict {
 	dicts, _ := b.currentState()
 	return dicts.Dict(n)
@@ -829,12 +1033,13 @@ func (b *bee) App() string {
 }
 
 // Emits a message. Note that m should be your data not an instance of Msg.
-func (b *bee) Emit(msgData interface{}) {
-	b.bufferOrEmit(newMsgFromData(msgData, b.ID(), 0))
+func (b *bee) Emit(msgData interface{}, opts ...EmitOption) {
+	b.bufferOrEmit(b.newMsg(msgData, b.ID(), 0, opts))
 }
 
 func (b *bee) doEmit(msgs []*msg) {
 	for i := range msgs {
+		b.hive.stamp(msgs[i])
 		b.hive.enqueMsg(msgs[i])
 	}
 }
@@ -863,6 +1068,10 @@ func (b *bee) throttle(msgs []*msg) {
 }
 
 func (b *bee) bufferOrEmit(m *msg) {
+	if !b.admitEmit(m) {
+		return
+	}
+
 	dicts, msgs := b.currentState()
 	if dicts.TxStatus() != state.TxOpen {
 		b.throttle([]*msg{m})
@@ -873,17 +1082,18 @@ func (b *bee) bufferOrEmit(m *msg) {
 	*msgs = append(*msgs, m)
 }
 
-func (b *bee) SendToCell(msgData interface{}, app string, cell CellKey) {
+func (b *bee) SendToCell(msgData interface{}, app string, cell CellKey,
+	opts ...EmitOption) {
+
 	bi, _, err := b.hive.registry.beeForCells(app, MappedCells{cell})
 	if err != nil {
 		glog.Fatalf("cannot find any bee in app %v for cell %v", app, cell)
 	}
-	msg := newMsgFromData(msgData, bi.ID, 0)
-	b.bufferOrEmit(msg)
+	b.bufferOrEmit(b.newMsg(msgData, bi.ID, 0, opts))
 }
 
 func (b *bee) SendToBee(msgData interface{}, to uint64) {
-	b.bufferOrEmit(newMsgFromData(msgData, b.beeID, to))
+	b.bufferOrEmit(b.newMsg(msgData, b.beeID, to, nil))
 }
 
 // Reply to msg with the provided reply.
@@ -932,10 +1142,23 @@ func (b *bee) StartDetachedFunc(start StartFunc, stop StopFunc,
 	return b.StartDetached(&funcDetached{start, stop, rcv})
 }
 
-func (b *bee) BeginTx() error {
+func (b *bee) Lookup(dict, index, key string, f state.IterFn) error {
 	dicts, _ := b.currentState()
+	return dicts.Lookup(dict, index, key, f)
+}
+
+func (b *bee) BeginTx() error {
+	dicts, msgs := b.currentState()
 	if dicts.TxStatus() == state.TxOpen {
-		return state.ErrOpenTx
+		if err := dicts.BeginTx(); err != nil {
+			return err
+		}
+		b.savepoints = append(b.savepoints, beeSavepoint{
+			nested: true,
+			msgs:   len(*msgs),
+		})
+		glog.V(2).Infof("%v begins a nested transaction", b)
+		return nil
 	}
 
 	if err := dicts.BeginTx(); err != nil {
@@ -948,6 +1171,7 @@ func (b *bee) BeginTx() error {
 }
 
 func (b *bee) commitTxBothLayers() (err error) {
+	var chs []*msg
 	hasL2 := b.stateL2 != nil
 	if hasL2 {
 		if err = b.stateL2.CommitTx(); err != nil {
@@ -955,6 +1179,7 @@ func (b *bee) commitTxBothLayers() (err error) {
 		}
 	}
 
+	chs = b.dictChanges(b.stateL1.TxOps())
 	if err = b.stateL1.CommitTx(); err != nil {
 		goto reset
 	}
@@ -963,6 +1188,7 @@ func (b *bee) commitTxBothLayers() (err error) {
 	if hasL2 {
 		b.throttle(b.msgBufL2)
 	}
+	b.throttle(chs)
 
 reset:
 	if hasL2 {
@@ -978,8 +1204,10 @@ func (b *bee) commitTxL1() (err error) {
 		b.commitTxL2()
 	}
 
+	chs := b.dictChanges(b.stateL1.TxOps())
 	if err = b.stateL1.CommitTx(); err == nil {
 		b.throttle(b.msgBufL1)
+		b.throttle(chs)
 	}
 	b.resetTx(b.stateL1, &b.msgBufL1)
 	return
@@ -998,6 +1226,7 @@ func (b *bee) commitTxL2() (err error) {
 
 func (b *bee) resetTx(dicts *state.Transactional, msgs *[]*msg) {
 	dicts.Reset()
+	b.savepoints = nil
 	for i := range *msgs {
 		(*msgs)[i] = nil
 	}
@@ -1022,6 +1251,12 @@ func (b *bee) replicate() error {
 		return state.ErrNoTx
 	}
 
+	if err := b.stateL1.Validate(); err != nil {
+		b.resetTx(b.stateL1, &b.msgBufL1)
+		b.Unlock()
+		return err
+	}
+
 	stx := b.stateL1.Tx()
 	if len(stx.Ops) == 0 {
 		err := b.commitTxL1()
@@ -1083,17 +1318,20 @@ func (b *bee) doRecruitFollowers() (recruited int) {
 		return 0
 	}
 
-	blacklist := []uint64{b.hive.ID()}
+	// The hives that hold a replica, and the hives that are already tried.
+	replicas := []uint64{b.hive.ID()}
+	var blacklist []uint64
 	for _, f := range c.Followers {
 		fb, err := b.hive.registry.bee(f)
 		if err != nil {
 			glog.Fatalf("%v cannot find the hive of follower %v: %v", b, f, err)
 		}
-		blacklist = append(blacklist, fb.Hive)
+		replicas = append(replicas, fb.Hive)
 	}
 
 	for r != 1 {
-		hives := b.hive.replStrategy.selectHives(blacklist, r-1)
+		hives := b.hive.replStrategy.selectHives(b.app.constraints, replicas,
+			blacklist, r-1)
 		if len(hives) == 0 {
 			glog.Warningf("can only find %v hives to create followers for %v",
 				len(c.Followers), b)
@@ -1140,6 +1378,7 @@ func (b *bee) doRecruitFollowers() (recruited int) {
 				glog.Errorf("%v cannot add %v as a follower: %v", b, finf.ID, err)
 				continue
 			}
+			replicas = append(replicas, finf.Hive)
 			recruited++
 			r--
 		}
@@ -1230,11 +1469,17 @@ func (b *bee) currentState() (dicts *state.Transactional, msgs *[]*msg) {
 }
 
 func (b *bee) CommitTx() error {
+	if i := b.lastNested(); i >= 0 {
+		dicts, _ := b.currentState()
+		b.savepoints = b.savepoints[:i]
+		glog.V(2).Infof("%v commits a nested transaction", b)
+		return dicts.CommitTx()
+	}
+
 	// No need to replicate and/or persist the transaction.
 	if !b.app.persistent() || b.detached {
 		glog.V(2).Infof("%v commits in memory transaction", b)
-		b.commitTxBothLayers()
-		return nil
+		return b.commitTxBothLayers()
 	}
 
 	glog.V(2).Infof("%v commits persistent transaction", b)
@@ -1247,6 +1492,14 @@ func (b *bee) AbortTx() error {
 		return state.ErrNoTx
 	}
 
+	if i := b.lastNested(); i >= 0 {
+		glog.V(2).Infof("%v aborts a nested transaction", b)
+		err := dicts.AbortTx()
+		b.truncateMsgs(msgs, b.savepoints[i].msgs)
+		b.savepoints = b.savepoints[:i]
+		return err
+	}
+
 	glog.V(2).Infof("%v aborts tx", b)
 	err := dicts.AbortTx()
 	b.resetTx(dicts, msgs)
@@ -1265,6 +1518,54 @@ func (b *bee) Restore(buf []byte) error {
 	return b.stateL1.Restore(buf)
 }
 
+func (b *bee) SaveChunks(w *raft.ChunkWriter, delta bool) error {
+	var since uint64
+	if delta {
+		since = b.snapVer
+	}
+	ver, err := b.stateL1.SaveChunks(since, func(c state.Chunk) error {
+		d, err := bhgob.Encode(c)
+		if err != nil {
+			return err
+		}
+		return w.WriteChunk(d)
+	})
+	if err != nil {
+		return err
+	}
+	// The deltas of the next snapshots are all after ver, so the keys deleted
+	// before ver no longer need their versions.
+	b.stateL1.DropTombstones(ver)
+	b.snapVer = ver
+	return nil
+}
+
+func (b *bee) RestoreChunks(r *raft.ChunkReader, delta bool) error {
+	if !delta {
+		if err := b.stateL1.Clear(); err != nil {
+			return err
+		}
+	}
+	for {
+		d, err := r.ReadChunk()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		var c state.Chunk
+		if err := bhgob.Decode(&c, d); err != nil {
+			return err
+		}
+		if err := b.stateL1.ApplyChunk(c); err != nil {
+			return err
+		}
+	}
+	b.snapVer = state.LastVersion()
+	return nil
+}
+
 func (b *bee) Apply(req interface{}) (interface{}, error) {
 	b.Lock()
 	defer b.Unlock()
@@ -1292,6 +1593,11 @@ func (b *bee) Apply(req interface{}) (interface{}, error) {
 			b.resetTx(b.stateL1, &b.msgBufL1)
 		}
 
+		var chs []*msg
+		if leader && b.emitInRaft {
+			chs = b.dictChanges(r.Tx.Ops)
+		}
+
 		if err := b.stateL1.Apply(r.Tx.Ops); err != nil {
 			return nil, err
 		}
@@ -1302,6 +1608,7 @@ func (b *bee) Apply(req interface{}) (interface{}, error) {
 				glog.V(2).Infof("%v emits %#v", b, msg)
 			}
 			b.throttle(r.Tx.Msgs)
+			b.throttle(chs)
 		}
 		return nil, nil
 
@@ -1358,3 +1665,5 @@ type commitTx struct {
 func init() {
 	gob.Register(commitTx{})
 }
+
+var _ raft.ChunkedStateMachine = &bee{}
@@ -274,3 +274,50 @@ func BenchmarkBeePersistence(b *testing.B) {
 	time.Sleep(1 * time.Second)
 	hive.node.Stop()
 }
+
+func TestBeeSavepoint(t *testing.T) {
+	b := &bee{
+		app: &app{
+			name:  "test",
+			flags: appFlagTransactional,
+		},
+		stateL1: state.NewTransactional(state.NewInMem()),
+	}
+
+	b.BeginTx()
+	b.Emit("a")
+	b.Savepoint("sp")
+	b.Emit("b")
+	b.Dict("d").Put("k", 1)
+	if err := b.RollbackTo("sp"); err != nil {
+		t.Fatalf("cannot rollback: %v", err)
+	}
+	if l := len(b.msgBufL1); l != 1 {
+		t.Errorf("invalid number of buffered messages: actual=%v want=1", l)
+	}
+	if _, err := b.Dict("d").Get("k"); err == nil {
+		t.Error("state is not rolled back")
+	}
+
+	b.BeginTx()
+	b.Emit("c")
+	b.AbortTx()
+	if l := len(b.msgBufL1); l != 1 {
+		t.Errorf("invalid number of buffered messages: actual=%v want=1", l)
+	}
+
+	b.BeginTx()
+	b.Emit("d")
+	b.CommitTx()
+	if l := len(b.msgBufL1); l != 2 {
+		t.Errorf("invalid number of buffered messages: actual=%v want=2", l)
+	}
+	if b.stateL1.TxStatus() != state.TxOpen {
+		t.Error("committing a nested transaction closes the transaction")
+	}
+
+	b.abortTx()
+	if l := len(b.msgBufL1); l != 0 {
+		t.Errorf("invalid number of buffered messages: actual=%v want=0", l)
+	}
+}
@@ -98,6 +98,21 @@ func (s *cellStore) assignBeeCells(app string, k CellKey, c Colony) {
 	keys[k.Key] = struct{}{}
 }
 
+func (s *cellStore) unassignBeeCell(bee uint64, k CellKey) {
+	dicts, ok := s.BeeCells[bee]
+	if !ok {
+		return
+	}
+	keys, ok := dicts[k.Dict]
+	if !ok {
+		return
+	}
+	delete(keys, k.Key)
+	if len(keys) == 0 {
+		delete(dicts, k.Dict)
+	}
+}
+
 func (s *cellStore) colony(app string, cell CellKey) (c Colony, ok bool) {
 	dicts, ok := s.CellBees[app]
 	if !ok {
@@ -11,6 +11,10 @@ type cmdCampaign struct{}
 type cmdCreateBee struct{}
 type cmdFindBee struct{ ID uint64 }
 type cmdHandoff struct{ To uint64 }
+type cmdHiveLoad struct {
+	Hive uint64
+	Load HiveLoad
+}
 type cmdRestoreState struct{ State []byte }
 type cmdJoinColony struct{ Colony Colony }
 type cmdAddMappedCells struct{ Cells MappedCells }
@@ -20,12 +24,25 @@ type cmdMigrate struct {
 	Bee uint64
 	To  uint64
 }
+type cmdSplit struct {
+	Bee   uint64
+	Cells MappedCells
+}
+type cmdSplitCells struct {
+	To    Colony
+	Cells MappedCells
+}
+type cmdForgetMoved struct {
+	Cells MappedCells
+	To    uint64
+}
 type cmdNewHiveID struct{}
 type cmdPing struct{}
 type cmdReloadBee struct {
 	ID     uint64
 	Colony Colony
 }
+type cmdRemoveBee struct{ ID uint64 }
 type cmdStart struct{}
 type cmdStartDetached struct{ Handler DetachedHandler }
 type cmdStop struct{}
@@ -39,6 +56,7 @@ func init() {
 	gob.Register(cmdCreateBee{})
 	gob.Register(cmdFindBee{})
 	gob.Register(cmdHandoff{})
+	gob.Register(cmdHiveLoad{})
 	gob.Register(cmdJoinColony{})
 	gob.Register(cmdLiveHives{})
 	gob.Register(cmdMigrate{})
@@ -46,7 +64,11 @@ func init() {
 	gob.Register(cmdPing{})
 	gob.Register(cmdRefreshRole{})
 	gob.Register(cmdReloadBee{})
+	gob.Register(cmdRemoveBee{})
 	gob.Register(cmdRestoreState{})
+	gob.Register(cmdSplit{})
+	gob.Register(cmdSplitCells{})
+	gob.Register(cmdForgetMoved{})
 	gob.Register(cmdStartDetached{})
 	gob.Register(cmdStart{})
 	gob.Register(cmdStop{})
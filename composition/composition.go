@@ -52,10 +52,15 @@ func (c *ComposedHandler) callMap(h bh.Handler, msg bh.Msg, ctx bh.MapContext) (
 	return
 }
 
-// Rcv method of the composed handler.
+// Rcv method of the composed handler. Before calling each handler, Rcv creates
+// a savepoint in the transaction. If the handler fails, its state changes and
+// emitted messages are rolled back before proceeding to the next step.
+// Otherwise, the savepoint is released.
 func (c *ComposedHandler) Rcv(msg bh.Msg, ctx bh.RcvContext) error {
 	var err error
 	for i := range c.Handlers {
+		sp := savepointName(i)
+		spErr := ctx.Savepoint(sp)
 		if c.Isolate {
 			rctx := composedRcvContext{RcvContext: ctx, prefix: strconv.Itoa(i)}
 			err = c.callRcv(c.Handlers[i], msg, rctx)
@@ -63,6 +68,13 @@ func (c *ComposedHandler) Rcv(msg bh.Msg, ctx bh.RcvContext) error {
 			err = c.callRcv(c.Handlers[i], msg, ctx)
 		}
 
+		if spErr == nil {
+			if err != nil {
+				ctx.RollbackTo(sp)
+			}
+			ctx.ReleaseSavepoint(sp)
+		}
+
 		switch c.Composer(msg, ctx, err) {
 		case Abort:
 			ctx.AbortTx()
@@ -89,6 +101,30 @@ func (c *ComposedHandler) Rcv(msg bh.Msg, ctx bh.RcvContext) error {
 	return nil
 }
 
+func savepointName(i int) string {
+	return "composition/" + strconv.Itoa(i)
+}
+
+// DictPrefixes returns the prefixes of the dictionaries used by the composed
+// handlers. When the dictionaries are isolated, the dictionaries of the i'th
+// handler are prefixed with i.
+func (c *ComposedHandler) DictPrefixes() []string {
+	var prefixes []string
+	for i, h := range c.Handlers {
+		var p string
+		if c.Isolate {
+			p = strconv.Itoa(i)
+			prefixes = append(prefixes, p)
+		}
+		if s, ok := h.(bh.DictScoper); ok {
+			for _, sp := range s.DictPrefixes() {
+				prefixes = append(prefixes, p+sp)
+			}
+		}
+	}
+	return prefixes
+}
+
 // Map method of the composed handler.
 func (c *ComposedHandler) Map(msg bh.Msg, ctx bh.MapContext) bh.MappedCells {
 	var cells bh.MappedCells
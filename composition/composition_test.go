@@ -2,10 +2,12 @@ package composition
 
 import (
 	"errors"
+	"reflect"
 	"strconv"
 	"testing"
 
 	bh "github.com/kandoo/beehive"
+	"github.com/kandoo/beehive/state"
 )
 
 type mockHandler struct {
@@ -163,3 +165,86 @@ func TestEverything(t *testing.T) {
 	testComposition(t, handlers, composed, []int{1, 1, 0}, []int{1, 1, 1}, false,
 		cells, false)
 }
+
+func TestRollbackFailedStep(t *testing.T) {
+	ctx := newMockContext()
+	ctx.BeginTx()
+
+	handlers := []bh.Handler{
+		&mockHandler{
+			rcvFunc: func(msg bh.Msg, ctx bh.RcvContext) error {
+				ctx.Dict("d").Put("failed", true)
+				return errors.New("error in rcv")
+			},
+		},
+		&mockHandler{
+			rcvFunc: func(msg bh.Msg, ctx bh.RcvContext) error {
+				return ctx.Dict("d").Put("succeeded", true)
+			},
+		},
+	}
+	composed := &ComposedHandler{
+		Handlers: handlers,
+		Composer: ComposeAny,
+	}
+	if err := composed.Rcv(nil, ctx); err != nil {
+		t.Fatalf("error in rcv: %v", err)
+	}
+
+	if _, err := ctx.Dict("d").Get("failed"); err == nil {
+		t.Error("the changes of the failed step are committed")
+	}
+	if _, err := ctx.Dict("d").Get("succeeded"); err != nil {
+		t.Error("the changes of the successful step are not committed")
+	}
+}
+
+func TestReleaseSavepoints(t *testing.T) {
+	ctx := newMockContext()
+	ctx.BeginTx()
+
+	var spErrs []error
+	rcv := func(msg bh.Msg, ctx bh.RcvContext) error {
+		for i := 0; i < 2; i++ {
+			spErrs = append(spErrs, ctx.RollbackTo(savepointName(i)))
+		}
+		return nil
+	}
+	handlers := []bh.Handler{
+		&mockHandler{rcvFunc: rcv},
+		&mockHandler{rcvFunc: rcv},
+	}
+	composed := &ComposedHandler{
+		Handlers: handlers,
+		Composer: ComposeAll,
+	}
+	if err := composed.Rcv(nil, ctx); err != nil {
+		t.Fatalf("error in rcv: %v", err)
+	}
+
+	want := []error{nil, state.ErrNoSuchSavepoint, state.ErrNoSuchSavepoint, nil}
+	if !reflect.DeepEqual(spErrs, want) {
+		t.Errorf("savepoints are not released: actual=%v want=%v", spErrs, want)
+	}
+}
+
+func TestDictPrefixes(t *testing.T) {
+	inner := &ComposedHandler{
+		Handlers: []bh.Handler{&mockHandler{}, &mockHandler{}},
+		Isolate:  true,
+	}
+	composed := &ComposedHandler{
+		Handlers: []bh.Handler{&mockHandler{}, inner},
+		Isolate:  true,
+	}
+	want := []string{"0", "1", "10", "11"}
+	if p := composed.DictPrefixes(); !reflect.DeepEqual(p, want) {
+		t.Errorf("invalid prefixes: actual=%v want=%v", p, want)
+	}
+
+	composed.Isolate = false
+	want = []string{"0", "1"}
+	if p := composed.DictPrefixes(); !reflect.DeepEqual(p, want) {
+		t.Errorf("invalid prefixes: actual=%v want=%v", p, want)
+	}
+}
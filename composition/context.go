@@ -14,6 +14,12 @@ func (c composedRcvContext) Dict(name string) state.Dict {
 	return c.RcvContext.Dict(c.prefix + name)
 }
 
+func (c composedRcvContext) Lookup(dict, index, key string,
+	f state.IterFn) error {
+
+	return c.RcvContext.Lookup(c.prefix+dict, index, key, f)
+}
+
 type composedMapContext struct {
 	bh.MapContext
 	prefix string
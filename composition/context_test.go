@@ -36,12 +36,21 @@ func (c mockContext) ID() uint64 {
 	return 0
 }
 
+func (c mockContext) Attempt() int { return 1 }
+
 func (c mockContext) Printf(format string, a ...interface{}) {}
 
-func (c mockContext) Emit(msgData interface{})                 {}
-func (c mockContext) SendToBee(msgData interface{}, to uint64) {}
+func (c mockContext) Emit(msgData interface{}, opts ...bh.EmitOption) {}
+func (c mockContext) SendToBee(msgData interface{}, to uint64)        {}
+func (c mockContext) EmitTo(topic string, msgData interface{},
+	opts ...bh.EmitOption) {
+}
+func (c mockContext) Ask(req interface{}, opts ...bh.EmitOption) (bh.Future,
+	error) {
+	return bh.Future{}, nil
+}
 func (c mockContext) SendToCell(msgData interface{}, to string,
-	dk bh.CellKey) {
+	dk bh.CellKey, opts ...bh.EmitOption) {
 }
 func (c mockContext) Reply(msg bh.Msg, replyData interface{}) error {
 	return nil
@@ -71,6 +80,14 @@ func (c mockContext) DeferReply(msg bh.Msg) bh.Repliable {
 	return bh.Repliable{}
 }
 
+func (c mockContext) Gather(ctx context.Context, app string,
+	cells []bh.CellKey, req interface{}) []bh.GatherResult {
+	return nil
+}
+func (c mockContext) SyncAll(ctx context.Context, app string,
+	req interface{}) []bh.GatherResult {
+	return nil
+}
 func (c mockContext) Sync(ctx context.Context, req interface{}) (
 	res interface{}, err error) {
 
@@ -0,0 +1,276 @@
+package beehive
+
+import (
+	"hash/fnv"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
+)
+
+// DefaultVirtualNodes is the number of virtual nodes of each hive on the ring
+// of ConsistentHashPlacement, when its number of virtual nodes is not positive.
+const DefaultVirtualNodes = 64
+
+// ConsistentHashPlacement is a placement method that places mapped cells on the
+// owner of the cells on a consistent hash ring of live hives. Each hive has
+// multiple virtual nodes on the ring, and the owner of the cells is the hive of
+// the first virtual node after the hash of the cells. As a result, the cells
+// are placed on the same hive as long as the live hives do not change, and a
+// hive joining or leaving the ring moves only a fraction of the cells.
+//
+// If the load factor is positive, the load of hives is bounded: hives with
+// more than load factor times the average number of bees of the application
+// are skipped on the ring. The bees of the application are counted using the
+// registry, and as such the load is bounded only when ConsistentHashPlacement
+// is used as the placement method of an application.
+//
+// ConsistentHashPlacement should be created using NewConsistentHashPlacement.
+type ConsistentHashPlacement struct {
+	vnodes     int
+	loadFactor float64
+
+	m     sync.Mutex
+	hives string  // The hives of the ring.
+	ring  []vnode // Sorted by hash.
+}
+
+type vnode struct {
+	hash uint64
+	hive uint64
+}
+
+type byHash []vnode
+
+func (r byHash) Len() int           { return len(r) }
+func (r byHash) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r byHash) Less(i, j int) bool { return r[i].hash < r[j].hash }
+
+// NewConsistentHashPlacement creates a consistent hash placement with the given
+// number of virtual nodes per hive and the given load factor. The load of hives
+// is not bounded if loadFactor is not positive, and loadFactor should be
+// larger than 1 otherwise.
+func NewConsistentHashPlacement(vnodes int,
+	loadFactor float64) *ConsistentHashPlacement {
+
+	if vnodes <= 0 {
+		vnodes = DefaultVirtualNodes
+	}
+	return &ConsistentHashPlacement{
+		vnodes:     vnodes,
+		loadFactor: loadFactor,
+	}
+}
+
+// hashString hashes s using FNV-1a, and mixes the bits of the hash since FNV
+// does not distribute short and similar strings uniformly.
+func hashString(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// hashCells returns the hash of the smallest cell, so that cells mapped in any
+// order have the same hash.
+func hashCells(cells MappedCells) uint64 {
+	if len(cells) == 0 {
+		return 0
+	}
+	min := cells[0]
+	for _, c := range cells[1:] {
+		if c.Dict < min.Dict || (c.Dict == min.Dict && c.Key < min.Key) {
+			min = c
+		}
+	}
+	return hashString(min.Dict + "/" + min.Key)
+}
+
+// hiveIDs returns the IDs of hives as a string, which is the same for the same
+// set of hives.
+func hiveIDs(hives []HiveInfo) string {
+	ids := make([]string, 0, len(hives))
+	for _, h := range hives {
+		ids = append(ids, strconv.FormatUint(h.ID, 10))
+	}
+	sort.Strings(ids)
+	return strings.Join(ids, ",")
+}
+
+// ringOf returns the ring of the given hives, which is rebuilt only when the
+// hives change.
+func (p *ConsistentHashPlacement) ringOf(hives []HiveInfo) []vnode {
+	ids := hiveIDs(hives)
+
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	if ids == p.hives {
+		return p.ring
+	}
+
+	ring := make([]vnode, 0, len(hives)*p.vnodes)
+	for _, h := range hives {
+		for i := 0; i < p.vnodes; i++ {
+			k := strconv.FormatUint(h.ID, 10) + "-" + strconv.Itoa(i)
+			ring = append(ring, vnode{hash: hashString(k), hive: h.ID})
+		}
+	}
+	sort.Sort(byHash(ring))
+	p.hives, p.ring = ids, ring
+	return ring
+}
+
+func (p *ConsistentHashPlacement) Place(cells MappedCells, thisHive Hive,
+	liveHives []HiveInfo) HiveInfo {
+
+	return p.place(cells, liveHives, nil)
+}
+
+// place places the cells on the owner of the cells on the ring. bees is the
+// number of bees of the application on each hive, and the load is not bounded
+// if it is nil.
+func (p *ConsistentHashPlacement) place(cells MappedCells,
+	liveHives []HiveInfo, bees map[uint64]int) HiveInfo {
+
+	infos := make(map[uint64]HiveInfo, len(liveHives))
+	total := 0
+	for _, h := range liveHives {
+		infos[h.ID] = h
+		total += bees[h.ID]
+	}
+
+	bound := math.MaxInt32
+	if p.loadFactor > 0 && total > 0 {
+		bound = int(math.Ceil(p.loadFactor * float64(total+1) /
+			float64(len(liveHives))))
+	}
+
+	ring := p.ringOf(liveHives)
+	h := hashCells(cells)
+	i := sort.Search(len(ring), func(i int) bool { return ring[i].hash >= h })
+	for n := 0; n < len(ring); n++ {
+		vn := ring[(i+n)%len(ring)]
+		if bees[vn.hive] < bound {
+			return infos[vn.hive]
+		}
+	}
+	// All the hives are at the bound.
+	return infos[ring[i%len(ring)].hive]
+}
+
+// beesPerHive returns the number of bees of the application on each hive,
+// counting only the leaders of colonies.
+func (a *app) beesPerHive() map[uint64]int {
+	bees := make(map[uint64]int)
+	for _, b := range a.hive.registry.bees() {
+		if b.App == a.Name() && !b.Detached && b.Colony.Leader == b.ID {
+			bees[b.Hive]++
+		}
+	}
+	return bees
+}
+
+// place places the cells on one of the hives using the placement method of
+// the application. exclude is the bee that is being placed, if it already
+// exists, and is not counted in the load of its hive.
+func (a *app) place(cells MappedCells, hives []HiveInfo,
+	exclude BeeInfo) HiveInfo {
+
+	p, ok := a.placement.(*ConsistentHashPlacement)
+	if !ok || p.loadFactor <= 0 {
+		return a.placement.Place(cells, a.hive, hives)
+	}
+	bees := a.beesPerHive()
+	if exclude.ID != Nil {
+		bees[exclude.Hive]--
+	}
+	return p.place(cells, hives, bees)
+}
+
+// Rebalance is an application option that periodically checks whether the live
+// hives have changed, and if so, migrates the local bees of the application to
+// the hive chosen by the placement method of the application for their cells.
+// It should be used with deterministic placement methods, such as
+// ConsistentHashPlacement. If a bee cannot be migrated, the bees are rebalanced
+// again in the next period.
+func Rebalance(period time.Duration) AppOption {
+	return func(a *app) {
+		r := &rebalancer{app: a}
+		a.Detached(NewTimer(period, r.rebalance))
+	}
+}
+
+type rebalancer struct {
+	app   *app
+	hives string // The live hives in the last rebalance.
+}
+
+func (r *rebalancer) rebalance() {
+	a := r.app
+	if a.placement == nil {
+		return
+	}
+
+	hives := a.constraints.filter(a.hive.loadedHives())
+	if len(hives) == 0 {
+		return
+	}
+	ids := hiveIDs(hives)
+	if ids == r.hives {
+		return
+	}
+	prev := r.hives
+	r.hives = ids
+	if prev == "" {
+		// Bees are placed on the current hives.
+		return
+	}
+
+	type beeAndCells struct {
+		id    uint64
+		cells MappedCells
+	}
+	var bees []beeAndCells
+	a.qee.RLock()
+	for id, b := range a.qee.bees {
+		if b.detached || b.proxy || b.colony().Leader != id {
+			continue
+		}
+		bees = append(bees, beeAndCells{id: id})
+	}
+	a.qee.RUnlock()
+
+	// Cells are read from the registry, since migrated bees do not have their
+	// cells locally.
+	for i := range bees {
+		bees[i].cells = a.hive.registry.beeCells(bees[i].id)
+	}
+
+	for _, b := range bees {
+		if len(b.cells) == 0 {
+			continue
+		}
+		to := a.place(b.cells, hives, BeeInfo{ID: b.id, Hive: a.hive.ID()})
+		if to.ID == a.hive.ID() {
+			continue
+		}
+		glog.V(2).Infof("%v rebalances bee %v to hive %v", a, b.id, to.ID)
+		if _, err := a.qee.processCmd(cmdMigrate{Bee: b.id, To: to.ID}); err != nil {
+			glog.Errorf("%v cannot rebalance bee %v to hive %v: %v", a, b.id, to.ID,
+				err)
+			// Retry in the next period.
+			r.hives = prev
+			return
+		}
+	}
+}
@@ -46,6 +46,8 @@ type MapContext interface {
 type Repliable struct {
 	From   uint64 // The ID of the bee that originally sent the message.
 	SyncID uint64 // The sync message ID if the message was sync, otherwise 0.
+	Stream bool   // Whether the sync message is a streaming request.
+	Credit int    // The number of responses that can be sent on the stream.
 }
 
 // Reply replies to the Repliable using replyData.
@@ -66,14 +68,37 @@ type RcvContext interface {
 
 	// ID returns the bee id of this context.
 	ID() uint64
-
-	// Emit emits a message.
-	Emit(msgData interface{})
+	// Attempt returns the attempt number of the message being received, which
+	// is 1 for the first attempt. Messages are retried based on the retry
+	// policy of the application.
+	Attempt() int
+
+	// Emit emits a message. The priority of the message can be set using the
+	// Priority option.
+	Emit(msgData interface{}, opts ...EmitOption)
+	// EmitTo emits a message on the given topic. The message is received by the
+	// applications subscribed to the topic.
+	EmitTo(topic string, msgData interface{}, opts ...EmitOption)
 	// SendToCell sends a message to the bee of the give app that owns the
 	// given cell.
-	SendToCell(msgData interface{}, app string, cell CellKey)
+	SendToCell(msgData interface{}, app string, cell CellKey,
+		opts ...EmitOption)
 	// SendToBee sends a message to the given bee.
 	SendToBee(msgData interface{}, to uint64)
+	// Ask sends a synchrounous message (req) without blocking the bee. The
+	// response is delivered to the bee in an Answer message, along with the
+	// message that the bee is currently receiving. The application must handle
+	// Answer.
+	Ask(req interface{}, opts ...EmitOption) (Future, error)
+	// Gather sends a synchrounous message (req) to the bees of app that own the
+	// given cells, and returns the response of each cell. Gather must not be
+	// used to send a request to the bee itself.
+	Gather(ctx context.Context, app string, cells []CellKey,
+		req interface{}) []GatherResult
+	// SyncAll sends a synchrounous message (req) to all the bees of app, and
+	// returns the response of each bee. SyncAll must not be used on the app of
+	// the bee itself.
+	SyncAll(ctx context.Context, app string, req interface{}) []GatherResult
 	// Reply replies to a message: Sends a message from the current bee to the
 	// bee that emitted msg.
 	Reply(msg Msg, replyData interface{}) error
@@ -100,6 +125,11 @@ type RcvContext interface {
 	// SetBeeLocal sets a data in the bee-local storage.
 	SetBeeLocal(d interface{})
 
+	// Lookup iterates over the entries of dictionary dict whose index key in the
+	// given secondary index is key. Indexes are declared using the Index app
+	// option.
+	Lookup(dict, index, key string, f state.IterFn) error
+
 	// Starts a transaction in this context. Transactions span multiple
 	// dictionaries and buffer all messages. When a transaction commits all the
 	// side effects will be applied. Note that since handlers are called in a
@@ -113,6 +143,17 @@ type RcvContext interface {
 	CommitTx() error
 	// Aborts the transaction.
 	AbortTx() error
+
+	// Savepoint creates a savepoint in the current transaction. Calling BeginTx
+	// while a transaction is open begins a nested transaction, which is rolled
+	// back by AbortTx or is merged into its parent by CommitTx.
+	Savepoint(name string) error
+	// RollbackTo rolls back the state changes and the messages emitted after
+	// the savepoint.
+	RollbackTo(name string) error
+	// ReleaseSavepoint removes the savepoint and the savepoints created after it,
+	// keeping the state changes and the messages emitted after the savepoint.
+	ReleaseSavepoint(name string) error
 }
 
 func init() {
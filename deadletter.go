@@ -0,0 +1,206 @@
+package beehive
+
+import (
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/gorilla/mux"
+	"github.com/kandoo/beehive/Godeps/_workspace/src/golang.org/x/net/context"
+	bhgob "github.com/kandoo/beehive/gob"
+)
+
+const (
+	appDeadLetters     = "bh_deadletters"
+	dictDeadLetters    = "DeadLetters"
+	dictDeadLetterMeta = "DeadLetterMeta"
+	keyLastDeadLetter  = "last"
+
+	// maxDeadLetters is the maximum number of dead letters kept on each hive.
+	// When there are more dead letters, the oldest ones are removed.
+	maxDeadLetters = 1024
+)
+
+var (
+	// ErrNoSuchDeadLetter is returned when the dead letter is not found.
+	ErrNoSuchDeadLetter = bhgob.Error("deadletter: no such dead letter")
+
+	errMapDrop = errors.New("map drops the message")
+)
+
+// DeadLetter is a message that could not be handled. Dead letters are
+// collected by the dead-letter app of each hive, when the hive is created with
+// the DeadLetters option.
+type DeadLetter struct {
+	ID      uint64    // ID of the dead letter on its hive.
+	Msg     msg       // The message.
+	App     string    // The application that failed to handle the message.
+	Bee     uint64    // The bee that failed. It is 0 if the map function failed.
+	Err     string    // The error.
+	Retries int       // The number of times the message was retried.
+	Time    time.Time // When the message failed.
+}
+
+// Data returns the data of the dead message.
+func (d DeadLetter) Data() interface{} {
+	return d.Msg.Data()
+}
+
+func (d DeadLetter) String() string {
+	return fmt.Sprintf("dead letter %v of %v (bee %v): %v", d.ID, d.App, d.Bee,
+		d.Err)
+}
+
+// deadLetter records a dead letter for msg, if dead letters are enabled.
+func (h *hive) deadLetter(app string, bee uint64, m *msg, err interface{},
+	retries int) {
+
+	if !h.config.DeadLetters || app == appDeadLetters {
+		return
+	}
+
+	h.Emit(DeadLetter{
+		Msg:     *m,
+		App:     app,
+		Bee:     bee,
+		Err:     fmt.Sprintf("%v", err),
+		Retries: retries,
+		Time:    time.Now(),
+	})
+}
+
+func installDeadLetters(h *hive) {
+	a := h.NewApp(appDeadLetters, NonTransactional())
+	a.Handle(DeadLetter{}, deadLetterHandler{})
+	a.Handle(listDeadLetters{}, deadLetterHandler{})
+	a.Handle(reemitDeadLetter{}, deadLetterHandler{})
+	a.HandleHTTP("/letters", &deadLetterHTTPHandler{hive: h}).Methods("GET")
+	a.HandleHTTP("/letters/{id:[0-9]+}",
+		&deadLetterHTTPHandler{hive: h}).Methods("POST")
+
+	glog.V(1).Infof("%v installs the dead-letter app", h)
+}
+
+type listDeadLetters struct{}
+
+type reemitDeadLetter struct {
+	ID uint64
+}
+
+type deadLetterHandler struct{}
+
+func (h deadLetterHandler) Map(msg Msg, ctx MapContext) MappedCells {
+	return ctx.LocalMappedCells()
+}
+
+func (h deadLetterHandler) Rcv(msg Msg, ctx RcvContext) error {
+	switch d := msg.Data().(type) {
+	case DeadLetter:
+		return h.add(d, ctx)
+
+	case listDeadLetters:
+		var letters []DeadLetter
+		ctx.Dict(dictDeadLetters).ForEach(func(k string, v interface{}) bool {
+			letters = append(letters, v.(DeadLetter))
+			return true
+		})
+		return ctx.Reply(msg, letters)
+
+	case reemitDeadLetter:
+		dict := ctx.Dict(dictDeadLetters)
+		k := formatDeadLetterID(d.ID)
+		v, err := dict.Get(k)
+		if err != nil {
+			return ErrNoSuchDeadLetter
+		}
+		dl := v.(DeadLetter)
+		dict.Del(k)
+		glog.V(2).Infof("%v re-emits %v", ctx, dl)
+		switch {
+		case dl.Msg.IsUnicast():
+			ctx.SendToBee(dl.Data(), dl.Msg.To())
+		case dl.Msg.Topic() != "":
+			ctx.EmitTo(dl.Msg.Topic(), dl.Data(), Priority(dl.Msg.Priority()))
+		default:
+			ctx.Emit(dl.Data(), Priority(dl.Msg.Priority()))
+		}
+		return ctx.Reply(msg, dl)
+	}
+	return nil
+}
+
+func (h deadLetterHandler) add(d DeadLetter, ctx RcvContext) error {
+	meta := ctx.Dict(dictDeadLetterMeta)
+	var last uint64
+	if v, err := meta.Get(keyLastDeadLetter); err == nil {
+		last = v.(uint64)
+	}
+	last++
+	d.ID = last
+	if err := meta.Put(keyLastDeadLetter, last); err != nil {
+		return err
+	}
+
+	dict := ctx.Dict(dictDeadLetters)
+	if last > maxDeadLetters {
+		dict.Del(formatDeadLetterID(last - maxDeadLetters))
+	}
+	glog.V(2).Infof("%v records %v", ctx, d)
+	return dict.Put(formatDeadLetterID(d.ID), d)
+}
+
+func formatDeadLetterID(id uint64) string {
+	return fmt.Sprintf("%016X", id)
+}
+
+// deadLetterHTTPHandler lists the dead letters of the hive on GET, and
+// re-emits a dead letter on POST.
+type deadLetterHTTPHandler struct {
+	hive Hive
+}
+
+func (h *deadLetterHTTPHandler) ServeHTTP(w http.ResponseWriter,
+	r *http.Request) {
+
+	var req interface{} = listDeadLetters{}
+	if r.Method == "POST" {
+		id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		req = reemitDeadLetter{ID: id}
+	}
+
+	ctx, ccl := context.WithTimeout(context.Background(), 10*time.Second)
+	defer ccl()
+	res, err := h.hive.Sync(ctx, req)
+	if err != nil {
+		code := http.StatusInternalServerError
+		if err.Error() == ErrNoSuchDeadLetter.Error() {
+			code = http.StatusNotFound
+		}
+		http.Error(w, err.Error(), code)
+		return
+	}
+
+	b, err := json.Marshal(res)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+func init() {
+	gob.Register(DeadLetter{})
+	gob.Register([]DeadLetter{})
+	gob.Register(listDeadLetters{})
+	gob.Register(reemitDeadLetter{})
+}
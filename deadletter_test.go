@@ -0,0 +1,88 @@
+package beehive
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+func deadLettersForTest(t *testing.T, h Hive, n int) []DeadLetter {
+	for i := 0; i < 100; i++ {
+		res, err := h.Sync(context.Background(), listDeadLetters{})
+		if err != nil {
+			t.Fatalf("cannot list dead letters: %v", err)
+		}
+		letters, _ := res.([]DeadLetter)
+		if len(letters) >= n {
+			return letters
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("dead letters are not collected")
+	return nil
+}
+
+func TestDeadLetters(t *testing.T) {
+	h := newHiveForTest(DeadLetters(true))
+	app := h.NewApp("deadletters")
+	mf := func(msg Msg, ctx MapContext) MappedCells {
+		if msg.Data().(AppTestMsg) < 0 {
+			return nil
+		}
+		return MappedCells{{"D", "0"}}
+	}
+	fail := int32(1)
+	ch := make(chan AppTestMsg, 1)
+	rf := func(msg Msg, ctx RcvContext) error {
+		if atomic.LoadInt32(&fail) == 1 {
+			return errors.New("rcv fails")
+		}
+		ch <- msg.Data().(AppTestMsg)
+		return nil
+	}
+	app.HandleFunc(AppTestMsg(0), mf, rf)
+
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	h.Emit(AppTestMsg(1))
+	h.Emit(AppTestMsg(-1))
+	letters := deadLettersForTest(t, h, 2)
+	var rcvLetter DeadLetter
+	for _, l := range letters {
+		if l.App != "deadletters" {
+			t.Errorf("invalid app of dead letter: actual=%v want=deadletters",
+				l.App)
+		}
+		switch l.Data().(AppTestMsg) {
+		case 1:
+			if l.Bee == 0 || l.Err != "rcv fails" {
+				t.Errorf("invalid dead letter for rcv: %v", l)
+			}
+			rcvLetter = l
+		case -1:
+			if l.Bee != 0 || l.Err != errMapDrop.Error() {
+				t.Errorf("invalid dead letter for map: %v", l)
+			}
+		}
+	}
+
+	atomic.StoreInt32(&fail, 0)
+	if _, err := h.Sync(context.Background(),
+		reemitDeadLetter{ID: rcvLetter.ID}); err != nil {
+		t.Fatalf("cannot re-emit dead letter: %v", err)
+	}
+	if m := <-ch; m != 1 {
+		t.Errorf("invalid re-emitted message: actual=%v want=1", m)
+	}
+
+	_, err := h.Sync(context.Background(), reemitDeadLetter{ID: rcvLetter.ID})
+	if err == nil || err.Error() != ErrNoSuchDeadLetter.Error() {
+		t.Errorf("invalid error for a re-emitted dead letter: actual=%v want=%v",
+			err, ErrNoSuchDeadLetter)
+	}
+}
@@ -0,0 +1,53 @@
+package beehive
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
+)
+
+// Deadline is an emit option that sets the deadline of the message. Bees drop
+// the messages whose deadline has passed instead of receiving them.
+//
+// Messages emitted while a bee handles a message inherit the deadline of that
+// message, unless they are emitted with an explicit deadline. The zero time
+// removes the deadline.
+func Deadline(t time.Time) EmitOption {
+	return func(m *msg) {
+		m.MsgDeadline = t
+	}
+}
+
+// TTL is an emit option that sets the deadline of the message to d from now.
+func TTL(d time.Duration) EmitOption {
+	return Deadline(time.Now().Add(d))
+}
+
+// expired returns whether the deadline of the message is before now.
+func (m *msg) expired(now time.Time) bool {
+	return !m.MsgDeadline.IsZero() && m.MsgDeadline.Before(now)
+}
+
+// dropExpired drops mh and returns true if mh has expired.
+func (b *bee) dropExpired(mh msgAndHandler) bool {
+	if !mh.msg.expired(time.Now()) {
+		return false
+	}
+	glog.V(2).Infof("%v drops expired message %v", b, mh.msg)
+	atomic.AddUint64(&b.app.counters.expired, 1)
+	return true
+}
+
+// newMsg creates a message emitted by the bee. The message inherits the
+// deadline of the message that the bee is receiving.
+func (b *bee) newMsg(data interface{}, from, to uint64,
+	opts []EmitOption) *msg {
+
+	m := newMsgFromData(data, from, to)
+	if b.rcvMsg != nil {
+		m.MsgDeadline = b.rcvMsg.MsgDeadline
+	}
+	m.applyOptions(opts)
+	return m
+}
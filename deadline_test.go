@@ -0,0 +1,54 @@
+package beehive
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+type deadlineTestMsg int
+
+func TestDeadline(t *testing.T) {
+	h := newHiveForTest()
+	app := h.NewApp("deadline")
+	mf := func(msg Msg, ctx MapContext) MappedCells {
+		return MappedCells{{"D", "0"}}
+	}
+	ch := make(chan time.Time, 10)
+	rf := func(msg Msg, ctx RcvContext) error {
+		switch msg.Data().(type) {
+		case AppTestMsg:
+			ctx.Emit(deadlineTestMsg(0))
+		case deadlineTestMsg:
+			ch <- msg.Deadline()
+		}
+		return nil
+	}
+	app.HandleFunc(AppTestMsg(0), mf, rf)
+	app.HandleFunc(deadlineTestMsg(0), mf, rf)
+
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	h.Emit(deadlineTestMsg(0), Deadline(time.Now().Add(-time.Second)))
+	dl := time.Now().Add(time.Hour)
+	h.Emit(AppTestMsg(0), Deadline(dl))
+	if d := <-ch; !d.Equal(dl) {
+		t.Errorf("invalid deadline: actual=%v want=%v", d, dl)
+	}
+	if n := h.(*hive).appStats()["deadline"].Expired; n != 1 {
+		t.Errorf("invalid number of expired messages: actual=%v want=1", n)
+	}
+
+	ctx, cnl := context.WithTimeout(context.Background(), time.Minute)
+	defer cnl()
+	dl, _ = ctx.Deadline()
+	if _, err := h.Sync(ctx, deadlineTestMsg(0)); err != nil {
+		t.Fatalf("error in sync: %v", err)
+	}
+	if d := <-ch; !d.Equal(dl) {
+		t.Errorf("invalid deadline: actual=%v want=%v", d, dl)
+	}
+}
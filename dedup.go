@@ -0,0 +1,142 @@
+package beehive
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
+	"github.com/kandoo/beehive/state"
+)
+
+// dictDedup is the dictionary in which bees record the idempotency keys of the
+// messages they have received.
+const dictDedup = "bh_dedup"
+
+// Idempotent is a message data with an idempotency key. Messages whose data is
+// Idempotent are emitted with that key, unless an explicit key is set using the
+// IdempotencyKey option.
+type Idempotent interface {
+	IdempotencyKey() string
+}
+
+// IdempotencyKey is an emit option that sets the idempotency key of the
+// message. Bees of applications with the ExactlyOnce option receive at most one
+// message for each idempotency key. Keys should be unique among the messages
+// that are not duplicates of each other.
+func IdempotencyKey(k string) EmitOption {
+	return func(m *msg) {
+		m.MsgKey = k
+	}
+}
+
+// ExactlyOnce is an application option that deduplicates the messages received
+// by the bees of the application. Each message is identified by its
+// idempotency key or, if it has none, by the sequence number that its sender
+// hive assigns to it when it is emitted. Retries of a message, such as the
+// messages resent to a new leader after a failover, keep the same sequence
+// number.
+//
+// Each bee records the keys of the messages it has successfully received in its
+// state, in the same transaction as the changes made by the batch of messages
+// being received, and drops the messages whose key is already recorded. Since the keys are replicated
+// along with the state, a new leader of a persistent bee recognizes the
+// messages committed by the previous leader, even if they are retried by the
+// emitter.
+//
+// Keys are kept for at least window, and are removed every window. This option
+// also makes the application transactional.
+func ExactlyOnce(window time.Duration) AppOption {
+	return func(a *app) {
+		a.flags |= appFlagTransactional
+		a.dedup = window
+	}
+}
+
+// stamp assigns the next sequence number of the hive to m, unless m is already
+// stamped by its sender.
+func (h *hive) stamp(m *msg) {
+	if m.MsgSeq != 0 {
+		return
+	}
+	m.MsgSender = h.id
+	m.MsgSeq = atomic.AddUint64(&h.msgSeq, 1)
+}
+
+// dedupKey returns the key with which m is deduplicated, or "" if m has neither
+// an idempotency key nor a sequence number.
+func (m *msg) dedupKey() string {
+	switch {
+	case m.MsgKey != "":
+		return "k/" + m.MsgKey
+	case m.MsgSeq != 0:
+		return fmt.Sprintf("s/%016x/%016x", m.MsgSender, m.MsgSeq)
+	}
+	return ""
+}
+
+// isDedupDict returns whether d is the dictionary of deduplication keys.
+func isDedupDict(d string) bool {
+	return d == dictDedup
+}
+
+// dropDuplicate drops mh and returns true if the bee has already received a
+// message with the same key.
+func (b *bee) dropDuplicate(mh msgAndHandler) bool {
+	if b.app.dedup == 0 {
+		return false
+	}
+	k := mh.msg.dedupKey()
+	if k == "" {
+		return false
+	}
+	if _, ok := b.dedupKeys[k]; !ok {
+		if _, err := b.Dict(dictDedup).Get(k); err != nil {
+			return false
+		}
+	}
+	glog.V(2).Infof("%v drops duplicate message %v", b, mh.msg)
+	atomic.AddUint64(&b.app.counters.duplicates, 1)
+	return true
+}
+
+// recordKey records the key of mh, to be written in the state of the bee by
+// writeKeys.
+func (b *bee) recordKey(mh msgAndHandler) {
+	if b.app.dedup == 0 {
+		return
+	}
+	k := mh.msg.dedupKey()
+	if k == "" {
+		return
+	}
+	if b.dedupKeys == nil {
+		b.dedupKeys = make(map[string]struct{})
+	}
+	b.dedupKeys[k] = struct{}{}
+}
+
+// forgetKey drops the key of mh recorded by recordKey, if it is not written
+// yet.
+func (b *bee) forgetKey(mh msgAndHandler) {
+	if k := mh.msg.dedupKey(); k != "" {
+		delete(b.dedupKeys, k)
+	}
+}
+
+// writeKeys writes the recorded keys in the open transaction of the bee, so
+// that the keys of a batch of messages are committed along with the changes
+// made by the batch.
+func (b *bee) writeKeys() {
+	if len(b.dedupKeys) == 0 {
+		return
+	}
+	d := b.Dict(dictDedup)
+	now := time.Now()
+	for k := range b.dedupKeys {
+		if err := state.PutWithTTL(d, k, now, b.app.dedup); err != nil {
+			glog.Errorf("%v cannot record key %v: %v", b, k, err)
+		}
+		delete(b.dedupKeys, k)
+	}
+}
@@ -0,0 +1,136 @@
+package beehive
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kandoo/beehive/state"
+)
+
+type idempotentTestMsg string
+
+func (m idempotentTestMsg) IdempotencyKey() string {
+	return string(m)
+}
+
+func TestExactlyOnce(t *testing.T) {
+	h := newHiveForTest()
+	app := h.NewApp("dedup", ExactlyOnce(time.Minute))
+	mf := func(msg Msg, ctx MapContext) MappedCells {
+		return MappedCells{{"D", "0"}}
+	}
+	ch := make(chan Msg, 10)
+	rf := func(msg Msg, ctx RcvContext) error {
+		ch <- msg
+		return nil
+	}
+	app.HandleFunc(AppTestMsg(0), mf, rf)
+	app.HandleFunc(idempotentTestMsg(""), mf, rf)
+
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	h.Emit(AppTestMsg(1), IdempotencyKey("k1"))
+	h.Emit(AppTestMsg(2), IdempotencyKey("k1"))
+	h.Emit(idempotentTestMsg("k2"))
+	h.Emit(idempotentTestMsg("k2"))
+	h.Emit(AppTestMsg(3))
+	h.Emit(AppTestMsg(3))
+
+	want := []interface{}{
+		AppTestMsg(1),
+		idempotentTestMsg("k2"),
+		AppTestMsg(3),
+		AppTestMsg(3),
+	}
+	for _, w := range want {
+		if m := <-ch; m.Data() != w {
+			t.Errorf("invalid message: actual=%v want=%v", m.Data(), w)
+		}
+	}
+	select {
+	case m := <-ch:
+		t.Errorf("duplicate message %v", m)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	if n := h.(*hive).appStats()["dedup"].Duplicates; n != 2 {
+		t.Errorf("invalid number of duplicates: actual=%v want=2", n)
+	}
+}
+
+func TestExactlyOnceRetry(t *testing.T) {
+	window := 50 * time.Millisecond
+	h := newHiveForTest()
+	app := h.NewApp("dedup", ExactlyOnce(window))
+	ch := make(chan Msg, 10)
+	app.HandleFunc(AppTestMsg(0),
+		func(msg Msg, ctx MapContext) MappedCells {
+			return MappedCells{{"D", "0"}}
+		},
+		func(msg Msg, ctx RcvContext) error {
+			ch <- msg
+			return nil
+		})
+
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	// A retried message keeps the sequence number it is stamped with.
+	m := newMsgFromData(AppTestMsg(1), 0, 0)
+	h.(*hive).stamp(m)
+	retry, late := *m, *m
+	h.(*hive).enqueMsg(m)
+	h.(*hive).enqueMsg(&retry)
+
+	<-ch
+	select {
+	case m := <-ch:
+		t.Errorf("duplicate message %v", m)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	// The key is removed after the window, without the Expiry option.
+	time.Sleep(3 * window)
+	h.(*hive).enqueMsg(&late)
+	select {
+	case <-ch:
+	case <-time.After(time.Second):
+		t.Error("message is dropped after the deduplication window")
+	}
+}
+
+func TestDedupKeysOfBatch(t *testing.T) {
+	b := &bee{
+		app: &app{
+			name:  "test",
+			dedup: time.Millisecond,
+		},
+		stateL1: state.NewTransactional(state.NewInMem()),
+	}
+
+	mh := msgAndHandler{msg: &msg{MsgKey: "k"}}
+	b.recordKey(mh)
+	if !b.dropDuplicate(mh) {
+		t.Error("the recorded key is not deduplicated before it is written")
+	}
+	b.writeKeys()
+	if len(b.dedupKeys) != 0 {
+		t.Errorf("keys are not written: %v", b.dedupKeys)
+	}
+	if !b.dropDuplicate(mh) {
+		t.Error("the written key is not deduplicated")
+	}
+
+	// Expired keys leave no version behind in bees without snapshots.
+	time.Sleep(2 * time.Millisecond)
+	b.expire(isDedupDict)
+	if b.dropDuplicate(mh) {
+		t.Error("the expired key is deduplicated")
+	}
+	if v, _ := state.Version(b.Dict(dictDedup), mh.msg.dedupKey()); v != 0 {
+		t.Errorf("the expired key has a version: %v", v)
+	}
+}
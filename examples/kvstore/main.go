@@ -20,6 +20,8 @@ var (
 	cpuprofile = flag.String("kv.cpuprofile", "", "write cpu profile to file")
 	quiet      = flag.Bool("kv.quiet", false, "no raft log")
 	random     = flag.Bool("kv.rand", false, "whether to use random placement")
+	chash      = flag.Bool("kv.chash", false,
+		"whether to use consistent hash placement")
 )
 
 func main() {
@@ -44,6 +46,9 @@ func main() {
 			Rand: rand.New(rand.NewSource(time.Now().UnixNano())),
 		}
 		opts = append(opts, bh.Placement(rp))
+	} else if *chash {
+		opts = append(opts, bh.Placement(bh.NewConsistentHashPlacement(0, 1.25)),
+			bh.Rebalance(10*time.Second))
 	}
 	a := bh.NewApp("kvstore", opts...)
 	kv := &store.KVStore{
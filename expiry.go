@@ -0,0 +1,81 @@
+package beehive
+
+import (
+	"encoding/gob"
+	"time"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
+	"github.com/kandoo/beehive/state"
+)
+
+// Expired is the message sent to the bee that owns an expired key, after the
+// key is deleted from the dictionary. Applications that want to be notified
+// of expirations should handle this message and use the Expiry option.
+type Expired struct {
+	Dict  string      // Dictionary of the key.
+	Key   string      // The expired key.
+	Value interface{} // The value of the key before expiration.
+}
+
+// isAppDict returns whether d is a dictionary of the application, as opposed to
+// the dictionaries that beehive keeps in the state of bees.
+func isAppDict(d string) bool {
+	return !isDedupDict(d) && !isFuturesDict(d)
+}
+
+// expire deletes the expired keys of the bee in the dictionaries matched by
+// match, in a transaction. If the app handles Expired, an Expired message is
+// sent to the bee for each key.
+func (b *bee) expire(match func(dict string) bool) {
+	now := time.Now()
+	var exps []Expired
+	for _, d := range b.stateL1.Dicts() {
+		ed, ok := d.(state.ExpiringDict)
+		if !ok || !match(d.Name()) {
+			continue
+		}
+		ed.Expired(now, func(k string, v interface{}) bool {
+			exps = append(exps, Expired{Dict: d.Name(), Key: k, Value: v})
+			return true
+		})
+	}
+
+	if len(exps) == 0 {
+		return
+	}
+
+	glog.V(2).Infof("%v expires %v keys", b, len(exps))
+
+	usetx := b.app.transactional()
+	if usetx {
+		if err := b.BeginTx(); err != nil {
+			glog.Errorf("%v cannot expire keys: %v", b, err)
+			return
+		}
+	}
+
+	notify := b.app.handler(MsgType(Expired{})) != nil
+	for _, e := range exps {
+		b.Dict(e.Dict).Del(e.Key)
+		if notify && isAppDict(e.Dict) {
+			b.SendToBee(e, b.ID())
+		}
+	}
+
+	if usetx {
+		if err := b.CommitTx(); err != nil && err != state.ErrNoTx {
+			glog.Errorf("%v cannot commit expirations: %v", b, err)
+		}
+	}
+
+	// The versions of the expired keys are needed only for the deltas of the
+	// snapshots, which drop them once saved. Without snapshots, they are dropped
+	// right away.
+	if !b.app.persistent() {
+		b.stateL1.DropTombstones(state.LastVersion())
+	}
+}
+
+func init() {
+	gob.Register(Expired{})
+}
@@ -0,0 +1,113 @@
+package beehive
+
+import (
+	"errors"
+	"math/rand"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// GatherResult is the result of a sync request sent to a cell, or to a bee,
+// by Gather and SyncAll.
+type GatherResult struct {
+	Cell CellKey     // The cell, if the request is sent to a cell.
+	Bee  uint64      // The bee that owns the cell.
+	Data interface{} // The response of the bee.
+	Err  error       // The error, if any.
+}
+
+// Gather sends req to the bees of app that own cells, and waits for their
+// responses until ctx is done. It returns the result of each cell, in the order
+// of cells. A request is sent to each bee only once, and the cells owned by the
+// same bee have the same result. Cells that are not owned by any bee have
+// ErrNoSuchBee as their error, and cells whose bee has not responded before ctx
+// is done have the error of ctx.
+func (h *hive) Gather(ctx context.Context, app string, cells []CellKey,
+	req interface{}) []GatherResult {
+
+	res := make([]GatherResult, len(cells))
+	bees := make(map[uint64][]int)
+	for i, c := range cells {
+		res[i].Cell = c
+		bi, _, err := h.registry.beeForCells(app, MappedCells{c})
+		if err != nil {
+			res[i].Err = err
+			continue
+		}
+		res[i].Bee = bi.ID
+		bees[bi.ID] = append(bees[bi.ID], i)
+	}
+	h.gather(ctx, bees, req, res)
+	return res
+}
+
+// SyncAll sends req to all the bees of app, and waits for their responses
+// until ctx is done. It returns the result of each bee.
+func (h *hive) SyncAll(ctx context.Context, app string,
+	req interface{}) []GatherResult {
+
+	var res []GatherResult
+	bees := make(map[uint64][]int)
+	for _, b := range h.registry.bees() {
+		if b.App != app || b.Detached || b.Colony.Leader != b.ID {
+			continue
+		}
+		bees[b.ID] = []int{len(res)}
+		res = append(res, GatherResult{Bee: b.ID})
+	}
+	h.gather(ctx, bees, req, res)
+	return res
+}
+
+// gather sends req to each bee in bees, and stores the responses of each bee in
+// the results at the indices of that bee.
+func (h *hive) gather(ctx context.Context, bees map[uint64][]int,
+	req interface{}, res []GatherResult) {
+
+	ch := make(chan syncRes, len(bees))
+	reqs := make(map[uint64]uint64, len(bees))
+	for b := range bees {
+		id := uint64(rand.Int63())
+		reqs[id] = b
+		h.sendSyncTo(ctx, syncReq{ID: id, Data: req}, b, ch)
+	}
+
+	for len(reqs) != 0 {
+		select {
+		case r := <-ch:
+			b, ok := reqs[r.ID]
+			if !ok {
+				continue
+			}
+			delete(reqs, r.ID)
+			var err error
+			if r.Err != nil {
+				err = errors.New(r.Err.Error())
+			}
+			for _, i := range bees[b] {
+				res[i].Data = r.Data
+				res[i].Err = err
+			}
+
+		case <-ctx.Done():
+			for _, b := range reqs {
+				for _, i := range bees[b] {
+					res[i].Err = ctx.Err()
+				}
+			}
+			return
+		}
+	}
+}
+
+func (b *bee) Gather(ctx context.Context, app string, cells []CellKey,
+	req interface{}) []GatherResult {
+
+	return b.hive.Gather(ctx, app, cells, req)
+}
+
+func (b *bee) SyncAll(ctx context.Context, app string,
+	req interface{}) []GatherResult {
+
+	return b.hive.SyncAll(ctx, app, req)
+}
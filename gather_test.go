@@ -0,0 +1,120 @@
+package beehive
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+type gatherTestPut struct {
+	Key string
+	Val int
+}
+
+type gatherTestGet struct{}
+
+func TestGather(t *testing.T) {
+	h := newHiveForTest()
+	app := h.NewApp("gather")
+	app.HandleFunc(gatherTestPut{},
+		func(msg Msg, ctx MapContext) MappedCells {
+			return MappedCells{{"D", msg.Data().(gatherTestPut).Key}}
+		},
+		func(msg Msg, ctx RcvContext) error {
+			p := msg.Data().(gatherTestPut)
+			return ctx.Dict("D").Put(p.Key, p.Val)
+		})
+	app.HandleFunc(gatherTestGet{},
+		func(msg Msg, ctx MapContext) MappedCells {
+			return ctx.LocalMappedCells()
+		},
+		func(msg Msg, ctx RcvContext) error {
+			sum := 0
+			ctx.Dict("D").ForEach(func(k string, v interface{}) bool {
+				sum += v.(int)
+				return true
+			})
+			return ctx.Reply(msg, sum)
+		})
+
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	ctx, cnl := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cnl()
+	for i, k := range []string{"a", "b"} {
+		if _, err := h.Sync(ctx, gatherTestPut{Key: k, Val: i + 1}); err != nil {
+			t.Fatalf("cannot put %v: %v", k, err)
+		}
+	}
+
+	cells := []CellKey{{Dict: "D", Key: "a"}, {Dict: "D", Key: "b"},
+		{Dict: "D", Key: "c"}}
+	res := h.Gather(ctx, "gather", cells, gatherTestGet{})
+	if len(res) != len(cells) {
+		t.Fatalf("invalid number of results: actual=%v want=%v", len(res),
+			len(cells))
+	}
+	for i, want := range []int{1, 2} {
+		if res[i].Cell != cells[i] {
+			t.Errorf("invalid cell: actual=%v want=%v", res[i].Cell, cells[i])
+		}
+		if res[i].Err != nil || res[i].Data != want {
+			t.Errorf("invalid result for %v: actual=%v,%v want=%v", cells[i],
+				res[i].Data, res[i].Err, want)
+		}
+	}
+	if res[2].Err != ErrNoSuchBee {
+		t.Errorf("invalid error for a cell without bee: %v", res[2].Err)
+	}
+
+	res = h.SyncAll(ctx, "gather", gatherTestGet{})
+	sum := 0
+	for _, r := range res {
+		if r.Err != nil {
+			t.Errorf("error in the result of bee %v: %v", r.Bee, r.Err)
+			continue
+		}
+		sum += r.Data.(int)
+	}
+	if len(res) != 2 || sum != 3 {
+		t.Errorf("invalid results of sync all: %v", res)
+	}
+}
+
+func TestGatherTimeout(t *testing.T) {
+	h := newHiveForTest()
+	app := h.NewApp("gatherTimeout")
+	app.HandleFunc(gatherTestPut{},
+		func(msg Msg, ctx MapContext) MappedCells {
+			return MappedCells{{"D", msg.Data().(gatherTestPut).Key}}
+		},
+		func(msg Msg, ctx RcvContext) error {
+			return nil
+		})
+	app.HandleFunc(gatherTestGet{},
+		func(msg Msg, ctx MapContext) MappedCells {
+			return ctx.LocalMappedCells()
+		},
+		func(msg Msg, ctx RcvContext) error {
+			ctx.DeferReply(msg)
+			return nil
+		})
+
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	if _, err := h.Sync(context.Background(), gatherTestPut{Key: "a"}); err != nil {
+		t.Fatalf("cannot put: %v", err)
+	}
+
+	ctx, cnl := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cnl()
+	res := h.SyncAll(ctx, "gatherTimeout", gatherTestGet{})
+	if len(res) != 1 || res[0].Err != context.DeadlineExceeded {
+		t.Errorf("invalid results: %v", res)
+	}
+}
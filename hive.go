@@ -49,7 +49,9 @@ type Hive interface {
 	NewApp(name string, opts ...AppOption) App
 
 	// Emits a message containing msgData from this hive.
-	Emit(msgData interface{})
+	Emit(msgData interface{}, opts ...EmitOption)
+	// Emits a message containing msgData on the given topic from this hive.
+	EmitTo(topic string, msgData interface{}, opts ...EmitOption)
 	// Sends a message to a specific bee that owns a specific dictionary key.
 	SendToCellKey(msgData interface{}, to string, dk CellKey)
 	// Sends a message to a sepcific bee.
@@ -59,6 +61,17 @@ type Hive interface {
 	// Sync processes a synchrounous message (req) and blocks until the response
 	// is recieved.
 	Sync(ctx context.Context, req interface{}) (res interface{}, err error)
+	// SyncStream processes a synchrounous message (req) whose handler streams
+	// its responses. At most window responses are sent to the stream before
+	// they are received from the stream.
+	SyncStream(ctx context.Context, req interface{}, window int) *Stream
+	// Gather sends a synchrounous message (req) to the bees of app that own the
+	// given cells, and returns the response of each cell.
+	Gather(ctx context.Context, app string, cells []CellKey,
+		req interface{}) []GatherResult
+	// SyncAll sends a synchrounous message (req) to all the bees of app, and
+	// returns the response of each bee.
+	SyncAll(ctx context.Context, app string, req interface{}) []GatherResult
 
 	// Registers a message for encoding/decoding. This method should be called
 	// only on messages that have no active handler. Such messages are almost
@@ -80,6 +93,10 @@ type HiveConfig struct {
 	Pprof          bool // whether to enable pprof web handlers.
 	Instrument     bool // whether to instrument apps on the hive.
 	OptimizeThresh uint // when to notify the optimizer (in msg/s).
+	SplitThresh    uint // when to split the cells of a bee (in msg/s).
+	DeadLetters    bool // whether to collect dead letters.
+
+	Labels map[string]string // labels of the hive (e.g., its zone and rack).
 
 	RaftTick       time.Duration // the raft tick interval.
 	RaftTickDelta  time.Duration // the maximum random delta added to the tick.
@@ -172,6 +189,22 @@ var optimizeThresh = args.NewUint(args.Flag("optthresh", uint(10),
 // messages per second) after which we notify the optimizer.
 func OptimizeThresh(t uint) HiveOption { return HiveOption(optimizeThresh(t)) }
 
+var splitThresh = args.NewUint(args.Flag("splitthresh", uint(0),
+	"when the local stat collector should split the cells of a bee (in msg/s)."))
+
+// SplitThresh represents the minimum message rate (i.e., the number of messages
+// per second) of a bee after which its cells are split into two bees. Bees are
+// not split if it is 0, which is the default.
+func SplitThresh(t uint) HiveOption { return HiveOption(splitThresh(t)) }
+
+var deadLetters = args.NewBool(args.Flag("deadletters", false,
+	"whether to collect the messages that cannot be handled"))
+
+// DeadLetters represents whether the hive should collect dead letters: the
+// messages whose rcv function fails or whose map function drops them. Dead
+// letters can be inspected and re-emitted on "/apps/bh_deadletters/letters".
+func DeadLetters(d bool) HiveOption { return HiveOption(deadLetters(d)) }
+
 var statePath = args.NewString(args.Flag("statepath", "/tmp/beehive",
 	"where to store persistent state data"))
 
@@ -249,6 +282,9 @@ func hiveConfig(opts ...HiveOption) (cfg HiveConfig) {
 	cfg.Pprof = pprof.Get(opts)
 	cfg.Instrument = instrument.Get(opts)
 	cfg.OptimizeThresh = optimizeThresh.Get(opts)
+	cfg.SplitThresh = splitThresh.Get(opts)
+	cfg.DeadLetters = deadLetters.Get(opts)
+	cfg.Labels = hiveLabels(opts)
 	cfg.RaftTick = raftTick.Get(opts)
 	cfg.RaftTickDelta = raftTickDelta.Get(opts)
 	cfg.RaftFsyncTick = raftFsyncTick.Get(opts)
@@ -287,6 +323,9 @@ func NewHive(opts ...HiveOption) Hive {
 		syncCh: make(chan syncReqAndChan, cfg.DataChBufSize),
 		apps:   make(map[string]*app, 0),
 		qees:   make(map[string][]qeeAndHandler),
+		// Sequence numbers start from the current time, so that they are not
+		// reused when the hive restarts.
+		msgSeq: uint64(time.Now().UnixNano()),
 	}
 
 	h.client = newRPCClientPool(h)
@@ -300,6 +339,10 @@ func NewHive(opts ...HiveOption) Hive {
 		h.collector = &noOpStatCollector{}
 	}
 
+	if h.config.DeadLetters {
+		installDeadLetters(h)
+	}
+
 	h.initSync()
 
 	return h
@@ -324,6 +367,7 @@ type hive struct {
 	sync.Mutex
 
 	id     uint64
+	msgSeq uint64 // The last sequence number assigned to an emitted message.
 	meta   hiveMeta
 	config HiveConfig
 
@@ -334,14 +378,24 @@ type hive struct {
 	syncCh chan syncReqAndChan
 	sigCh  chan os.Signal
 
-	apps map[string]*app
-	qees map[string][]qeeAndHandler
+	appsM sync.RWMutex // Guards apps, qees, and subs.
+	apps  map[string]*app
+	qees  map[string][]qeeAndHandler
+	subs  []topicSub
+
+	// Whether any application has the Backpressure option.
+	backpressure bool
+	// The number of bees of each application that are blocked on the queues of
+	// other applications, guarded by waitsM.
+	waitsM sync.Mutex
+	waits  map[*app]map[*app]int
 
 	httpServer *httpServer
 	listener   net.Listener
 
 	node     *raft.MultiNode
 	registry *registry
+	loads    hiveLoads
 	ticker   *randtime.Ticker
 	client   *rpcClientPool
 
@@ -366,23 +420,13 @@ func (h *hive) RegisterMsg(msg interface{}) {
 }
 
 // Sync processes a synchrounous request and returns the response and error.
+// If ctx has a deadline, the request and the messages emitted while handling
+// it expire at that deadline.
 func (h *hive) Sync(ctx context.Context, req interface{}) (res interface{},
 	err error) {
 
-	id := uint64(rand.Int63())
 	ch := make(chan syncRes, 1)
-
-	// We should run this in parallel in case we are blocked on h.syncCh.
-	go func() {
-		sc := syncReqAndChan{
-			req: syncReq{ID: id, Data: req},
-			ch:  ch,
-		}
-		select {
-		case h.syncCh <- sc:
-		case <-ctx.Done():
-		}
-	}()
+	h.sendSync(ctx, syncReq{ID: uint64(rand.Int63()), Data: req}, ch)
 
 	select {
 	case r := <-ch:
@@ -395,11 +439,52 @@ func (h *hive) Sync(ctx context.Context, req interface{}) (res interface{},
 		return nil, ctx.Err()
 	}
 }
+
+// sendSync sends the sync request to the sync handlers of the hive. The
+// responses are delivered on ch.
+func (h *hive) sendSync(ctx context.Context, req syncReq, ch chan syncRes) {
+	h.sendSyncTo(ctx, req, 0, ch)
+}
+
+// sendSyncTo sends the sync request to the given bee, or emits the request if
+// the bee is 0. The responses are delivered on ch.
+func (h *hive) sendSyncTo(ctx context.Context, req syncReq, to uint64,
+	ch chan syncRes) {
+
+	// We should run this in parallel in case we are blocked on h.syncCh.
+	go func() {
+		sc := syncReqAndChan{
+			req:  req,
+			to:   to,
+			ch:   ch,
+			done: ctx.Done(),
+		}
+		sc.deadline, _ = ctx.Deadline()
+		select {
+		case h.syncCh <- sc:
+		case <-ctx.Done():
+		}
+	}()
+}
+
 func (h *hive) app(name string) (*app, bool) {
+	h.appsM.RLock()
 	a, ok := h.apps[name]
+	h.appsM.RUnlock()
 	return a, ok
 }
 
+// appList returns the applications registered on the hive.
+func (h *hive) appList() []*app {
+	h.appsM.RLock()
+	defer h.appsM.RUnlock()
+	apps := make([]*app, 0, len(h.apps))
+	for _, a := range h.apps {
+		apps = append(apps, a)
+	}
+	return apps
+}
+
 func (h *hive) hiveAddr(id uint64) (string, error) {
 	i, err := h.registry.hive(id)
 	return i.Addr, err
@@ -415,11 +500,13 @@ func (h *hive) stopListener() {
 func (h *hive) stopQees() {
 	glog.Infof("%v is stopping qees...", h)
 	qs := make(map[*qee]bool)
+	h.appsM.RLock()
 	for _, mhs := range h.qees {
 		for _, mh := range mhs {
 			qs[mh.q] = true
 		}
 	}
+	h.appsM.RUnlock()
 
 	stopCh := make(chan cmdResult)
 	for q := range qs {
@@ -485,6 +572,10 @@ func (h *hive) handleCmd(cc cmdAndChannel) {
 			Data: h.registry.hives(),
 		}
 
+	case cmdHiveLoad:
+		h.loads.set(d.Hive, d.Load)
+		cc.ch <- cmdResult{}
+
 	default:
 		cc.ch <- cmdResult{
 			Err: ErrInvalidCmd,
@@ -506,10 +597,14 @@ func (h *hive) raftBarrier() error {
 }
 
 func (h *hive) registerApp(a *app) {
+	h.appsM.Lock()
 	h.apps[a.Name()] = a
+	h.appsM.Unlock()
 }
 
 func (h *hive) registerHandler(t string, q *qee, l Handler) {
+	h.appsM.Lock()
+	defer h.appsM.Unlock()
 	for i, qh := range h.qees[t] {
 		if qh.q == q {
 			h.qees[t][i].h = l
@@ -547,16 +642,29 @@ func (h *hive) handleMsg(m *msg) {
 			a.qee.enqueMsg(msgAndHandler{msg: m})
 			return
 		}
-		a.qee.enqueMsg(msgAndHandler{msg: m, handler: a.handler(m.Type())})
+		// Only the applications that handle answers can have asked the request.
+		if a.handler(MsgType(Answer{})) != nil {
+			m = answerMsg(m)
+		}
+		hd := a.msgHandler(m)
+		if hd == nil && isStreamCredit(m) {
+			glog.V(2).Infof("%v drops stream credit %v", h, m)
+			return
+		}
+		a.qee.enqueMsg(msgAndHandler{msg: m, handler: hd})
+	case m.MsgTopic != "":
+		h.publish(m)
 	default:
+		h.appsM.RLock()
 		for _, qh := range h.qees[m.Type()] {
-			qh.q.enqueMsg(msgAndHandler{m, qh.h})
+			qh.q.enqueMsg(msgAndHandler{msg: m, handler: qh.h})
 		}
+		h.appsM.RUnlock()
 	}
 }
 
 func (h *hive) startQees() {
-	for _, a := range h.apps {
+	for _, a := range h.appList() {
 		go a.qee.start()
 	}
 }
@@ -656,6 +764,9 @@ func (h *hive) Start() error {
 		glog.Fatalf("error when joining the cluster: %v", err)
 	}
 	glog.V(2).Infof("%v is in sync with the cluster", h)
+	if err := h.syncLabels(); err != nil {
+		glog.Errorf("%v cannot update its labels: %v", h, err)
+	}
 	h.startQees()
 	h.reloadState()
 
@@ -675,8 +786,9 @@ func (h *hive) Start() error {
 
 func (h *hive) info() HiveInfo {
 	return HiveInfo{
-		ID:   h.id,
-		Addr: h.config.Addr,
+		ID:     h.id,
+		Addr:   h.config.Addr,
+		Labels: h.config.Labels,
 	}
 }
 
@@ -700,9 +812,10 @@ func (h *hive) waitUntilStarted() {
 
 func (h *hive) NewApp(name string, options ...AppOption) App {
 	a := &app{
-		name:     name,
-		hive:     h,
-		handlers: make(map[string]Handler),
+		name:       name,
+		hive:       h,
+		handlers:   make(map[string]Handler),
+		askTimeout: defaultAskTimeout,
 	}
 	a.initQee()
 	h.registerApp(a)
@@ -718,8 +831,10 @@ func (h *hive) NewApp(name string, options ...AppOption) App {
 	return a
 }
 
-func (h *hive) Emit(msgData interface{}) {
-	h.enqueMsg(&msg{MsgData: msgData})
+func (h *hive) Emit(msgData interface{}, opts ...EmitOption) {
+	m := newMsgFromData(msgData, 0, 0)
+	m.applyOptions(opts)
+	h.emitMsg(m)
 }
 
 func (h *hive) enqueMsg(msg *msg) {
@@ -732,7 +847,7 @@ func (h *hive) SendToCellKey(msgData interface{}, to string, k CellKey) {
 }
 
 func (h *hive) SendToBee(msgData interface{}, to uint64) {
-	h.enqueMsg(newMsgFromData(msgData, 0, to))
+	h.emitMsg(newMsgFromData(msgData, 0, to))
 }
 
 // Reply to thatMsg with the provided replyData.
@@ -742,7 +857,7 @@ func (h *hive) Reply(thatMsg Msg, replyData interface{}) error {
 		return errors.New("cannot reply to this message")
 	}
 
-	h.enqueMsg(newMsgFromData(replyData, 0, m.From()))
+	h.emitMsg(newMsgFromData(replyData, 0, m.From()))
 	return nil
 }
 
@@ -5,6 +5,7 @@ import (
 	"encoding/gob"
 	"encoding/json"
 	"net/http"
+	"strconv"
 
 	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/gorilla/mux"
 )
@@ -14,6 +15,8 @@ import (
 const (
 	serverV1StatePath = "/api/v1/state"
 	serverV1BeesPath  = "/api/v1/bees"
+	serverV1StatsPath = "/api/v1/stats"
+	serverV1SplitPath = "/api/v1/bees/{id:[0-9]+}/split"
 )
 
 func buildURL(scheme, addr, path string) string {
@@ -69,6 +72,8 @@ type v1Handler struct {
 func (h *v1Handler) install(r *mux.Router) {
 	r.HandleFunc(serverV1StatePath, h.handleHiveState)
 	r.HandleFunc(serverV1BeesPath, h.handleBees)
+	r.HandleFunc(serverV1StatsPath, h.handleStats)
+	r.HandleFunc(serverV1SplitPath, h.handleSplit).Methods("POST")
 }
 
 func (h *v1Handler) handleHiveState(w http.ResponseWriter, r *http.Request) {
@@ -98,6 +103,49 @@ func (h *v1Handler) handleBees(w http.ResponseWriter, r *http.Request) {
 	w.Write(j)
 }
 
+// handleSplit splits the cells of a bee, and responds with the ID of the new
+// bee. The cells to move can be posted in json, otherwise half of the cells
+// are moved.
+func (h *v1Handler) handleSplit(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var cells MappedCells
+	if r.ContentLength > 0 {
+		if err := json.NewDecoder(r.Body).Decode(&cells); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	newb, err := h.srv.hive.splitBee(id, cells)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	j, err := json.Marshal(newb)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(j)
+}
+
+func (h *v1Handler) handleStats(w http.ResponseWriter, r *http.Request) {
+	j, err := json.Marshal(h.srv.hive.appStats())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(j)
+}
+
 func init() {
 	gob.Register(HiveState{})
 }
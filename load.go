@@ -0,0 +1,130 @@
+package beehive
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
+)
+
+// hiveLoadPeriod is the interval in which the stat collector of each hive
+// sends the load of the hive to other hives.
+const hiveLoadPeriod = 5 * time.Second
+
+// maxLoadAge is the age after which the load of a hive is considered stale and
+// is ignored, for example when the hive is partitioned or stopped.
+const maxLoadAge = 3 * hiveLoadPeriod
+
+// HiveLoad is the load of a hive, as collected by the stat collector of that
+// hive. The load is zero if the hive does not instrument its applications.
+type HiveLoad struct {
+	Bees    int       `json:"bees"`     // Number of local bees.
+	Queue   int       `json:"queue"`    // Messages queued on the local bees.
+	MsgRate uint64    `json:"msg_rate"` // Messages received per second.
+	Memory  uint64    `json:"memory"`   // Bytes allocated on the heap.
+	Updated time.Time `json:"updated"`  // When the load is collected.
+}
+
+// hiveLoads stores the latest load of each hive. Loads change too often to be
+// kept in the registry, and are instead sent directly to other hives.
+type hiveLoads struct {
+	sync.RWMutex
+	loads map[uint64]HiveLoad
+}
+
+func (l *hiveLoads) set(hive uint64, load HiveLoad) {
+	l.Lock()
+	defer l.Unlock()
+	if l.loads == nil {
+		l.loads = make(map[uint64]HiveLoad)
+	}
+	if load.Updated.Before(l.loads[hive].Updated) {
+		return
+	}
+	l.loads[hive] = load
+}
+
+// get returns the load of the hive, or a zero load if the load of the hive is
+// unknown or stale.
+func (l *hiveLoads) get(hive uint64) HiveLoad {
+	l.RLock()
+	defer l.RUnlock()
+	load, ok := l.loads[hive]
+	if !ok || time.Since(load.Updated) > maxLoadAge {
+		return HiveLoad{}
+	}
+	return load
+}
+
+// loadedHives returns the live hives with their latest loads.
+func (h *hive) loadedHives() []HiveInfo {
+	hives := h.registry.hives()
+	for i := range hives {
+		hives[i].Load = h.loads.get(hives[i].ID)
+	}
+	return hives
+}
+
+// load returns the current load of the hive. rate is the message rate, which
+// is measured by the stat collector.
+func (h *hive) load(rate uint64) HiveLoad {
+	l := HiveLoad{
+		MsgRate: rate,
+		Updated: time.Now(),
+	}
+	for _, a := range h.appList() {
+		l.Queue += a.qee.dataCh.size()
+		a.qee.RLock()
+		for _, b := range a.qee.bees {
+			if b.detached || b.proxy {
+				continue
+			}
+			l.Bees++
+			l.Queue += b.dataCh.size()
+		}
+		a.qee.RUnlock()
+	}
+
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	l.Memory = ms.HeapAlloc
+	return l
+}
+
+// loadUpdater periodically measures the load of the hive and sends it to all
+// hives. It is run by a timer of the stat collector.
+type loadUpdater struct {
+	hive  *hive
+	msgs  *uint64 // Messages received by the local bees, updated atomically.
+	last  uint64
+	lastT time.Time
+}
+
+func (u *loadUpdater) update() {
+	now := time.Now()
+	msgs := atomic.LoadUint64(u.msgs)
+	var rate uint64
+	if d := now.Sub(u.lastT); !u.lastT.IsZero() && d > 0 {
+		rate = uint64(float64(msgs-u.last) / d.Seconds())
+	}
+	u.last, u.lastT = msgs, now
+
+	l := u.hive.load(rate)
+	u.hive.loads.set(u.hive.ID(), l)
+	for _, h := range u.hive.registry.hives() {
+		if h.ID == u.hive.ID() {
+			continue
+		}
+		go func(id uint64) {
+			_, err := u.hive.client.sendCmd(cmd{
+				Hive: id,
+				Data: cmdHiveLoad{Hive: u.hive.ID(), Load: l},
+			})
+			if err != nil {
+				glog.V(2).Infof("%v cannot send its load to %v: %v", u.hive, id, err)
+			}
+		}(h.ID)
+	}
+}
@@ -0,0 +1,368 @@
+package beehive
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
+	"github.com/kandoo/beehive/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/kandoo/beehive/state"
+)
+
+// ErrColonyConflict is returned by the registry when the cells of a message
+// are owned by different colonies. The queen resolves such conflicts by merging
+// the colonies.
+var ErrColonyConflict = errors.New("registry: cells are owned by different " +
+	"colonies")
+
+// ErrMergeConflict is returned when colonies cannot be merged because their
+// dictionaries have keys in common. The messages that need such colonies to be
+// merged are dead-lettered.
+var ErrMergeConflict = errors.New("merge: colonies have keys in common")
+
+// isColonyConflict returns whether err is ErrColonyConflict, possibly
+// returned in a batch response.
+func isColonyConflict(err error) bool {
+	return err != nil && err.Error() == ErrColonyConflict.Error()
+}
+
+// isMergeConflict returns whether err is ErrMergeConflict, possibly returned
+// by a remote hive.
+func isMergeConflict(err error) bool {
+	return err != nil && err.Error() == ErrMergeConflict.Error()
+}
+
+// cmdMergeColony is sent to the leader of a colony to merge the colony into
+// another colony.
+type cmdMergeColony struct{ To Colony }
+
+// cmdMergeChunk is sent to the leader of the surviving colony with a chunk of
+// the state of the merged colony. The chunks are staged by the surviving bee
+// until the merge is committed by cmdMergeState. A chunk with Seq 0 discards
+// the chunks staged by a previous merge attempt of the same bee.
+type cmdMergeChunk struct {
+	From  uint64
+	Seq   int
+	Chunk state.Chunk
+}
+
+// cmdMergeState is sent to the leader of the surviving colony with the cells of
+// the merged colony, after the chunks of its state are sent in Staged
+// cmdMergeChunk commands. The state is saved in chunks, the same way it is
+// saved in the snapshots of the colony. Chunks has the entries that are not
+// staged, if any.
+type cmdMergeState struct {
+	From   uint64
+	Staged int
+	Chunks []state.Chunk
+	Cells  MappedCells
+}
+
+// cmdDrainBee is sent to the queens of an application to wait until a retired
+// bee is drained on their hive: the registry of the hive no longer routes
+// messages to the bee, and the local bee with that ID, which is either the
+// retired bee or a proxy to it, has relayed the messages queued on it.
+type cmdDrainBee struct{ ID uint64 }
+
+// cmdDrained is sent to a bee to check whether it has any queued message.
+type cmdDrained struct{}
+
+// maxColonyMerges is the maximum number of times the colonies of a set of cells
+// are merged, before their messages are dead-lettered. The colonies are merged
+// again if the cells are owned by other colonies while the colonies are being
+// merged.
+const maxColonyMerges = 3
+
+// colonies returns the distinct colonies that own the cells. The colony that
+// should survive a merge is the first one: the colony with the most cells, and
+// the lowest leader ID among those.
+func (r *registry) colonies(app string, cells MappedCells) []Colony {
+	r.m.RLock()
+	defer r.m.RUnlock()
+
+	var cols []Colony
+	size := make(map[uint64]int)
+	for _, k := range cells {
+		c, ok := r.Store.colony(app, k)
+		if !ok {
+			continue
+		}
+		if _, ok := size[c.Leader]; ok {
+			continue
+		}
+		size[c.Leader] = len(r.Store.cells(c.Leader))
+		cols = append(cols, c)
+	}
+
+	sort.Sort(bySurvival{cols, size})
+	return cols
+}
+
+type bySurvival struct {
+	cols []Colony
+	size map[uint64]int
+}
+
+func (s bySurvival) Len() int      { return len(s.cols) }
+func (s bySurvival) Swap(i, j int) { s.cols[i], s.cols[j] = s.cols[j], s.cols[i] }
+func (s bySurvival) Less(i, j int) bool {
+	si, sj := s.size[s.cols[i].Leader], s.size[s.cols[j].Leader]
+	return si > sj || (si == sj && s.cols[i].Leader < s.cols[j].Leader)
+}
+
+// mergeAsync merges the colonies that own the cells of pc off the queen. The
+// messages of the cells are queued until the merge is done, and are handed
+// back to the queen on placementCh.
+func (q *qee) mergeAsync(pc *pendingCells) {
+	q.addToPendings(pc)
+	pc.merges++
+	cells := pc.MappedCells()
+	go func() {
+		err := q.mergeColonies(cells)
+		q.placementCh <- placementRes{pCells: pc, merged: true, err: err}
+	}()
+}
+
+// handleMergeRes enqueues the messages of merged cells on the bee of the
+// surviving colony. If the cells are owned by different colonies again, they
+// are merged again, at most maxColonyMerges times.
+func (q *qee) handleMergeRes(res placementRes) error {
+	pc := res.pCells
+	err := res.err
+	var b *bee
+	if err == nil {
+		b, err = q.beeByCells(pc.MappedCells())
+	}
+	if isColonyConflict(err) && pc.merges < maxColonyMerges {
+		q.mergeAsync(pc)
+		return nil
+	}
+	if err != nil {
+		for _, mh := range pc.msgs {
+			q.hive.deadLetter(q.app.Name(), 0, mh.msg, err, 0)
+		}
+		return err
+	}
+
+	for _, mh := range pc.msgs {
+		b.enqueMsg(mh)
+	}
+	return nil
+}
+
+// mergeColonies merges the colonies that own cells into one colony.
+func (q *qee) mergeColonies(cells MappedCells) error {
+	cols := q.hive.registry.colonies(q.app.Name(), cells)
+	if len(cols) < 2 {
+		return nil
+	}
+
+	to := cols[0]
+	for _, from := range cols[1:] {
+		glog.V(2).Infof("%v merges %v into %v", q, from, to)
+		if _, err := q.sendCmdToBee(from.Leader, cmdMergeColony{To: to}); err != nil {
+			return err
+		}
+		go q.retireColony(from)
+	}
+	return q.hive.raftBarrier()
+}
+
+// retireColony removes the bees of a merged colony. The followers are removed
+// right away. The leader, which relays the messages in flight to the surviving
+// colony, is removed once it is drained on all the hives.
+func (q *qee) retireColony(c Colony) {
+	for _, f := range c.Followers {
+		q.retireBee(f)
+	}
+
+	info, err := q.hive.registry.bee(c.Leader)
+	if err != nil {
+		return
+	}
+	if err := q.drainBeeOnHives(c.Leader, info.Hive); err != nil {
+		glog.Errorf("%v cannot drain %v: %v", q, c.Leader, err)
+	}
+	q.retireBee(c.Leader)
+}
+
+// drainBeeOnHives drains the bee on all the hives. The proxies on other hives
+// relay their messages to the bee, so the hive of the bee is drained last.
+func (q *qee) drainBeeOnHives(id uint64, hive uint64) (err error) {
+	for _, h := range q.hive.registry.hives() {
+		if h.ID == hive {
+			continue
+		}
+		if _, herr := q.sendCmdToQueen(h.ID, cmdDrainBee{ID: id}); herr != nil {
+			glog.Errorf("%v cannot drain %v on %v: %v", q, id, h.ID, herr)
+			err = herr
+		}
+	}
+	if _, herr := q.sendCmdToQueen(hive, cmdDrainBee{ID: id}); herr != nil {
+		err = herr
+	}
+	return err
+}
+
+// retireBee removes the bee on the hive it lives on.
+func (q *qee) retireBee(id uint64) {
+	info, err := q.hive.registry.bee(id)
+	if err != nil {
+		return
+	}
+	if _, err := q.sendCmdToQueen(info.Hive, cmdRemoveBee{ID: id}); err != nil {
+		glog.Errorf("%v cannot remove %v: %v", q, id, err)
+	}
+}
+
+// drainBee waits until the local bee with the given ID, if any, is drained.
+// The registry is synced first, so that the queen routes no new message to
+// that bee afterwards.
+func (q *qee) drainBee(id uint64) error {
+	if err := q.hive.raftBarrier(); err != nil {
+		return err
+	}
+	b, ok := q.beeByID(id)
+	if !ok {
+		return nil
+	}
+
+	timeout := time.After(10 * q.hive.config.RaftElectTimeout())
+	for {
+		// The bee handles commands in between batches of messages, so its
+		// queue is drained once it is empty when the command is handled.
+		res, err := b.processCmd(cmdDrained{})
+		if err != nil {
+			return err
+		}
+		if res.(bool) {
+			return nil
+		}
+		select {
+		case <-time.After(q.hive.config.RaftTick):
+		case <-timeout:
+			return fmt.Errorf("%v cannot drain %v: %v queued messages", q, b,
+				b.dataCh.size())
+		}
+	}
+}
+
+// mergeInto hands off the state and the cells of the bee to the leader of the
+// given colony, transfers its cells in the registry, and then proxies the
+// messages in flight to the new leader. The raft group of the bee is removed
+// when it becomes a proxy. The state is sent chunk by chunk, and the merge is
+// committed when all the chunks are sent.
+func (b *bee) mergeInto(to Colony) error {
+	from := b.colony()
+	if from.Leader == to.Leader {
+		return nil
+	}
+
+	ms := cmdMergeState{From: b.ID(), Cells: b.mappedCells()}
+	_, err := b.stateL1.SaveChunks(0, func(c state.Chunk) error {
+		// Indexes are rebuilt by the surviving bee.
+		if state.IsIndexDict(c.Dict) {
+			return nil
+		}
+		mc := cmdMergeChunk{From: b.ID(), Seq: ms.Staged, Chunk: c}
+		if _, err := b.qee.sendCmdToBee(to.Leader, mc); err != nil {
+			return err
+		}
+		ms.Staged++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := b.qee.sendCmdToBee(to.Leader, ms); err != nil {
+		return err
+	}
+
+	ctx, cnl := context.WithTimeout(context.Background(),
+		10*b.hive.config.RaftElectTimeout())
+	defer cnl()
+	t := transferCells{From: from, To: to}
+	if _, err := b.hive.proposeAmongHives(ctx, t); err != nil {
+		return err
+	}
+
+	glog.V(2).Infof("%v is merged into %v", b, to)
+	b.becomeProxyTo(to.Leader)
+	return nil
+}
+
+// stageChunk stages a chunk of the state of a bee being merged into this bee.
+func (b *bee) stageChunk(mc cmdMergeChunk) {
+	if b.staged == nil {
+		b.staged = make(map[uint64][]state.Chunk)
+	}
+	if mc.Seq == 0 {
+		delete(b.staged, mc.From)
+	}
+	b.staged[mc.From] = append(b.staged[mc.From], mc.Chunk)
+}
+
+// mergeState merges the state of a merged colony into the state of the bee in
+// one transaction, and adds the cells of that colony to the bee. It returns
+// ErrMergeConflict, without changing the state, if a key of the application's
+// dictionaries exists in both states.
+func (b *bee) mergeState(ms cmdMergeState) error {
+	chunks := b.staged[ms.From]
+	delete(b.staged, ms.From)
+	if len(chunks) != ms.Staged {
+		return fmt.Errorf("%v has %v staged chunks of %v instead of %v", b,
+			len(chunks), ms.From, ms.Staged)
+	}
+	chunks = append(chunks, ms.Chunks...)
+
+	if err := b.BeginTx(); err != nil {
+		return err
+	}
+	for _, c := range chunks {
+		if err := b.mergeChunk(c); err != nil {
+			b.AbortTx()
+			return err
+		}
+	}
+	if err := b.CommitTx(); err != nil {
+		return err
+	}
+	b.addMappedCells(ms.Cells)
+	return nil
+}
+
+// mergeChunk puts the entries of the chunk in the state of the bee.
+func (b *bee) mergeChunk(c state.Chunk) error {
+	d := b.Dict(c.Dict)
+	for _, e := range c.Entries {
+		if e.Del {
+			continue
+		}
+		if _, err := d.Get(e.Key); err == nil && isAppDict(c.Dict) {
+			glog.Errorf("%v cannot merge key %v of %v: key exists", b, e.Key,
+				c.Dict)
+			return ErrMergeConflict
+		}
+		var err error
+		if ed, ok := d.(state.ExpiringDict); ok && !e.Deadline.IsZero() {
+			err = ed.PutWithDeadline(e.Key, e.Val, e.Deadline)
+		} else {
+			err = d.Put(e.Key, e.Val)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func init() {
+	gob.Register(cmdMergeColony{})
+	gob.Register(cmdMergeChunk{})
+	gob.Register(cmdMergeState{})
+	gob.Register(cmdDrainBee{})
+	gob.Register(cmdDrained{})
+}
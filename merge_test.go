@@ -0,0 +1,229 @@
+package beehive
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/kandoo/beehive/state"
+)
+
+func TestRegistryLockCellConflict(t *testing.T) {
+	r := newRegistry("test")
+	c1 := Colony{ID: 1, Leader: 1}
+	c2 := Colony{ID: 2, Leader: 2}
+	a := CellKey{Dict: "D", Key: "a"}
+	b := CellKey{Dict: "D", Key: "b"}
+	c := CellKey{Dict: "D", Key: "c"}
+	r.Store.assign("app", a, c1)
+	r.Store.assign("app", b, c2)
+
+	l := lockMappedCell{Colony: c1, App: "app", Cells: MappedCells{a, c, b}}
+	if _, err := r.lockCell(l); err != ErrColonyConflict {
+		t.Errorf("invalid error for conflicting colonies: %v", err)
+	}
+	if _, ok := r.Store.colony("app", c); ok {
+		t.Errorf("conflicting lock has assigned a cell")
+	}
+}
+
+type mergeTestPut struct {
+	Key string
+	Val int
+}
+
+type mergeTestSum []string
+
+func TestMergeColonies(t *testing.T) {
+	h := newHiveForTest(RaftTick(20 * time.Millisecond))
+	app := h.NewApp("merge")
+	app.HandleFunc(mergeTestPut{},
+		func(msg Msg, ctx MapContext) MappedCells {
+			return MappedCells{{"D", msg.Data().(mergeTestPut).Key}}
+		},
+		func(msg Msg, ctx RcvContext) error {
+			p := msg.Data().(mergeTestPut)
+			if err := ctx.Dict("D").Put(p.Key, p.Val); err != nil {
+				return err
+			}
+			// Entries that do not fit in one chunk of the merged state.
+			for i := 0; i <= state.ChunkSize; i++ {
+				if err := ctx.Dict("E").Put(fmt.Sprintf("%v/%v", p.Key, i),
+					i); err != nil {
+
+					return err
+				}
+			}
+			return ctx.Reply(msg, ctx.ID())
+		})
+	app.HandleFunc(mergeTestSum{},
+		func(msg Msg, ctx MapContext) MappedCells {
+			var cells MappedCells
+			for _, k := range msg.Data().(mergeTestSum) {
+				cells = append(cells, CellKey{"D", k})
+			}
+			return cells
+		},
+		func(msg Msg, ctx RcvContext) error {
+			sum := 0
+			for _, k := range msg.Data().(mergeTestSum) {
+				v, err := ctx.Dict("D").Get(k)
+				if err != nil {
+					return err
+				}
+				sum += v.(int)
+			}
+			n := 0
+			ctx.Dict("E").ForEach(func(k string, v interface{}) bool {
+				n++
+				return true
+			})
+			if n != 2*(state.ChunkSize+1) {
+				return fmt.Errorf("invalid number of entries: %v", n)
+			}
+			return ctx.Reply(msg, sum)
+		})
+
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	ctx, cnl := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cnl()
+	var bees []uint64
+	for i, k := range []string{"a", "b"} {
+		id, err := h.Sync(ctx, mergeTestPut{Key: k, Val: i + 1})
+		if err != nil {
+			t.Fatalf("cannot put %v: %v", k, err)
+		}
+		bees = append(bees, id.(uint64))
+	}
+	if bees[0] == bees[1] {
+		t.Fatalf("cells are owned by the same bee: %v", bees)
+	}
+
+	sum, err := h.Sync(ctx, mergeTestSum{"a", "b"})
+	if err != nil {
+		t.Fatalf("cannot sum the merged cells: %v", err)
+	}
+	if sum != 3 {
+		t.Errorf("invalid sum: actual=%v want=3", sum)
+	}
+
+	cols := h.(*hive).registry.colonies("merge",
+		MappedCells{{"D", "a"}, {"D", "b"}})
+	if len(cols) != 1 {
+		t.Errorf("cells are owned by more than one colony: %v", cols)
+	}
+
+	// Messages sent to the merged bee are relayed to the surviving bee.
+	id, err := h.Sync(ctx, mergeTestPut{Key: "a", Val: 2})
+	if err != nil {
+		t.Fatalf("cannot put after merge: %v", err)
+	}
+	if id != cols[0].Leader {
+		t.Errorf("invalid bee after merge: actual=%v want=%v", id, cols[0].Leader)
+	}
+
+	// The merged bee is removed after relaying the messages in flight.
+	merged := bees[0]
+	if merged == cols[0].Leader {
+		merged = bees[1]
+	}
+	for i := 0; ; i++ {
+		if _, err := h.(*hive).registry.bee(merged); err == ErrNoSuchBee {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("merged bee %v is not removed", merged)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	a, _ := h.(*hive).app("merge")
+	if _, ok := a.qee.beeByID(merged); ok {
+		t.Errorf("merged bee %v is still in the queen", merged)
+	}
+}
+
+func TestMergeConflict(t *testing.T) {
+	h := newHiveForTest()
+	app := h.NewApp("merge")
+	app.HandleFunc(mergeTestPut{},
+		func(msg Msg, ctx MapContext) MappedCells {
+			return MappedCells{{"D", msg.Data().(mergeTestPut).Key}}
+		},
+		func(msg Msg, ctx RcvContext) error {
+			p := msg.Data().(mergeTestPut)
+			// Both bees put the same key in a dictionary that is not mapped.
+			if err := ctx.Dict("S").Put("shared", p.Val); err != nil {
+				return err
+			}
+			return ctx.Reply(msg, ctx.ID())
+		})
+	app.HandleFunc(mergeTestSum{},
+		func(msg Msg, ctx MapContext) MappedCells {
+			var cells MappedCells
+			for _, k := range msg.Data().(mergeTestSum) {
+				cells = append(cells, CellKey{"D", k})
+			}
+			return cells
+		},
+		func(msg Msg, ctx RcvContext) error {
+			return ctx.Reply(msg, 0)
+		})
+
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	ctx, cnl := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cnl()
+	for i, k := range []string{"a", "b"} {
+		if _, err := h.Sync(ctx, mergeTestPut{Key: k, Val: i}); err != nil {
+			t.Fatalf("cannot put %v: %v", k, err)
+		}
+	}
+
+	sctx, scnl := context.WithTimeout(context.Background(), time.Second)
+	defer scnl()
+	if _, err := h.Sync(sctx, mergeTestSum{"a", "b"}); err == nil {
+		t.Errorf("colonies with a key in common are merged")
+	}
+	cols := h.(*hive).registry.colonies("merge",
+		MappedCells{{"D", "a"}, {"D", "b"}})
+	if len(cols) != 2 {
+		t.Errorf("invalid colonies after a failed merge: %v", cols)
+	}
+}
+
+func TestRegistryTransfer(t *testing.T) {
+	r := newRegistry("test")
+	c1 := Colony{ID: 1, Leader: 1}
+	c2 := Colony{ID: 2, Leader: 2}
+	r.Bees[1] = BeeInfo{ID: 1, App: "app", Colony: c1}
+	r.Bees[2] = BeeInfo{ID: 2, App: "app", Colony: c2}
+	a := CellKey{Dict: "D", Key: "a"}
+	b := CellKey{Dict: "D", Key: "b"}
+	r.Store.assign("app", a, c1)
+	r.Store.assign("app", b, c2)
+
+	if err := r.transfer(transferCells{From: c1, To: c2}); err != nil {
+		t.Fatalf("cannot transfer cells: %v", err)
+	}
+	for _, k := range []CellKey{a, b} {
+		if c, ok := r.Store.colony("app", k); !ok || !c.Equals(c2) {
+			t.Errorf("cell %v is not transferred: %v", k, c)
+		}
+	}
+	if cells := r.Store.cells(1); len(cells) != 0 {
+		t.Errorf("merged colony still has cells: %v", cells)
+	}
+	if cells := r.Store.cells(2); len(cells) != 2 {
+		t.Errorf("invalid cells of the surviving colony: %v", cells)
+	}
+	if err := r.transfer(transferCells{From: c1, To: c2}); err != ErrInvalidParam {
+		t.Errorf("invalid error for transferring a colony without cells: %v",
+			err)
+	}
+}
@@ -10,8 +10,10 @@ import (
 )
 
 type HiveInfo struct {
-	ID   uint64 `json:"id"`
-	Addr string `json:"addr"`
+	ID     uint64            `json:"id"`
+	Addr   string            `json:"addr"`
+	Load   HiveLoad          `json:"load"`
+	Labels map[string]string `json:"labels,omitempty"`
 }
 
 type hiveMeta struct {
@@ -40,6 +40,22 @@ func (m MockMsg) NoReply() bool {
 	return m.MsgFrom == Nil
 }
 
+func (m MockMsg) Priority() MsgPriority {
+	return m.MsgPriority
+}
+
+func (m MockMsg) Deadline() time.Time {
+	return m.MsgDeadline
+}
+
+func (m MockMsg) IdempotencyKey() string {
+	return m.MsgKey
+}
+
+func (m MockMsg) Topic() string {
+	return m.MsgTopic
+}
+
 // MockRcvContext is a mock for RcvContext.
 type MockRcvContext struct {
 	CtxHive  Hive
@@ -47,6 +63,7 @@ type MockRcvContext struct {
 	CtxDicts *state.InMem
 	CtxID    uint64
 	CtxMsgs  []Msg
+	CtxTry   int
 	// TODO(soheil): add message handling methods.
 }
 
@@ -69,18 +86,42 @@ func (m MockRcvContext) ID() uint64 {
 	return m.CtxID
 }
 
+func (m MockRcvContext) Attempt() int {
+	if m.CtxTry == 0 {
+		return 1
+	}
+	return m.CtxTry
+}
+
 func (m MockRcvContext) Printf(format string, a ...interface{}) {}
 
-func (m *MockRcvContext) Emit(msgData interface{}) {
-	msg := MockMsg{
-		MsgData: msgData,
-		MsgFrom: m.ID(),
-	}
-	m.CtxMsgs = append(m.CtxMsgs, msg)
+func (m *MockRcvContext) Emit(msgData interface{}, opts ...EmitOption) {
+	msg := newMsgFromData(msgData, m.ID(), 0)
+	msg.applyOptions(opts)
+	m.CtxMsgs = append(m.CtxMsgs, MockMsg(*msg))
+}
+
+func (m *MockRcvContext) EmitTo(topic string, msgData interface{},
+	opts ...EmitOption) {
+
+	msg := newMsgFromData(msgData, m.ID(), 0)
+	msg.MsgTopic = topic
+	msg.applyOptions(opts)
+	m.CtxMsgs = append(m.CtxMsgs, MockMsg(*msg))
+}
+
+func (m *MockRcvContext) Ask(req interface{}, opts ...EmitOption) (Future,
+	error) {
+
+	f := Future{ID: uint64(len(m.CtxMsgs) + 1)}
+	msg := newMsgFromData(req, m.ID(), 0)
+	msg.applyOptions(opts)
+	m.CtxMsgs = append(m.CtxMsgs, MockMsg(*msg))
+	return f, nil
 }
 
 func (m MockRcvContext) SendToCell(msgData interface{}, app string,
-	cell CellKey) {
+	cell CellKey, opts ...EmitOption) {
 }
 
 func (m MockRcvContext) DeferReply(msg Msg) Repliable {
@@ -125,6 +166,10 @@ func (m MockRcvContext) BeeLocal() interface{} {
 
 func (m MockRcvContext) SetBeeLocal(d interface{}) {}
 
+func (m MockRcvContext) Lookup(dict, index, key string, f state.IterFn) error {
+	return state.ErrNoSuchIndex
+}
+
 func (m MockRcvContext) BeginTx() error {
 	return nil
 }
@@ -137,6 +182,30 @@ func (m MockRcvContext) AbortTx() error {
 	return nil
 }
 
+func (m MockRcvContext) Savepoint(name string) error {
+	return nil
+}
+
+func (m MockRcvContext) RollbackTo(name string) error {
+	return nil
+}
+
+func (m MockRcvContext) ReleaseSavepoint(name string) error {
+	return nil
+}
+
+func (m MockRcvContext) Gather(ctx context.Context, app string,
+	cells []CellKey, req interface{}) []GatherResult {
+
+	return m.CtxHive.Gather(ctx, app, cells, req)
+}
+
+func (m MockRcvContext) SyncAll(ctx context.Context, app string,
+	req interface{}) []GatherResult {
+
+	return m.CtxHive.SyncAll(ctx, app, req)
+}
+
 func (m MockRcvContext) Sync(ctx context.Context, req interface{}) (
 	res interface{}, err error) {
 
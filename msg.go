@@ -5,6 +5,9 @@ import (
 	"fmt"
 	"reflect"
 	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Msg is a generic interface for messages emitted in the system. Messages
@@ -25,6 +28,13 @@ type Msg interface {
 	IsBroadCast() bool
 	// IsUnicast returns whether the message is a unicast.
 	IsUnicast() bool
+	// Deadline returns the deadline of the message. The zero time means the
+	// message never expires.
+	Deadline() time.Time
+	// IdempotencyKey returns the idempotency key of the message, if any.
+	IdempotencyKey() string
+	// Topic returns the topic of the message, if it is emitted on a topic.
+	Topic() string
 }
 
 // Typed is a message data with an explicit type.
@@ -33,9 +43,15 @@ type Typed interface {
 }
 
 type msg struct {
-	MsgData interface{}
-	MsgFrom uint64
-	MsgTo   uint64
+	MsgData     interface{}
+	MsgFrom     uint64
+	MsgTo       uint64
+	MsgPriority MsgPriority
+	MsgDeadline time.Time
+	MsgKey      string
+	MsgSender   uint64 // The hive that emitted the message.
+	MsgSeq      uint64 // The sequence number of the message on its sender.
+	MsgTopic    string
 }
 
 func (m msg) NoReply() bool {
@@ -66,6 +82,22 @@ func (m msg) From() uint64 {
 	return m.MsgFrom
 }
 
+func (m msg) Priority() MsgPriority {
+	return m.MsgPriority
+}
+
+func (m msg) Deadline() time.Time {
+	return m.MsgDeadline
+}
+
+func (m msg) IdempotencyKey() string {
+	return m.MsgKey
+}
+
+func (m msg) Topic() string {
+	return m.MsgTopic
+}
+
 func (m msg) String() string {
 	if m.Data() == nil {
 		return fmt.Sprintf("%v -> %v\t(nil)", m.From(), m.To())
@@ -82,40 +114,66 @@ func MsgType(d interface{}) string {
 }
 
 func newMsgFromData(data interface{}, from uint64, to uint64) *msg {
-	return &msg{
+	m := &msg{
 		MsgData: data,
 		MsgFrom: from,
 		MsgTo:   to,
 	}
+	if p, ok := data.(Prioritized); ok {
+		m.MsgPriority = p.Priority()
+	}
+	if i, ok := data.(Idempotent); ok {
+		m.MsgKey = i.IdempotencyKey()
+	}
+	return m
 }
 
 type msgAndHandler struct {
 	msg     *msg
 	handler Handler
+	attempt int         // Number of failed attempts to receive the message.
+	cells   MappedCells // The cells the message is mapped to, if known.
+}
+
+func (mh msgAndHandler) priority() MsgPriority {
+	if mh.msg == nil {
+		return NormalPriority
+	}
+	return mh.msg.MsgPriority
 }
 
 type Emitter interface {
-	Emit(msgData interface{})
+	Emit(msgData interface{}, opts ...EmitOption)
 }
 
 func init() {
 	gob.Register(msg{})
 }
 
+// msgChannel is an unbounded channel of messages. Pending messages are kept in
+// one queue per priority, and are delivered from the queue of the highest
+// priority first. Emitters can use the watermarks of the channel to avoid
+// overloading it.
 type msgChannel struct {
-	chin  chan msgAndHandler
-	chout chan msgAndHandler
-	buf   []msgAndHandler
-	start int
-	end   int
+	chin   chan msgAndHandler
+	chout  chan msgAndHandler
+	queues [numPriorities]msgQueue
+	queued int64 // Number of messages in the queues, updated atomically.
+
+	marks Watermarks
+	over  int32 // 1 if the channel is overloaded, updated atomically.
+	lowMu sync.Mutex
+	low   chan struct{} // Closed when the channel is no longer overloaded.
+	// Number of emitters blocked in waitForLow, updated atomically.
+	waiters int32
 }
 
 func newMsgChannel(bufSize uint) *msgChannel {
 	q := &msgChannel{
 		chin:  make(chan msgAndHandler, bufSize),
 		chout: make(chan msgAndHandler, bufSize),
-		buf:   make([]msgAndHandler, bufSize),
 	}
+	q.queues[NormalPriority.index()].buf = make([]msgAndHandler, bufSize)
 	go q.pipe()
 	return q
 }
@@ -137,12 +195,26 @@ func (q *msgChannel) pipe() {
 			q.maybeReadMore()
 			if dequed == false {
 				first, dequed = q.deque()
+			} else if next, _ := q.peek(); next.priority() > first.priority() {
+				// Put back first and deliver the message of a higher priority.
+				q.queues[first.priority().index()].pushFront(first)
+				first, _ = q.deque()
 			}
 		case chout <- first:
 			q.maybeWriteMore()
 			first, dequed = q.deque()
 		}
+		q.updateQueued(dequed)
+		q.drained()
+	}
+}
+
+func (q *msgChannel) updateQueued(dequed bool) {
+	n := int64(q.len())
+	if dequed {
+		n++
 	}
+	atomic.StoreInt64(&q.queued, n)
 }
 
 func (q *msgChannel) maybeFastPipe() {
@@ -193,8 +265,9 @@ func (q *msgChannel) maybeWriteMore() {
 		l = w
 	}
 	for ; l > 0; l-- {
+		mh, _ := q.peek()
 		select {
-		case q.chout <- q.buf[q.start]:
+		case q.chout <- mh:
 			q.deque()
 		default:
 			return
@@ -214,11 +287,57 @@ func (q *msgChannel) empty() bool {
 	return q.len() == 0
 }
 
-func (q *msgChannel) full() bool {
-	return q.len() == len(q.buf)-1
+func (q *msgChannel) enque(mh msgAndHandler) {
+	q.queues[mh.priority().index()].enque(mh)
 }
 
-func (q *msgChannel) enque(mh msgAndHandler) {
+// peek returns the message of the highest priority without dequeing it.
+func (q *msgChannel) peek() (msgAndHandler, bool) {
+	for i := range q.queues {
+		if !q.queues[i].empty() {
+			return q.queues[i].buf[q.queues[i].start], true
+		}
+	}
+	return msgAndHandler{}, false
+}
+
+// deque dequeues the message of the highest priority.
+func (q *msgChannel) deque() (msgAndHandler, bool) {
+	for i := range q.queues {
+		if mh, ok := q.queues[i].deque(); ok {
+			return mh, true
+		}
+	}
+	return msgAndHandler{}, false
+}
+
+func (q *msgChannel) len() int {
+	l := 0
+	for i := range q.queues {
+		l += q.queues[i].len()
+	}
+	return l
+}
+
+// minQueueSize is the initial size of the queues that are not preallocated.
+const minQueueSize = 16
+
+// msgQueue is a ring buffer of messages.
+type msgQueue struct {
+	buf   []msgAndHandler
+	start int
+	end   int
+}
+
+func (q *msgQueue) empty() bool {
+	return q.len() == 0
+}
+
+func (q *msgQueue) full() bool {
+	return q.len() >= len(q.buf)-1
+}
+
+func (q *msgQueue) enque(mh msgAndHandler) {
 	if q.full() {
 		q.maybeExpand()
 	}
@@ -230,7 +349,20 @@ func (q *msgChannel) enque(mh msgAndHandler) {
 	}
 }
 
-func (q *msgChannel) deque() (msgAndHandler, bool) {
+// pushFront adds mh to the head of the queue.
+func (q *msgQueue) pushFront(mh msgAndHandler) {
+	if q.full() {
+		q.maybeExpand()
+	}
+
+	q.start--
+	if q.start < 0 {
+		q.start = len(q.buf) - 1
+	}
+	q.buf[q.start] = mh
+}
+
+func (q *msgQueue) deque() (msgAndHandler, bool) {
 	if q.empty() {
 		return msgAndHandler{}, false
 	}
@@ -244,7 +376,7 @@ func (q *msgChannel) deque() (msgAndHandler, bool) {
 	return mh, true
 }
 
-func (q *msgChannel) len() int {
+func (q *msgQueue) len() int {
 	l := q.end - q.start
 	if l >= 0 {
 		return l
@@ -252,15 +384,20 @@ func (q *msgChannel) len() int {
 	return len(q.buf) + l
 }
 
-func (q *msgChannel) free() int {
+func (q *msgQueue) free() int {
 	return len(q.buf) - q.len()
 }
 
-func (q *msgChannel) maybeExpand() {
+func (q *msgQueue) maybeExpand() {
 	if !q.full() {
 		return
 	}
 
+	if len(q.buf) == 0 {
+		q.buf = make([]msgAndHandler, minQueueSize)
+		return
+	}
+
 	qlen := q.len()
 	buf := make([]msgAndHandler, len(q.buf)*2)
 	if q.start < q.end {
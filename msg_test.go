@@ -74,6 +74,74 @@ func TestMsgChannelParallel(t *testing.T) {
 	wg.Wait()
 }
 
+func TestMsgChannelPriority(t *testing.T) {
+	ch := newMsgChannel(7)
+	prios := []MsgPriority{LowPriority, NormalPriority, HighPriority,
+		NormalPriority, HighPriority, LowPriority}
+	for i, p := range prios {
+		ch.enque(msgAndHandler{msg: &msg{MsgData: i, MsgPriority: p}})
+	}
+
+	want := []int{2, 4, 1, 3, 0, 5}
+	for _, w := range want {
+		mh, ok := ch.deque()
+		if !ok {
+			t.Fatalf("cannot deque message %v", w)
+		}
+		if mh.msg.MsgData != w {
+			t.Errorf("invalid message: actual=%v want=%v", mh.msg.MsgData, w)
+		}
+	}
+}
+
+func TestPrioritize(t *testing.T) {
+	mhs := []msgAndHandler{
+		{msg: &msg{MsgData: 0}},
+		{msg: &msg{MsgData: 1, MsgPriority: LowPriority}},
+		{msg: &msg{MsgData: 2, MsgPriority: HighPriority}},
+		{msg: &msg{MsgData: 3}},
+	}
+	prioritize(mhs)
+	for i, w := range []int{2, 0, 3, 1} {
+		if mhs[i].msg.MsgData != w {
+			t.Errorf("invalid message at %v: actual=%v want=%v", i,
+				mhs[i].msg.MsgData, w)
+		}
+	}
+}
+
+func TestPrioritizedMsgs(t *testing.T) {
+	msgs := []msg{
+		{MsgData: 0},
+		{MsgData: 1, MsgPriority: HighPriority},
+	}
+	sorted := prioritizedMsgs(msgs)
+	if sorted[0].MsgData != 1 || sorted[1].MsgData != 0 {
+		t.Errorf("messages are not sorted: %v", sorted)
+	}
+	if msgs[0].MsgData != 0 {
+		t.Error("prioritizedMsgs reorders the messages of the caller")
+	}
+}
+
+type prioritizedMsg struct{}
+
+func (m prioritizedMsg) Priority() MsgPriority { return HighPriority }
+
+func TestEmitPriority(t *testing.T) {
+	ctx := &MockRcvContext{}
+	ctx.Emit(1)
+	ctx.Emit(prioritizedMsg{})
+	ctx.Emit(prioritizedMsg{}, Priority(LowPriority))
+	want := []MsgPriority{NormalPriority, HighPriority, LowPriority}
+	for i, m := range ctx.CtxMsgs {
+		if p := m.(Prioritized).Priority(); p != want[i] {
+			t.Errorf("invalid priority of message %v: actual=%v want=%v", i, p,
+				want[i])
+		}
+	}
+}
+
 func BenchmarkMsgChannel(b *testing.B) {
 	b.StopTimer()
 
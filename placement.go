@@ -13,8 +13,9 @@ type PlacementMethod interface {
 	// Place returns the metadata of the hive chosen for cells. cells is the
 	// mapped cells of a message according to the map function of the
 	// application's message handler. thisHive is the local hive and liveHives
-	// contains the meta data about live hives. Note that liveHives contains
-	// thisHive.
+	// contains the meta data about live hives that satisfy the labels required
+	// by the application. Note that liveHives contains thisHive, unless thisHive
+	// does not have the required labels.
 	Place(cells MappedCells, thisHive Hive, liveHives []HiveInfo) HiveInfo
 }
 
@@ -29,3 +30,73 @@ func (r RandomPlacement) Place(cells MappedCells, thisHive Hive,
 
 	return liveHives[r.Intn(len(liveHives))]
 }
+
+// LoadFunc returns a single value for the load of a hive. Hives with lower
+// values are less loaded.
+type LoadFunc func(l HiveLoad) float64
+
+// DefaultLoad is the load function used by the load-aware placement methods,
+// when they have no load function. It weighs the number of bees, the queued
+// messages, and the message rate of the hive equally.
+func DefaultLoad(l HiveLoad) float64 {
+	return float64(l.Bees) + float64(l.Queue) + float64(l.MsgRate)
+}
+
+func (f LoadFunc) load(h HiveInfo) float64 {
+	if f == nil {
+		return DefaultLoad(h.Load)
+	}
+	return f(h.Load)
+}
+
+// LeastLoadedPlacement is a placement method that places mapped cells on the
+// least loaded live hive. The load of hives is collected periodically, only
+// when the hives instrument their applications. Since all the cells placed in
+// between are placed on the same hive, PowerOfTwoPlacement is preferred for
+// applications that create many bees.
+type LeastLoadedPlacement struct {
+	Load LoadFunc
+}
+
+func (p LeastLoadedPlacement) Place(cells MappedCells, thisHive Hive,
+	liveHives []HiveInfo) HiveInfo {
+
+	var least []HiveInfo
+	min := 0.0
+	for _, h := range liveHives {
+		l := p.Load.load(h)
+		switch {
+		case len(least) == 0 || l < min:
+			least = append(least[:0], h)
+			min = l
+		case l == min:
+			least = append(least, h)
+		}
+	}
+	// Break the ties randomly.
+	return least[rand.Intn(len(least))]
+}
+
+// PowerOfTwoPlacement is a placement method that chooses two random live hives,
+// and places mapped cells on the less loaded one.
+type PowerOfTwoPlacement struct {
+	Load LoadFunc
+}
+
+func (p PowerOfTwoPlacement) Place(cells MappedCells, thisHive Hive,
+	liveHives []HiveInfo) HiveInfo {
+
+	if len(liveHives) == 1 {
+		return liveHives[0]
+	}
+
+	i := rand.Intn(len(liveHives))
+	j := rand.Intn(len(liveHives) - 1)
+	if j >= i {
+		j++
+	}
+	if p.Load.load(liveHives[j]) < p.Load.load(liveHives[i]) {
+		return liveHives[j]
+	}
+	return liveHives[i]
+}
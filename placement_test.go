@@ -3,8 +3,10 @@ package beehive
 import (
 	"strconv"
 	"testing"
+	"time"
 
 	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
+	"github.com/kandoo/beehive/Godeps/_workspace/src/golang.org/x/net/context"
 )
 
 type testNonLocalPlacementMethod struct{}
@@ -74,3 +76,254 @@ func TestPlacement(t *testing.T) {
 		}
 	}
 }
+
+func testLoadedHives() []HiveInfo {
+	return []HiveInfo{
+		{ID: 1, Load: HiveLoad{Bees: 3, MsgRate: 10}},
+		{ID: 2, Load: HiveLoad{Bees: 1, Queue: 1}},
+		{ID: 3, Load: HiveLoad{Bees: 5, Queue: 100}},
+	}
+}
+
+func TestLeastLoadedPlacement(t *testing.T) {
+	p := LeastLoadedPlacement{}
+	if h := p.Place(nil, nil, testLoadedHives()); h.ID != 2 {
+		t.Errorf("invalid hive: actual=%v want=2", h.ID)
+	}
+
+	p.Load = func(l HiveLoad) float64 { return -float64(l.Bees) }
+	if h := p.Place(nil, nil, testLoadedHives()); h.ID != 3 {
+		t.Errorf("invalid hive with custom load: actual=%v want=3", h.ID)
+	}
+}
+
+func TestPowerOfTwoPlacement(t *testing.T) {
+	p := PowerOfTwoPlacement{}
+	hives := testLoadedHives()
+	for i := 0; i < 100; i++ {
+		if h := p.Place(nil, nil, hives); h.ID == 3 {
+			t.Fatalf("placed on the most loaded hive")
+		}
+	}
+	if h := p.Place(nil, nil, hives[2:]); h.ID != 3 {
+		t.Errorf("invalid hive: actual=%v want=3", h.ID)
+	}
+}
+
+func TestHiveLoadUpdate(t *testing.T) {
+	h := newHiveForTest()
+	app := h.NewApp("load")
+	app.HandleFunc(int(0),
+		func(msg Msg, ctx MapContext) MappedCells {
+			return MappedCells{{"D", "0"}}
+		},
+		func(msg Msg, ctx RcvContext) error {
+			return ctx.Reply(msg, nil)
+		})
+
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	if _, err := h.Sync(context.Background(), 0); err != nil {
+		t.Fatalf("cannot sync: %v", err)
+	}
+
+	msgs := uint64(0)
+	u := loadUpdater{hive: h.(*hive), msgs: &msgs}
+	u.update()
+	l := h.(*hive).loads.get(h.ID())
+	if l.Updated.IsZero() || l.Bees == 0 || l.Memory == 0 {
+		t.Errorf("invalid load: %+v", l)
+	}
+
+	l.Bees = 42
+	if _, err := h.(*hive).processCmd(cmdHiveLoad{Hive: h.ID(), Load: l}); err != nil {
+		t.Fatalf("cannot send the load: %v", err)
+	}
+	for _, i := range h.(*hive).loadedHives() {
+		if i.ID == h.ID() && i.Load.Bees != 42 {
+			t.Errorf("received load is not used: %+v", i.Load)
+		}
+	}
+}
+
+func TestHiveLoadStale(t *testing.T) {
+	var loads hiveLoads
+	now := time.Now()
+	loads.set(1, HiveLoad{Bees: 1, Updated: now})
+	loads.set(1, HiveLoad{Bees: 2, Updated: now.Add(-time.Second)})
+	if l := loads.get(1); l.Bees != 1 {
+		t.Errorf("load is overwritten by an older load: %+v", l)
+	}
+
+	loads.set(2, HiveLoad{Bees: 1, Updated: now.Add(-2 * maxLoadAge)})
+	if l := loads.get(2); l.Bees != 0 {
+		t.Errorf("stale load is not ignored: %+v", l)
+	}
+}
+
+func TestConsistentHashPlacement(t *testing.T) {
+	var hives []HiveInfo
+	for i := uint64(1); i <= 4; i++ {
+		hives = append(hives, HiveInfo{ID: i})
+	}
+
+	p := NewConsistentHashPlacement(0, 0)
+	owners := make(map[string]uint64)
+	for i := 0; i < 1000; i++ {
+		k := strconv.Itoa(i)
+		owners[k] = p.Place(MappedCells{{"D", k}}, nil, hives).ID
+	}
+	for k, o := range owners {
+		cells := MappedCells{{"E", "x"}, {"D", k}}
+		if h := p.Place(cells, nil, hives); h.ID != o {
+			t.Fatalf("placement is not deterministic for %v: %v != %v", k, h.ID, o)
+		}
+	}
+
+	// Only the cells of the removed hive should move.
+	moved := 0
+	for k, o := range owners {
+		h := p.Place(MappedCells{{"D", k}}, nil, hives[:3])
+		if o != 4 && h.ID != o {
+			t.Fatalf("cell %v is moved from %v to %v", k, o, h.ID)
+		}
+		if h.ID != o {
+			moved++
+		}
+	}
+	if moved == 0 || moved > len(owners)/2 {
+		t.Errorf("invalid number of moved cells: %v", moved)
+	}
+
+	// Hives over the bound are skipped.
+	p = NewConsistentHashPlacement(0, 1.25)
+	bees := map[uint64]int{1: 100}
+	for k, o := range owners {
+		h := p.place(MappedCells{{"D", k}}, hives, bees)
+		if h.ID == 1 {
+			t.Fatalf("cell %v is placed on an overloaded hive", k)
+		}
+		if o != 1 && h.ID != o {
+			t.Fatalf("cell %v is moved from %v to %v", k, o, h.ID)
+		}
+	}
+}
+
+func registerRebalanceApp(h Hive, p PlacementMethod) App {
+	a := h.NewApp("rebalance", NonTransactional(), Placement(p),
+		Rebalance(50*time.Millisecond))
+	a.HandleFunc(int(0),
+		func(msg Msg, ctx MapContext) MappedCells {
+			return MappedCells{{"D", strconv.Itoa(msg.Data().(int))}}
+		},
+		func(msg Msg, ctx RcvContext) error {
+			return ctx.Reply(msg, nil)
+		})
+	return a
+}
+
+// waitForRebalance waits until the bees of the given keys are placed on the
+// owner of their cells among the live hives, and returns the hive of each
+// key. It ignores the keys whose bees are not on a live hive.
+func waitForRebalance(t *testing.T, h Hive, p *ConsistentHashPlacement,
+	keys int) map[int]uint64 {
+
+	r := h.(*hive).registry
+	for start := time.Now(); ; time.Sleep(50 * time.Millisecond) {
+		hives := r.hives()
+		live := make(map[uint64]bool)
+		for _, i := range hives {
+			live[i.ID] = true
+		}
+		owners := make(map[int]uint64)
+		placed := true
+		for k := 0; k < keys; k++ {
+			cells := MappedCells{{"D", strconv.Itoa(k)}}
+			b, _, err := r.beeForCells("rebalance", cells)
+			if err != nil {
+				t.Fatalf("cannot find the bee of %v: %v", k, err)
+			}
+			if !live[b.Hive] {
+				continue
+			}
+			if o := p.Place(cells, h, hives).ID; b.Hive != o {
+				placed = false
+			}
+			owners[k] = b.Hive
+		}
+		if placed {
+			return owners
+		}
+		if time.Since(start) > 10*time.Second {
+			t.Fatalf("bees are not rebalanced: %v", owners)
+		}
+	}
+}
+
+func TestRebalance(t *testing.T) {
+	p := NewConsistentHashPlacement(0, 0)
+	keys := 20
+
+	h1 := newHiveForTest()
+	registerRebalanceApp(h1, p)
+	go h1.Start()
+	defer h1.Stop()
+	waitTilStareted(h1)
+
+	for k := 0; k < keys; k++ {
+		if _, err := h1.Sync(context.Background(), k); err != nil {
+			t.Fatalf("cannot sync: %v", err)
+		}
+	}
+	// Let the rebalancer see the initial hives.
+	time.Sleep(200 * time.Millisecond)
+
+	var hives []Hive
+	for i := 0; i < 2; i++ {
+		h := newHiveForTest(PeerAddrs(h1.Config().Addr))
+		registerRebalanceApp(h, p)
+		go h.Start()
+		waitTilStareted(h)
+		hives = append(hives, h)
+
+		owners := waitForRebalance(t, h1, p, keys)
+		moved := 0
+		for _, o := range owners {
+			if o == h.ID() {
+				moved++
+			}
+		}
+		if moved == 0 {
+			t.Errorf("no bee is moved to the joining hive %v", h)
+		}
+	}
+	h2, h3 := hives[0], hives[1]
+	defer h2.Stop()
+
+	before := waitForRebalance(t, h1, p, keys)
+	h3.Stop()
+	ctx, cnl := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cnl()
+	err := h1.(*hive).node.RemoveNodeFromGroup(ctx, h3.ID(), hiveGroup, nil)
+	if err != nil {
+		t.Fatalf("cannot remove %v: %v", h3, err)
+	}
+	if _, err := h1.(*hive).registry.hive(h3.ID()); err != ErrNoSuchHive {
+		t.Fatalf("%v is not removed from the registry", h3)
+	}
+	// Let the rebalancers see the hive leaving.
+	time.Sleep(200 * time.Millisecond)
+
+	after := waitForRebalance(t, h1, p, keys)
+	for k, o := range before {
+		if o == h3.ID() {
+			continue
+		}
+		if after[k] != o {
+			t.Errorf("bee of %v is moved from %v to %v after %v left", k, o,
+				after[k], h3)
+		}
+	}
+}
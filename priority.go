@@ -0,0 +1,111 @@
+package beehive
+
+import "sort"
+
+// MsgPriority is the priority of a message. Pending messages of a higher
+// priority are delivered before the pending messages of a lower priority.
+// Messages of the same priority are delivered in order.
+type MsgPriority int8
+
+// Valid values for MsgPriority.
+const (
+	LowPriority    MsgPriority = -1
+	NormalPriority MsgPriority = 0
+	HighPriority   MsgPriority = 1
+)
+
+// numPriorities is the number of message priorities.
+const numPriorities = 3
+
+func (p MsgPriority) String() string {
+	switch p {
+	case LowPriority:
+		return "low"
+	case NormalPriority:
+		return "normal"
+	case HighPriority:
+		return "high"
+	}
+	return "invalid"
+}
+
+// index returns the index of the priority, where the highest priority has the
+// index of 0. Priorities out of range are treated as the closest valid
+// priority.
+func (p MsgPriority) index() int {
+	switch {
+	case p >= HighPriority:
+		return 0
+	case p <= LowPriority:
+		return numPriorities - 1
+	}
+	return 1
+}
+
+// Prioritized is a message data with an explicit priority. Messages whose data
+// is Prioritized are emitted with that priority, unless an explicit priority is
+// set using the Priority option.
+//
+// The messages passed to handlers are also Prioritized, and return the
+// priority they are emitted with.
+type Prioritized interface {
+	Priority() MsgPriority
+}
+
+// EmitOption represents an option for emitting a message.
+type EmitOption func(m *msg)
+
+// Priority is an emit option that sets the priority of the message.
+func Priority(p MsgPriority) EmitOption {
+	return func(m *msg) {
+		m.MsgPriority = p
+	}
+}
+
+func (m *msg) applyOptions(opts []EmitOption) {
+	for _, opt := range opts {
+		opt(m)
+	}
+}
+
+// prioritize sorts the messages in mhs by their priority, preserving the order
+// of messages of the same priority.
+func prioritize(mhs []msgAndHandler) {
+	for i := 1; i < len(mhs); i++ {
+		if mhs[i].priority() != mhs[0].priority() {
+			sort.Stable(byPriority(mhs))
+			return
+		}
+	}
+}
+
+type byPriority []msgAndHandler
+
+func (p byPriority) Len() int      { return len(p) }
+func (p byPriority) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p byPriority) Less(i, j int) bool {
+	return p[i].priority() > p[j].priority()
+}
+
+// prioritizedMsgs returns msgs sorted by their priority, preserving the order
+// of messages of the same priority. msgs is not modified, and is returned as is
+// if all messages have the same priority.
+func prioritizedMsgs(msgs []msg) []msg {
+	for i := 1; i < len(msgs); i++ {
+		if msgs[i].MsgPriority != msgs[0].MsgPriority {
+			sorted := make([]msg, len(msgs))
+			copy(sorted, msgs)
+			sort.Stable(msgsByPriority(sorted))
+			return sorted
+		}
+	}
+	return msgs
+}
+
+type msgsByPriority []msg
+
+func (p msgsByPriority) Len() int      { return len(p) }
+func (p msgsByPriority) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p msgsByPriority) Less(i, j int) bool {
+	return p[i].MsgPriority > p[j].MsgPriority
+}
@@ -3,6 +3,7 @@ package beehive
 import (
 	"errors"
 	"fmt"
+	"math/rand"
 	"runtime/debug"
 	"strconv"
 	"sync"
@@ -31,6 +32,7 @@ type qee struct {
 	bees         map[uint64]*bee
 	pendingCells map[CellKey]*pendingCells
 
+	idM    sync.Mutex // Guards maxID and nextID.
 	maxID  uint64
 	nextID uint64
 }
@@ -50,6 +52,7 @@ func (q *qee) start() {
 			for i := 0; i < l; i++ {
 				batch = append(batch, <-dataCh)
 			}
+			q.dataCh.drained()
 			q.handleMsgs(batch)
 			batch = batch[0:0]
 
@@ -123,6 +126,9 @@ func (q *qee) allocateBeeID() error {
 }
 
 func (q *qee) newBeeID() (bid uint64, err error) {
+	q.idM.Lock()
+	defer q.idM.Unlock()
+
 	if q.maxID == 0 || q.nextID == q.maxID {
 		if err := q.allocateBeeID(); err != nil {
 			return 0, err
@@ -174,7 +180,11 @@ func (q *qee) defaultColony(bee uint64) Colony {
 
 func (q *qee) newLocalBeeWithID(id uint64, withColony bool) (*bee, error) {
 	b := q.defaultLocalBee(id)
-	b.setState(q.app.newState())
+	s, err := q.app.newBeeState(b.statePath())
+	if err != nil {
+		return nil, err
+	}
+	b.setState(s)
 
 	if withColony {
 		b.beeColony = q.defaultColony(id)
@@ -330,6 +340,19 @@ func (q *qee) handleCmd(cc cmdAndChannel) {
 	case cmdReloadBee:
 		_, err = q.reloadBee(cmd.ID, cmd.Colony)
 
+	case cmdRemoveBee:
+		err = q.removeBee(cmd.ID)
+
+	case cmdDrainBee:
+		// Draining waits for other bees, and must not block the queen.
+		go func(ch chan cmdResult) {
+			err := q.drainBee(cmd.ID)
+			if ch != nil {
+				ch <- cmdResult{Err: err}
+			}
+		}(cc.ch)
+		return
+
 	case cmdStartDetached:
 		var b *bee
 		b, err = q.newDetachedBee(cmd.Handler)
@@ -340,6 +363,20 @@ func (q *qee) handleCmd(cc cmdAndChannel) {
 	case cmdMigrate:
 		res, err = q.migrate(cmd.Bee, cmd.To)
 
+	case cmdSplit:
+		// Splitting waits for the bee and for the registry, and must not block
+		// the queen.
+		go func(ch chan cmdResult) {
+			res, err := q.split(cmd.Bee, cmd.Cells)
+			if err != nil {
+				glog.Errorf("%v cannot split %v: %v", q, cmd.Bee, err)
+			}
+			if ch != nil {
+				ch <- cmdResult{Data: res, Err: err}
+			}
+		}(cc.ch)
+		return
+
 	default:
 		err = fmt.Errorf("unknown queen bee command %#v", cmd)
 	}
@@ -356,13 +393,48 @@ func (q *qee) handleCmd(cc cmdAndChannel) {
 	}
 }
 
+// removeBee stops the bee, if it is local, and deletes it from the queen and
+// from the registry.
+func (q *qee) removeBee(id uint64) error {
+	if b, ok := q.beeByID(id); ok {
+		glog.V(2).Infof("%v removes %v", q, b)
+		if _, err := b.processCmd(cmdStop{}); err != nil {
+			glog.Errorf("%v cannot stop %v: %v", q, b, err)
+		}
+		q.Lock()
+		delete(q.bees, id)
+		q.Unlock()
+	}
+	return q.hive.delBeeFromRegistry(id)
+}
+
+// sendCmdToQueen sends the command to the queen of the application on the given
+// hive.
+func (q *qee) sendCmdToQueen(hive uint64, data interface{}) (interface{},
+	error) {
+
+	if hive == q.hive.ID() {
+		return q.processCmd(data)
+	}
+	return q.hive.client.sendCmd(cmd{Hive: hive, App: q.app.Name(), Data: data})
+}
+
 func (q *qee) reloadBee(id uint64, col Colony) (*bee, error) {
 	info, err := q.hive.bee(id)
 	if err != nil {
 		return nil, err
 	}
+	// The state of a stopped bee is already closed, but a running bee still
+	// owns the files of its state.
+	if old, ok := q.beeByID(id); ok && old.status == beeStatusStarted {
+		return nil, fmt.Errorf("%v has already loaded %v", q, old)
+	}
 	b := q.defaultLocalBee(id)
-	b.setState(q.app.newState())
+	s, err := q.app.newBeeState(b.statePath())
+	if err != nil {
+		return nil, err
+	}
+	b.setState(s)
 	b.setColony(info.Colony)
 	if b.isLeader() {
 		b.becomeLeader()
@@ -424,6 +496,7 @@ func (q *qee) handleUnicastMsg(mh msgAndHandler) {
 func (q *qee) handleLocalBcast(mh msgAndHandler) {
 	glog.V(2).Infof("%v sends a message to all local bees: %v", q, mh.msg)
 
+	var bees []*bee
 	q.RLock()
 	for id, b := range q.bees {
 		if b.detached || b.proxy {
@@ -432,19 +505,29 @@ func (q *qee) handleLocalBcast(mh msgAndHandler) {
 		if b.colony().Leader != id {
 			continue
 		}
-		b.enqueMsg(mh)
+		bees = append(bees, b)
 	}
 	q.RUnlock()
+
+	for _, b := range bees {
+		if q.admitToBee(b, mh) {
+			b.enqueMsg(mh)
+		}
+	}
 }
 
 type placementRes struct {
 	hive   uint64
 	colony Colony
 	pCells *pendingCells
+
+	merged bool  // Whether the colonies of the cells are merged.
+	err    error // The error in merging the colonies.
 }
 
 type pendingCells struct {
 	visited bool
+	merges  int // Number of times the colonies of the cells are merged.
 
 	bee   *bee
 	beeID uint64
@@ -502,7 +585,10 @@ func (q *qee) removePending(pc *pendingCells) {
 }
 
 func (q *qee) handlePlacementRes(res placementRes) error {
-	defer q.removePending(res.pCells)
+	q.removePending(res.pCells)
+	if res.merged {
+		return q.handleMergeRes(res)
+	}
 
 	if res.colony.IsNil() {
 		b, err := q.newLocalBee(true)
@@ -518,16 +604,24 @@ func (q *qee) handlePlacementRes(res placementRes) error {
 
 		lockRes, err := q.hive.node.ProposeRetry(hiveGroup, lock,
 			q.hive.config.RaftElectTimeout(), -1)
-		if err != nil {
+		if err != nil && !isColonyConflict(err) {
 			return err
 		}
 
-		col := lockRes.(Colony)
-		if col.Leader == b.ID() {
+		if col, ok := lockRes.(Colony); ok && col.Leader == b.ID() {
 			b.processCmd(cmdAddMappedCells{Cells: lock.Cells})
 		} else {
+			// The cells are owned by other colonies, and the new bee is not
+			// needed.
+			if err := q.removeBee(b.ID()); err != nil {
+				glog.Errorf("%v cannot remove %v: %v", q, b, err)
+			}
 			var err error
 			if b, err = q.beeByCells(lock.Cells); err != nil {
+				if isColonyConflict(err) {
+					q.mergeAsync(res.pCells)
+					return nil
+				}
 				return err
 			}
 		}
@@ -556,6 +650,7 @@ func (q *qee) handlePlacementRes(res placementRes) error {
 }
 
 func (q *qee) handleMsgs(mhs []msgAndHandler) {
+	prioritize(mhs)
 	pendingC := make(map[CellKey]*pendingCells)
 
 	for i := range mhs {
@@ -568,8 +663,10 @@ func (q *qee) handleMsgs(mhs []msgAndHandler) {
 		glog.V(2).Infof("%v broadcasts message %v", q, mh.msg)
 
 		cells := q.invokeMap(mh)
+		mh.cells = cells
 		if cells == nil {
 			glog.V(2).Infof("%v drops message %v", q, mh.msg)
+			q.hive.deadLetter(q.app.Name(), 0, mh.msg, errMapDrop, 0)
 			continue
 		}
 
@@ -584,7 +681,18 @@ func (q *qee) handleMsgs(mhs []msgAndHandler) {
 
 		b, err := q.beeByCells(cells)
 		if err == nil {
-			b.enqueMsg(mh)
+			if q.admitToBee(b, mh) {
+				b.enqueMsg(mh)
+			}
+			continue
+		}
+		if isColonyConflict(err) {
+			pc := newBeeCellMsgs()
+			for _, c := range cells {
+				pc.cells[c] = struct{}{}
+			}
+			pc.msgs = append(pc.msgs, mh)
+			q.mergeAsync(pc)
 			continue
 		}
 
@@ -606,7 +714,7 @@ func (q *qee) handleMsgs(mhs []msgAndHandler) {
 			bcm.cells[c] = struct{}{}
 		}
 
-		bcm.msgs = append(bcm.msgs, mhs[i])
+		bcm.msgs = append(bcm.msgs, mh)
 	}
 
 	if len(pendingC) == 0 {
@@ -626,7 +734,14 @@ func (q *qee) handleMsgs(mhs []msgAndHandler) {
 		if mapped == nil {
 			panic(mapped)
 		}
-		hive := q.placeBee(mapped)
+		hive, err := q.placeBee(mapped)
+		if err != nil {
+			glog.Errorf("%v cannot place a bee for %v: %v", q, mapped, err)
+			for _, mh := range pc.msgs {
+				q.hive.deadLetter(q.app.Name(), 0, mh.msg, err, 0)
+			}
+			continue
+		}
 
 		if hive != q.hive.ID() {
 			q.addToPendings(pc)
@@ -634,7 +749,6 @@ func (q *qee) handleMsgs(mhs []msgAndHandler) {
 			continue
 		}
 
-		var err error
 		pc.beeID, err = q.newBeeID()
 		if err != nil {
 			// TODO(soheil): this shouldn't be fatal.
@@ -655,8 +769,11 @@ func (q *qee) handleMsgs(mhs []msgAndHandler) {
 	}
 
 	var wg sync.WaitGroup
+	var mergeM sync.Mutex
+	var merges []*pendingCells
 	for i, r := range lockRes.(batchRes) {
-		if !r.Err.IsNil() {
+		// Conflicting colonies are merged when we find the bee of the cells.
+		if !r.Err.IsNil() && !isColonyConflict(r.Err) {
 			glog.Fatalf("cannot lock the cells TODO: %v", r.Err)
 		}
 
@@ -668,9 +785,10 @@ func (q *qee) handleMsgs(mhs []msgAndHandler) {
 
 		wg.Add(1)
 		go func(res interface{}, lock lockMappedCell) {
+			defer wg.Done()
 			cells := lock.Cells
 			pc := pendingC[cells[0]]
-			if res.(Colony).Leader == lock.Colony.Leader {
+			if col, ok := res.(Colony); ok && col.Leader == lock.Colony.Leader {
 				if pc.bee == nil {
 					var err error
 					if pc.bee, err = q.newLocalBeeWithID(pc.beeID, true); err != nil {
@@ -679,10 +797,20 @@ func (q *qee) handleMsgs(mhs []msgAndHandler) {
 				}
 				pc.bee.processCmd(cmdAddMappedCells{Cells: cells})
 			} else {
+				// The bee added for these cells is not needed.
+				if pc.bee == nil {
+					q.hive.delBeeFromRegistry(pc.beeID)
+				}
 				// TODO(soheil): maybe, we can find by id.
 				var err error
 				if pc.bee, err = q.beeByCells(cells); err != nil {
-					glog.Fatalf("neither can lock a cell nor can find its bee")
+					if !isColonyConflict(err) {
+						glog.Fatalf("neither can lock a cell nor can find its bee")
+					}
+					mergeM.Lock()
+					merges = append(merges, pc)
+					mergeM.Unlock()
+					return
 				}
 			}
 
@@ -690,11 +818,13 @@ func (q *qee) handleMsgs(mhs []msgAndHandler) {
 				glog.V(2).Infof("%v enques message to bee %v: %v", q, pc.bee, mh.msg)
 				pc.bee.enqueMsg(mh)
 			}
-			wg.Done()
 		}(r.Res, lock)
 	}
 
 	wg.Wait()
+	for _, pc := range merges {
+		q.mergeAsync(pc)
+	}
 }
 
 func (q *qee) newRemoteBee(pc *pendingCells, hive uint64) {
@@ -732,19 +862,37 @@ fallback:
 	q.placementCh <- placementRes{pCells: pc}
 }
 
-func (q *qee) placeBee(cells MappedCells) (hiveID uint64) {
-	if q.app.placement == nil || q.app.placement == PlacementMethod(nil) {
-		return q.hive.ID()
+// placeBee returns the hive on which a new bee should be created for the
+// cells. It returns ErrNoMatchingHive if no hive has the labels required by the
+// application.
+func (q *qee) placeBee(cells MappedCells) (hiveID uint64, err error) {
+	c := q.app.constraints
+	noPlacement := q.app.placement == nil ||
+		q.app.placement == PlacementMethod(nil)
+	if noPlacement && len(c.require) == 0 {
+		return q.hive.ID(), nil
+	}
+
+	hives := c.filter(q.hive.loadedHives())
+	if len(hives) == 0 {
+		return Nil, ErrNoMatchingHive
+	}
+
+	if noPlacement {
+		if c.allows(q.hive.info()) {
+			return q.hive.ID(), nil
+		}
+		return hives[rand.Intn(len(hives))].ID, nil
 	}
 
 	defer func() {
 		if r := recover(); r != nil {
-			hiveID = q.hive.ID()
+			hiveID, err = q.hive.ID(), nil
 		}
 	}()
 
-	h := q.app.placement.Place(cells, q.hive, q.hive.registry.hives())
-	return h.ID
+	h := q.app.place(cells, hives, BeeInfo{})
+	return h.ID, nil
 }
 
 func (q *qee) beeByCells(cells MappedCells) (*bee, error) {
@@ -760,6 +908,8 @@ func (q *qee) beeByCells(cells MappedCells) (*bee, error) {
 			App:    q.app.Name(),
 			Cells:  cells,
 		}
+		// The cells are owned by different colonies if this returns
+		// ErrColonyConflict, and the caller should merge the colonies.
 		if _, err := q.hive.node.ProposeRetry(hiveGroup, lock,
 			q.hive.config.RaftElectTimeout(), -1); err != nil {
 
@@ -880,10 +1030,15 @@ func (q *qee) defaultLocalBee(id uint64) *bee {
 		batch = q.hive.config.BatchSize
 	}
 
+	dataCh := newMsgChannel(q.hive.config.DataChBufSize)
+	if q.app.bp != nil {
+		dataCh.marks = q.app.bp.bee
+	}
+
 	return &bee{
 		qee:       q,
 		beeID:     id,
-		dataCh:    newMsgChannel(q.hive.config.DataChBufSize),
+		dataCh:    dataCh,
 		outCh:     make(chan []*msg, cap(q.ctrlCh)),
 		ctrlCh:    make(chan cmdAndChannel, cap(q.ctrlCh)),
 		hive:      q.hive,
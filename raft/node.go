@@ -119,6 +119,7 @@ type group struct {
 	applied uint64
 	snapmu  sync.RWMutex
 	snapped uint64
+	chain   snapChain
 
 	stopc       chan struct{}
 	saverDone   chan struct{}
@@ -200,11 +201,7 @@ func (g *group) startApplier() {
 }
 
 func (g *group) stop() {
-	select {
-	case g.stopc <- struct{}{}:
-	case <-g.saverDone:
-	case <-g.applierDone:
-	}
+	close(g.stopc)
 	<-g.saverDone
 	<-g.applierDone
 }
@@ -279,6 +276,7 @@ func (g *group) save(rdsv readySaved) error {
 	select {
 	case g.applyc <- rdsv.ready:
 	case <-g.node.done:
+	case <-g.stopc:
 	}
 
 	return nil
@@ -302,9 +300,7 @@ func (g *group) apply(ready etcdraft.Ready) error {
 	if !etcdraft.IsEmptySnap(ready.Snapshot) &&
 		ready.Snapshot.Metadata.Index > g.applied {
 
-		if err := g.stateMachine.Restore(ready.Snapshot.Data); err != nil {
-			glog.Fatalf("error in recovering the state machine: %v", err)
-		}
+		g.restore(ready.Snapshot)
 		// FIXME(soheil): update the nodes and notify the application?
 		g.applied = ready.Snapshot.Metadata.Index
 		glog.Infof("%v recovered from incoming snapshot at index %d", g.node,
@@ -471,24 +467,133 @@ func (g *group) applyConfChange(e raftpb.Entry) error {
 	return nil
 }
 
-func (g *group) snapshot() {
-	d, err := g.stateMachine.Save()
+// restore restores the state machine from an incoming snapshot.
+func (g *group) restore(snap raftpb.Snapshot) {
+	if _, ok := g.stateMachine.(ChunkedStateMachine); !ok {
+		if err := g.stateMachine.Restore(snap.Data); err != nil {
+			glog.Fatalf("error in recovering the state machine: %v", err)
+		}
+		return
+	}
+
+	// Delta snapshots are rebuilt into full snapshots when they are received
+	// (see StepBatch), so that only full snapshots are stored.
+	h, chunks, err := decodeSnapshot(snap.Data)
+	if err == nil && h.delta() {
+		err = ErrInvalidSnapshot
+	}
+	if err != nil {
+		glog.Fatalf("error in decoding the snapshot: %v", err)
+	}
+	if err := restoreSnapshot(g.stateMachine, snap.Data); err != nil {
+		glog.Fatalf("error in recovering the state machine: %v", err)
+	}
+	g.chain.restore(h, len(chunks))
+}
+
+// rebuildSnapshot replaces the delta snapshot in m with the full snapshot
+// rebuilt from the last snapshot in the storage.
+func (g *group) rebuildSnapshot(m *raftpb.Message) error {
+	if _, ok := g.stateMachine.(ChunkedStateMachine); !ok {
+		return nil
+	}
+	h, _, err := decodeSnapshot(m.Snapshot.Data)
+	if err != nil || !h.delta() {
+		return err
+	}
+	stored, err := g.raftStorage.Snapshot()
 	if err != nil {
+		return err
+	}
+	full, err := rebuildSnapshot(stored.Data, m.Snapshot.Data)
+	if err != nil {
+		return err
+	}
+	glog.V(2).Infof("%v rebuilds a snapshot at %v from delta %v..%v", g,
+		h.index, h.base, h.index)
+	m.Snapshot.Data = full
+	return nil
+}
+
+// saveState saves the state machine for a snapshot at the applied index, and
+// returns the snapshot data. For a ChunkedStateMachine, it saves only the
+// changes since the last snapshot in the storage and appends them to that
+// snapshot, unless the chain should be compacted into a new full snapshot.
+func (g *group) saveState() []byte {
+	csm, ok := g.stateMachine.(ChunkedStateMachine)
+	if !ok {
+		d, err := g.stateMachine.Save()
+		if err != nil {
+			glog.Fatalf("error in seralizing the state machine: %v", err)
+		}
+		return d
+	}
+
+	stored := g.storedChunks()
+	delta := stored != nil && !g.chain.shouldCompact()
+	var buf bytes.Buffer
+	if err := csm.SaveChunks(NewChunkWriter(&buf), delta); err != nil {
 		glog.Fatalf("error in seralizing the state machine: %v", err)
 	}
+	if !delta {
+		g.chain.reset(g.applied, buf.Len())
+		h := snapHeader{index: g.applied, baseLen: uint64(buf.Len())}
+		return encodeSnapshot(h, buf.Bytes())
+	}
+	h := g.chain.header(g.applied)
+	g.chain.append(g.applied, buf.Bytes())
+	return encodeSnapshot(h, stored, buf.Bytes())
+}
+
+// storedChunks returns the chunks of the last snapshot in the storage, if it
+// is the last snapshot of the chain. Otherwise, it returns nil.
+func (g *group) storedChunks() []byte {
+	if g.chain.empty() {
+		return nil
+	}
+	snap, err := g.raftStorage.Snapshot()
+	if err != nil || etcdraft.IsEmptySnap(snap) {
+		return nil
+	}
+	h, chunks, err := decodeSnapshot(snap.Data)
+	if err != nil || h.delta() || h.index != g.chain.last {
+		return nil
+	}
+	return chunks
+}
+
+// snapshotFor replaces the snapshot in m with a delta snapshot, if the
+// destination has already received a previous snapshot in the chain.
+func (g *group) snapshotFor(m raftpb.Message) raftpb.Message {
+	if _, ok := g.stateMachine.(ChunkedStateMachine); !ok {
+		return m
+	}
+	d, ok := g.chain.delta(m.To, m.Snapshot.Metadata.Index)
+	if !ok {
+		return m
+	}
+	glog.V(2).Infof("%v sends a delta snapshot of %d bytes instead of %d to %v",
+		g, len(d), len(m.Snapshot.Data), m.To)
+	m.Snapshot.Data = d
+	return m
+}
+
+func (g *group) snapshot() {
+	d := g.saveState()
 	g.snapped = g.applied
 
-	go func(snapi uint64) {
-		snap, err := g.raftStorage.CreateSnapshot(snapi, &g.confState, d)
-		if err != nil {
-			// the snapshot was done asynchronously with the progress of raft.
-			// raft might have already got a newer snapshot.
-			if err == etcdraft.ErrSnapOutOfDate {
-				return
-			}
-			glog.Fatalf("unexpected create snapshot error %v", err)
+	// The snapshot is created synchronously so that the next delta is appended
+	// to this snapshot.
+	snap, err := g.raftStorage.CreateSnapshot(g.snapped, &g.confState, d)
+	if err != nil {
+		// raft might have already got a newer snapshot.
+		if err == etcdraft.ErrSnapOutOfDate {
+			return
 		}
+		glog.Fatalf("unexpected create snapshot error %v", err)
+	}
 
+	go func(snapi uint64) {
 		if err := g.diskStorage.SaveSnap(snap); err != nil {
 			glog.Fatalf("save snapshot error: %v", err)
 		}
@@ -547,6 +652,7 @@ type MultiNode struct {
 	gen  *gen.SeqIDGen
 
 	groups   map[uint64]*group
+	gmu      sync.RWMutex // Guards groups for readers other than start.
 	groupc   chan groupRequest
 	recvc    chan batchTimeout
 	propc    chan multiMessage
@@ -723,6 +829,7 @@ func (n *MultiNode) handleReadies(readies map[uint64]etcdraft.Ready) {
 	beatBatch := make(nodeBatch)
 	normBatch := make(nodeBatch)
 	snapBatch := make(nodeBatch)
+	snapSent := make(map[uint64]map[uint64]sentSnap)
 
 	saved := make(chan struct{}, len(readies))
 	for gid, rd := range readies {
@@ -753,6 +860,18 @@ func (n *MultiNode) handleReadies(readies map[uint64]etcdraft.Ready) {
 			var batch *Batch
 			if !etcdraft.IsEmptySnap(m.Snapshot) {
 				batch = snapBatch.batch(m.To)
+				if g, ok := n.groups[gid]; ok {
+					m = g.snapshotFor(m)
+					sent, ok := snapSent[m.To]
+					if !ok {
+						sent = make(map[uint64]sentSnap)
+						snapSent[m.To] = sent
+					}
+					sent[gid] = sentSnap{
+						chain: &g.chain,
+						index: m.Snapshot.Metadata.Index,
+					}
+				}
 			} else {
 				batch = normBatch.batch(m.To)
 			}
@@ -791,7 +910,7 @@ func (n *MultiNode) handleReadies(readies map[uint64]etcdraft.Ready) {
 		batch.From = n.id
 		batch.To = nid
 		batch.Priority = Low
-		n.send(batch, n.node)
+		n.send(batch, snapReporter{Reporter: n.node, sent: snapSent[nid]})
 	}
 
 	select {
@@ -861,6 +980,14 @@ func (n *MultiNode) CreateGroup(ctx context.Context, cfg GroupConfig) error {
 		applierDone:  make(chan struct{}),
 		saverDone:    make(chan struct{}),
 	}
+	if _, ok := g.stateMachine.(ChunkedStateMachine); ok &&
+		!etcdraft.IsEmptySnap(snap) {
+
+		// The state machine is restored from this snapshot in OpenStorage.
+		if h, chunks, err := decodeSnapshot(snap.Data); err == nil && !h.delta() {
+			g.chain.restore(h, len(chunks))
+		}
+	}
 	ch := make(chan groupResponse, 1)
 	n.groupc <- groupRequest{
 		reqType: groupRequestCreate,
@@ -879,6 +1006,27 @@ func (n *MultiNode) CreateGroup(ctx context.Context, cfg GroupConfig) error {
 	}
 }
 
+// setGroup sets the group with the given ID. If g is nil, the group is removed.
+func (n *MultiNode) setGroup(id uint64, g *group) {
+	n.gmu.Lock()
+	defer n.gmu.Unlock()
+
+	if g == nil {
+		delete(n.groups, id)
+		return
+	}
+	n.groups[id] = g
+}
+
+// group returns the group with the given ID. Unlike accessing groups directly,
+// it is safe to call group outside of the start goroutine.
+func (n *MultiNode) group(id uint64) *group {
+	n.gmu.RLock()
+	defer n.gmu.RUnlock()
+
+	return n.groups[id]
+}
+
 func (n *MultiNode) handleGroupRequest(req groupRequest) {
 	_, ok := n.groups[req.group.id]
 	res := groupResponse{
@@ -892,13 +1040,13 @@ func (n *MultiNode) handleGroupRequest(req groupRequest) {
 			break
 		}
 
-		n.groups[req.group.id] = req.group
+		n.setGroup(req.group.id, req.group)
 		err := n.node.CreateGroup(req.group.id, req.config, req.peers)
 		if err == nil {
 			go req.group.startSaver()
 			go req.group.startApplier()
 		} else {
-			delete(n.groups, req.group.id)
+			n.setGroup(req.group.id, nil)
 		}
 
 	case groupRequestRemove:
@@ -913,8 +1061,12 @@ func (n *MultiNode) handleGroupRequest(req groupRequest) {
 			break
 		}
 
+		if err := n.node.RemoveGroup(g.id); err != nil {
+			res.err = err
+			break
+		}
 		g.stop()
-		delete(n.groups, req.group.id)
+		n.setGroup(req.group.id, nil)
 
 	case groupRequestStatus:
 		// TODO(soheil): add softstate to the response.
@@ -1147,6 +1299,33 @@ func (n *MultiNode) Exists(ctx context.Context, gid uint64) (ok bool) {
 	}
 }
 
+// RemoveGroup stops the group and removes it from the node. The state machine
+// of the group is not used after RemoveGroup returns.
+func (n *MultiNode) RemoveGroup(ctx context.Context, gid uint64) error {
+	ch := make(chan groupResponse, 1)
+	req := groupRequest{
+		reqType: groupRequestRemove,
+		group:   &group{id: gid},
+		ch:      ch,
+	}
+	select {
+	case n.groupc <- req:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-n.done:
+		return ErrStopped
+	}
+
+	select {
+	case res := <-ch:
+		return res.err
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-n.done:
+		return ErrStopped
+	}
+}
+
 // Campaign instructs the node to campign for the given group.
 func (n *MultiNode) Campaign(ctx context.Context, group uint64) error {
 	if !n.Exists(ctx, group) {
@@ -1166,18 +1345,45 @@ type batchTimeout struct {
 func (n *MultiNode) StepBatch(ctx context.Context, batch Batch,
 	timeout time.Duration) error {
 
+	err := n.rebuildSnapshots(&batch)
 	bt := batchTimeout{
 		batch:   batch,
 		timeout: timeout,
 	}
 	select {
 	case n.recvc <- bt:
-		return nil
+		return err
 	case <-ctx.Done():
 		return ctx.Err()
 	}
 }
 
+// rebuildSnapshots rebuilds full snapshots from the delta snapshots in the
+// batch. The delta snapshots that cannot be rebuilt are removed from the batch
+// and an error is returned, so that the sender reports a snapshot failure and
+// sends a full snapshot next time.
+func (n *MultiNode) rebuildSnapshots(batch *Batch) (err error) {
+	for gid, msgs := range batch.Messages {
+		g := n.group(gid)
+		if g == nil {
+			continue
+		}
+		rebuilt := msgs[:0]
+		for _, m := range msgs {
+			if m.Type == raftpb.MsgSnap {
+				if rerr := g.rebuildSnapshot(&m); rerr != nil {
+					glog.Errorf("%v drops the snapshot from %v: %v", g, m.From, rerr)
+					err = rerr
+					continue
+				}
+			}
+			rebuilt = append(rebuilt, m)
+		}
+		batch.Messages[gid] = rebuilt
+	}
+	return err
+}
+
 // Status returns the latest status of the group. Returns nil if the group
 // does not exists.
 func (n *MultiNode) Status(group uint64) *etcdraft.Status {
@@ -0,0 +1,339 @@
+package raft
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+
+	etcdraft "github.com/kandoo/beehive/Godeps/_workspace/src/github.com/coreos/etcd/raft"
+)
+
+var (
+	ErrInvalidSnapshot = errors.New("raft: invalid snapshot")
+	ErrNoSnapshotBase  = errors.New("raft: no base for the delta snapshot")
+)
+
+// ChunkedStateMachine is a StateMachine that can save its state in chunks and
+// incrementally. The snapshots of a ChunkedStateMachine are a full snapshot
+// followed by a chain of deltas. Instead of saving the whole state on every
+// snapshot, only the changes since the previous snapshot are saved and appended
+// to the chain. Followers that have received a previous snapshot of the chain
+// are sent only the deltas they are missing, and rebuild the full snapshot from
+// their last snapshot.
+type ChunkedStateMachine interface {
+	StateMachine
+
+	// SaveChunks writes the state into w. If delta is true, only the changes
+	// made since the previous call to SaveChunks or RestoreChunks should be
+	// written.
+	SaveChunks(w *ChunkWriter, delta bool) error
+	// RestoreChunks restores the state from the chunks in r. If delta is true,
+	// the chunks should be applied on the current state. Otherwise, the current
+	// state should be replaced.
+	RestoreChunks(r *ChunkReader, delta bool) error
+}
+
+// ChunkWriter writes size delimited chunks.
+type ChunkWriter struct {
+	w io.Writer
+}
+
+// NewChunkWriter creates a ChunkWriter that writes chunks into w.
+func NewChunkWriter(w io.Writer) *ChunkWriter {
+	return &ChunkWriter{w: w}
+}
+
+// WriteChunk writes chunk.
+func (w *ChunkWriter) WriteChunk(chunk []byte) error {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], uint32(len(chunk)))
+	if _, err := w.w.Write(buf[:]); err != nil {
+		return err
+	}
+	_, err := w.w.Write(chunk)
+	return err
+}
+
+// ChunkReader reads size delimited chunks.
+type ChunkReader struct {
+	r io.Reader
+}
+
+// NewChunkReader creates a ChunkReader that reads chunks from r.
+func NewChunkReader(r io.Reader) *ChunkReader {
+	return &ChunkReader{r: r}
+}
+
+// ReadChunk reads the next chunk. If there is no chunk left, it returns
+// io.EOF.
+func (r *ChunkReader) ReadChunk() ([]byte, error) {
+	var buf [4]byte
+	n, err := io.ReadFull(r.r, buf[:])
+	if err != nil {
+		if err == io.ErrUnexpectedEOF || n != 0 {
+			return nil, ErrNoEnoughData
+		}
+		return nil, err
+	}
+	b := make([]byte, binary.BigEndian.Uint32(buf[:]))
+	if _, err = io.ReadFull(r.r, b); err != nil {
+		return nil, ErrNoEnoughData
+	}
+	return b, nil
+}
+
+// snapHeaderLen is the length of a snapshot header.
+const snapHeaderLen = 32
+
+// maxSnapDeltas is the maximum number of deltas appended to a full snapshot,
+// after which the chain is compacted into a new full snapshot.
+const maxSnapDeltas = 16
+
+// snapHeader is the header of a chunked snapshot. A snapshot whose base is 0
+// is a full snapshot. Otherwise, it contains the changes from the snapshot at
+// index base up to the snapshot at index.
+//
+// The chunks of a full snapshot are the chunks of the state saved at a
+// previous snapshot, followed by the chunks of deltas. deltas is the number of
+// those deltas and baseLen is the length of the chunks before them.
+type snapHeader struct {
+	base    uint64
+	index   uint64
+	deltas  uint64
+	baseLen uint64
+}
+
+func (h snapHeader) delta() bool {
+	return h.base != 0
+}
+
+// encodeSnapshot encodes a chunked snapshot from its header and the
+// concatenation of its chunks.
+func encodeSnapshot(h snapHeader, chunks ...[]byte) []byte {
+	size := snapHeaderLen
+	for _, c := range chunks {
+		size += len(c)
+	}
+	b := make([]byte, snapHeaderLen, size)
+	binary.BigEndian.PutUint64(b[0:], h.base)
+	binary.BigEndian.PutUint64(b[8:], h.index)
+	binary.BigEndian.PutUint64(b[16:], h.deltas)
+	binary.BigEndian.PutUint64(b[24:], h.baseLen)
+	for _, c := range chunks {
+		b = append(b, c...)
+	}
+	return b
+}
+
+// decodeSnapshot decodes the header of a chunked snapshot and returns the
+// chunks.
+func decodeSnapshot(b []byte) (h snapHeader, chunks []byte, err error) {
+	if len(b) < snapHeaderLen {
+		return h, nil, ErrInvalidSnapshot
+	}
+	h.base = binary.BigEndian.Uint64(b[0:])
+	h.index = binary.BigEndian.Uint64(b[8:])
+	h.deltas = binary.BigEndian.Uint64(b[16:])
+	h.baseLen = binary.BigEndian.Uint64(b[24:])
+	chunks = b[snapHeaderLen:]
+	if (h.base >= h.index && h.delta()) || h.baseLen > uint64(len(chunks)) {
+		return h, nil, ErrInvalidSnapshot
+	}
+	return h, chunks, nil
+}
+
+// restoreSnapshot restores the state machine from the snapshot data in b.
+func restoreSnapshot(sm StateMachine, b []byte) error {
+	csm, ok := sm.(ChunkedStateMachine)
+	if !ok {
+		return sm.Restore(b)
+	}
+	h, chunks, err := decodeSnapshot(b)
+	if err != nil {
+		return err
+	}
+	return csm.RestoreChunks(NewChunkReader(bytes.NewReader(chunks)), h.delta())
+}
+
+// rebuildSnapshot rebuilds a full snapshot from the full snapshot in stored and
+// the delta snapshot in delta. Since a delta has the final values of all the
+// keys modified after its base, it can be applied on any snapshot taken between
+// its base and its index.
+func rebuildSnapshot(stored, delta []byte) ([]byte, error) {
+	dh, dchunks, err := decodeSnapshot(delta)
+	if err != nil {
+		return nil, err
+	}
+	sh, schunks, err := decodeSnapshot(stored)
+	if err != nil || sh.delta() || sh.index < dh.base || sh.index >= dh.index {
+		return nil, ErrNoSnapshotBase
+	}
+	h := snapHeader{
+		index:   dh.index,
+		deltas:  sh.deltas + 1,
+		baseLen: sh.baseLen,
+	}
+	return encodeSnapshot(h, schunks, dchunks), nil
+}
+
+// snapDelta is the delta saved for a snapshot.
+type snapDelta struct {
+	index  uint64
+	chunks []byte
+}
+
+// snapChain is the chain of snapshots of a ChunkedStateMachine: a full
+// snapshot followed by the deltas of the following snapshots. The chunks of
+// the chain are stored in the last snapshot of the raft storage, and the chain
+// keeps only the deltas it has created since from, so that they can be sent to
+// the peers that have the snapshot at from or a later one.
+type snapChain struct {
+	sync.RWMutex
+
+	last      uint64 // Index of the last snapshot.
+	baseSize  int    // Size of the chunks of the full state.
+	numDeltas int    // Number of the deltas appended to the full state.
+	deltaSize int    // Total size of the deltas appended to the full state.
+
+	from   uint64 // Index of the snapshot from which the deltas are kept.
+	deltas []snapDelta
+
+	// The last snapshot delivered to each peer.
+	delivered map[uint64]uint64
+}
+
+func (c *snapChain) empty() bool {
+	return c.last == 0
+}
+
+// reset replaces the chain with a full snapshot of the given size.
+func (c *snapChain) reset(index uint64, size int) {
+	c.restore(snapHeader{index: index, baseLen: uint64(size)}, size)
+}
+
+// restore replaces the chain with the chain of a stored snapshot whose chunks
+// are of the given size.
+func (c *snapChain) restore(h snapHeader, size int) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.last = h.index
+	c.baseSize = int(h.baseLen)
+	c.numDeltas = int(h.deltas)
+	c.deltaSize = size - c.baseSize
+	c.from = h.index
+	c.deltas = nil
+}
+
+// header returns the header of the full snapshot at index, which has the chunks
+// of the last snapshot followed by a new delta.
+func (c *snapChain) header(index uint64) snapHeader {
+	c.RLock()
+	defer c.RUnlock()
+
+	return snapHeader{
+		index:   index,
+		deltas:  uint64(c.numDeltas + 1),
+		baseLen: uint64(c.baseSize),
+	}
+}
+
+// append appends a delta to the chain.
+func (c *snapChain) append(index uint64, chunks []byte) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.last = index
+	c.deltas = append(c.deltas, snapDelta{index: index, chunks: chunks})
+	c.numDeltas++
+	c.deltaSize += len(chunks)
+}
+
+// shouldCompact returns whether the next snapshot should be a full snapshot,
+// which is when there are maxSnapDeltas deltas in the chain or when the deltas
+// are larger than the full state.
+func (c *snapChain) shouldCompact() bool {
+	c.RLock()
+	defer c.RUnlock()
+
+	return c.empty() || c.numDeltas >= maxSnapDeltas ||
+		c.deltaSize > c.baseSize
+}
+
+// delta returns a snapshot for peer at index, which contains only the deltas
+// that the peer has not received. ok is false if the peer should be sent the
+// full snapshot.
+func (c *snapChain) delta(peer, index uint64) (snap []byte, ok bool) {
+	c.RLock()
+	defer c.RUnlock()
+
+	base, ok := c.delivered[peer]
+	if !ok || c.empty() || base < c.from || base >= index {
+		return nil, false
+	}
+
+	var chunks [][]byte
+	found := base == c.from
+	for _, d := range c.deltas {
+		if d.index > index {
+			break
+		}
+		if found {
+			chunks = append(chunks, d.chunks)
+		}
+		if d.index == base {
+			found = true
+		}
+		if d.index == index {
+			if !found {
+				return nil, false
+			}
+			return encodeSnapshot(snapHeader{base: base, index: index},
+				chunks...), true
+		}
+	}
+	return nil, false
+}
+
+// reportSnapshot records the status of the snapshot sent to peer.
+func (c *snapChain) reportSnapshot(peer, index uint64,
+	status etcdraft.SnapshotStatus) {
+
+	c.Lock()
+	defer c.Unlock()
+
+	if status != etcdraft.SnapshotFinish {
+		delete(c.delivered, peer)
+		return
+	}
+	if c.delivered == nil {
+		c.delivered = make(map[uint64]uint64)
+	}
+	if c.delivered[peer] < index {
+		c.delivered[peer] = index
+	}
+}
+
+// sentSnap is a snapshot sent to a peer in a batch.
+type sentSnap struct {
+	chain *snapChain
+	index uint64
+}
+
+// snapReporter records the snapshots delivered to a peer and then reports to
+// the underlying reporter.
+type snapReporter struct {
+	Reporter
+	sent map[uint64]sentSnap // Sent snapshots keyed by group.
+}
+
+func (r snapReporter) ReportSnapshot(id, group uint64,
+	status etcdraft.SnapshotStatus) {
+
+	if s, ok := r.sent[group]; ok {
+		s.chain.reportSnapshot(id, s.index, status)
+	}
+	r.Reporter.ReportSnapshot(id, group, status)
+}
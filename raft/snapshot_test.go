@@ -0,0 +1,282 @@
+package raft
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	etcdraft "github.com/kandoo/beehive/Godeps/_workspace/src/github.com/coreos/etcd/raft"
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/coreos/etcd/raft/raftpb"
+)
+
+func TestChunkReadWrite(t *testing.T) {
+	chunks := [][]byte{{1}, {}, {2, 2}}
+	var buf bytes.Buffer
+	w := NewChunkWriter(&buf)
+	for _, c := range chunks {
+		if err := w.WriteChunk(c); err != nil {
+			t.Fatalf("cannot write chunk: %v", err)
+		}
+	}
+
+	r := NewChunkReader(&buf)
+	for _, c := range chunks {
+		rc, err := r.ReadChunk()
+		if err != nil {
+			t.Fatalf("cannot read chunk: %v", err)
+		}
+		if !bytes.Equal(rc, c) {
+			t.Errorf("invalid chunk: actual=%v want=%v", rc, c)
+		}
+	}
+	if _, err := r.ReadChunk(); err != io.EOF {
+		t.Errorf("invalid error at the end: actual=%v want=%v", err, io.EOF)
+	}
+}
+
+func TestSnapshotEncoding(t *testing.T) {
+	h := snapHeader{base: 1, index: 2, deltas: 1, baseLen: 1}
+	b := encodeSnapshot(h, []byte{1}, []byte{2, 3})
+	dh, chunks, err := decodeSnapshot(b)
+	if err != nil {
+		t.Fatalf("cannot decode snapshot: %v", err)
+	}
+	if dh != h {
+		t.Errorf("invalid header: actual=%v want=%v", dh, h)
+	}
+	if !bytes.Equal(chunks, []byte{1, 2, 3}) {
+		t.Errorf("invalid chunks: actual=%v", chunks)
+	}
+
+	if _, _, err := decodeSnapshot(b[:3]); err != ErrInvalidSnapshot {
+		t.Errorf("short snapshot is decoded: %v", err)
+	}
+}
+
+func TestSnapChainDelta(t *testing.T) {
+	var c snapChain
+	c.reset(10, 1)
+	c.append(20, []byte{20})
+	c.append(30, []byte{30})
+
+	if _, ok := c.delta(1, 30); ok {
+		t.Error("delta for a peer without any snapshot")
+	}
+
+	c.reportSnapshot(1, 10, etcdraft.SnapshotFinish)
+	d, ok := c.delta(1, 30)
+	if !ok {
+		t.Fatal("no delta for the peer")
+	}
+	h, chunks, _ := decodeSnapshot(d)
+	if h.base != 10 || h.index != 30 || !bytes.Equal(chunks, []byte{20, 30}) {
+		t.Errorf("invalid delta: header=%v chunks=%v", h, chunks)
+	}
+
+	c.reportSnapshot(1, 20, etcdraft.SnapshotFinish)
+	d, _ = c.delta(1, 30)
+	if _, chunks, _ = decodeSnapshot(d); !bytes.Equal(chunks, []byte{30}) {
+		t.Errorf("invalid delta: %v", chunks)
+	}
+
+	c.reportSnapshot(1, 30, etcdraft.SnapshotFailure)
+	if _, ok := c.delta(1, 30); ok {
+		t.Error("delta for a peer whose last snapshot failed")
+	}
+
+	c.reportSnapshot(2, 20, etcdraft.SnapshotFinish)
+	c.reset(40, 1)
+	if _, ok := c.delta(2, 40); ok {
+		t.Error("delta from a snapshot that is not in the chain")
+	}
+}
+
+func TestRebuildSnapshot(t *testing.T) {
+	stored := encodeSnapshot(snapHeader{index: 20}, []byte{10, 20})
+	delta := encodeSnapshot(snapHeader{base: 10, index: 30}, []byte{30})
+	full, err := rebuildSnapshot(stored, delta)
+	if err != nil {
+		t.Fatalf("cannot rebuild the snapshot: %v", err)
+	}
+	h, chunks, _ := decodeSnapshot(full)
+	if h.delta() || h.index != 30 || !bytes.Equal(chunks, []byte{10, 20, 30}) {
+		t.Errorf("invalid snapshot: header=%v chunks=%v", h, chunks)
+	}
+
+	delta = encodeSnapshot(snapHeader{base: 25, index: 30}, []byte{30})
+	if _, err := rebuildSnapshot(stored, delta); err != ErrNoSnapshotBase {
+		t.Errorf("delta is rebuilt on an older snapshot: %v", err)
+	}
+	if _, err := rebuildSnapshot(nil, delta); err != ErrNoSnapshotBase {
+		t.Errorf("delta is rebuilt without a snapshot: %v", err)
+	}
+}
+
+// kvStateMachine is a ChunkedStateMachine that stores each key and its value
+// in a chunk.
+type kvStateMachine struct {
+	kvs     map[string]string
+	changed map[string]bool
+}
+
+func newKVStateMachine() *kvStateMachine {
+	return &kvStateMachine{
+		kvs:     make(map[string]string),
+		changed: make(map[string]bool),
+	}
+}
+
+func (s *kvStateMachine) set(k, v string) {
+	s.kvs[k] = v
+	s.changed[k] = true
+}
+
+func (s *kvStateMachine) SaveChunks(w *ChunkWriter, delta bool) error {
+	for k, v := range s.kvs {
+		if delta && !s.changed[k] {
+			continue
+		}
+		if err := w.WriteChunk([]byte(k + "=" + v)); err != nil {
+			return err
+		}
+	}
+	s.changed = make(map[string]bool)
+	return nil
+}
+
+func (s *kvStateMachine) RestoreChunks(r *ChunkReader, delta bool) error {
+	if !delta {
+		s.kvs = make(map[string]string)
+	}
+	s.changed = make(map[string]bool)
+	for {
+		c, err := r.ReadChunk()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		kv := strings.SplitN(string(c), "=", 2)
+		s.kvs[kv[0]] = kv[1]
+	}
+}
+
+func (s *kvStateMachine) Save() ([]byte, error)                              { return nil, nil }
+func (s *kvStateMachine) Restore(b []byte) error                             { return nil }
+func (s *kvStateMachine) Apply(req interface{}) (interface{}, error)         { return nil, nil }
+func (s *kvStateMachine) ApplyConfChange(raftpb.ConfChange, GroupNode) error { return nil }
+func (s *kvStateMachine) ProcessStatusChange(event interface{})              {}
+
+func newGroupForTest(sm StateMachine) *group {
+	return &group{
+		stateMachine: sm,
+		raftStorage:  etcdraft.NewMemoryStorage(),
+	}
+}
+
+func createSnapshot(t *testing.T, g *group, index uint64) raftpb.Snapshot {
+	g.applied = index
+	snap := raftpb.Snapshot{
+		Data:     g.saveState(),
+		Metadata: raftpb.SnapshotMetadata{Index: index, Term: 1},
+	}
+	if err := g.raftStorage.ApplySnapshot(snap); err != nil {
+		t.Fatalf("cannot store the snapshot: %v", err)
+	}
+	return snap
+}
+
+func TestDeltaSnapshotIsRebuilt(t *testing.T) {
+	lsm := newKVStateMachine()
+	leader := newGroupForTest(lsm)
+	fsm := newKVStateMachine()
+	follower := newGroupForTest(fsm)
+
+	lsm.set("a", "1")
+	lsm.set("b", "1")
+	snap := createSnapshot(t, leader, 10)
+	follower.raftStorage.ApplySnapshot(snap)
+	follower.restore(snap)
+	leader.chain.reportSnapshot(2, 10, etcdraft.SnapshotFinish)
+
+	lsm.set("b", "2")
+	snap = createSnapshot(t, leader, 20)
+	if h, _, _ := decodeSnapshot(snap.Data); h.delta() {
+		t.Fatalf("stored snapshot is a delta: %v", h)
+	}
+	m := leader.snapshotFor(raftpb.Message{
+		Type:     raftpb.MsgSnap,
+		To:       2,
+		Snapshot: snap,
+	})
+	if h, _, _ := decodeSnapshot(m.Snapshot.Data); h.base != 10 {
+		t.Fatalf("leader does not send a delta: %v", h)
+	}
+
+	if err := newGroupForTest(newKVStateMachine()).rebuildSnapshot(&m); err == nil {
+		t.Error("delta is rebuilt without a base snapshot")
+	}
+	if err := follower.rebuildSnapshot(&m); err != nil {
+		t.Fatalf("cannot rebuild the snapshot: %v", err)
+	}
+	follower.restore(m.Snapshot)
+	want := map[string]string{"a": "1", "b": "2"}
+	if !reflect.DeepEqual(fsm.kvs, want) {
+		t.Errorf("invalid state on the follower: actual=%v want=%v", fsm.kvs, want)
+	}
+}
+
+func TestSnapshotSizeIsBounded(t *testing.T) {
+	lsm := newKVStateMachine()
+	leader := newGroupForTest(lsm)
+	fsm := newKVStateMachine()
+	follower := newGroupForTest(fsm)
+
+	for i := 0; i < 10; i++ {
+		lsm.set(string(rune('a'+i)), "0")
+	}
+	snap := createSnapshot(t, leader, 1)
+	follower.raftStorage.ApplySnapshot(snap)
+	follower.restore(snap)
+	leader.chain.reportSnapshot(2, 1, etcdraft.SnapshotFinish)
+	max := 2*len(snap.Data) + snapHeaderLen
+
+	for i := uint64(2); i < 100; i++ {
+		lsm.set("a", strings.Repeat("1", int(i%3)))
+		snap = createSnapshot(t, leader, i)
+		h, _, _ := decodeSnapshot(snap.Data)
+		if h.deltas > maxSnapDeltas || len(snap.Data) > max {
+			t.Fatalf("snapshot %v is not compacted: deltas=%v size=%v", i, h.deltas,
+				len(snap.Data))
+		}
+
+		m := leader.snapshotFor(raftpb.Message{
+			Type:     raftpb.MsgSnap,
+			To:       2,
+			Snapshot: snap,
+		})
+		if err := follower.rebuildSnapshot(&m); err != nil {
+			t.Fatalf("cannot rebuild snapshot %v: %v", i, err)
+		}
+		if len(m.Snapshot.Data) > max {
+			t.Fatalf("rebuilt snapshot %v is not compacted: size=%v", i,
+				len(m.Snapshot.Data))
+		}
+		follower.raftStorage.ApplySnapshot(m.Snapshot)
+		follower.restore(m.Snapshot)
+		leader.chain.reportSnapshot(2, i, etcdraft.SnapshotFinish)
+
+		// The follower compacts its chain when it saves its own snapshot.
+		follower.applied = i
+		if d := follower.saveState(); len(d) > max {
+			t.Fatalf("follower snapshot %v is not compacted: size=%v", i, len(d))
+		}
+		if !reflect.DeepEqual(fsm.kvs, lsm.kvs) {
+			t.Fatalf("invalid state on the follower: actual=%v want=%v", fsm.kvs,
+				lsm.kvs)
+		}
+	}
+}
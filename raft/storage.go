@@ -97,7 +97,7 @@ func OpenStorage(node uint64, dir string, stateMachine StateMachine) (
 	}
 
 	if ss != nil {
-		if err = stateMachine.Restore(ss.Data); err != nil {
+		if err = restoreSnapshot(stateMachine, ss.Data); err != nil {
 			err = fmt.Errorf("raft: cannot restore statemachine from snapshot: %v",
 				err)
 			return
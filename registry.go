@@ -84,6 +84,14 @@ type transferCells struct {
 	To   Colony
 }
 
+// splitCells moves a subset of the cells of a colony to another colony.
+type splitCells struct {
+	App   string
+	From  Colony
+	To    Colony
+	Cells MappedCells
+}
+
 // batchReq is a batch of registery requests that should be processed in a
 // seqeunce. The response to batch requests is batchRes.
 //
@@ -169,6 +177,10 @@ func (r *registry) doApply(req interface{}) (interface{}, error) {
 		return r.lockCell(req)
 	case transferCells:
 		return nil, r.transfer(req)
+	case splitCells:
+		return nil, r.split(req)
+	case updateHiveLabels:
+		return nil, r.updateLabels(req)
 	case batchReq:
 		return r.handleBatch(req), nil
 	}
@@ -371,31 +383,20 @@ func (r *registry) lockCell(l lockMappedCell) (Colony, error) {
 	for _, k := range l.Cells {
 		c, ok := r.Store.colony(l.App, k)
 		if !ok {
-			if locked {
-				r.Store.assign(l.App, k, l.Colony)
-			} else {
-				openk = append(openk, k)
-			}
+			openk = append(openk, k)
 			continue
 		}
 
 		if locked && !c.Equals(l.Colony) {
-			// FIXME(soheil): Fix this bug after refactoring the code.
-			glog.Fatal("TODO registery conflict between colonies")
+			// The colonies should be merged before locking these cells.
+			return Colony{}, ErrColonyConflict
 		}
 
 		locked = true
 		l.Colony = c
 	}
 
-	if locked {
-		for _, k := range openk {
-			r.Store.assign(l.App, k, l.Colony)
-		}
-		return l.Colony, nil
-	}
-
-	for _, k := range l.Cells {
+	for _, k := range openk {
 		r.Store.assign(l.App, k, l.Colony)
 	}
 	return l.Colony, nil
@@ -413,6 +414,24 @@ func (r *registry) transfer(t transferCells) error {
 	for _, k := range keys {
 		r.Store.assign(i.App, k, t.To)
 	}
+	delete(r.Store.BeeCells, t.From.Leader)
+	return nil
+}
+
+func (r *registry) split(s splitCells) error {
+	if len(s.Cells) == 0 {
+		return ErrInvalidParam
+	}
+	for _, k := range s.Cells {
+		c, ok := r.Store.colony(s.App, k)
+		if !ok || c.Leader != s.From.Leader {
+			return ErrInvalidParam
+		}
+	}
+	for _, k := range s.Cells {
+		r.Store.unassignBeeCell(s.From.Leader, k)
+		r.Store.assign(s.App, k, s.To)
+	}
 	return nil
 }
 
@@ -468,6 +487,13 @@ func (r *registry) bee(id uint64) (BeeInfo, error) {
 	return i, nil
 }
 
+// beeCells returns the cells of the colony led by the bee.
+func (r *registry) beeCells(id uint64) MappedCells {
+	r.m.RLock()
+	defer r.m.RUnlock()
+	return r.Store.cells(id)
+}
+
 func (r *registry) beeAndHive(id uint64) (BeeInfo, HiveInfo, error) {
 	r.m.RLock()
 	defer r.m.RUnlock()
@@ -558,6 +584,7 @@ func init() {
 	gob.Register(cellStore{})
 	gob.Register(delBee(0))
 	gob.Register(lockMappedCell{})
+	gob.Register(splitCells{})
 	gob.Register(newHiveID{})
 	gob.Register(noOp{})
 	gob.Register(transferCells{})
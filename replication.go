@@ -3,16 +3,20 @@ package beehive
 import "math/rand"
 
 type replicationStrategy interface {
-	// SelectHives selects n hives that are not blacklisted. If not possible, it
-	// returns an empty slice.
-	selectHives(blackList []uint64, n int) []uint64
+	// SelectHives selects n hives that satisfy the constraints and neither hold
+	// a replica nor are blacklisted. The replicas are spread across the hives
+	// with values of the spread label not used by the hives in replicas. If not
+	// possible, it returns an empty slice.
+	selectHives(c constraints, replicas, blacklist []uint64, n int) []uint64
 }
 
 type rndRepliction struct {
 	hive *hive
 }
 
-func (r *rndRepliction) selectHives(blacklist []uint64, n int) []uint64 {
+func (r *rndRepliction) selectHives(c constraints, replicas,
+	blacklist []uint64, n int) []uint64 {
+
 	if n <= 0 {
 		return nil
 	}
@@ -21,14 +25,26 @@ func (r *rndRepliction) selectHives(blacklist []uint64, n int) []uint64 {
 	for _, h := range blacklist {
 		blmap[h] = h
 	}
+	rmap := make(map[uint64]bool)
+	for _, h := range replicas {
+		rmap[h] = true
+	}
 
+	// Values of the spread label that are already used by the replicas.
+	used := make(map[string]bool)
 	lives := r.hive.registry.hives()
-	whitelist := make([]uint64, 0, len(lives))
+	whitelist := make([]HiveInfo, 0, len(lives))
 	for _, h := range lives {
-		if h.ID == r.hive.ID() || blmap[h.ID] != 0 {
+		if rmap[h.ID] {
+			if c.spread != "" {
+				used[h.Labels[c.spread]] = true
+			}
+			continue
+		}
+		if blmap[h.ID] != 0 || !c.allows(h) {
 			continue
 		}
-		whitelist = append(whitelist, h.ID)
+		whitelist = append(whitelist, h)
 	}
 
 	if len(whitelist) < n {
@@ -40,8 +56,29 @@ func (r *rndRepliction) selectHives(blacklist []uint64, n int) []uint64 {
 	}
 
 	rndHives := make([]uint64, 0, n)
-	for _, i := range rand.Perm(n) {
-		rndHives = append(rndHives, whitelist[i])
+	selected := make(map[uint64]bool, n)
+	perm := rand.Perm(len(whitelist))
+	if c.spread != "" {
+		// Prefer the hives with a value not used by other replicas.
+		for _, i := range perm {
+			if len(rndHives) == n {
+				break
+			}
+			h := whitelist[i]
+			if v := h.Labels[c.spread]; !used[v] {
+				used[v] = true
+				selected[h.ID] = true
+				rndHives = append(rndHives, h.ID)
+			}
+		}
+	}
+	for _, i := range perm {
+		if len(rndHives) == n {
+			break
+		}
+		if h := whitelist[i]; !selected[h.ID] {
+			rndHives = append(rndHives, h.ID)
+		}
 	}
 	return rndHives
 }
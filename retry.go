@@ -0,0 +1,100 @@
+package beehive
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
+)
+
+// RetryPolicy specifies how the bees of an application retry the messages
+// whose rcv function fails. A failed message is snoozed with an exponential
+// backoff and is then received again, until it succeeds or the maximum number
+// of attempts is reached.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts, including the first one.
+	MaxAttempts int
+	// Backoff is the delay before the first retry.
+	Backoff time.Duration
+	// MaxBackoff is the maximum delay between two attempts. 0 means no limit.
+	MaxBackoff time.Duration
+	// Multiplier is the factor by which the backoff is multiplied after each
+	// attempt. Values smaller than 1 are treated as 2.
+	Multiplier float64
+	// Jitter is the maximum fraction of the backoff that is randomly added to
+	// the backoff, in [0, 1].
+	Jitter float64
+	// Retryable returns whether the message should be retried for err. If nil,
+	// all errors are retryable.
+	Retryable func(err error) bool
+}
+
+// Retry is an application option that sets the retry policy of the
+// application. The state changes and the messages of a failed attempt are
+// aborted before the retry, and the attempt number is available through
+// RcvContext.Attempt. This option also makes the application transactional.
+func Retry(p RetryPolicy) AppOption {
+	return func(a *app) {
+		a.flags |= appFlagTransactional
+		a.retry = &p
+	}
+}
+
+// shouldRetry returns whether a message that has failed in attempt with err
+// should be retried.
+func (p *RetryPolicy) shouldRetry(attempt int, err error) bool {
+	if attempt >= p.MaxAttempts {
+		return false
+	}
+	return p.Retryable == nil || p.Retryable(err)
+}
+
+// backoff returns the delay after the given failed attempt.
+func (p *RetryPolicy) backoff(attempt int) time.Duration {
+	m := p.Multiplier
+	if m < 1 {
+		m = 2
+	}
+	d := float64(p.Backoff)
+	for i := 1; i < attempt; i++ {
+		d *= m
+		if p.MaxBackoff > 0 && d >= float64(p.MaxBackoff) {
+			break
+		}
+	}
+	if p.MaxBackoff > 0 && d > float64(p.MaxBackoff) {
+		d = float64(p.MaxBackoff)
+	}
+	if p.Jitter > 0 {
+		d += d * p.Jitter * rand.Float64()
+	}
+	return time.Duration(d)
+}
+
+// retry schedules mh to be received again, if the retry policy of the app
+// allows. It returns false if the message is not retried.
+func (b *bee) retry(mh msgAndHandler, r interface{}) bool {
+	p := b.app.retry
+	if p == nil {
+		return false
+	}
+
+	err, ok := r.(error)
+	if !ok {
+		err = fmt.Errorf("%v", r)
+	}
+
+	attempt := mh.attempt + 1
+	if !p.shouldRetry(attempt, err) {
+		return false
+	}
+
+	b.abortTx()
+	d := p.backoff(attempt)
+	glog.V(2).Infof("%v retries %v in %v (attempt %v): %v", b, mh.msg, d,
+		attempt, err)
+	mh.attempt = attempt
+	b.snooze(mh, d)
+	return true
+}
@@ -0,0 +1,90 @@
+package beehive
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	p := RetryPolicy{
+		MaxAttempts: 5,
+		Backoff:     10 * time.Millisecond,
+		MaxBackoff:  30 * time.Millisecond,
+	}
+	want := []time.Duration{10, 20, 30, 30}
+	for i, w := range want {
+		if d := p.backoff(i + 1); d != w*time.Millisecond {
+			t.Errorf("invalid backoff for attempt %v: actual=%v want=%v", i+1, d,
+				w*time.Millisecond)
+		}
+	}
+
+	p.Jitter = 0.5
+	for i := 0; i < 10; i++ {
+		d := p.backoff(1)
+		if d < 10*time.Millisecond || d > 15*time.Millisecond {
+			t.Errorf("invalid backoff with jitter: %v", d)
+		}
+	}
+
+	if p.shouldRetry(5, errors.New("error")) {
+		t.Error("retries after the maximum number of attempts")
+	}
+	p.Retryable = func(err error) bool { return false }
+	if p.shouldRetry(1, errors.New("error")) {
+		t.Error("retries an error that is not retryable")
+	}
+}
+
+func TestRetry(t *testing.T) {
+	h := newHiveForTest()
+	errPermanent := errors.New("permanent")
+	app := h.NewApp("retry", Retry(RetryPolicy{
+		MaxAttempts: 3,
+		Backoff:     time.Millisecond,
+		Retryable:   func(err error) bool { return err != errPermanent },
+	}))
+	mf := func(msg Msg, ctx MapContext) MappedCells {
+		return MappedCells{{"D", "0"}}
+	}
+	ch := make(chan int, 10)
+	rf := func(msg Msg, ctx RcvContext) error {
+		ch <- ctx.Attempt()
+		ctx.Dict("D").Put("k", ctx.Attempt())
+		switch msg.Data().(AppTestMsg) {
+		case 0:
+			return errors.New("transient")
+		case 1:
+			return errPermanent
+		}
+		return nil
+	}
+	app.HandleFunc(AppTestMsg(0), mf, rf)
+
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	h.Emit(AppTestMsg(0))
+	for i := 1; i <= 3; i++ {
+		if a := <-ch; a != i {
+			t.Errorf("invalid attempt: actual=%v want=%v", a, i)
+		}
+	}
+
+	h.Emit(AppTestMsg(1))
+	if a := <-ch; a != 1 {
+		t.Errorf("invalid attempt: actual=%v want=1", a)
+	}
+
+	h.Emit(AppTestMsg(2))
+	if a := <-ch; a != 1 {
+		t.Errorf("invalid attempt: actual=%v want=1", a)
+	}
+	select {
+	case a := <-ch:
+		t.Errorf("unexpected attempt %v", a)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
@@ -129,7 +129,7 @@ func (p *rpcClientPool) sendMsg(msgs []msg) (err error) {
 			continue
 		}
 
-		if berr = client.sendMsg(bmsgs); p.shouldReset(berr) {
+		if _, berr = client.sendMsg(bmsgs); p.shouldReset(berr) {
 			p.resetBeeClient(b, client)
 			err = berr
 		}
@@ -321,10 +321,51 @@ func newRPCClient(addr string) (client *rpcClient, err error) {
 	return client, nil
 }
 
-func (c *rpcClient) sendMsg(msgs []msg) error {
-	var f struct{}
+// sendMsg sends msgs to the remote hive, and returns the messages that are not
+// sent along with the error. The messages rejected by the remote hive because
+// it is overloaded are returned with ErrOverloaded.
+func (c *rpcClient) sendMsg(msgs []msg) (unsent []msg, err error) {
 	glog.V(3).Infof("%v sends %v messages", c, len(msgs))
-	return c.msg.Call("rpcServer.EnqueMsg", msgs, &f)
+	// High priority messages are sent over the priority connection, so that they
+	// are not blocked by the messages of lower priorities.
+	msgs = prioritizedMsgs(msgs)
+	h := 0
+	for h < len(msgs) && msgs[h].MsgPriority >= HighPriority {
+		h++
+	}
+	if h != 0 {
+		unsent, err = enqueRemoteMsg(c.prio, msgs[:h])
+		if err != nil && !isOverloadedError(err) {
+			return append(unsent, msgs[h:]...), err
+		}
+		msgs = msgs[h:]
+	}
+	if len(msgs) == 0 {
+		return unsent, err
+	}
+	rest, merr := enqueRemoteMsg(c.msg, msgs)
+	if merr != nil {
+		err = merr
+	}
+	return append(unsent, rest...), err
+}
+
+// enqueRemoteMsg enqueues msgs on the remote hive of client. It returns the
+// messages that are not sent, or ErrOverloaded and the messages rejected by the
+// remote hive.
+func enqueRemoteMsg(client *rpc.Client, msgs []msg) (unsent []msg, err error) {
+	var rejected []int
+	if err = client.Call("rpcServer.EnqueMsg", msgs, &rejected); err != nil {
+		return msgs, err
+	}
+	if len(rejected) == 0 {
+		return nil, nil
+	}
+	unsent = make([]msg, 0, len(rejected))
+	for _, i := range rejected {
+		unsent = append(unsent, msgs[i])
+	}
+	return unsent, ErrOverloaded
 }
 
 func (c *rpcClient) sendCmd(cm cmd) (res interface{}, err error) {
@@ -502,9 +543,21 @@ func (s *rpcServer) ProcessRaft(batch raft.Batch, dummy *bool) (err error) {
 	return
 }
 
-func (s *rpcServer) EnqueMsg(msgs []msg, dummy *struct{}) error {
+// EnqueMsg enqueues the messages that are admitted by the receiving
+// applications, and sets rejected to the indices of the messages rejected with
+// ErrOverloaded. EnqueMsg never blocks on an overloaded application, since that
+// would block the sending hive: the messages are rejected instead, and the
+// sending hive retries them if the application blocks when overloaded.
+func (s *rpcServer) EnqueMsg(msgs []msg, rejected *[]int) error {
 	for i := range msgs {
-		s.h.enqueMsg(&msgs[i])
+		switch err := s.h.admit(&msgs[i], nil, false); err {
+		case nil:
+			s.h.enqueMsg(&msgs[i])
+		case ErrOverloaded:
+			*rejected = append(*rejected, i)
+		default:
+			glog.V(2).Infof("%v drops message %v: %v", s.h, &msgs[i], err)
+		}
 	}
 	return nil
 }
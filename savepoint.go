@@ -0,0 +1,90 @@
+package beehive
+
+import "github.com/kandoo/beehive/state"
+
+// beeSavepoint is the bee-side counterpart of a savepoint in the state of the
+// bee. It keeps the number of messages buffered before the savepoint.
+type beeSavepoint struct {
+	name   string
+	nested bool // Whether the savepoint is created by a nested BeginTx.
+	msgs   int  // Number of buffered messages at the savepoint.
+}
+
+func (b *bee) Savepoint(name string) error {
+	dicts, msgs := b.currentState()
+	if err := dicts.Savepoint(name); err != nil {
+		return err
+	}
+	b.savepoints = append(b.savepoints, beeSavepoint{
+		name: name,
+		msgs: len(*msgs),
+	})
+	return nil
+}
+
+func (b *bee) RollbackTo(name string) error {
+	dicts, msgs := b.currentState()
+	if err := dicts.RollbackTo(name); err != nil {
+		return err
+	}
+	for i := len(b.savepoints) - 1; i >= 0; i-- {
+		if sp := b.savepoints[i]; !sp.nested && sp.name == name {
+			b.truncateMsgs(msgs, sp.msgs)
+			b.savepoints = b.savepoints[:i+1]
+			break
+		}
+	}
+	return nil
+}
+
+func (b *bee) ReleaseSavepoint(name string) error {
+	dicts, _ := b.currentState()
+	if err := dicts.ReleaseSavepoint(name); err != nil {
+		return err
+	}
+	for i := len(b.savepoints) - 1; i >= 0; i-- {
+		if sp := b.savepoints[i]; !sp.nested && sp.name == name {
+			b.savepoints = b.savepoints[:i]
+			break
+		}
+	}
+	return nil
+}
+
+// lastNested returns the index of the savepoint of the innermost nested
+// transaction, or -1 if there is no nested transaction.
+func (b *bee) lastNested() int {
+	for i := len(b.savepoints) - 1; i >= 0; i-- {
+		if b.savepoints[i].nested {
+			return i
+		}
+	}
+	return -1
+}
+
+// releaseNested merges all the open nested transactions into the outermost
+// transaction.
+func (b *bee) releaseNested() {
+	dicts, _ := b.currentState()
+	for i := b.lastNested(); i >= 0; i = b.lastNested() {
+		dicts.CommitTx()
+		b.savepoints = b.savepoints[:i]
+	}
+}
+
+// abortTx aborts the open transaction along with all its nested transactions.
+func (b *bee) abortTx() {
+	dicts, msgs := b.currentState()
+	if dicts.TxStatus() != state.TxOpen {
+		return
+	}
+	b.resetTx(dicts, msgs)
+}
+
+// truncateMsgs drops the messages buffered after the first n messages.
+func (b *bee) truncateMsgs(msgs *[]*msg, n int) {
+	for i := n; i < len(*msgs); i++ {
+		(*msgs)[i] = nil
+	}
+	*msgs = (*msgs)[:n]
+}
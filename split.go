@@ -0,0 +1,335 @@
+package beehive
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
+	"github.com/kandoo/beehive/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/kandoo/beehive/state"
+)
+
+// split moves cells of a local bee to a new local bee, and returns the ID of
+// the new bee. If cells is empty, about half of the cells of the bee are moved,
+// without separating the cells that are recently mapped together. The messages
+// already queued on the bee for the moved cells are relayed to the new bee.
+func (q *qee) split(bid uint64, cells MappedCells) (newb uint64, err error) {
+	b, ok := q.beeByID(bid)
+	if !ok {
+		return Nil, fmt.Errorf("%v cannot find %v", q, bid)
+	}
+
+	if b.detached || b.proxy {
+		return Nil, fmt.Errorf("%v cannot split nonlocal bee %v", q, bid)
+	}
+
+	owned := b.mappedCells()
+	if len(cells) == 0 {
+		cells = splitGroups(b.coaccessGroups(owned))
+	}
+
+	if len(cells) == 0 || len(cells) >= len(owned) {
+		return Nil, fmt.Errorf("%v cannot split %v cells of %v with %v cells", q,
+			len(cells), b, len(owned))
+	}
+
+	local := make(map[CellKey]bool, len(owned))
+	for _, c := range owned {
+		local[c] = true
+	}
+	for _, c := range cells {
+		if !local[c] {
+			return Nil, fmt.Errorf("%v does not own cell %v", b, c)
+		}
+	}
+
+	glog.V(2).Infof("%v splits %v cells of %v", q, len(cells), b)
+	nb, err := q.newLocalBee(true)
+	if err != nil {
+		return Nil, err
+	}
+
+	if _, err = q.sendCmdToBee(bid, cmdSplitCells{To: nb.colony(),
+		Cells: cells}); err != nil {
+
+		if rerr := q.removeBee(nb.ID()); rerr != nil {
+			glog.Errorf("%v cannot remove %v: %v", q, nb, rerr)
+		}
+		return Nil, err
+	}
+	go q.pruneMoved(bid, cells, nb.ID())
+	return nb.ID(), nil
+}
+
+// pruneMoved makes the bee forget the cells it has moved to another bee, once
+// it has relayed the messages of those cells. That is when the bee is drained
+// on all the hives, since the registries route no new message of the cells to
+// the bee afterwards.
+func (q *qee) pruneMoved(bid uint64, cells MappedCells, to uint64) {
+	if err := q.drainBeeOnHives(bid, q.hive.ID()); err != nil {
+		glog.Errorf("%v cannot drain %v: %v", q, bid, err)
+		return
+	}
+	if _, err := q.sendCmdToBee(bid, cmdForgetMoved{Cells: cells,
+		To: to}); err != nil {
+
+		glog.Errorf("%v cannot prune the moved cells of %v: %v", q, bid, err)
+	}
+}
+
+// splitGroups returns the cells of the groups that should be moved to split
+// the groups in two halves. It returns nil if there are less than two groups.
+func splitGroups(groups []MappedCells) MappedCells {
+	n := 0
+	for _, g := range groups {
+		sort.Sort(g)
+		n += len(g)
+	}
+	sort.Sort(byFirstCell(groups))
+
+	var cells MappedCells
+	for i := len(groups) - 1; i > 0 && len(cells) < n/2; i-- {
+		cells = append(cells, groups[i]...)
+	}
+	return cells
+}
+
+type byFirstCell []MappedCells
+
+func (g byFirstCell) Len() int      { return len(g) }
+func (g byFirstCell) Swap(i, j int) { g[i], g[j] = g[j], g[i] }
+func (g byFirstCell) Less(i, j int) bool {
+	return MappedCells{g[i][0], g[j][0]}.Less(0, 1)
+}
+
+// coaccess is a disjoint-set forest of the cells that are mapped together.
+// Each cell points to another cell in its set, and the root of a set points to
+// itself.
+type coaccess map[CellKey]CellKey
+
+// find returns the root of the set of k.
+func (c coaccess) find(k CellKey) CellKey {
+	for {
+		p, ok := c[k]
+		if !ok || p == k {
+			return k
+		}
+		// Shorten the path for the next lookups.
+		if gp, ok := c[p]; ok {
+			c[k] = gp
+		}
+		k = p
+	}
+}
+
+// union puts the cells in the same set.
+func (c coaccess) union(cells MappedCells) {
+	r := c.find(cells[0])
+	c[r] = r
+	for _, k := range cells[1:] {
+		if kr := c.find(k); kr != r {
+			c[kr] = r
+		}
+	}
+}
+
+// recordCoaccess records the cells that are mapped together in the messages.
+func (b *bee) recordCoaccess(mhs []msgAndHandler) {
+	b.Lock()
+	defer b.Unlock()
+
+	if now := time.Now(); now.Sub(b.coaccessSince) > splitCooldown {
+		b.coaccess[1], b.coaccess[0] = b.coaccess[0], nil
+		b.coaccessSince = now
+	}
+	for _, mh := range mhs {
+		if len(mh.cells) < 2 {
+			continue
+		}
+		if b.coaccess[0] == nil {
+			b.coaccess[0] = make(coaccess)
+		}
+		b.coaccess[0].union(mh.cells)
+	}
+}
+
+// coaccessGroups groups the cells that are mapped together in the last two
+// splitCooldown periods. A cell that is not mapped with other cells is in a
+// group of its own.
+func (b *bee) coaccessGroups(cells MappedCells) []MappedCells {
+	b.Lock()
+	defer b.Unlock()
+
+	all := make(coaccess)
+	for _, c := range b.coaccess {
+		for k := range c {
+			all.union(MappedCells{k, c.find(k)})
+		}
+	}
+
+	roots := make(map[CellKey]int)
+	var groups []MappedCells
+	for _, k := range cells {
+		r := all.find(k)
+		i, ok := roots[r]
+		if !ok {
+			i = len(groups)
+			roots[r] = i
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], k)
+	}
+	return groups
+}
+
+// splitInto moves the given cells and their dictionary entries to the leader of
+// the given colony. The entries are deleted from the bee before the cells are
+// moved in the registry in one request, and are put back if the registry
+// cannot be updated. Either way, the entries are owned by one bee.
+func (b *bee) splitInto(to Colony, cells MappedCells) error {
+	ms := cmdMergeState{Cells: cells}
+	chunks := make(map[string]int)
+	for _, c := range cells {
+		v, err := b.Dict(c.Dict).Get(c.Key)
+		if err != nil {
+			continue
+		}
+		i, ok := chunks[c.Dict]
+		if !ok {
+			i = len(ms.Chunks)
+			chunks[c.Dict] = i
+			ms.Chunks = append(ms.Chunks, state.Chunk{Dict: c.Dict})
+		}
+		ms.Chunks[i].Entries = append(ms.Chunks[i].Entries,
+			state.ChunkEntry{Key: c.Key, Val: v})
+	}
+	if _, err := b.qee.sendCmdToBee(to.Leader, ms); err != nil {
+		return err
+	}
+
+	if err := b.BeginTx(); err != nil {
+		return err
+	}
+	for _, c := range ms.Chunks {
+		for _, e := range c.Entries {
+			b.Dict(c.Dict).Del(e.Key)
+		}
+	}
+	if err := b.CommitTx(); err != nil {
+		return err
+	}
+
+	ctx, cnl := context.WithTimeout(context.Background(),
+		10*b.hive.config.RaftElectTimeout())
+	defer cnl()
+	s := splitCells{
+		App:   b.app.Name(),
+		From:  b.colony(),
+		To:    to,
+		Cells: cells,
+	}
+	if _, err := b.hive.proposeAmongHives(ctx, s); err != nil {
+		if merr := b.mergeState(ms); merr != nil {
+			glog.Errorf("%v cannot restore the entries of %v: %v", b, cells, merr)
+		}
+		return err
+	}
+	b.removeMappedCells(cells)
+	b.markMoved(cells, to.Leader)
+	return nil
+}
+
+// forgetMoved forgets the cells moved to the given bee.
+func (b *bee) forgetMoved(cells MappedCells, to uint64) {
+	b.Lock()
+	defer b.Unlock()
+
+	for _, c := range cells {
+		if b.moved[c] == to {
+			delete(b.moved, c)
+		}
+	}
+}
+
+// markMoved records that the cells are moved to the given bee.
+func (b *bee) markMoved(cells MappedCells, to uint64) {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.moved == nil {
+		b.moved = make(map[CellKey]uint64)
+	}
+	for _, c := range cells {
+		b.moved[c] = to
+	}
+}
+
+// movedTo returns the bee to which one of the cells is moved, if any.
+func (b *bee) movedTo(cells MappedCells) (uint64, bool) {
+	b.Lock()
+	defer b.Unlock()
+
+	for _, c := range cells {
+		if to, ok := b.moved[c]; ok {
+			return to, true
+		}
+	}
+	return Nil, false
+}
+
+// relayMoved relays the messages that are mapped to moved cells to the bees
+// that own those cells, and returns the rest of the messages. Such messages
+// are queued on the bee before its cells are moved.
+func (b *bee) relayMoved(mhs []msgAndHandler) []msgAndHandler {
+	b.Lock()
+	n := len(b.moved)
+	b.Unlock()
+	if n == 0 {
+		return mhs
+	}
+
+	rest := mhs[:0]
+	for _, mh := range mhs {
+		to, ok := b.movedTo(mh.cells)
+		if !ok {
+			rest = append(rest, mh)
+			continue
+		}
+		glog.V(2).Infof("%v relays %v to %v", b, mh.msg, to)
+		if nb, ok := b.qee.beeByID(to); ok {
+			nb.enqueMsg(mh)
+			continue
+		}
+		// The bee is not local, and the message is relayed through its proxy.
+		m := *mh.msg
+		m.MsgTo = to
+		b.hive.enqueMsg(&m)
+	}
+	return rest
+}
+
+// splitBee splits the cells of the given bee, which can be on any hive. It
+// returns the ID of the new bee.
+func (h *hive) splitBee(id uint64, cells MappedCells) (uint64, error) {
+	bi, err := h.registry.bee(id)
+	if err != nil {
+		return Nil, err
+	}
+
+	sc := cmdSplit{Bee: id, Cells: cells}
+	var res interface{}
+	if bi.Hive == h.ID() {
+		a, ok := h.app(bi.App)
+		if !ok {
+			return Nil, fmt.Errorf("%v cannot find app %v", h, bi.App)
+		}
+		res, err = a.qee.processCmd(sc)
+	} else {
+		res, err = h.client.sendCmd(cmd{Hive: bi.Hive, App: bi.App, Data: sc})
+	}
+	if err != nil {
+		return Nil, err
+	}
+	return res.(uint64), nil
+}
@@ -0,0 +1,267 @@
+package beehive
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+type splitTestPutAll []string
+
+type splitTestGet string
+
+func TestSplitBee(t *testing.T) {
+	h := newHiveForTest()
+	app := h.NewApp("split")
+	app.HandleFunc(splitTestPutAll{},
+		func(msg Msg, ctx MapContext) MappedCells {
+			var cells MappedCells
+			for _, k := range msg.Data().(splitTestPutAll) {
+				cells = append(cells, CellKey{"D", k})
+			}
+			return cells
+		},
+		func(msg Msg, ctx RcvContext) error {
+			for _, k := range msg.Data().(splitTestPutAll) {
+				if err := ctx.Dict("D").Put(k, k); err != nil {
+					return err
+				}
+			}
+			return ctx.Reply(msg, ctx.ID())
+		})
+	app.HandleFunc(splitTestGet(""),
+		func(msg Msg, ctx MapContext) MappedCells {
+			return MappedCells{{"D", string(msg.Data().(splitTestGet))}}
+		},
+		func(msg Msg, ctx RcvContext) error {
+			k := string(msg.Data().(splitTestGet))
+			v, err := ctx.Dict("D").Get(k)
+			if err != nil {
+				return err
+			}
+			n := 0
+			ctx.Dict("D").ForEach(func(k string, v interface{}) bool {
+				n++
+				return true
+			})
+			return ctx.Reply(msg, []interface{}{ctx.ID(), v, n})
+		})
+
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	ctx, cnl := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cnl()
+	keys := []string{"a", "b", "c", "d"}
+	id, err := h.Sync(ctx, splitTestPutAll(keys))
+	if err != nil {
+		t.Fatalf("cannot put: %v", err)
+	}
+	oldb := id.(uint64)
+
+	if _, err := h.(*hive).splitBee(oldb, MappedCells{{"D", "a"}, {"D", "b"},
+		{"D", "c"}, {"D", "d"}}); err == nil {
+		t.Errorf("can split all the cells of a bee")
+	}
+
+	// The cells are mapped together, and are not split.
+	if _, err := h.(*hive).splitBee(oldb, nil); err == nil {
+		t.Errorf("can split the cells that are mapped together")
+	}
+
+	a, _ := h.(*hive).app("split")
+	b, _ := a.qee.beeByID(oldb)
+	b.Lock()
+	b.coaccess = [2]coaccess{}
+	b.Unlock()
+	for _, ks := range [][]string{keys[:2], keys[2:]} {
+		if _, err := h.Sync(ctx, splitTestPutAll(ks)); err != nil {
+			t.Fatalf("cannot put: %v", err)
+		}
+	}
+
+	newb, err := h.(*hive).splitBee(oldb, nil)
+	if err != nil {
+		t.Fatalf("cannot split bee %v: %v", oldb, err)
+	}
+
+	for i, k := range keys {
+		want := oldb
+		if i >= len(keys)/2 {
+			want = newb
+		}
+		res, err := h.Sync(ctx, splitTestGet(k))
+		if err != nil {
+			t.Fatalf("cannot get %v: %v", k, err)
+		}
+		r := res.([]interface{})
+		if r[0] != want || r[1] != k || r[2] != len(keys)/2 {
+			t.Errorf("invalid response for %v: actual=%v want=[%v %v %v]", k, r,
+				want, k, len(keys)/2)
+		}
+	}
+}
+
+type splitTestWho string
+
+func newSplitTestApp(h Hive, who chan uint64) App {
+	app := h.NewApp("split")
+	app.HandleFunc(splitTestPutAll{},
+		func(msg Msg, ctx MapContext) MappedCells {
+			var cells MappedCells
+			for _, k := range msg.Data().(splitTestPutAll) {
+				cells = append(cells, CellKey{"D", k})
+			}
+			return cells
+		},
+		func(msg Msg, ctx RcvContext) error {
+			for _, k := range msg.Data().(splitTestPutAll) {
+				if err := ctx.Dict("D").Put(k, k); err != nil {
+					return err
+				}
+			}
+			return ctx.Reply(msg, ctx.ID())
+		})
+	app.HandleFunc(splitTestWho(""),
+		func(msg Msg, ctx MapContext) MappedCells {
+			return MappedCells{{"D", string(msg.Data().(splitTestWho))}}
+		},
+		func(msg Msg, ctx RcvContext) error {
+			_, err := ctx.Dict("D").Get(string(msg.Data().(splitTestWho)))
+			if err != nil {
+				return err
+			}
+			who <- ctx.ID()
+			return nil
+		})
+	return app
+}
+
+func TestSplitBeeRelaysQueuedMsgs(t *testing.T) {
+	h := newHiveForTest()
+	who := make(chan uint64, 10)
+	a := newSplitTestApp(h, who).(*app)
+
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	ctx, cnl := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cnl()
+	id, err := h.Sync(ctx, splitTestPutAll{"a", "b"})
+	if err != nil {
+		t.Fatalf("cannot put: %v", err)
+	}
+	oldb := id.(uint64)
+	newb, err := h.(*hive).splitBee(oldb, MappedCells{{"D", "b"}})
+	if err != nil {
+		t.Fatalf("cannot split bee %v: %v", oldb, err)
+	}
+
+	// The moved cells are forgotten once the old bee is drained.
+	b, _ := a.qee.beeByID(oldb)
+	for i := 0; ; i++ {
+		if _, ok := b.movedTo(MappedCells{{"D", "b"}}); !ok {
+			break
+		}
+		if i == 100 {
+			t.Fatal("moved cells are not pruned")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// A message queued on the old bee before the split is relayed to the new
+	// bee.
+	b.markMoved(MappedCells{{"D", "b"}}, newb)
+	b.enqueMsg(msgAndHandler{
+		msg:     newMsgFromData(splitTestWho("b"), 0, 0),
+		handler: a.handler(MsgType(splitTestWho(""))),
+		cells:   MappedCells{{"D", "b"}},
+	})
+	select {
+	case id := <-who:
+		if id != newb {
+			t.Errorf("queued message is received by %v instead of %v", id, newb)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("queued message is not received")
+	}
+}
+
+func TestSplitBeeFailure(t *testing.T) {
+	h := newHiveForTest()
+	who := make(chan uint64, 10)
+	a := newSplitTestApp(h, who).(*app)
+
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	ctx, cnl := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cnl()
+	id, err := h.Sync(ctx, splitTestPutAll{"a", "b"})
+	if err != nil {
+		t.Fatalf("cannot put: %v", err)
+	}
+	oldb := id.(uint64)
+	splitBees := func() (n int) {
+		for _, bi := range h.(*hive).registry.bees() {
+			if bi.App == "split" {
+				n++
+			}
+		}
+		return n
+	}
+	nbees := splitBees()
+
+	// The registry rejects the split of a cell that the bee does not own in the
+	// registry.
+	b, _ := a.qee.beeByID(oldb)
+	b.addMappedCells(MappedCells{{"D", "z"}})
+	if _, err := h.(*hive).splitBee(oldb, MappedCells{{"D", "b"},
+		{"D", "z"}}); err == nil {
+
+		t.Fatal("can split a cell that is not in the registry")
+	}
+
+	if n := splitBees(); n != nbees {
+		t.Errorf("new bee is not removed: actual=%v bees want=%v", n, nbees)
+	}
+	h.Emit(splitTestWho("b"))
+	select {
+	case id := <-who:
+		if id != oldb {
+			t.Errorf("cell is owned by %v instead of %v", id, oldb)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the entry of the cell is not restored")
+	}
+}
+
+func TestSplitGroups(t *testing.T) {
+	c := make(coaccess)
+	c.union(MappedCells{{"D", "a"}, {"D", "d"}})
+	c.union(MappedCells{{"D", "e"}, {"D", "c"}})
+	c.union(MappedCells{{"D", "c"}, {"D", "f"}})
+	b := &bee{coaccess: [2]coaccess{nil, c}}
+
+	cells := MappedCells{{"D", "a"}, {"D", "b"}, {"D", "c"}, {"D", "d"},
+		{"D", "e"}, {"D", "f"}}
+	groups := b.coaccessGroups(cells)
+	if len(groups) != 3 {
+		t.Fatalf("invalid groups: %v", groups)
+	}
+	moved := splitGroups(groups)
+	want := MappedCells{{"D", "c"}, {"D", "e"}, {"D", "f"}}
+	if !reflect.DeepEqual(moved, want) {
+		t.Errorf("invalid moved cells: actual=%v want=%v", moved, want)
+	}
+
+	c.union(MappedCells{{"D", "a"}, {"D", "b"}, {"D", "f"}})
+	if moved := splitGroups(b.coaccessGroups(cells)); len(moved) != 0 {
+		t.Errorf("cells mapped together are split: %v", moved)
+	}
+}
@@ -0,0 +1,122 @@
+package state
+
+import "reflect"
+
+// UpdateFn is the function used to atomically update the value of a key. old
+// is the current value of the key and ok is whether the key exists. If it
+// returns an error, the key is not updated.
+type UpdateFn func(old interface{}, ok bool) (val interface{}, err error)
+
+// modifyFn is called with the current value of a key and whether the key
+// exists. It returns the new value of the key, and whether the new value should
+// be put.
+type modifyFn func(old interface{}, ok bool) (val interface{}, put bool,
+	err error)
+
+// modifier is a dictionary that can be used concurrently, and can read and put
+// a key atomically. f is called while the dictionary is locked, and must not
+// use the dictionary.
+type modifier interface {
+	modify(key string, f modifyFn) (val interface{}, put bool, err error)
+}
+
+// modify reads key from d, and puts the value returned by f. For dictionaries
+// that are not modifiers, such as in-memory and transactional dictionaries,
+// the read and the put are atomic with respect to the bee that owns d.
+func modify(d Dict, key string, f modifyFn) (interface{}, bool, error) {
+	if m, ok := d.(modifier); ok {
+		return m.modify(key, f)
+	}
+
+	old, err := d.Get(key)
+	ok := true
+	switch err {
+	case nil:
+	case ErrNoSuchKey:
+		ok = false
+	default:
+		return nil, false, err
+	}
+	val, put, err := f(old, ok)
+	if err != nil || !put {
+		return val, false, err
+	}
+	if err := d.Put(key, val); err != nil {
+		return nil, false, err
+	}
+	return val, true, nil
+}
+
+// CompareAndSwap associates val with key in d, only if the current value of key
+// is equal to old. Values are compared using reflect.DeepEqual. If key does not
+// exist, it returns ErrNoSuchKey.
+//
+// CompareAndSwap is stored as an ordinary put. As such, in a transaction it is
+// replicated just like any other put.
+func CompareAndSwap(d Dict, key string, old, val interface{}) (swapped bool,
+	err error) {
+
+	_, swapped, err = modify(d, key,
+		func(v interface{}, ok bool) (interface{}, bool, error) {
+			if !ok {
+				return nil, false, ErrNoSuchKey
+			}
+			return val, reflect.DeepEqual(v, old), nil
+		})
+	return swapped, err
+}
+
+// PutIfAbsent associates val with key in d, only if key does not exist.
+func PutIfAbsent(d Dict, key string, val interface{}) (put bool, err error) {
+	_, put, err = modify(d, key,
+		func(v interface{}, ok bool) (interface{}, bool, error) {
+			return val, !ok, nil
+		})
+	return put, err
+}
+
+// Update associates the value returned by f with key in d, and returns that
+// value. f must not use the state of d.
+func Update(d Dict, key string, f UpdateFn) (val interface{}, err error) {
+	val, _, err = modify(d, key,
+		func(old interface{}, ok bool) (interface{}, bool, error) {
+			v, err := f(old, ok)
+			return v, err == nil, err
+		})
+	if err != nil {
+		return nil, err
+	}
+	return val, nil
+}
+
+func (d *onDiskDict) modify(k string, f modifyFn) (interface{}, bool, error) {
+	d.state.Lock()
+	defer d.state.Unlock()
+
+	var old interface{}
+	p, ok := d.index[k]
+	if ok {
+		b, err := d.readValue(p)
+		if err != nil {
+			return nil, false, err
+		}
+		if old, err = decodeValue(b); err != nil {
+			return nil, false, err
+		}
+	}
+
+	val, put, err := f(old, ok)
+	if err != nil || !put {
+		return val, false, err
+	}
+	b, err := encodeValue(val)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := d.append(Put, k, b); err != nil {
+		return nil, false, err
+	}
+	return val, true, d.maybeCompact()
+}
+
+var _ modifier = &onDiskDict{}
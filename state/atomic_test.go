@@ -0,0 +1,125 @@
+package state
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"testing"
+)
+
+func TestCompareAndSwap(t *testing.T) {
+	d := NewInMem().Dict("d")
+	if _, err := CompareAndSwap(d, "k", nil, 1); err != ErrNoSuchKey {
+		t.Errorf("swapped a non-existing key: %v", err)
+	}
+
+	d.Put("k", []int{1})
+	if ok, err := CompareAndSwap(d, "k", []int{2}, []int{3}); ok || err != nil {
+		t.Errorf("swapped with an invalid old value: ok=%v err=%v", ok, err)
+	}
+	if ok, err := CompareAndSwap(d, "k", []int{1}, []int{3}); !ok || err != nil {
+		t.Errorf("cannot swap: ok=%v err=%v", ok, err)
+	}
+	if v, _ := d.Get("k"); v.([]int)[0] != 3 {
+		t.Errorf("invalid value after swap: actual=%v want=[3]", v)
+	}
+}
+
+func TestPutIfAbsent(t *testing.T) {
+	d := NewInMem().Dict("d")
+	if ok, err := PutIfAbsent(d, "k", 1); !ok || err != nil {
+		t.Errorf("cannot put an absent key: ok=%v err=%v", ok, err)
+	}
+	if ok, err := PutIfAbsent(d, "k", 2); ok || err != nil {
+		t.Errorf("put an existing key: ok=%v err=%v", ok, err)
+	}
+	if v, _ := d.Get("k"); v.(int) != 1 {
+		t.Errorf("invalid value: actual=%v want=1", v)
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	d := NewInMem().Dict("d")
+	inc := func(old interface{}, ok bool) (interface{}, error) {
+		if !ok {
+			return 1, nil
+		}
+		return old.(int) + 1, nil
+	}
+	for i := 1; i <= 3; i++ {
+		if v, err := Update(d, "k", inc); err != nil || v.(int) != i {
+			t.Errorf("invalid update: actual=%v want=%v (err=%v)", v, i, err)
+		}
+	}
+
+	errUp := errors.New("update error")
+	_, err := Update(d, "k", func(old interface{}, ok bool) (interface{}, error) {
+		return 10, errUp
+	})
+	if err != errUp {
+		t.Errorf("invalid error: actual=%v want=%v", err, errUp)
+	}
+	if v, _ := d.Get("k"); v.(int) != 3 {
+		t.Errorf("value updated despite the error: actual=%v want=3", v)
+	}
+}
+
+func TestAtomicOpsInTx(t *testing.T) {
+	tx := NewTransactional(NewInMem())
+	tx.Dict("d").Put("k1", 1)
+
+	tx.BeginTx()
+	d := tx.Dict("d")
+	CompareAndSwap(d, "k1", 1, 2)
+	PutIfAbsent(d, "k2", 1)
+	d.Del("k1")
+	if ok, _ := PutIfAbsent(d, "k1", 3); !ok {
+		t.Error("cannot put a key deleted in the transaction")
+	}
+
+	ops := tx.TxOps()
+	if len(ops) != 2 {
+		t.Fatalf("invalid number of ops: actual=%v want=2", len(ops))
+	}
+	for _, op := range ops {
+		if op.T != Put {
+			t.Errorf("invalid op type: actual=%v want=%v", op.T, Put)
+		}
+	}
+	tx.CommitTx()
+
+	if v, _ := tx.Dict("d").Get("k1"); v.(int) != 3 {
+		t.Errorf("invalid value after commit: actual=%v want=3", v)
+	}
+}
+
+func TestOnDiskUpdateIsAtomic(t *testing.T) {
+	s, dir := newOnDiskForTest(t)
+	defer os.RemoveAll(dir)
+	defer s.Close()
+
+	d := s.Dict("d")
+	inc := func(old interface{}, ok bool) (interface{}, error) {
+		if !ok {
+			return 1, nil
+		}
+		return old.(int) + 1, nil
+	}
+
+	const n = 100
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := Update(d, "k", inc); err != nil {
+				t.Errorf("cannot update: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if v, _ := d.Get("k"); v.(int) != n {
+		t.Errorf("lost updates: actual=%v want=%v", v, n)
+	}
+}
@@ -0,0 +1,305 @@
+package state
+
+import (
+	"errors"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
+)
+
+var (
+	ErrNotChunked error = errors.New("state: state cannot be saved in chunks")
+)
+
+// ChunkSize is the maximum number of entries in a chunk.
+const ChunkSize = 256
+
+// ChunkEntry is an entry of a dictionary in a chunk.
+type ChunkEntry struct {
+	Key      string      // The key.
+	Val      interface{} // The value of the key, if not deleted.
+	Del      bool        // Whether the key is deleted.
+	Deadline time.Time   // The deadline of the key, if any.
+}
+
+// Chunk is a part of a saved state, and contains a set of entries of one
+// dictionary.
+type Chunk struct {
+	Dict    string
+	Entries []ChunkEntry
+}
+
+// ChunkedState is a state that can be saved in chunks, and incrementally.
+type ChunkedState interface {
+	State
+
+	// SaveChunks calls f for the chunks of the entries modified after version
+	// since. If since is 0, all the entries are saved. It returns the version of
+	// the state which can be used as since in the next call to SaveChunks.
+	// Deleted keys are kept as tombstones, so that they are saved in the next
+	// chunks.
+	SaveChunks(since uint64, f func(c Chunk) error) (ver uint64, err error)
+	// DropTombstones drops the tombstones of the keys deleted at or before
+	// version ver. It should be called once all the entries are saved at ver,
+	// when chunks since an older version are no longer needed.
+	DropTombstones(ver uint64)
+	// ApplyChunk applies the entries of c to the state.
+	ApplyChunk(c Chunk) error
+	// Clear removes all the dictionaries of the state.
+	Clear() error
+}
+
+// chunker groups the entries of a dictionary into chunks.
+type chunker struct {
+	chunk Chunk
+	f     func(c Chunk) error
+}
+
+func (c *chunker) add(e ChunkEntry) error {
+	c.chunk.Entries = append(c.chunk.Entries, e)
+	if len(c.chunk.Entries) < ChunkSize {
+		return nil
+	}
+	return c.flush()
+}
+
+func (c *chunker) flush() error {
+	if len(c.chunk.Entries) == 0 {
+		return nil
+	}
+	err := c.f(c.chunk)
+	c.chunk.Entries = nil
+	return err
+}
+
+// modifiedKeys returns the keys of versions modified after since, in order.
+func modifiedKeys(versions map[string]uint64, since uint64) []string {
+	var keys []string
+	for k, v := range versions {
+		if v > since {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (s *InMem) SaveChunks(since uint64, f func(c Chunk) error) (uint64,
+	error) {
+
+	ver := LastVersion()
+	names := make([]string, 0, len(s.InMemDicts))
+	for n := range s.InMemDicts {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	for _, n := range names {
+		d := s.InMemDicts[n]
+		var keys []string
+		if since == 0 {
+			keys = make([]string, 0, len(d.Dict))
+			for k := range d.Dict {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+		} else {
+			keys = modifiedKeys(d.versions, since)
+		}
+
+		c := chunker{chunk: Chunk{Dict: n}, f: f}
+		for _, k := range keys {
+			e := ChunkEntry{Key: k}
+			if v, ok := d.Dict[k]; ok {
+				e.Val = v
+				e.Deadline = d.Expiries[k]
+			} else {
+				e.Del = true
+			}
+			if err := c.add(e); err != nil {
+				return 0, err
+			}
+		}
+		if err := c.flush(); err != nil {
+			return 0, err
+		}
+	}
+	return ver, nil
+}
+
+func (s *InMem) DropTombstones(ver uint64) {
+	for _, d := range s.InMemDicts {
+		d.pruneTombstones(ver)
+	}
+}
+
+func (s *InMem) ApplyChunk(c Chunk) error {
+	return applyChunk(s.inMemDict(c.Dict), c)
+}
+
+func (s *InMem) Clear() error {
+	s.InMemDicts = make(map[string]*inMemDict)
+	return nil
+}
+
+func (s *OnDisk) SaveChunks(since uint64, f func(c Chunk) error) (uint64,
+	error) {
+
+	s.Lock()
+	defer s.Unlock()
+
+	if s.closed {
+		return 0, ErrClosed
+	}
+
+	ver := LastVersion()
+	names := make([]string, 0, len(s.dicts))
+	for n := range s.dicts {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	for _, n := range names {
+		d := s.dicts[n]
+		var keys []string
+		if since == 0 {
+			keys = d.keys.keys("", "", iterOptions{})
+		} else {
+			keys = modifiedKeys(d.versions, since)
+		}
+
+		c := chunker{chunk: Chunk{Dict: n}, f: f}
+		for _, k := range keys {
+			e := ChunkEntry{Key: k}
+			if p, ok := d.index[k]; ok {
+				b, err := d.readValue(p)
+				if err != nil {
+					return 0, err
+				}
+				if e.Val, err = decodeValue(b); err != nil {
+					return 0, err
+				}
+				e.Deadline = d.expiries[k]
+			} else {
+				e.Del = true
+			}
+			if err := c.add(e); err != nil {
+				return 0, err
+			}
+		}
+		if err := c.flush(); err != nil {
+			return 0, err
+		}
+	}
+	return ver, nil
+}
+
+func (s *OnDisk) DropTombstones(ver uint64) {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, d := range s.dicts {
+		d.pruneTombstones(ver)
+	}
+}
+
+func (s *OnDisk) ApplyChunk(c Chunk) error {
+	return applyChunk(s.Dict(c.Dict), c)
+}
+
+func (s *OnDisk) Clear() error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.closed {
+		return ErrClosed
+	}
+	return s.clear()
+}
+
+// clear removes all the dictionaries. The state must be locked.
+func (s *OnDisk) clear() error {
+	for n, d := range s.dicts {
+		d.file.Close()
+		if err := os.Remove(d.path()); err != nil {
+			return err
+		}
+		delete(s.dicts, n)
+	}
+	return nil
+}
+
+func applyChunk(d Dict, c Chunk) error {
+	for _, e := range c.Entries {
+		var err error
+		switch {
+		case e.Del:
+			if err = d.Del(e.Key); err == ErrNoSuchKey {
+				err = nil
+			}
+		case !e.Deadline.IsZero():
+			if ed, ok := d.(ExpiringDict); ok {
+				err = ed.PutWithDeadline(e.Key, e.Val, e.Deadline)
+				break
+			}
+			fallthrough
+		default:
+			err = d.Put(e.Key, e.Val)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SaveChunks saves the underlying state in chunks. It returns ErrNotChunked if
+// the state is not a ChunkedState.
+func (t *Transactional) SaveChunks(since uint64, f func(c Chunk) error) (
+	uint64, error) {
+
+	cs, ok := t.State.(ChunkedState)
+	if !ok {
+		return 0, ErrNotChunked
+	}
+	if t.status == TxOpen {
+		glog.Warningf("transactional has an open tx when the snapshot is taken")
+	}
+	return cs.SaveChunks(since, f)
+}
+
+// DropTombstones drops the tombstones of the underlying state, if it is a
+// ChunkedState.
+func (t *Transactional) DropTombstones(ver uint64) {
+	if cs, ok := t.State.(ChunkedState); ok {
+		cs.DropTombstones(ver)
+	}
+}
+
+// ApplyChunk applies c on the underlying state. It returns ErrNotChunked if the
+// state is not a ChunkedState.
+func (t *Transactional) ApplyChunk(c Chunk) error {
+	cs, ok := t.State.(ChunkedState)
+	if !ok {
+		return ErrNotChunked
+	}
+	return cs.ApplyChunk(c)
+}
+
+// Clear removes all the dictionaries of the underlying state. It returns
+// ErrNotChunked if the state is not a ChunkedState.
+func (t *Transactional) Clear() error {
+	cs, ok := t.State.(ChunkedState)
+	if !ok {
+		return ErrNotChunked
+	}
+	t.Reset()
+	t.stage = make(map[string]*TxDict)
+	return cs.Clear()
+}
+
+var _ ChunkedState = &InMem{}
+var _ ChunkedState = &OnDisk{}
+var _ ChunkedState = &Transactional{}
@@ -0,0 +1,107 @@
+package state
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func saveChunksForTest(t *testing.T, s ChunkedState, since uint64) ([]Chunk,
+	uint64) {
+
+	var chunks []Chunk
+	ver, err := s.SaveChunks(since, func(c Chunk) error {
+		chunks = append(chunks, c)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("cannot save chunks: %v", err)
+	}
+	return chunks, ver
+}
+
+func applyChunksForTest(t *testing.T, s ChunkedState, chunks []Chunk) {
+	for _, c := range chunks {
+		if err := s.ApplyChunk(c); err != nil {
+			t.Fatalf("cannot apply chunk: %v", err)
+		}
+	}
+}
+
+func testChunkedState(t *testing.T, src, dst ChunkedState) {
+	d := src.Dict("d")
+	for i := 0; i < ChunkSize+1; i++ {
+		d.Put(string(rune('a'+i%26))+string(rune('a'+i/26)), i)
+	}
+	PutWithTTL(d, "ttl", "v", time.Hour)
+
+	full, ver := saveChunksForTest(t, src, 0)
+	if len(full) != 2 {
+		t.Errorf("invalid number of chunks: actual=%v want=2", len(full))
+	}
+	applyChunksForTest(t, dst, full)
+	if _, ok := dst.Dict("d").(ExpiringDict).Deadline("ttl"); !ok {
+		t.Error("deadline is not restored")
+	}
+
+	d.Put("aa", "new")
+	d.Del("ba")
+	delta, _ := saveChunksForTest(t, src, ver)
+	if len(delta) != 1 || len(delta[0].Entries) != 2 {
+		t.Fatalf("invalid delta: %#v", delta)
+	}
+	applyChunksForTest(t, dst, delta)
+
+	src.Dict("d").ForEach(func(k string, v interface{}) bool {
+		if dv, err := dst.Dict("d").Get(k); err != nil || dv != v {
+			t.Errorf("invalid value for %v: actual=%v want=%v", k, dv, v)
+		}
+		return true
+	})
+	if _, err := dst.Dict("d").Get("ba"); err != ErrNoSuchKey {
+		t.Error("deleted key is not removed by the delta")
+	}
+
+	_, ver = saveChunksForTest(t, src, 0)
+	if v, _ := Version(d, "ba"); v == 0 {
+		t.Error("tombstone is dropped by saving the chunks")
+	}
+	src.DropTombstones(ver)
+	if v, _ := Version(d, "ba"); v != 0 {
+		t.Errorf("tombstone is not dropped: %v", v)
+	}
+	d.Del("ca")
+	if delta, _ = saveChunksForTest(t, src, ver); len(delta) != 1 ||
+		len(delta[0].Entries) != 1 || !delta[0].Entries[0].Del {
+
+		t.Errorf("deletion after a full save is not in the delta: %#v", delta)
+	}
+
+	if err := dst.Clear(); err != nil {
+		t.Fatalf("cannot clear the state: %v", err)
+	}
+	if _, err := dst.Dict("d").Get("aa"); err != ErrNoSuchKey {
+		t.Error("clear does not remove the keys")
+	}
+}
+
+func TestInMemChunks(t *testing.T) {
+	testChunkedState(t, NewInMem(), NewInMem())
+}
+
+func TestOnDiskChunks(t *testing.T) {
+	src, sdir := newOnDiskForTest(t)
+	defer os.RemoveAll(sdir)
+	defer src.Close()
+
+	dst, ddir := newOnDiskForTest(t)
+	defer os.RemoveAll(ddir)
+	defer dst.Close()
+
+	testChunkedState(t, src, dst)
+}
+
+func TestTxChunks(t *testing.T) {
+	testChunkedState(t, NewTransactional(NewInMem()),
+		NewTransactional(NewInMem()))
+}
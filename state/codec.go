@@ -0,0 +1,60 @@
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/gogo/protobuf/proto"
+	bhgob "github.com/kandoo/beehive/gob"
+)
+
+// Codec encodes and decodes the values of a typed dictionary.
+type Codec interface {
+	// Encode encodes v into bytes.
+	Encode(v interface{}) ([]byte, error)
+	// Decode decodes b into v. v is always a pointer.
+	Decode(b []byte, v interface{}) error
+}
+
+// GobCodec encodes values using encoding/gob. Since the type of values is known
+// in a typed dictionary, the value types do not need to be registered in gob.
+type GobCodec struct{}
+
+func (c GobCodec) Encode(v interface{}) ([]byte, error) {
+	return bhgob.Encode(v)
+}
+
+func (c GobCodec) Decode(b []byte, v interface{}) error {
+	return bhgob.Decode(v, b)
+}
+
+// JSONCodec encodes values using encoding/json.
+type JSONCodec struct{}
+
+func (c JSONCodec) Encode(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (c JSONCodec) Decode(b []byte, v interface{}) error {
+	return json.Unmarshal(b, v)
+}
+
+// ProtoCodec encodes values using protocol buffers. Values must implement
+// proto.Message.
+type ProtoCodec struct{}
+
+func (c ProtoCodec) Encode(v interface{}) ([]byte, error) {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("state: %T is not a proto message", v)
+	}
+	return proto.Marshal(m)
+}
+
+func (c ProtoCodec) Decode(b []byte, v interface{}) error {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return fmt.Errorf("state: %T is not a proto message", v)
+	}
+	return proto.Unmarshal(b, m)
+}
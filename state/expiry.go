@@ -0,0 +1,190 @@
+package state
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrNoExpiry error = errors.New("state: dictionary does not support expiry")
+)
+
+// ExpiringDict is a dictionary that supports keys with a time to live.
+//
+// Dictionaries do not delete the expired keys by themselves. Instead, the owner
+// of the dictionary (e.g., a bee) finds the expired keys using Expired and
+// deletes them. Put and Del clear the deadline of a key.
+type ExpiringDict interface {
+	Dict
+
+	// PutWithTTL associates val with key, and sets the deadline of key to ttl
+	// from now.
+	PutWithTTL(key string, val interface{}, ttl time.Duration) error
+	// PutWithDeadline associates val with key, and sets the deadline of key.
+	PutWithDeadline(key string, val interface{}, deadline time.Time) error
+	// Deadline returns the deadline of key. ok is false if key has no deadline.
+	Deadline(key string) (deadline time.Time, ok bool)
+	// Expired iterates over the entries whose deadline is not after now.
+	Expired(now time.Time, f IterFn)
+}
+
+// PutWithTTL associates val with key in d, and sets the deadline of key to ttl
+// from now. It returns ErrNoExpiry if d is not an ExpiringDict.
+func PutWithTTL(d Dict, key string, val interface{}, ttl time.Duration) error {
+	ed, ok := d.(ExpiringDict)
+	if !ok {
+		return ErrNoExpiry
+	}
+	return ed.PutWithTTL(key, val, ttl)
+}
+
+func (d *inMemDict) PutWithTTL(k string, v interface{},
+	ttl time.Duration) error {
+
+	return d.PutWithDeadline(k, v, time.Now().Add(ttl))
+}
+
+func (d *inMemDict) PutWithDeadline(k string, v interface{},
+	deadline time.Time) error {
+
+	d.Put(k, v)
+	if d.Expiries == nil {
+		d.Expiries = make(map[string]time.Time)
+	}
+	d.Expiries[k] = deadline
+	return nil
+}
+
+func (d *inMemDict) Deadline(k string) (time.Time, bool) {
+	t, ok := d.Expiries[k]
+	return t, ok
+}
+
+func (d *inMemDict) Expired(now time.Time, f IterFn) {
+	var keys []string
+	for k, t := range d.Expiries {
+		if !t.After(now) {
+			keys = append(keys, k)
+		}
+	}
+	for _, k := range keys {
+		if !f(k, d.Dict[k]) {
+			return
+		}
+	}
+}
+
+func (d *onDiskDict) PutWithTTL(k string, v interface{},
+	ttl time.Duration) error {
+
+	return d.PutWithDeadline(k, v, time.Now().Add(ttl))
+}
+
+func (d *onDiskDict) PutWithDeadline(k string, v interface{},
+	deadline time.Time) error {
+
+	b, err := encodeValue(v)
+	if err != nil {
+		return err
+	}
+
+	// The deadline and the value are written in one record, so that the key
+	// is never stored without its deadline.
+	rec := append(encodeDeadline(deadline), b...)
+	d.state.Lock()
+	defer d.state.Unlock()
+	if err := d.append(onDiskPutTTL, k, rec); err != nil {
+		return err
+	}
+	return d.maybeCompact()
+}
+
+func (d *onDiskDict) Deadline(k string) (time.Time, bool) {
+	d.state.Lock()
+	t, ok := d.expiries[k]
+	d.state.Unlock()
+	return t, ok
+}
+
+func (d *onDiskDict) Expired(now time.Time, f IterFn) {
+	d.state.Lock()
+	var keys []string
+	for k, t := range d.expiries {
+		if !t.After(now) {
+			keys = append(keys, k)
+		}
+	}
+	d.state.Unlock()
+
+	for _, k := range keys {
+		v, err := d.Get(k)
+		if err != nil {
+			continue
+		}
+		if !f(k, v) {
+			return
+		}
+	}
+}
+
+func (d *TxDict) PutWithTTL(k string, v interface{}, ttl time.Duration) error {
+	return d.PutWithDeadline(k, v, time.Now().Add(ttl))
+}
+
+func (d *TxDict) PutWithDeadline(k string, v interface{},
+	deadline time.Time) error {
+
+	d.updateIndexes(k, v, false)
+	d.Ops[k] = Op{
+		T: Put,
+		D: d.Dict.Name(),
+		K: k,
+		V: v,
+		E: deadline,
+	}
+	return nil
+}
+
+func (d *TxDict) Deadline(k string) (time.Time, bool) {
+	if op, ok := d.Ops[k]; ok {
+		return op.E, op.T == Put && !op.E.IsZero()
+	}
+	if ed, ok := d.Dict.(ExpiringDict); ok {
+		return ed.Deadline(k)
+	}
+	return time.Time{}, false
+}
+
+// Expired iterates over the expired entries and merges the uncommitted
+// operations of the transaction into the iteration.
+func (d *TxDict) Expired(now time.Time, f IterFn) {
+	if ed, ok := d.Dict.(ExpiringDict); ok {
+		stopped := false
+		ed.Expired(now, func(k string, v interface{}) bool {
+			if _, ok := d.Ops[k]; ok {
+				return true
+			}
+			if !f(k, v) {
+				stopped = true
+				return false
+			}
+			return true
+		})
+		if stopped {
+			return
+		}
+	}
+
+	for k, op := range d.Ops {
+		if op.T != Put || op.E.IsZero() || op.E.After(now) {
+			continue
+		}
+		if !f(k, op.V) {
+			return
+		}
+	}
+}
+
+var _ ExpiringDict = &inMemDict{}
+var _ ExpiringDict = &onDiskDict{}
+var _ ExpiringDict = &TxDict{}
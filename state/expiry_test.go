@@ -0,0 +1,170 @@
+package state
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func testExpiringDict(t *testing.T, d Dict) {
+	now := time.Now()
+	ed := d.(ExpiringDict)
+	ed.PutWithDeadline("k1", "v1", now.Add(-time.Second))
+	ed.PutWithDeadline("k2", "v2", now.Add(time.Hour))
+	ed.PutWithDeadline("k3", "v3", now.Add(-time.Second))
+	d.Put("k3", "v3")
+	d.Put("k4", "v4")
+
+	if _, ok := ed.Deadline("k4"); ok {
+		t.Error("key without ttl has a deadline")
+	}
+	if _, ok := ed.Deadline("k3"); ok {
+		t.Error("put does not clear the deadline")
+	}
+	if dl, ok := ed.Deadline("k2"); !ok || !dl.Equal(now.Add(time.Hour)) {
+		t.Errorf("invalid deadline for k2: actual=%v want=%v", dl,
+			now.Add(time.Hour))
+	}
+
+	var expired []string
+	ed.Expired(now, func(k string, v interface{}) bool {
+		expired = append(expired, k)
+		if v.(string) != "v1" {
+			t.Errorf("invalid expired value: actual=%v want=v1", v)
+		}
+		return true
+	})
+	if len(expired) != 1 || expired[0] != "k1" {
+		t.Errorf("invalid expired keys: actual=%v want=[k1]", expired)
+	}
+
+	d.Del("k1")
+	ed.Expired(now, func(k string, v interface{}) bool {
+		t.Errorf("deleted key %v is expired", k)
+		return true
+	})
+}
+
+func TestInMemExpiry(t *testing.T) {
+	testExpiringDict(t, NewInMem().Dict("d"))
+}
+
+func TestOnDiskExpiry(t *testing.T) {
+	s, dir := newOnDiskForTest(t)
+	defer os.RemoveAll(dir)
+	defer s.Close()
+
+	testExpiringDict(t, s.Dict("d"))
+}
+
+func TestOnDiskExpiryReopen(t *testing.T) {
+	s, dir := newOnDiskForTest(t)
+	defer os.RemoveAll(dir)
+
+	dl := time.Now().Add(time.Hour)
+	PutWithTTL(s.Dict("d"), "k", "v", time.Minute)
+	s.Dict("d").(ExpiringDict).PutWithDeadline("k", "v", dl)
+	if err := s.Close(); err != nil {
+		t.Fatalf("cannot close the state: %v", err)
+	}
+
+	s, err := NewOnDisk(dir)
+	if err != nil {
+		t.Fatalf("cannot reopen the state: %v", err)
+	}
+	defer s.Close()
+
+	d := s.Dict("d").(*onDiskDict)
+	if t1, ok := d.Deadline("k"); !ok || !t1.Equal(dl) {
+		t.Errorf("invalid deadline after reopen: actual=%v want=%v", t1, dl)
+	}
+	if err := d.compact(); err != nil {
+		t.Fatalf("cannot compact: %v", err)
+	}
+	if t1, ok := d.Deadline("k"); !ok || !t1.Equal(dl) {
+		t.Errorf("invalid deadline after compaction: actual=%v want=%v", t1, dl)
+	}
+}
+
+func TestOnDiskExpiryAtomic(t *testing.T) {
+	s, dir := newOnDiskForTest(t)
+	defer os.RemoveAll(dir)
+
+	d := s.Dict("d").(*onDiskDict)
+	d.Put("j", "v")
+	size := d.size
+	PutWithTTL(d, "k", "v", time.Hour)
+	s.Close()
+
+	// A crash in the middle of writing the record loses both the value and the
+	// deadline of the key.
+	if err := os.Truncate(d.path(), size+(d.size-size)/2); err != nil {
+		t.Fatalf("cannot truncate: %v", err)
+	}
+	s, err := NewOnDisk(dir)
+	if err != nil {
+		t.Fatalf("cannot reopen the state: %v", err)
+	}
+	defer s.Close()
+
+	if _, err := s.Dict("d").Get("k"); err != ErrNoSuchKey {
+		t.Errorf("partially written key is loaded: %v", err)
+	}
+	if _, err := s.Dict("d").Get("j"); err != nil {
+		t.Errorf("cannot get the key before the partial record: %v", err)
+	}
+}
+
+func TestOnDiskExpiryLegacyRecord(t *testing.T) {
+	s, dir := newOnDiskForTest(t)
+	defer os.RemoveAll(dir)
+
+	dl := time.Now().Add(time.Hour).Round(0)
+	d := s.Dict("d").(*onDiskDict)
+	d.Put("k", "v")
+	s.Lock()
+	d.append(onDiskTTL, "k", encodeDeadline(dl))
+	s.Unlock()
+	s.Close()
+
+	s, err := NewOnDisk(dir)
+	if err != nil {
+		t.Fatalf("cannot reopen the state: %v", err)
+	}
+	defer s.Close()
+	if t1, ok := s.Dict("d").(ExpiringDict).Deadline("k"); !ok || !t1.Equal(dl) {
+		t.Errorf("invalid deadline of a legacy record: actual=%v want=%v", t1, dl)
+	}
+}
+
+func TestTxDictExpiry(t *testing.T) {
+	tx := NewTransactional(NewInMem())
+	tx.BeginTx()
+	testExpiringDict(t, tx.Dict("d"))
+	tx.CommitTx()
+
+	ed := tx.Dict("d").(ExpiringDict)
+	if _, ok := ed.Deadline("k2"); !ok {
+		t.Error("deadline is not committed")
+	}
+
+	tx.BeginTx()
+	tx.Dict("d").Put("k2", "v")
+	if _, ok := tx.Dict("d").(ExpiringDict).Deadline("k2"); ok {
+		t.Error("put does not clear the deadline in the transaction")
+	}
+	tx.AbortTx()
+	if _, ok := ed.Deadline("k2"); !ok {
+		t.Error("aborted transaction cleared the deadline")
+	}
+}
+
+func TestPutWithTTLNotSupported(t *testing.T) {
+	if err := PutWithTTL(dictOnly{}, "k", "v", time.Second); err != ErrNoExpiry {
+		t.Errorf("invalid error: actual=%v want=%v", err, ErrNoExpiry)
+	}
+}
+
+type dictOnly struct {
+	Dict
+}
@@ -0,0 +1,200 @@
+package state
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	ErrNoSuchIndex error = errors.New("state: no such index")
+	ErrDupIndex    error = errors.New("state: index already exists")
+)
+
+// IndexFn extracts the index keys of an entry in a dictionary. An entry can
+// have zero or more index keys.
+type IndexFn func(key string, val interface{}) []string
+
+// index is a secondary index on a dictionary. The entries of an index are
+// stored in a separate dictionary, so that they are saved, restored and
+// replicated along with the indexed dictionary.
+type index struct {
+	dict string
+	name string
+	fn   IndexFn
+}
+
+// indexDictPrefix is the prefix of the dictionaries that store indexes.
+const indexDictPrefix = "__index_"
+
+// dictName returns the name of the dictionary that stores the index.
+func (i *index) dictName() string {
+	return fmt.Sprintf("%s%d_%s_%s", indexDictPrefix, len(i.dict), i.dict,
+		i.name)
+}
+
+// IsIndexDict returns whether the dictionary stores a secondary index. Such
+// dictionaries are maintained by the state, and should not be modified
+// directly.
+func IsIndexDict(name string) bool {
+	return strings.HasPrefix(name, indexDictPrefix)
+}
+
+// indexPrefix returns the prefix of the index entries of ikey.
+func indexPrefix(ikey string) string {
+	return fmt.Sprintf("%08X%s", len(ikey), ikey)
+}
+
+// indexEntry returns the key of the index entry of ikey for the primary key k.
+func indexEntry(ikey, k string) string {
+	return indexPrefix(ikey) + k
+}
+
+// AddIndex declares a secondary index on dictionary dict. The index is
+// maintained for all the modifications made in transactions, and is updated
+// atomically with the transaction: the index entries are committed or aborted
+// along with the entries of dict.
+//
+// Indexes are not persisted and must be declared whenever the state is
+// created. The entries already in dict are indexed when the index is declared.
+func (t *Transactional) AddIndex(dict, name string, f IndexFn) error {
+	if t.indexes == nil {
+		t.indexes = make(map[string][]*index)
+	}
+	for _, i := range t.indexes[dict] {
+		if i.name == name {
+			return ErrDupIndex
+		}
+	}
+	i := &index{
+		dict: dict,
+		name: name,
+		fn:   f,
+	}
+	if err := i.rebuild(t.State); err != nil {
+		return err
+	}
+	t.indexes[dict] = append(t.indexes[dict], i)
+	return nil
+}
+
+// rebuild updates the index entries stored in s to match the entries of the
+// indexed dictionary in s. Index entries that are already in s are not
+// rewritten.
+func (i *index) rebuild(s State) error {
+	want := make(map[string]string)
+	s.Dict(i.dict).ForEach(func(k string, v interface{}) bool {
+		for _, ik := range i.fn(k, v) {
+			want[indexEntry(ik, k)] = k
+		}
+		return true
+	})
+
+	idict := s.Dict(i.dictName())
+	var stale []string
+	idict.ForEach(func(e string, v interface{}) bool {
+		if _, ok := want[e]; ok {
+			delete(want, e)
+		} else {
+			stale = append(stale, e)
+		}
+		return true
+	})
+
+	for _, e := range stale {
+		if err := idict.Del(e); err != nil && err != ErrNoSuchKey {
+			return err
+		}
+	}
+	for e, k := range want {
+		if err := idict.Put(e, k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *Transactional) index(dict, name string) (*index, error) {
+	for _, i := range t.indexes[dict] {
+		if i.name == name {
+			return i, nil
+		}
+	}
+	return nil, ErrNoSuchIndex
+}
+
+// Lookup iterates over the entries of dictionary dict that have ikey as an
+// index key in the given index. If a transaction is open, the uncommitted
+// modifications of the transaction are visible in the lookup.
+func (t *Transactional) Lookup(dict, index, ikey string, f IterFn) error {
+	i, err := t.index(dict, index)
+	if err != nil {
+		return err
+	}
+
+	d := t.Dict(dict)
+	td, tx := d.(*TxDict)
+	Prefix(t.Dict(i.dictName()), indexPrefix(ikey),
+		func(_ string, v interface{}) bool {
+			k := v.(string)
+			var val interface{}
+			var err error
+			if tx {
+				// Only the entries passed to f are recorded as reads.
+				if val, err = td.peek(k); err == nil {
+					td.read(k)
+				}
+			} else {
+				val, err = d.Get(k)
+			}
+			if err != nil {
+				return true
+			}
+			return f(k, val)
+		})
+	return nil
+}
+
+// updateIndexes updates the indexes of the dictionary, before the value of k is
+// replaced with v. If del is true, k is being deleted.
+func (d *TxDict) updateIndexes(k string, v interface{}, del bool) {
+	if d.tx == nil {
+		return
+	}
+	indexes := d.tx.indexes[d.Dict.Name()]
+	if len(indexes) == 0 {
+		return
+	}
+
+	// The old value is read only to maintain the index, and is not recorded as
+	// a read of the transaction.
+	old, err := d.peek(k)
+	for _, i := range indexes {
+		var oldKeys, newKeys []string
+		if err == nil {
+			oldKeys = i.fn(k, old)
+		}
+		if !del {
+			newKeys = i.fn(k, v)
+		}
+
+		idict := d.tx.Dict(i.dictName())
+		for _, ik := range oldKeys {
+			if !containsKey(newKeys, ik) {
+				idict.Del(indexEntry(ik, k))
+			}
+		}
+		for _, ik := range newKeys {
+			idict.Put(indexEntry(ik, k), k)
+		}
+	}
+}
+
+func containsKey(keys []string, k string) bool {
+	for _, key := range keys {
+		if key == k {
+			return true
+		}
+	}
+	return false
+}
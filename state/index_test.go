@@ -0,0 +1,170 @@
+package state
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+type indexTestUser struct {
+	Name string
+	City string
+}
+
+func byCity(k string, v interface{}) []string {
+	return []string{v.(indexTestUser).City}
+}
+
+func lookupKeys(t *testing.T, tx *Transactional, ikey string) []string {
+	var keys []string
+	err := tx.Lookup("users", "city", ikey, func(k string, v interface{}) bool {
+		if v.(indexTestUser).City != ikey {
+			t.Errorf("invalid value in lookup: actual=%v want=%v",
+				v.(indexTestUser).City, ikey)
+		}
+		keys = append(keys, k)
+		return true
+	})
+	if err != nil {
+		t.Fatalf("error in lookup: %v", err)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestIndex(t *testing.T) {
+	tx := NewTransactional(NewInMem())
+	if err := tx.AddIndex("users", "city", byCity); err != nil {
+		t.Fatalf("cannot add index: %v", err)
+	}
+	if err := tx.AddIndex("users", "city", byCity); err != ErrDupIndex {
+		t.Errorf("duplicate index is added: %v", err)
+	}
+
+	tx.BeginTx()
+	d := tx.Dict("users")
+	d.Put("u1", indexTestUser{Name: "a", City: "x"})
+	d.Put("u2", indexTestUser{Name: "b", City: "x"})
+	d.Put("u3", indexTestUser{Name: "c", City: "y"})
+	if keys := lookupKeys(t, tx, "x"); !reflect.DeepEqual(keys,
+		[]string{"u1", "u2"}) {
+
+		t.Errorf("invalid lookup in tx: actual=%v want=[u1 u2]", keys)
+	}
+	tx.CommitTx()
+
+	tx.BeginTx()
+	d = tx.Dict("users")
+	d.Put("u1", indexTestUser{Name: "a", City: "y"})
+	d.Del("u2")
+	if keys := lookupKeys(t, tx, "y"); !reflect.DeepEqual(keys,
+		[]string{"u1", "u3"}) {
+
+		t.Errorf("invalid lookup in tx: actual=%v want=[u1 u3]", keys)
+	}
+	if keys := lookupKeys(t, tx, "x"); len(keys) != 0 {
+		t.Errorf("invalid lookup in tx: actual=%v want=[]", keys)
+	}
+	tx.AbortTx()
+
+	if keys := lookupKeys(t, tx, "x"); !reflect.DeepEqual(keys,
+		[]string{"u1", "u2"}) {
+
+		t.Errorf("invalid lookup after abort: actual=%v want=[u1 u2]", keys)
+	}
+
+	if err := tx.Lookup("users", "name", "a", nil); err != ErrNoSuchIndex {
+		t.Errorf("lookup on a non-existing index: %v", err)
+	}
+}
+
+func TestIndexReplication(t *testing.T) {
+	leader := NewTransactional(NewInMem())
+	leader.AddIndex("users", "city", byCity)
+	follower := NewTransactional(NewInMem())
+	follower.AddIndex("users", "city", byCity)
+
+	leader.BeginTx()
+	leader.Dict("users").Put("u1", indexTestUser{Name: "a", City: "x"})
+	ops := leader.TxOps()
+	leader.CommitTx()
+
+	if err := follower.Apply(ops); err != nil {
+		t.Fatalf("cannot apply: %v", err)
+	}
+	if keys := lookupKeys(t, follower, "x"); !reflect.DeepEqual(keys,
+		[]string{"u1"}) {
+
+		t.Errorf("invalid lookup on follower: actual=%v want=[u1]", keys)
+	}
+}
+
+func TestIndexNestedTransactional(t *testing.T) {
+	l1 := NewTransactional(NewInMem())
+	l1.AddIndex("users", "city", byCity)
+	l1.BeginTx()
+
+	l2 := NewTransactional(l1)
+	l2.BeginTx()
+	l2.Dict("users").Put("u1", indexTestUser{Name: "a", City: "x"})
+	if keys := lookupKeys(t, l2, "x"); !reflect.DeepEqual(keys,
+		[]string{"u1"}) {
+
+		t.Errorf("invalid lookup in l2: actual=%v want=[u1]", keys)
+	}
+	l2.CommitTx()
+	l1.CommitTx()
+
+	if keys := lookupKeys(t, l1, "x"); !reflect.DeepEqual(keys,
+		[]string{"u1"}) {
+
+		t.Errorf("invalid lookup in l1: actual=%v want=[u1]", keys)
+	}
+}
+
+func TestIndexBackfill(t *testing.T) {
+	s := NewInMem()
+	d := s.Dict("users")
+	d.Put("u1", indexTestUser{Name: "a", City: "x"})
+	d.Put("u2", indexTestUser{Name: "b", City: "y"})
+
+	tx := NewTransactional(s)
+	if err := tx.AddIndex("users", "city", byCity); err != nil {
+		t.Fatalf("cannot add index: %v", err)
+	}
+	if keys := lookupKeys(t, tx, "x"); !reflect.DeepEqual(keys,
+		[]string{"u1"}) {
+
+		t.Errorf("existing entries are not indexed: actual=%v want=[u1]", keys)
+	}
+
+	d.Put("u1", indexTestUser{Name: "a", City: "y"})
+	tx = NewTransactional(s)
+	if err := tx.AddIndex("users", "city", byCity); err != nil {
+		t.Fatalf("cannot add index: %v", err)
+	}
+	if keys := lookupKeys(t, tx, "x"); len(keys) != 0 {
+		t.Errorf("stale entries are not removed: actual=%v want=[]", keys)
+	}
+	if keys := lookupKeys(t, tx, "y"); !reflect.DeepEqual(keys,
+		[]string{"u1", "u2"}) {
+
+		t.Errorf("invalid lookup after rebuild: actual=%v want=[u1 u2]", keys)
+	}
+}
+
+func TestIndexUpdateIsNotARead(t *testing.T) {
+	s := NewInMem()
+	s.Dict("users").Put("u1", indexTestUser{Name: "a", City: "x"})
+	tx := NewTransactional(s)
+	tx.AddIndex("users", "city", byCity)
+	tx.TrackReads(true)
+
+	tx.BeginTx()
+	tx.Dict("users").Put("u1", indexTestUser{Name: "a", City: "y"})
+	s.Dict("users").Put("u2", indexTestUser{Name: "b", City: "y"})
+	s.Dict("users").Put("u1", indexTestUser{Name: "c", City: "z"})
+	if err := tx.CommitTx(); err != nil {
+		t.Errorf("blind put conflicts with a concurrent put: %v", err)
+	}
+}
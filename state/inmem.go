@@ -3,6 +3,7 @@ package state
 import (
 	"bytes"
 	"encoding/gob"
+	"time"
 )
 
 // InMem is a simple dictionary that uses in memory maps.
@@ -59,6 +60,9 @@ func (s *InMem) inMemDict(name string) *inMemDict {
 type inMemDict struct {
 	DictName string
 	Dict     map[string]interface{}
+	Expiries map[string]time.Time
+
+	versions map[string]uint64
 }
 
 func (d inMemDict) Name() string {
@@ -75,6 +79,8 @@ func (d *inMemDict) Get(k string) (interface{}, error) {
 
 func (d *inMemDict) Put(k string, v interface{}) error {
 	d.Dict[k] = v
+	delete(d.Expiries, k)
+	d.modified(k)
 	return nil
 }
 
@@ -84,6 +90,8 @@ func (d *inMemDict) Del(k string) error {
 	}
 
 	delete(d.Dict, k)
+	delete(d.Expiries, k)
+	d.modified(k)
 	return nil
 }
 
@@ -94,3 +102,18 @@ func (d *inMemDict) ForEach(f IterFn) {
 		}
 	}
 }
+
+func (d *inMemDict) Range(from, to string, f IterFn, opts ...IterOption) {
+	var keys []string
+	for k := range d.Dict {
+		if inRange(k, from, to) {
+			keys = append(keys, k)
+		}
+	}
+	iterSorted(keys, func(k string) interface{} { return d.Dict[k] }, f,
+		newIterOptions(opts))
+}
+
+func (d *inMemDict) Prefix(prefix string, f IterFn, opts ...IterOption) {
+	d.Range(prefix, prefixEnd(prefix), f, opts...)
+}
@@ -0,0 +1,105 @@
+package state
+
+import "sort"
+
+// keyBlockLen is the number of keys after which a block of a keyIndex is split.
+const keyBlockLen = 512
+
+// keyIndex is an ordered set of keys. Keys are kept sorted in blocks, so that
+// adding or removing a key moves only the keys of one block, and finding a key
+// is a binary search over the blocks followed by a binary search in the block.
+type keyIndex struct {
+	blocks [][]string // Sorted, and each block is non-empty.
+}
+
+// block returns the index of the first block whose last key is not smaller
+// than k. It returns len(x.blocks) if k is larger than all the keys.
+func (x *keyIndex) block(k string) int {
+	return sort.Search(len(x.blocks), func(i int) bool {
+		b := x.blocks[i]
+		return b[len(b)-1] >= k
+	})
+}
+
+// add adds k to the index, if it is not already in the index.
+func (x *keyIndex) add(k string) {
+	if len(x.blocks) == 0 {
+		x.blocks = [][]string{{k}}
+		return
+	}
+
+	i := x.block(k)
+	if i == len(x.blocks) {
+		i--
+	}
+	b := x.blocks[i]
+	j := sort.SearchStrings(b, k)
+	if j < len(b) && b[j] == k {
+		return
+	}
+	b = append(b, "")
+	copy(b[j+1:], b[j:])
+	b[j] = k
+
+	if len(b) < 2*keyBlockLen {
+		x.blocks[i] = b
+		return
+	}
+
+	// Split the block in two.
+	l := append([]string(nil), b[:keyBlockLen]...)
+	r := append([]string(nil), b[keyBlockLen:]...)
+	x.blocks = append(x.blocks, nil)
+	copy(x.blocks[i+2:], x.blocks[i+1:])
+	x.blocks[i], x.blocks[i+1] = l, r
+}
+
+// del removes k from the index.
+func (x *keyIndex) del(k string) {
+	i := x.block(k)
+	if i == len(x.blocks) {
+		return
+	}
+	b := x.blocks[i]
+	j := sort.SearchStrings(b, k)
+	if j == len(b) || b[j] != k {
+		return
+	}
+	copy(b[j:], b[j+1:])
+	b[len(b)-1] = ""
+	b = b[:len(b)-1]
+	if len(b) != 0 {
+		x.blocks[i] = b
+		return
+	}
+	copy(x.blocks[i:], x.blocks[i+1:])
+	x.blocks[len(x.blocks)-1] = nil
+	x.blocks = x.blocks[:len(x.blocks)-1]
+}
+
+// keys returns the keys in [from, to) in the order of iteration. An empty to
+// means there is no upper bound.
+func (x *keyIndex) keys(from, to string, o iterOptions) []string {
+	var keys []string
+blocks:
+	for i := x.block(from); i < len(x.blocks); i++ {
+		b := x.blocks[i]
+		j := 0
+		if b[0] < from {
+			j = sort.SearchStrings(b, from)
+		}
+		for ; j < len(b); j++ {
+			if to != "" && b[j] >= to {
+				break blocks
+			}
+			keys = append(keys, b[j])
+		}
+	}
+
+	if o.reverse {
+		for i, j := 0, len(keys)-1; i < j; i, j = i+1, j-1 {
+			keys[i], keys[j] = keys[j], keys[i]
+		}
+	}
+	return keys
+}
@@ -0,0 +1,64 @@
+package state
+
+import (
+	"math/rand"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+func TestKeyIndex(t *testing.T) {
+	var x keyIndex
+	set := make(map[string]bool)
+	for i := 0; i < 10*keyBlockLen; i++ {
+		k := strconv.Itoa(rand.Intn(5 * keyBlockLen))
+		if rand.Intn(3) == 0 {
+			x.del(k)
+			delete(set, k)
+			continue
+		}
+		x.add(k)
+		set[k] = true
+	}
+
+	var want []string
+	for k := range set {
+		want = append(want, k)
+	}
+	sort.Strings(want)
+	if keys := x.keys("", "", iterOptions{}); !reflect.DeepEqual(keys, want) {
+		t.Fatalf("invalid keys: actual=%v want=%v", len(keys), len(want))
+	}
+	for _, b := range x.blocks {
+		if len(b) == 0 || len(b) >= 2*keyBlockLen {
+			t.Errorf("invalid block size: %v", len(b))
+		}
+	}
+
+	from, to := "2", "3"
+	var inRng []string
+	for _, k := range want {
+		if inRange(k, from, to) {
+			inRng = append(inRng, k)
+		}
+	}
+	if keys := x.keys(from, to, iterOptions{}); !reflect.DeepEqual(keys,
+		inRng) {
+
+		t.Errorf("invalid keys in range: actual=%v want=%v", keys, inRng)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(inRng)))
+	if keys := x.keys(from, to, iterOptions{reverse: true}); !reflect.DeepEqual(
+		keys, inRng) {
+
+		t.Errorf("invalid keys in reverse: actual=%v want=%v", keys, inRng)
+	}
+
+	for _, k := range want {
+		x.del(k)
+	}
+	if len(x.blocks) != 0 {
+		t.Errorf("blocks remain after deleting all keys: %v", len(x.blocks))
+	}
+}
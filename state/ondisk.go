@@ -0,0 +1,719 @@
+package state
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
+	bhgob "github.com/kandoo/beehive/gob"
+)
+
+var (
+	ErrClosed          error = errors.New("state: closed")
+	ErrInvalidSnapshot error = errors.New("state: invalid snapshot")
+)
+
+const (
+	onDiskExt = ".dict"
+	// Size of the record header: crc (4), op (1), key length (4) and value
+	// length (4).
+	onDiskHdrLen = 13
+	// The minimum number of stale bytes in a dictionary file before we consider
+	// compacting it.
+	onDiskMinCompact = 1 << 20
+	// onDiskTTL is the type of records that set the deadline of a key. These
+	// records are written by older versions, and are only read.
+	onDiskTTL OpType = 0x7f
+	// onDiskPutTTL is the type of records that put a key with a deadline. The
+	// value of these records is the deadline followed by the value of the key.
+	onDiskPutTTL OpType = 0x7e
+	// Size of the deadline in onDiskPutTTL records.
+	onDiskDeadlineLen = 8
+)
+
+// OnDisk is a state that stores each dictionary in an append-only log file
+// under a directory. Only the keys, in a sorted index, and the position of
+// their latest values are kept in memory, and values are read from the disk on
+// demand. As such, it is suitable for dictionaries that do not fit in memory.
+//
+// Values are encoded using gob, and must be registered in gob.
+type OnDisk struct {
+	sync.Mutex
+
+	dir    string
+	dicts  map[string]*onDiskDict
+	closed bool
+}
+
+// NewOnDisk opens the on-disk state stored in dir. If dir does not exist, it
+// creates an empty state in dir.
+func NewOnDisk(dir string) (*OnDisk, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	s := &OnDisk{
+		dir:   dir,
+		dicts: make(map[string]*onDiskDict),
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), onDiskExt) {
+			continue
+		}
+		name, err := hex.DecodeString(strings.TrimSuffix(f.Name(), onDiskExt))
+		if err != nil {
+			glog.Warningf("state: ignoring invalid file %v in %v", f.Name(), dir)
+			continue
+		}
+		d, err := s.openDict(string(name))
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.dicts[d.name] = d
+	}
+	return s, nil
+}
+
+// Dir returns the directory of this state.
+func (s *OnDisk) Dir() string {
+	return s.dir
+}
+
+// Dict returns the dictionary with the given name. If the dictionary cannot be
+// opened, it returns a dictionary that fails all operations with the error.
+func (s *OnDisk) Dict(name string) Dict {
+	s.Lock()
+	defer s.Unlock()
+
+	d, ok := s.dicts[name]
+	if ok {
+		return d
+	}
+
+	if s.closed {
+		return failedDict{name: name, err: ErrClosed}
+	}
+
+	d, err := s.openDict(name)
+	if err != nil {
+		glog.Errorf("state: cannot create dictionary %v in %v: %v", name, s.dir,
+			err)
+		return failedDict{name: name, err: err}
+	}
+	s.dicts[name] = d
+	return d
+}
+
+func (s *OnDisk) Dicts() []Dict {
+	s.Lock()
+	defer s.Unlock()
+
+	dicts := make([]Dict, 0, len(s.dicts))
+	for _, d := range s.dicts {
+		dicts = append(dicts, d)
+	}
+	return dicts
+}
+
+// Save returns the live records of all dictionaries in the format of the
+// dictionary files: values are copied as they are stored on the disk, without
+// being decoded and re-encoded. Note that the raft snapshots of bees do not use
+// Save, and are saved incrementally using SaveChunks.
+func (s *OnDisk) Save() ([]byte, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.closed {
+		return nil, ErrClosed
+	}
+
+	var b []byte
+	for n, d := range s.dicts {
+		var recs []byte
+		err := d.liveRecords(func(op OpType, k string, rec []byte) error {
+			recs = append(recs, rec...)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		b = appendBlock(b, []byte(n))
+		b = appendBlock(b, recs)
+	}
+	return b, nil
+}
+
+// Restore replaces all the dictionaries in this state with the ones saved in b.
+func (s *OnDisk) Restore(b []byte) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.closed {
+		return ErrClosed
+	}
+
+	if err := s.clear(); err != nil {
+		return err
+	}
+
+	for len(b) != 0 {
+		var name, recs []byte
+		var err error
+		if name, b, err = readBlock(b); err != nil {
+			return err
+		}
+		if recs, b, err = readBlock(b); err != nil {
+			return err
+		}
+
+		d, err := s.openDict(string(name))
+		if err != nil {
+			return err
+		}
+		s.dicts[d.name] = d
+		if _, err := d.file.WriteAt(recs, 0); err != nil {
+			return err
+		}
+		if err := d.load(); err != nil {
+			return err
+		}
+		if d.size != int64(len(recs)) {
+			return fmt.Errorf("state: invalid snapshot for dictionary %v", d.name)
+		}
+	}
+	return s.sync()
+}
+
+// appendBlock appends the size of blk and blk to b.
+func appendBlock(b, blk []byte) []byte {
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(len(blk)))
+	return append(append(b, size[:]...), blk...)
+}
+
+// readBlock reads a block appended using appendBlock from b, and returns the
+// rest of b.
+func readBlock(b []byte) (blk, rest []byte, err error) {
+	if len(b) < 4 {
+		return nil, nil, ErrInvalidSnapshot
+	}
+	size := int(binary.BigEndian.Uint32(b))
+	if len(b)-4 < size {
+		return nil, nil, ErrInvalidSnapshot
+	}
+	return b[4 : 4+size], b[4+size:], nil
+}
+
+// Sync commits the contents of all dictionaries to stable storage.
+func (s *OnDisk) Sync() error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.closed {
+		return ErrClosed
+	}
+	return s.sync()
+}
+
+func (s *OnDisk) sync() error {
+	for _, d := range s.dicts {
+		if err := d.file.Sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close syncs and closes all the dictionary files of this state.
+func (s *OnDisk) Close() error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.closed {
+		return ErrClosed
+	}
+	s.closed = true
+
+	var err error
+	for _, d := range s.dicts {
+		if serr := d.file.Sync(); serr != nil && err == nil {
+			err = serr
+		}
+		if cerr := d.file.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+func (s *OnDisk) openDict(name string) (*onDiskDict, error) {
+	d := &onDiskDict{
+		state:    s,
+		name:     name,
+		index:    make(map[string]onDiskPos),
+		expiries: make(map[string]time.Time),
+		versions: make(map[string]uint64),
+	}
+
+	f, err := os.OpenFile(d.path(), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	d.file = f
+
+	if err := d.load(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+// onDiskPos is the position of a record in a dictionary file.
+type onDiskPos struct {
+	off  int64 // Offset of the record.
+	klen uint32
+	vlen uint32 // Length of the value of the record, including the deadline.
+	ttl  bool   // Whether the record is an onDiskPutTTL record.
+}
+
+func newOnDiskPos(op OpType, off int64, klen, vlen uint32) onDiskPos {
+	return onDiskPos{off: off, klen: klen, vlen: vlen, ttl: op == onDiskPutTTL}
+}
+
+func (p onDiskPos) size() int64 {
+	return onDiskHdrLen + int64(p.klen) + int64(p.vlen)
+}
+
+// value returns the offset and the length of the value of the key.
+func (p onDiskPos) value() (off int64, n uint32) {
+	off, n = p.off+onDiskHdrLen+int64(p.klen), p.vlen
+	if p.ttl {
+		off, n = off+onDiskDeadlineLen, n-onDiskDeadlineLen
+	}
+	return
+}
+
+type onDiskDict struct {
+	state *OnDisk
+	name  string
+	file  *os.File
+	size  int64 // Size of the file.
+	stale int64 // Bytes occupied by overwritten and deleted records.
+	index map[string]onDiskPos
+	keys  keyIndex // The keys of index in order.
+	// Deadlines of the keys that have a TTL.
+	expiries map[string]time.Time
+	versions map[string]uint64
+}
+
+func (d *onDiskDict) path() string {
+	return path.Join(d.state.dir, hex.EncodeToString([]byte(d.name))+onDiskExt)
+}
+
+func (d *onDiskDict) Name() string {
+	return d.name
+}
+
+func (d *onDiskDict) Get(k string) (interface{}, error) {
+	d.state.Lock()
+	p, ok := d.index[k]
+	if !ok {
+		d.state.Unlock()
+		return nil, ErrNoSuchKey
+	}
+	b, err := d.readValue(p)
+	d.state.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return decodeValue(b)
+}
+
+func (d *onDiskDict) Put(k string, v interface{}) error {
+	b, err := encodeValue(v)
+	if err != nil {
+		return err
+	}
+
+	d.state.Lock()
+	defer d.state.Unlock()
+	if err := d.append(Put, k, b); err != nil {
+		return err
+	}
+	return d.maybeCompact()
+}
+
+func (d *onDiskDict) Del(k string) error {
+	d.state.Lock()
+	defer d.state.Unlock()
+
+	if _, ok := d.index[k]; !ok {
+		return ErrNoSuchKey
+	}
+	if err := d.append(Del, k, nil); err != nil {
+		return err
+	}
+	return d.maybeCompact()
+}
+
+func (d *onDiskDict) ForEach(f IterFn) {
+	// We copy the keys, since f might modify the dictionary.
+	d.state.Lock()
+	keys := make([]string, 0, len(d.index))
+	for k := range d.index {
+		keys = append(keys, k)
+	}
+	d.state.Unlock()
+
+	for _, k := range keys {
+		v, err := d.Get(k)
+		if err == ErrNoSuchKey {
+			continue
+		}
+		if err != nil {
+			glog.Errorf("state: cannot read %v from %v: %v", k, d.name, err)
+			continue
+		}
+		if !f(k, v) {
+			return
+		}
+	}
+}
+
+func (d *onDiskDict) Range(from, to string, f IterFn, opts ...IterOption) {
+	// We copy the keys, since f might modify the dictionary.
+	o := newIterOptions(opts)
+	d.state.Lock()
+	keys := d.keys.keys(from, to, o)
+	d.state.Unlock()
+
+	d.iterKeys(keys, f, o)
+}
+
+func (d *onDiskDict) Prefix(prefix string, f IterFn, opts ...IterOption) {
+	d.Range(prefix, prefixEnd(prefix), f, opts...)
+}
+
+// iterKeys calls f for the keys, in order, that are still in the dictionary.
+func (d *onDiskDict) iterKeys(keys []string, f IterFn, o iterOptions) {
+	f = o.limited(f)
+	for _, k := range keys {
+		v, err := d.Get(k)
+		if err == ErrNoSuchKey {
+			continue
+		}
+		if err != nil {
+			glog.Errorf("state: cannot read %v from %v: %v", k, d.name, err)
+			continue
+		}
+		if !f(k, v) {
+			return
+		}
+	}
+}
+
+// append writes a record at the end of the dictionary file and updates the
+// index. It must be called with the state locked.
+func (d *onDiskDict) append(op OpType, k string, v []byte) error {
+	if d.state.closed {
+		return ErrClosed
+	}
+
+	p := newOnDiskPos(op, d.size, uint32(len(k)), uint32(len(v)))
+	if _, err := d.file.WriteAt(encodeRecord(op, k, v), d.size); err != nil {
+		return err
+	}
+	d.size += p.size()
+	d.track(op, k, p, v)
+	return nil
+}
+
+// track updates the index and the expiries for a record written at p.
+func (d *onDiskDict) track(op OpType, k string, p onDiskPos, v []byte) {
+	if op == onDiskTTL {
+		if _, ok := d.expiries[k]; ok {
+			d.stale += p.size()
+		}
+		d.expiries[k] = decodeDeadline(v)
+		return
+	}
+
+	old, ok := d.index[k]
+	if ok {
+		d.stale += old.size()
+	}
+	if _, exp := d.expiries[k]; exp {
+		if !ok || !old.ttl {
+			// The deadline is set by a separate onDiskTTL record.
+			d.stale += onDiskHdrLen + int64(len(k)) + onDiskDeadlineLen
+		}
+		delete(d.expiries, k)
+	}
+
+	d.versions[k] = nextVersion()
+	switch op {
+	case Put, onDiskPutTTL:
+		if !ok {
+			d.keys.add(k)
+		}
+		d.index[k] = p
+		if op == onDiskPutTTL {
+			d.expiries[k] = decodeDeadline(v[:onDiskDeadlineLen])
+		}
+	case Del:
+		if ok {
+			d.keys.del(k)
+		}
+		delete(d.index, k)
+		d.stale += p.size()
+	}
+}
+
+func (d *onDiskDict) readValue(p onDiskPos) ([]byte, error) {
+	if d.state.closed {
+		return nil, ErrClosed
+	}
+	off, n := p.value()
+	b := make([]byte, n)
+	_, err := d.file.ReadAt(b, off)
+	return b, err
+}
+
+// load rebuilds the index by reading all the records of the file. If the last
+// record is partially written, the file is truncated to the last valid record.
+func (d *onDiskDict) load() error {
+	var hdr [onDiskHdrLen]byte
+	for {
+		n, err := d.file.ReadAt(hdr[:], d.size)
+		if err == io.EOF && n == 0 {
+			return nil
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if n < onDiskHdrLen {
+			return d.truncate()
+		}
+
+		op := OpType(hdr[4])
+		switch op {
+		case Put, Del, onDiskTTL, onDiskPutTTL:
+		default:
+			return fmt.Errorf("state: invalid record at %v in %v", d.size, d.path())
+		}
+
+		p := newOnDiskPos(op, d.size, binary.BigEndian.Uint32(hdr[5:9]),
+			binary.BigEndian.Uint32(hdr[9:13]))
+		if op == onDiskPutTTL && p.vlen < onDiskDeadlineLen {
+			return fmt.Errorf("state: invalid record at %v in %v", d.size, d.path())
+		}
+		rec := make([]byte, p.size()-4)
+		copy(rec, hdr[4:])
+		n, err = d.file.ReadAt(rec[onDiskHdrLen-4:], d.size+onDiskHdrLen)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if n < len(rec)-(onDiskHdrLen-4) ||
+			crc32.ChecksumIEEE(rec) != binary.BigEndian.Uint32(hdr[0:4]) {
+
+			return d.truncate()
+		}
+
+		k := string(rec[onDiskHdrLen-4 : onDiskHdrLen-4+int(p.klen)])
+		d.track(op, k, p, rec[onDiskHdrLen-4+int(p.klen):])
+		d.size += p.size()
+	}
+}
+
+func (d *onDiskDict) truncate() error {
+	glog.Warningf("state: truncating %v to %v bytes", d.path(), d.size)
+	return d.file.Truncate(d.size)
+}
+
+// maybeCompact rewrites the dictionary file without its stale records, if
+// stale records occupy more than half of the file.
+func (d *onDiskDict) maybeCompact() error {
+	if d.stale < onDiskMinCompact || d.stale < d.size/2 {
+		return nil
+	}
+	return d.compact()
+}
+
+func (d *onDiskDict) compact() error {
+	glog.V(2).Infof("state: compacting %v (size=%v, stale=%v)", d.path(), d.size,
+		d.stale)
+
+	tmp := d.path() + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	index := make(map[string]onDiskPos, len(d.index))
+	size := int64(0)
+	err = d.liveRecords(func(op OpType, k string, rec []byte) error {
+		if _, err := f.WriteAt(rec, size); err != nil {
+			return err
+		}
+		if op != onDiskTTL {
+			index[k] = newOnDiskPos(op, size, uint32(len(k)),
+				uint32(len(rec)-onDiskHdrLen-len(k)))
+		}
+		size += int64(len(rec))
+		return nil
+	})
+	if err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, d.path()); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	d.file.Close()
+	d.file = f
+	d.index = index
+	d.size = size
+	d.stale = 0
+	return nil
+}
+
+// liveRecords calls f for the records of the keys in the dictionary, followed
+// by the records of the deadlines that are not stored with their keys. It must
+// be called with the state locked.
+func (d *onDiskDict) liveRecords(f func(op OpType, k string,
+	rec []byte) error) error {
+
+	for k, p := range d.index {
+		rec := make([]byte, p.size())
+		if _, err := d.file.ReadAt(rec, p.off); err != nil {
+			return err
+		}
+		if err := f(OpType(rec[4]), k, rec); err != nil {
+			return err
+		}
+	}
+	for k, t := range d.expiries {
+		if d.index[k].ttl {
+			continue
+		}
+		if err := f(onDiskTTL, k, encodeRecord(onDiskTTL, k,
+			encodeDeadline(t))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func encodeRecord(op OpType, k string, v []byte) []byte {
+	rec := make([]byte, onDiskHdrLen+len(k)+len(v))
+	rec[4] = byte(op)
+	binary.BigEndian.PutUint32(rec[5:9], uint32(len(k)))
+	binary.BigEndian.PutUint32(rec[9:13], uint32(len(v)))
+	copy(rec[onDiskHdrLen:], k)
+	copy(rec[onDiskHdrLen+len(k):], v)
+	binary.BigEndian.PutUint32(rec[0:4], crc32.ChecksumIEEE(rec[4:]))
+	return rec
+}
+
+func encodeDeadline(t time.Time) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(t.UnixNano()))
+	return b
+}
+
+func decodeDeadline(b []byte) time.Time {
+	return time.Unix(0, int64(binary.BigEndian.Uint64(b)))
+}
+
+// diskValue wraps values stored on disk so that gob can encode interfaces.
+type diskValue struct {
+	V interface{}
+}
+
+func encodeValue(v interface{}) ([]byte, error) {
+	return bhgob.Encode(diskValue{V: v})
+}
+
+func decodeValue(b []byte) (interface{}, error) {
+	var dv diskValue
+	if err := bhgob.Decode(&dv, b); err != nil {
+		return nil, err
+	}
+	return dv.V, nil
+}
+
+// failedDict is a dictionary that could not be opened. All its operations
+// fail with the error of opening the dictionary.
+type failedDict struct {
+	name string
+	err  error
+}
+
+func (d failedDict) Name() string {
+	return d.name
+}
+
+func (d failedDict) Get(k string) (interface{}, error) {
+	return nil, d.err
+}
+
+func (d failedDict) Put(k string, v interface{}) error {
+	return d.err
+}
+
+func (d failedDict) Del(k string) error {
+	return d.err
+}
+
+func (d failedDict) ForEach(f IterFn) {}
+
+func (d failedDict) Range(from, to string, f IterFn, opts ...IterOption) {}
+
+func (d failedDict) Prefix(prefix string, f IterFn, opts ...IterOption) {}
+
+func (d failedDict) PutWithTTL(k string, v interface{},
+	ttl time.Duration) error {
+
+	return d.err
+}
+
+func (d failedDict) PutWithDeadline(k string, v interface{},
+	deadline time.Time) error {
+
+	return d.err
+}
+
+func (d failedDict) Deadline(k string) (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (d failedDict) Expired(now time.Time, f IterFn) {}
+
+var _ ExpiringDict = failedDict{}
+var _ OrderedDict = failedDict{}
@@ -0,0 +1,204 @@
+package state
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func newOnDiskForTest(t *testing.T) (*OnDisk, string) {
+	dir, err := ioutil.TempDir("", "bhstate")
+	if err != nil {
+		t.Fatalf("cannot create temp dir: %v", err)
+	}
+	s, err := NewOnDisk(dir)
+	if err != nil {
+		t.Fatalf("cannot open on-disk state: %v", err)
+	}
+	return s, dir
+}
+
+func TestOnDiskPutGetDel(t *testing.T) {
+	s, dir := newOnDiskForTest(t)
+	defer os.RemoveAll(dir)
+	defer s.Close()
+
+	d := s.Dict("d")
+	if err := d.Put("k", "v"); err != nil {
+		t.Errorf("error in put: %v", err)
+	}
+	v, err := d.Get("k")
+	if err != nil {
+		t.Errorf("error in get: %v", err)
+	}
+	if v.(string) != "v" {
+		t.Errorf("invalid value: actual=%v want=v", v)
+	}
+	if err := d.Del("k"); err != nil {
+		t.Errorf("error in del: %v", err)
+	}
+	if _, err := d.Get("k"); err != ErrNoSuchKey {
+		t.Errorf("value found for deleted key: %v", err)
+	}
+	if err := d.Del("k"); err != ErrNoSuchKey {
+		t.Errorf("deleted a non-existing key: %v", err)
+	}
+}
+
+func TestOnDiskReopen(t *testing.T) {
+	s, dir := newOnDiskForTest(t)
+	defer os.RemoveAll(dir)
+
+	d := s.Dict("d/1")
+	d.Put("k1", "v1")
+	d.Put("k2", "v2")
+	d.Put("k1", "v3")
+	d.Del("k2")
+	if err := s.Close(); err != nil {
+		t.Fatalf("cannot close the state: %v", err)
+	}
+
+	s, err := NewOnDisk(dir)
+	if err != nil {
+		t.Fatalf("cannot reopen the state: %v", err)
+	}
+	defer s.Close()
+
+	if l := len(s.Dicts()); l != 1 {
+		t.Errorf("invalid number of dictionaries: actual=%v want=1", l)
+	}
+	v, err := s.Dict("d/1").Get("k1")
+	if err != nil || v.(string) != "v3" {
+		t.Errorf("invalid value for k1: actual=%v want=v3 (err=%v)", v, err)
+	}
+	if _, err := s.Dict("d/1").Get("k2"); err == nil {
+		t.Error("deleted key is reloaded")
+	}
+}
+
+func TestOnDiskSaveRestore(t *testing.T) {
+	src, sdir := newOnDiskForTest(t)
+	defer os.RemoveAll(sdir)
+	defer src.Close()
+
+	tx := NewTransactional(src)
+	tx.BeginTx()
+	tx.Dict("d").Put("k", "v")
+	tx.CommitTx()
+
+	b, err := tx.Save()
+	if err != nil {
+		t.Fatalf("cannot save: %v", err)
+	}
+
+	dst, ddir := newOnDiskForTest(t)
+	defer os.RemoveAll(ddir)
+	defer dst.Close()
+
+	dst.Dict("d").Put("old", "v")
+	dst.Dict("old").Put("k", "v")
+	if err := dst.Restore(b); err != nil {
+		t.Fatalf("cannot restore: %v", err)
+	}
+
+	if l := len(dst.Dicts()); l != 1 {
+		t.Errorf("invalid number of dictionaries: actual=%v want=1", l)
+	}
+	if _, err := dst.Dict("d").Get("old"); err == nil {
+		t.Error("stale key remains after restore")
+	}
+	v, err := dst.Dict("d").Get("k")
+	if err != nil || v.(string) != "v" {
+		t.Errorf("invalid value after restore: actual=%v want=v (err=%v)", v, err)
+	}
+}
+
+func TestOnDiskRestoreTx(t *testing.T) {
+	s, dir := newOnDiskForTest(t)
+	defer os.RemoveAll(dir)
+	defer s.Close()
+
+	tx := NewTransactional(s)
+	tx.BeginTx()
+	tx.Dict("d").Put("k1", "v")
+	tx.CommitTx()
+	b, err := tx.Save()
+	if err != nil {
+		t.Fatalf("cannot save: %v", err)
+	}
+	if err := tx.Restore(b); err != nil {
+		t.Fatalf("cannot restore: %v", err)
+	}
+
+	tx.BeginTx()
+	tx.Dict("d").Put("k2", "v")
+	if err := tx.CommitTx(); err != nil {
+		t.Fatalf("cannot commit after restore: %v", err)
+	}
+	for _, k := range []string{"k1", "k2"} {
+		if _, err := s.Dict("d").Get(k); err != nil {
+			t.Errorf("cannot get %v after restore: %v", k, err)
+		}
+	}
+}
+
+func TestOnDiskCompact(t *testing.T) {
+	s, dir := newOnDiskForTest(t)
+	defer os.RemoveAll(dir)
+	defer s.Close()
+
+	d := s.Dict("d").(*onDiskDict)
+	for i := 0; i < 10; i++ {
+		d.Put("k", i)
+	}
+	d.Put("j", "v")
+	if err := d.compact(); err != nil {
+		t.Fatalf("cannot compact: %v", err)
+	}
+	if d.stale != 0 {
+		t.Errorf("stale bytes after compaction: %v", d.stale)
+	}
+	v, err := d.Get("k")
+	if err != nil || v.(int) != 9 {
+		t.Errorf("invalid value after compaction: actual=%v want=9 (err=%v)", v,
+			err)
+	}
+	if err := d.Put("k", 10); err != nil {
+		t.Errorf("cannot put after compaction: %v", err)
+	}
+}
+
+func TestOnDiskOrdered(t *testing.T) {
+	s, dir := newOnDiskForTest(t)
+	defer os.RemoveAll(dir)
+	defer s.Close()
+
+	testOrderedDict(t, s.Dict("d"))
+}
+
+func TestOnDiskClosed(t *testing.T) {
+	s, dir := newOnDiskForTest(t)
+	defer os.RemoveAll(dir)
+
+	s.Dict("d").Put("k", "v")
+	b, err := s.Save()
+	if err != nil {
+		t.Fatalf("cannot save: %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("cannot close: %v", err)
+	}
+
+	for _, n := range []string{"d", "new"} {
+		if err := s.Dict(n).Put("k", "v"); err != ErrClosed {
+			t.Errorf("can put in %v after close: %v", n, err)
+		}
+	}
+
+	dst, ddir := newOnDiskForTest(t)
+	defer os.RemoveAll(ddir)
+	defer dst.Close()
+	if err := dst.Restore(b[:len(b)-1]); err == nil {
+		t.Error("truncated snapshot is restored")
+	}
+}
@@ -1,5 +1,7 @@
 package state
 
+import "time"
+
 // OpType is the type of an operation in a transaction.
 type OpType int
 
@@ -16,4 +18,22 @@ type Op struct {
 	D string      // Dictionary.
 	K string      // Key.
 	V interface{} // Value.
+	E time.Time   // Expiration deadline of the key, if any.
+}
+
+// applyOp applies o on d.
+func applyOp(d Dict, o Op) error {
+	switch o.T {
+	case Put:
+		if o.E.IsZero() {
+			return d.Put(o.K, o.V)
+		}
+		if ed, ok := d.(ExpiringDict); ok {
+			return ed.PutWithDeadline(o.K, o.V, o.E)
+		}
+		return d.Put(o.K, o.V)
+	case Del:
+		return d.Del(o.K)
+	}
+	return nil
 }
@@ -0,0 +1,136 @@
+package state
+
+import "sort"
+
+// OrderedDict is a dictionary that can iterate over its entries in the order
+// of their keys.
+type OrderedDict interface {
+	Dict
+
+	// Range iterates over the entries whose keys are in [from, to) in the
+	// ascending order of keys (or descending, if Reverse() is passed). An empty
+	// to means there is no upper bound.
+	Range(from, to string, f IterFn, opts ...IterOption)
+	// Prefix iterates over the entries whose keys start with prefix in the
+	// order of their keys.
+	Prefix(prefix string, f IterFn, opts ...IterOption)
+}
+
+// IterOption represents an option for ordered iterations.
+type IterOption func(o *iterOptions)
+
+type iterOptions struct {
+	reverse bool
+	limit   int
+}
+
+// Reverse is an iteration option that iterates over keys in descending order.
+func Reverse() IterOption {
+	return func(o *iterOptions) {
+		o.reverse = true
+	}
+}
+
+// Limit is an iteration option that stops the iteration after visiting n
+// entries. 0 means no limit.
+func Limit(n int) IterOption {
+	return func(o *iterOptions) {
+		o.limit = n
+	}
+}
+
+func newIterOptions(opts []IterOption) (o iterOptions) {
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return
+}
+
+// before returns whether k1 is visited before k2.
+func (o iterOptions) before(k1, k2 string) bool {
+	if o.reverse {
+		return k1 > k2
+	}
+	return k1 < k2
+}
+
+// limited wraps f and stops the iteration after reaching the limit.
+func (o iterOptions) limited(f IterFn) IterFn {
+	if o.limit <= 0 {
+		return f
+	}
+	n := 0
+	return func(k string, v interface{}) bool {
+		n++
+		return f(k, v) && n < o.limit
+	}
+}
+
+// Range iterates over the entries of d whose keys are in [from, to). If d is
+// not an OrderedDict, the entries of d are sorted in memory.
+func Range(d Dict, from, to string, f IterFn, opts ...IterOption) {
+	if od, ok := d.(OrderedDict); ok {
+		od.Range(from, to, f, opts...)
+		return
+	}
+
+	var keys []string
+	vals := make(map[string]interface{})
+	d.ForEach(func(k string, v interface{}) bool {
+		if inRange(k, from, to) {
+			keys = append(keys, k)
+			vals[k] = v
+		}
+		return true
+	})
+	iterSorted(keys, func(k string) interface{} { return vals[k] }, f,
+		newIterOptions(opts))
+}
+
+// Prefix iterates over the entries of d whose keys start with prefix. If d is
+// not an OrderedDict, the entries of d are sorted in memory.
+func Prefix(d Dict, prefix string, f IterFn, opts ...IterOption) {
+	Range(d, prefix, prefixEnd(prefix), f, opts...)
+}
+
+func inRange(k, from, to string) bool {
+	return from <= k && (to == "" || k < to)
+}
+
+// prefixEnd returns the smallest key that is larger than all the keys starting
+// with prefix. If there is no such key, it returns "".
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return ""
+}
+
+// iterSorted sorts keys and calls f for each key and the value returned by get.
+func iterSorted(keys []string, get func(k string) interface{}, f IterFn,
+	o iterOptions) {
+
+	sortKeys(keys, o)
+	f = o.limited(f)
+	for _, k := range keys {
+		if !f(k, get(k)) {
+			return
+		}
+	}
+}
+
+func sortKeys(keys []string, o iterOptions) {
+	if o.reverse {
+		sort.Sort(sort.Reverse(sort.StringSlice(keys)))
+		return
+	}
+	sort.Strings(keys)
+}
+
+var _ OrderedDict = &inMemDict{}
+var _ OrderedDict = &onDiskDict{}
+var _ OrderedDict = &TxDict{}
@@ -0,0 +1,114 @@
+package state
+
+import (
+	"reflect"
+	"testing"
+)
+
+func collectKeys(iter func(f IterFn)) (keys []string) {
+	iter(func(k string, v interface{}) bool {
+		keys = append(keys, k)
+		return true
+	})
+	return
+}
+
+func testOrderedDict(t *testing.T, d Dict) {
+	for _, k := range []string{"b", "a/2", "a/1", "c", "a/3"} {
+		d.Put(k, k)
+	}
+
+	tests := []struct {
+		iter func(f IterFn)
+		want []string
+	}{
+		{
+			iter: func(f IterFn) { Range(d, "", "", f) },
+			want: []string{"a/1", "a/2", "a/3", "b", "c"},
+		},
+		{
+			iter: func(f IterFn) { Range(d, "a/2", "c", f) },
+			want: []string{"a/2", "a/3", "b"},
+		},
+		{
+			iter: func(f IterFn) { Range(d, "a/2", "c", f, Reverse()) },
+			want: []string{"b", "a/3", "a/2"},
+		},
+		{
+			iter: func(f IterFn) { Prefix(d, "a/", f) },
+			want: []string{"a/1", "a/2", "a/3"},
+		},
+		{
+			iter: func(f IterFn) { Prefix(d, "a/", f, Reverse(), Limit(2)) },
+			want: []string{"a/3", "a/2"},
+		},
+	}
+
+	for i, test := range tests {
+		if keys := collectKeys(test.iter); !reflect.DeepEqual(keys, test.want) {
+			t.Errorf("invalid keys for test %d: actual=%v want=%v", i, keys,
+				test.want)
+		}
+	}
+}
+
+func TestInMemOrdered(t *testing.T) {
+	testOrderedDict(t, NewInMem().Dict("d"))
+}
+
+func TestTxDictOrdered(t *testing.T) {
+	tx := NewTransactional(NewInMem())
+	tx.BeginTx()
+	testOrderedDict(t, tx.Dict("d"))
+}
+
+func TestTxDictOrderedMerge(t *testing.T) {
+	tx := NewTransactional(NewInMem())
+	for _, k := range []string{"a", "c", "e", "g"} {
+		tx.Dict("d").Put(k, k)
+	}
+
+	tx.BeginTx()
+	d := tx.Dict("d")
+	d.Put("b", "b")
+	d.Put("c", "c2")
+	d.Del("e")
+	d.Put("h", "h")
+
+	want := []string{"a", "b", "c", "g", "h"}
+	if keys := collectKeys(func(f IterFn) {
+		Range(d, "", "", f)
+	}); !reflect.DeepEqual(keys, want) {
+		t.Errorf("invalid keys: actual=%v want=%v", keys, want)
+	}
+
+	want = []string{"h", "g", "c"}
+	if keys := collectKeys(func(f IterFn) {
+		Range(d, "", "", f, Reverse(), Limit(3))
+	}); !reflect.DeepEqual(keys, want) {
+		t.Errorf("invalid reverse keys: actual=%v want=%v", keys, want)
+	}
+
+	Range(d, "c", "d", func(k string, v interface{}) bool {
+		if v.(string) != "c2" {
+			t.Errorf("uncommitted value is not used: actual=%v want=c2", v)
+		}
+		return true
+	})
+}
+
+func TestPrefixEnd(t *testing.T) {
+	tests := map[string]string{
+		"":       "",
+		"a":      "b",
+		"ab":     "ac",
+		"a\xff":  "b",
+		"\xff":   "",
+		"a/\xff": "a0",
+	}
+	for p, want := range tests {
+		if end := prefixEnd(p); end != want {
+			t.Errorf("invalid prefix end for %q: actual=%q want=%q", p, end, want)
+		}
+	}
+}
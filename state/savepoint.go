@@ -0,0 +1,121 @@
+package state
+
+import "errors"
+
+var (
+	ErrNoSuchSavepoint error = errors.New("tx: no such savepoint")
+)
+
+// savepoint is a snapshot of the operations of an open transaction.
+type savepoint struct {
+	name   string
+	nested bool // Whether the savepoint is created by a nested BeginTx.
+	ops    map[string]map[string]Op
+}
+
+// Savepoint creates a savepoint with the given name in the open transaction.
+// The transaction can be rolled back to this savepoint using RollbackTo.
+func (t *Transactional) Savepoint(name string) error {
+	if t.status != TxOpen {
+		return ErrNoTx
+	}
+	t.addSavepoint(name, false)
+	return nil
+}
+
+// RollbackTo rolls back the operations of the open transaction to the last
+// savepoint with the given name. The savepoint remains valid and the savepoints
+// created after it are removed. The savepoints created before the current
+// nested transaction are not visible.
+func (t *Transactional) RollbackTo(name string) error {
+	if t.status != TxOpen {
+		return ErrNoTx
+	}
+	if i := t.findSavepoint(name); i >= 0 {
+		t.rollback(i)
+		t.savepoints = t.savepoints[:i+1]
+		return nil
+	}
+	return ErrNoSuchSavepoint
+}
+
+// ReleaseSavepoint removes the last savepoint with the given name along with
+// the savepoints created after it, without rolling back any operation.
+func (t *Transactional) ReleaseSavepoint(name string) error {
+	if t.status != TxOpen {
+		return ErrNoTx
+	}
+	if i := t.findSavepoint(name); i >= 0 {
+		t.savepoints = t.savepoints[:i]
+		return nil
+	}
+	return ErrNoSuchSavepoint
+}
+
+// findSavepoint returns the index of the last savepoint with the given name in
+// the current nested transaction, or -1 if there is no such savepoint.
+func (t *Transactional) findSavepoint(name string) int {
+	for i := len(t.savepoints) - 1; i >= 0; i-- {
+		sp := t.savepoints[i]
+		if sp.nested {
+			break
+		}
+		if sp.name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// TxDepth returns the number of nested transactions in the open transaction.
+func (t *Transactional) TxDepth() int {
+	n := 0
+	for _, sp := range t.savepoints {
+		if sp.nested {
+			n++
+		}
+	}
+	return n
+}
+
+// lastNested returns the index of the savepoint of the innermost nested
+// transaction, or -1 if there is no nested transaction.
+func (t *Transactional) lastNested() int {
+	for i := len(t.savepoints) - 1; i >= 0; i-- {
+		if t.savepoints[i].nested {
+			return i
+		}
+	}
+	return -1
+}
+
+func (t *Transactional) addSavepoint(name string, nested bool) {
+	sp := savepoint{
+		name:   name,
+		nested: nested,
+		ops:    make(map[string]map[string]Op, len(t.stage)),
+	}
+	for n, d := range t.stage {
+		if len(d.Ops) == 0 {
+			continue
+		}
+		ops := make(map[string]Op, len(d.Ops))
+		for k, o := range d.Ops {
+			ops[k] = o
+		}
+		sp.ops[n] = ops
+	}
+	t.savepoints = append(t.savepoints, sp)
+}
+
+// rollback restores the operations saved in the i'th savepoint.
+func (t *Transactional) rollback(i int) {
+	sp := t.savepoints[i]
+	for n, d := range t.stage {
+		ops := sp.ops[n]
+		d.Ops = make(map[string]Op, len(ops))
+		for k, o := range ops {
+			d.Ops[k] = o
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package state
+
+import "testing"
+
+func TestSavepoint(t *testing.T) {
+	s := NewInMem()
+	tx := NewTransactional(s)
+	if err := tx.Savepoint("sp"); err != ErrNoTx {
+		t.Errorf("savepoint without a transaction: %v", err)
+	}
+
+	tx.BeginTx()
+	tx.Dict("d").Put("k1", "v1")
+	tx.Savepoint("sp1")
+	tx.Dict("d").Put("k1", "v2")
+	tx.Dict("d").Put("k2", "v2")
+	tx.Dict("e").Put("k", "v")
+	tx.Savepoint("sp2")
+	tx.Dict("d").Del("k2")
+
+	if err := tx.RollbackTo("sp1"); err != nil {
+		t.Fatalf("cannot rollback: %v", err)
+	}
+	if err := tx.RollbackTo("sp2"); err != ErrNoSuchSavepoint {
+		t.Errorf("savepoint is not removed after rollback: %v", err)
+	}
+	if err := tx.RollbackTo("sp1"); err != nil {
+		t.Errorf("cannot rollback twice to the same savepoint: %v", err)
+	}
+	if v, _ := tx.Dict("d").Get("k1"); v != "v1" {
+		t.Errorf("invalid value after rollback: actual=%v want=v1", v)
+	}
+	if _, err := tx.Dict("d").Get("k2"); err == nil {
+		t.Error("key put after the savepoint exists after rollback")
+	}
+	if _, err := tx.Dict("e").Get("k"); err == nil {
+		t.Error("dictionary modified after the savepoint is not rolled back")
+	}
+
+	tx.CommitTx()
+	if v, _ := s.Dict("d").Get("k1"); v != "v1" {
+		t.Errorf("invalid value after commit: actual=%v want=v1", v)
+	}
+	if l := len(s.Dict("e").(*inMemDict).Dict); l != 0 {
+		t.Errorf("rolled back entries are committed: %v", l)
+	}
+}
+
+func TestReleaseSavepoint(t *testing.T) {
+	tx := NewTransactional(NewInMem())
+	tx.BeginTx()
+	tx.Savepoint("sp1")
+	tx.Dict("d").Put("k1", "v1")
+	tx.Savepoint("sp2")
+	tx.Dict("d").Put("k2", "v2")
+
+	if err := tx.ReleaseSavepoint("sp1"); err != nil {
+		t.Fatalf("cannot release: %v", err)
+	}
+	if err := tx.RollbackTo("sp2"); err != ErrNoSuchSavepoint {
+		t.Errorf("later savepoint is not released: %v", err)
+	}
+	if err := tx.ReleaseSavepoint("sp1"); err != ErrNoSuchSavepoint {
+		t.Errorf("savepoint is released twice: %v", err)
+	}
+	if _, err := tx.Dict("d").Get("k2"); err != nil {
+		t.Error("release rolls back the transaction")
+	}
+}
+
+func TestNestedTx(t *testing.T) {
+	s := NewInMem()
+	tx := NewTransactional(s)
+	tx.BeginTx()
+	tx.Dict("d").Put("k1", "v1")
+	tx.Savepoint("sp")
+
+	if err := tx.BeginTx(); err != nil {
+		t.Fatalf("cannot begin a nested transaction: %v", err)
+	}
+	if d := tx.TxDepth(); d != 1 {
+		t.Errorf("invalid depth: actual=%v want=1", d)
+	}
+	tx.Dict("d").Put("k2", "v2")
+	if err := tx.RollbackTo("sp"); err != ErrNoSuchSavepoint {
+		t.Errorf("rollback to a savepoint of the parent: %v", err)
+	}
+	tx.AbortTx()
+	if tx.TxStatus() != TxOpen {
+		t.Fatal("aborting a nested transaction closes the parent")
+	}
+	if _, err := tx.Dict("d").Get("k2"); err == nil {
+		t.Error("nested transaction is not aborted")
+	}
+
+	tx.BeginTx()
+	tx.Dict("d").Put("k3", "v3")
+	tx.CommitTx()
+	if tx.TxStatus() != TxOpen {
+		t.Fatal("committing a nested transaction closes the parent")
+	}
+	if _, err := s.Dict("d").Get("k3"); err == nil {
+		t.Error("nested transaction is committed to the state")
+	}
+
+	tx.CommitTx()
+	if d := tx.TxDepth(); d != 0 {
+		t.Errorf("invalid depth: actual=%v want=0", d)
+	}
+	for _, k := range []string{"k1", "k3"} {
+		if _, err := s.Dict("d").Get(k); err != nil {
+			t.Errorf("%v is not committed", k)
+		}
+	}
+	if _, err := s.Dict("d").Get("k2"); err == nil {
+		t.Error("aborted nested transaction is committed")
+	}
+}
@@ -55,25 +55,39 @@ func (t Tx) String() string {
 	return fmt.Sprintf("Tx (ops: %d, open: %v)", len(t.Ops), t.Status == TxOpen)
 }
 
-// NewTransactional wraps s and writtens a transactional state.
+// NewTransactional wraps s and writtens a transactional state. If s is
+// transactional, the new state inherits its indexes and read tracking.
 func NewTransactional(s State) *Transactional {
-	return &Transactional{State: s}
+	t := &Transactional{State: s}
+	if ts, ok := s.(*Transactional); ok {
+		t.indexes = ts.indexes
+		t.trackReads = ts.trackReads
+	}
+	return t
 }
 
 // Transactional wraps any state dictionary and makes it transactional.
 type Transactional struct {
 	State
-	stage  map[string]*TxDict
-	status TxStatus
+	stage   map[string]*TxDict
+	status  TxStatus
+	indexes map[string][]*index
+
+	trackReads bool
+	savepoints []savepoint
 }
 
 func (t *Transactional) TxStatus() TxStatus {
 	return t.status
 }
 
+// BeginTx begins a transaction. If a transaction is already open, it begins a
+// nested transaction: CommitTx merges the nested transaction into its parent
+// and AbortTx rolls back only the nested transaction.
 func (t *Transactional) BeginTx() error {
 	if t.status == TxOpen {
-		return ErrOpenTx
+		t.addSavepoint("", true)
+		return nil
 	}
 
 	t.maybeNewTransaction()
@@ -112,11 +126,24 @@ func (t *Transactional) TxOps() []Op {
 	return ops
 }
 
+// CommitTx commits the open transaction. If the transaction is nested, it is
+// merged into its parent. If read tracking is enabled and the transaction has a
+// conflict, the transaction is aborted and a *ConflictError is returned.
 func (t *Transactional) CommitTx() error {
 	if t.status != TxOpen {
 		return ErrNoTx
 	}
 
+	if i := t.lastNested(); i >= 0 {
+		t.savepoints = t.savepoints[:i]
+		return nil
+	}
+
+	if err := t.Validate(); err != nil {
+		t.Reset()
+		return err
+	}
+
 	for _, d := range t.stage {
 		d.CommitTx()
 	}
@@ -129,12 +156,19 @@ func (t *Transactional) AbortTx() error {
 		return ErrNoTx
 	}
 
+	if i := t.lastNested(); i >= 0 {
+		t.rollback(i)
+		t.savepoints = t.savepoints[:i]
+		return nil
+	}
+
 	t.Reset()
 	return nil
 }
 
 func (t *Transactional) Reset() {
 	t.status = TxNone
+	t.savepoints = nil
 	if len(t.stage) == 0 {
 		return
 	}
@@ -152,12 +186,7 @@ func (t *Transactional) Apply(ops []Op) error {
 		return ErrOpenTx
 	}
 	for _, o := range ops {
-		switch o.T {
-		case Put:
-			t.Dict(o.D).Put(o.K, o.V)
-		case Del:
-			t.Dict(o.D).Del(o.K)
-		}
+		applyOp(t.Dict(o.D), o)
 	}
 	return nil
 }
@@ -170,7 +199,11 @@ func (t *Transactional) Save() ([]byte, error) {
 	return t.State.Save()
 }
 
+// Restore restores the underlying state from b. Since the dictionaries of the
+// underlying state can be replaced, the transaction is reset.
 func (t *Transactional) Restore(b []byte) error {
+	t.Reset()
+	t.stage = make(map[string]*TxDict)
 	return t.State.Restore(b)
 }
 
@@ -188,6 +221,7 @@ func (t *Transactional) Dict(name string) Dict {
 	d = &TxDict{
 		Dict: t.State.Dict(name),
 		Ops:  make(map[string]Op),
+		tx:   t,
 	}
 	d.BeginTx()
 	t.stage[name] = d
@@ -200,6 +234,9 @@ type TxDict struct {
 	Dict   Dict
 	Status TxStatus
 	Ops    map[string]Op
+
+	tx    *Transactional    // The transactional state of the dictionary.
+	reads map[string]uint64 // Versions of the keys read in the transaction.
 }
 
 func (d *TxDict) Name() string {
@@ -207,6 +244,7 @@ func (d *TxDict) Name() string {
 }
 
 func (d *TxDict) Put(k string, v interface{}) error {
+	d.updateIndexes(k, v, false)
 	d.Ops[k] = Op{
 		T: Put,
 		D: d.Dict.Name(),
@@ -217,13 +255,19 @@ func (d *TxDict) Put(k string, v interface{}) error {
 }
 
 func (d *TxDict) Get(k string) (interface{}, error) {
+	d.read(k)
+	return d.peek(k)
+}
+
+// peek returns the value of k without recording the read.
+func (d *TxDict) peek(k string) (interface{}, error) {
 	op, ok := d.Ops[k]
 	if ok {
 		switch op.T {
 		case Put:
 			return op.V, nil
 		case Del:
-			return nil, errors.New("No such key")
+			return nil, ErrNoSuchKey
 		}
 	}
 	return d.Dict.Get(k)
@@ -234,6 +278,7 @@ func (d *TxDict) Del(k string) error {
 		return ErrNoSuchKey
 	}
 
+	d.updateIndexes(k, nil, true)
 	d.Ops[k] = Op{
 		T: Del,
 		D: d.Dict.Name(),
@@ -244,6 +289,7 @@ func (d *TxDict) Del(k string) error {
 
 func (d *TxDict) ForEach(f IterFn) {
 	d.Dict.ForEach(func(k string, v interface{}) (next bool) {
+		d.read(k)
 		op, ok := d.Ops[k]
 		if ok {
 			switch op.T {
@@ -258,6 +304,68 @@ func (d *TxDict) ForEach(f IterFn) {
 	})
 }
 
+// Range iterates over the entries in [from, to) and merges the uncommitted
+// operations of the transaction into the iteration.
+func (d *TxDict) Range(from, to string, f IterFn, opts ...IterOption) {
+	o := newIterOptions(opts)
+	f = o.limited(f)
+
+	var keys []string
+	for k := range d.Ops {
+		if inRange(k, from, to) {
+			keys = append(keys, k)
+		}
+	}
+	sortKeys(keys, o)
+
+	i := 0
+	stopped := false
+	var under []IterOption
+	if o.reverse {
+		under = append(under, Reverse())
+	}
+	Range(d.Dict, from, to, func(k string, v interface{}) bool {
+		d.read(k)
+		for ; i < len(keys) && o.before(keys[i], k); i++ {
+			if op := d.Ops[keys[i]]; op.T == Put && !f(op.K, op.V) {
+				stopped = true
+				return false
+			}
+		}
+
+		if i < len(keys) && keys[i] == k {
+			op := d.Ops[k]
+			i++
+			if op.T == Del {
+				return true
+			}
+			v = op.V
+		}
+
+		if !f(k, v) {
+			stopped = true
+			return false
+		}
+		return true
+	}, under...)
+
+	if stopped {
+		return
+	}
+
+	for ; i < len(keys); i++ {
+		if op := d.Ops[keys[i]]; op.T == Put && !f(op.K, op.V) {
+			return
+		}
+	}
+}
+
+// Prefix iterates over the entries whose keys start with prefix and merges the
+// uncommitted operations of the transaction into the iteration.
+func (d *TxDict) Prefix(prefix string, f IterFn, opts ...IterOption) {
+	d.Range(prefix, prefixEnd(prefix), f, opts...)
+}
+
 func (d *TxDict) BeginTx() error {
 	if d.Status == TxOpen {
 		return ErrOpenTx
@@ -271,12 +379,7 @@ func (d *TxDict) CommitTx() error {
 		return ErrNoTx
 	}
 	for _, o := range d.Ops {
-		switch o.T {
-		case Put:
-			d.Dict.Put(o.K, o.V)
-		case Del:
-			d.Dict.Del(o.K)
-		}
+		applyOp(d.Dict, o)
 	}
 	d.reset()
 	return nil
@@ -292,6 +395,7 @@ func (d *TxDict) AbortTx() error {
 
 func (d *TxDict) reset() {
 	d.Status = TxNone
+	d.reads = nil
 	if len(d.Ops) == 0 {
 		return
 	}
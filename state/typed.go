@@ -0,0 +1,139 @@
+package state
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
+)
+
+// TypedDict wraps a dictionary and stores values of a single type. Values are
+// encoded using the codec of the dictionary and are stored as []byte in the
+// underlying dictionary. As such, the underlying dictionary can be saved and
+// replicated without registering the value type in gob, and values that
+// cannot be encoded are rejected in Put.
+//
+// TypedDict implements Dict and can be used wherever a Dict is expected.
+type TypedDict struct {
+	Dict  Dict
+	Codec Codec
+
+	typ reflect.Type
+}
+
+// NewTypedDict creates a typed dictionary over d for values of the same type
+// as proto. If proto is a pointer, the dictionary stores pointers of that
+// type.
+func NewTypedDict(d Dict, proto interface{}, c Codec) *TypedDict {
+	return &TypedDict{
+		Dict:  d,
+		Codec: c,
+		typ:   reflect.TypeOf(proto),
+	}
+}
+
+func (d *TypedDict) Name() string {
+	return d.Dict.Name()
+}
+
+// Put encodes v and stores it for k. It returns an error if v is not of the
+// dictionary's type or if v cannot be encoded.
+func (d *TypedDict) Put(k string, v interface{}) error {
+	b, err := d.encode(v)
+	if err != nil {
+		return err
+	}
+	return d.Dict.Put(k, b)
+}
+
+// Get returns the decoded value of k.
+func (d *TypedDict) Get(k string) (interface{}, error) {
+	b, err := d.Dict.Get(k)
+	if err != nil {
+		return nil, err
+	}
+	return d.decode(b)
+}
+
+// GetInto decodes the value of k into v, which must be a pointer to the
+// dictionary's type (or of the dictionary's type, if it is a pointer).
+func (d *TypedDict) GetInto(k string, v interface{}) error {
+	want := d.typ
+	if want.Kind() != reflect.Ptr {
+		want = reflect.PtrTo(want)
+	}
+	if t := reflect.TypeOf(v); t != want {
+		return fmt.Errorf("state: cannot decode %v of %v into %v", k, d.Name(), t)
+	}
+	b, err := d.Dict.Get(k)
+	if err != nil {
+		return err
+	}
+	bs, ok := b.([]byte)
+	if !ok {
+		return fmt.Errorf("state: %v of %v is not encoded", k, d.Name())
+	}
+	return d.Codec.Decode(bs, v)
+}
+
+func (d *TypedDict) Del(k string) error {
+	return d.Dict.Del(k)
+}
+
+// ForEach iterates over the decoded entries of the dictionary. Entries that
+// cannot be decoded are skipped.
+func (d *TypedDict) ForEach(f IterFn) {
+	d.Dict.ForEach(d.decoded(f))
+}
+
+// Range iterates over the decoded entries whose keys are in [from, to).
+func (d *TypedDict) Range(from, to string, f IterFn, opts ...IterOption) {
+	Range(d.Dict, from, to, d.decoded(f), opts...)
+}
+
+// Prefix iterates over the decoded entries whose keys start with prefix.
+func (d *TypedDict) Prefix(prefix string, f IterFn, opts ...IterOption) {
+	Prefix(d.Dict, prefix, d.decoded(f), opts...)
+}
+
+func (d *TypedDict) decoded(f IterFn) IterFn {
+	return func(k string, b interface{}) bool {
+		v, err := d.decode(b)
+		if err != nil {
+			glog.Errorf("state: cannot decode %v of %v: %v", k, d.Name(), err)
+			return true
+		}
+		return f(k, v)
+	}
+}
+
+func (d *TypedDict) encode(v interface{}) ([]byte, error) {
+	if t := reflect.TypeOf(v); t != d.typ {
+		return nil, fmt.Errorf("state: invalid value type for %v: actual=%v want=%v",
+			d.Name(), t, d.typ)
+	}
+	return d.Codec.Encode(v)
+}
+
+func (d *TypedDict) decode(b interface{}) (interface{}, error) {
+	bs, ok := b.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("state: value of %v is not encoded: %T", d.Name(), b)
+	}
+
+	if d.typ.Kind() == reflect.Ptr {
+		v := reflect.New(d.typ.Elem())
+		if err := d.Codec.Decode(bs, v.Interface()); err != nil {
+			return nil, err
+		}
+		return v.Interface(), nil
+	}
+
+	v := reflect.New(d.typ)
+	if err := d.Codec.Decode(bs, v.Interface()); err != nil {
+		return nil, err
+	}
+	return v.Elem().Interface(), nil
+}
+
+var _ OrderedDict = &TypedDict{}
@@ -0,0 +1,105 @@
+package state
+
+import (
+	"testing"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/coreos/etcd/raft/raftpb"
+)
+
+type typedTestValue struct {
+	S string
+	I int
+}
+
+// unregistered is never registered in gob.
+type unregistered struct {
+	V int
+}
+
+func testTypedDict(t *testing.T, c Codec) {
+	s := NewInMem()
+	d := NewTypedDict(s.Dict("d"), typedTestValue{}, c)
+	want := typedTestValue{S: "s", I: 1}
+	if err := d.Put("k", want); err != nil {
+		t.Fatalf("cannot put: %v", err)
+	}
+	if err := d.Put("k", &want); err == nil {
+		t.Error("put accepts a value of another type")
+	}
+	if _, ok := s.Dict("d").(*inMemDict).Dict["k"].([]byte); !ok {
+		t.Error("value is not stored as bytes")
+	}
+
+	v, err := d.Get("k")
+	if err != nil || v.(typedTestValue) != want {
+		t.Errorf("invalid value: actual=%v want=%v (err=%v)", v, want, err)
+	}
+	var got typedTestValue
+	if err := d.GetInto("k", &got); err != nil || got != want {
+		t.Errorf("invalid value: actual=%v want=%v (err=%v)", got, want, err)
+	}
+
+	n := 0
+	d.ForEach(func(k string, v interface{}) bool {
+		n++
+		if v.(typedTestValue) != want {
+			t.Errorf("invalid value in iteration: actual=%v want=%v", v, want)
+		}
+		return true
+	})
+	if n != 1 {
+		t.Errorf("invalid number of entries: actual=%v want=1", n)
+	}
+}
+
+func TestTypedDictGob(t *testing.T) {
+	testTypedDict(t, GobCodec{})
+}
+
+func TestTypedDictJSON(t *testing.T) {
+	testTypedDict(t, JSONCodec{})
+}
+
+func TestTypedDictProto(t *testing.T) {
+	d := NewTypedDict(NewInMem().Dict("d"), &raftpb.Entry{}, ProtoCodec{})
+	want := &raftpb.Entry{Term: 1, Index: 2, Data: []byte("d")}
+	if err := d.Put("k", want); err != nil {
+		t.Fatalf("cannot put: %v", err)
+	}
+	v, err := d.Get("k")
+	if err != nil {
+		t.Fatalf("cannot get: %v", err)
+	}
+	if e := v.(*raftpb.Entry); e.Term != 1 || e.Index != 2 ||
+		string(e.Data) != "d" {
+
+		t.Errorf("invalid value: actual=%v want=%v", e, want)
+	}
+
+	proto := NewTypedDict(NewInMem().Dict("d"), typedTestValue{}, ProtoCodec{})
+	if err := proto.Put("k", typedTestValue{}); err == nil {
+		t.Error("proto codec accepts a non-proto value")
+	}
+}
+
+func TestTypedDictSaveRestore(t *testing.T) {
+	src := NewInMem()
+	d := NewTypedDict(src.Dict("d"), unregistered{}, GobCodec{})
+	if err := d.Put("k", unregistered{V: 1}); err != nil {
+		t.Fatalf("cannot put: %v", err)
+	}
+	b, err := src.Save()
+	if err != nil {
+		t.Fatalf("cannot save a typed dictionary: %v", err)
+	}
+
+	dst := NewInMem()
+	if err := dst.Restore(b); err != nil {
+		t.Fatalf("cannot restore: %v", err)
+	}
+	v, err := NewTypedDict(dst.Dict("d"), unregistered{}, GobCodec{}).Get("k")
+	if err != nil || v.(unregistered).V != 1 {
+		t.Errorf("invalid value after restore: actual=%v want={1} (err=%v)", v,
+			err)
+	}
+}
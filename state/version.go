@@ -0,0 +1,161 @@
+package state
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// VersionedDict is a dictionary that keeps a version for each key. The version
+// of a key changes whenever the key is modified. Versions are kept in memory
+// and are not saved in snapshots. The versions of deleted keys are dropped by
+// ChunkedState.DropTombstones, after which their version is 0 again.
+type VersionedDict interface {
+	Dict
+
+	// Version returns the version of key. The version of a key that has not
+	// been modified is 0.
+	Version(key string) uint64
+}
+
+// Version returns the version of key in d. ok is false if d is not a
+// VersionedDict.
+func Version(d Dict, key string) (ver uint64, ok bool) {
+	vd, ok := d.(VersionedDict)
+	if !ok {
+		return 0, false
+	}
+	return vd.Version(key), true
+}
+
+// lastVersion is the last version assigned to a key. Versions are unique in
+// the process, so that a key never gets the same version twice even if its
+// dictionary is restored.
+var lastVersion uint64
+
+func nextVersion() uint64 {
+	return atomic.AddUint64(&lastVersion, 1)
+}
+
+// LastVersion returns the last version assigned to a key in any dictionary.
+func LastVersion() uint64 {
+	return atomic.LoadUint64(&lastVersion)
+}
+
+// ConflictError is returned when committing a transaction in which a key is
+// read and the key is modified before the transaction commits.
+type ConflictError struct {
+	Dict string // The dictionary of the key.
+	Key  string // The key that is modified.
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("tx: conflict on %v/%v", e.Dict, e.Key)
+}
+
+// TrackReads enables or disables tracking the versions of the keys read in the
+// transactions of t. When enabled, CommitTx fails with a *ConflictError if any
+// key read in the transaction is modified in the underlying state before the
+// transaction commits. Only the keys visited by Get, ForEach, Range and Prefix
+// are tracked; keys that are added to a range after it is read are not.
+//
+// Read tracking is effective only for the dictionaries that implement
+// VersionedDict.
+func (t *Transactional) TrackReads(track bool) {
+	t.trackReads = track
+}
+
+// Validate checks whether the keys read in the open transaction are still
+// current. It returns a *ConflictError if any of the keys is modified.
+func (t *Transactional) Validate() error {
+	if t.status != TxOpen {
+		return ErrNoTx
+	}
+	for _, d := range t.stage {
+		if err := d.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// read records the version of k, if k is read for the first time in the
+// transaction and is not modified in the transaction.
+func (d *TxDict) read(k string) {
+	if d.tx == nil || !d.tx.trackReads {
+		return
+	}
+	if _, ok := d.Ops[k]; ok {
+		return
+	}
+	if _, ok := d.reads[k]; ok {
+		return
+	}
+	ver, ok := Version(d.Dict, k)
+	if !ok {
+		return
+	}
+	if d.reads == nil {
+		d.reads = make(map[string]uint64)
+	}
+	d.reads[k] = ver
+}
+
+func (d *TxDict) validate() error {
+	for k, ver := range d.reads {
+		if v, _ := Version(d.Dict, k); v != ver {
+			return &ConflictError{Dict: d.Name(), Key: k}
+		}
+	}
+	return nil
+}
+
+func (d *inMemDict) Version(k string) uint64 {
+	return d.versions[k]
+}
+
+// modified assigns a new version to k.
+func (d *inMemDict) modified(k string) {
+	if d.versions == nil {
+		d.versions = make(map[string]uint64)
+	}
+	d.versions[k] = nextVersion()
+}
+
+// pruneTombstones drops the versions of the keys deleted at or before version
+// ver.
+func (d *inMemDict) pruneTombstones(ver uint64) {
+	for k, v := range d.versions {
+		if _, ok := d.Dict[k]; !ok && v <= ver {
+			delete(d.versions, k)
+		}
+	}
+}
+
+func (d *onDiskDict) Version(k string) uint64 {
+	d.state.Lock()
+	v := d.versions[k]
+	d.state.Unlock()
+	return v
+}
+
+// pruneTombstones drops the versions of the keys deleted at or before version
+// ver. It must be called with the state locked.
+func (d *onDiskDict) pruneTombstones(ver uint64) {
+	for k, v := range d.versions {
+		if _, ok := d.index[k]; !ok && v <= ver {
+			delete(d.versions, k)
+		}
+	}
+}
+
+// TxDict is versioned so that nested transactions can track their reads. The
+// version of a key modified in the transaction is not changed until the
+// transaction commits.
+func (d *TxDict) Version(k string) uint64 {
+	v, _ := Version(d.Dict, k)
+	return v
+}
+
+var _ VersionedDict = &inMemDict{}
+var _ VersionedDict = &onDiskDict{}
+var _ VersionedDict = &TxDict{}
@@ -0,0 +1,111 @@
+package state
+
+import (
+	"os"
+	"testing"
+)
+
+func testVersionedDict(t *testing.T, d Dict) {
+	vd := d.(VersionedDict)
+	if v := vd.Version("k"); v != 0 {
+		t.Errorf("invalid version of a new key: actual=%v want=0", v)
+	}
+	d.Put("k", "v")
+	v1 := vd.Version("k")
+	if v1 == 0 {
+		t.Error("put does not change the version")
+	}
+	d.Del("k")
+	if v2 := vd.Version("k"); v2 == v1 {
+		t.Error("del does not change the version")
+	}
+}
+
+func TestInMemVersion(t *testing.T) {
+	testVersionedDict(t, NewInMem().Dict("d"))
+}
+
+func TestOnDiskVersion(t *testing.T) {
+	s, dir := newOnDiskForTest(t)
+	defer os.RemoveAll(dir)
+	defer s.Close()
+
+	testVersionedDict(t, s.Dict("d"))
+}
+
+func TestTxConflict(t *testing.T) {
+	s := NewInMem()
+	s.Dict("d").Put("k", 1)
+
+	tx := NewTransactional(s)
+	tx.TrackReads(true)
+	tx.BeginTx()
+	v, _ := tx.Dict("d").Get("k")
+	tx.Dict("d").Put("j", v)
+
+	s.Dict("d").Put("k", 2)
+
+	err := tx.CommitTx()
+	cerr, ok := err.(*ConflictError)
+	if !ok {
+		t.Fatalf("invalid error: actual=%v want=*ConflictError", err)
+	}
+	if cerr.Dict != "d" || cerr.Key != "k" {
+		t.Errorf("invalid conflict: actual=%v/%v want=d/k", cerr.Dict, cerr.Key)
+	}
+	if _, err := s.Dict("d").Get("j"); err == nil {
+		t.Error("conflicting transaction is committed")
+	}
+	if tx.TxStatus() != TxNone {
+		t.Error("conflicting transaction is not aborted")
+	}
+
+	tx.BeginTx()
+	v, _ = tx.Dict("d").Get("k")
+	tx.Dict("d").Put("j", v)
+	if err := tx.CommitTx(); err != nil {
+		t.Errorf("cannot commit a transaction without conflicts: %v", err)
+	}
+}
+
+func TestTxConflictOwnWrites(t *testing.T) {
+	s := NewInMem()
+	tx := NewTransactional(s)
+	tx.TrackReads(true)
+	tx.BeginTx()
+	tx.Dict("d").Put("k", 1)
+	tx.Dict("d").Get("k")
+	if err := tx.CommitTx(); err != nil {
+		t.Errorf("reading own writes results in a conflict: %v", err)
+	}
+}
+
+func TestTxConflictRange(t *testing.T) {
+	s := NewInMem()
+	s.Dict("d").Put("a", 1)
+	s.Dict("d").Put("b", 1)
+
+	tx := NewTransactional(s)
+	tx.TrackReads(true)
+	tx.BeginTx()
+	Range(tx.Dict("d"), "a", "c", func(k string, v interface{}) bool {
+		return true
+	})
+	s.Dict("d").Del("b")
+	if _, ok := tx.CommitTx().(*ConflictError); !ok {
+		t.Error("modifying a key read in a range does not conflict")
+	}
+}
+
+func TestTxNoTracking(t *testing.T) {
+	s := NewInMem()
+	s.Dict("d").Put("k", 1)
+
+	tx := NewTransactional(s)
+	tx.BeginTx()
+	tx.Dict("d").Get("k")
+	s.Dict("d").Put("k", 2)
+	if err := tx.CommitTx(); err != nil {
+		t.Errorf("conflict without read tracking: %v", err)
+	}
+}
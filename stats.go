@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"sort"
 	"strconv"
+	"sync/atomic"
 	"time"
 
 	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
@@ -23,25 +24,32 @@ type noOpStatCollector struct{}
 func (c *noOpStatCollector) collect(bee uint64, in *msg, out []*msg) {}
 
 const (
-	appCollector  = "bh_collector"
-	dictLocalStat = "LocalStatDict"
-	dictLocalProv = "LocalProvDict"
-	dictOptimizer = "OptimizerDict"
+	appCollector   = "bh_collector"
+	dictLocalStat  = "LocalStatDict"
+	dictLocalProv  = "LocalProvDict"
+	dictOptimizer  = "OptimizerDict"
+	dictLocalSplit = "LocalSplitDict"
 
 	defaultMinScore = 3
+
+	// splitCooldown is the minimum time between two splits of a bee.
+	splitCooldown = time.Minute
 )
 
 type collectorApp struct {
 	hive Hive
+	msgs uint64 // Messages received by the local bees, updated atomically.
 }
 
 func newAppStatCollector(h *hive) collector {
 	c := &collectorApp{hive: h}
+	u := &loadUpdater{hive: h, msgs: &c.msgs}
 	a := h.NewApp(appCollector, NonTransactional())
 	a.Handle(beeRecord{}, localCollector{})
 	a.Handle(cmdMigrate{}, localCollector{})
 	a.Handle(pollLocalStat{}, localStatPoller{
-		thresh: uint64(h.config.OptimizeThresh),
+		thresh:      uint64(h.config.OptimizeThresh),
+		splitThresh: uint64(h.config.SplitThresh),
 	})
 
 	a.Handle(beeMatrixUpdate{}, optimizerCollector{})
@@ -51,6 +59,7 @@ func newAppStatCollector(h *hive) collector {
 		h.Emit(pollOptimizer{})
 		h.Emit(pollLocalStat{})
 	}))
+	a.Detached(NewTimer(hiveLoadPeriod, u.update))
 
 	a.Handle(statRequest{}, statRequestHandler{})
 	a.HandleHTTP("/stats", &statHTTPHandler{hive: h})
@@ -78,6 +87,8 @@ func parseBeeID(str string) uint64 {
 }
 
 func (c *collectorApp) collect(bee uint64, in *msg, out []*msg) {
+	atomic.AddUint64(&c.msgs, 1)
+
 	switch in.Data().(type) {
 	case beeMatrixUpdate, cmdMigrate:
 		return
@@ -181,7 +192,8 @@ func (c localCollector) updateProvenance(r beeRecord, ctx RcvContext) {
 type pollLocalStat struct{}
 
 type localStatPoller struct {
-	thresh uint64
+	thresh      uint64
+	splitThresh uint64
 }
 
 func (p localStatPoller) Map(msg Msg, ctx MapContext) MappedCells {
@@ -197,7 +209,11 @@ func (p localStatPoller) Rcv(msg Msg, ctx RcvContext) error {
 		if dur == 0 {
 			dur = 1
 		}
-		if lm.UpdateMsgCnt/dur < p.thresh {
+		rate := lm.UpdateMsgCnt / dur
+		if p.splitThresh != 0 && rate >= p.splitThresh {
+			p.maybeSplit(parseBeeID(k), ctx)
+		}
+		if rate < p.thresh {
 			return true
 		}
 
@@ -210,6 +226,34 @@ func (p localStatPoller) Rcv(msg Msg, ctx RcvContext) error {
 	return nil
 }
 
+// maybeSplit splits the cells of a hot bee, unless the bee is split in the last
+// splitCooldown. The bee is split in the background, since splitting waits for
+// the bee and for the registry.
+func (p localStatPoller) maybeSplit(id uint64, ctx RcvContext) {
+	bi, err := beeInfoFromContext(ctx, id)
+	if err != nil || bi.Detached || bi.App == appCollector {
+		return
+	}
+
+	d := ctx.Dict(dictLocalSplit)
+	k := formatBeeID(id)
+	now := time.Now()
+	if v, err := d.Get(k); err == nil && now.Sub(v.(time.Time)) < splitCooldown {
+		return
+	}
+	d.Put(k, now)
+
+	h := ctx.Hive().(*hive)
+	go func() {
+		newb, err := h.splitBee(id, nil)
+		if err != nil {
+			glog.V(2).Infof("%v cannot split bee %v: %v", h, id, err)
+			return
+		}
+		glog.Infof("%v splits bee %v into bee %v", h, id, newb)
+	}()
+}
+
 // TODO(soheil): implement migration status: none, initiated, and done.
 type optimizerStat struct {
 	Bee       uint64
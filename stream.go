@@ -0,0 +1,177 @@
+package beehive
+
+import (
+	"encoding/gob"
+	"errors"
+	"io"
+	"math/rand"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/golang.org/x/net/context"
+	bhgob "github.com/kandoo/beehive/gob"
+)
+
+var (
+	// ErrStreamClosed is returned when the stream is closed by the caller.
+	ErrStreamClosed = errors.New("sync: stream is closed")
+	// ErrStreamNoCredit is returned when the handler cannot send a response on
+	// the stream before the caller receives the previous responses.
+	ErrStreamNoCredit = errors.New("sync: no credit left on the stream")
+	// ErrSyncNotStream is returned when streaming on a sync request that is not
+	// a streaming request.
+	ErrSyncNotStream = errors.New("sync: request is not streaming")
+)
+
+// DefaultStreamWindow is the window of streams whose window is not positive.
+const DefaultStreamWindow = 16
+
+// StreamCredit is sent to the bee that streams the responses of a streaming
+// sync request, when the caller has received some of the responses. Handlers
+// that have run out of credit should handle StreamCredit, grant the credit to
+// the Repliable of the stream, and continue sending their responses.
+type StreamCredit struct {
+	SyncID uint64 // The ID of the sync request.
+	Credit int    // The number of responses received by the caller.
+	Closed bool   // Whether the caller has closed the stream.
+}
+
+func isStreamCredit(m *msg) bool {
+	_, ok := m.Data().(StreamCredit)
+	return ok
+}
+
+// Send sends a response on the stream of a streaming sync request. It returns
+// ErrStreamNoCredit if the handler has sent as many responses as the window of
+// the stream, and the caller has not yet received them. In such a case, the
+// handler should wait for a StreamCredit and resend the response.
+//
+// Note that Send modifies the credit of the Repliable, and the Repliable should
+// be saved in the dictionaries if the handler continues the stream in another
+// message.
+func (r *Repliable) Send(ctx RcvContext, data interface{}) error {
+	if !r.Stream {
+		return ErrSyncNotStream
+	}
+	if r.Credit <= 0 {
+		return ErrStreamNoCredit
+	}
+	r.Credit--
+	ctx.SendToBee(syncRes{ID: r.SyncID, Data: data, More: true}, r.From)
+	return nil
+}
+
+// Close closes the stream of a streaming sync request. If err is not nil, the
+// caller receives err after the responses sent on the stream.
+func (r *Repliable) Close(ctx RcvContext, err error) {
+	res := syncRes{ID: r.SyncID}
+	if err != nil {
+		res.Err = bhgob.Error(err.Error())
+	}
+	ctx.SendToBee(res, r.From)
+}
+
+// Grant adds the credit of c to the stream.
+func (r *Repliable) Grant(c StreamCredit) {
+	r.Credit += c.Credit
+}
+
+// Stream is the stream of responses to a streaming sync request, created using
+// Hive.SyncStream. The methods of Stream must not be called concurrently.
+type Stream struct {
+	hive   *hive
+	id     uint64
+	ctx    context.Context
+	cancel context.CancelFunc
+	ch     chan syncRes
+	window int
+
+	from     uint64 // The bee streaming the responses.
+	received int    // Responses received since the last credit.
+	err      error  // Set when the stream ends.
+}
+
+// Recv returns the next response of the stream. It returns io.EOF when the
+// handler has closed the stream, and the error of the handler if it has closed
+// the stream with an error.
+func (s *Stream) Recv() (res interface{}, err error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	select {
+	case r := <-s.ch:
+		s.from = r.from
+		if r.Err != nil {
+			s.end(errors.New(r.Err.Error()))
+			return nil, s.err
+		}
+		if !r.More {
+			s.end(io.EOF)
+			if r.Data == nil {
+				return nil, io.EOF
+			}
+			return r.Data, nil
+		}
+		s.credit()
+		return r.Data, nil
+
+	case <-s.ctx.Done():
+		s.end(s.ctx.Err())
+		return nil, s.err
+	}
+}
+
+// Close closes the stream. The handler is notified using a StreamCredit, if
+// it has not yet closed the stream.
+func (s *Stream) Close() {
+	if s.err != nil {
+		return
+	}
+	s.end(ErrStreamClosed)
+	if s.from != 0 {
+		s.hive.SendToBee(StreamCredit{SyncID: s.id, Closed: true}, s.from)
+	}
+}
+
+func (s *Stream) end(err error) {
+	s.err = err
+	s.cancel()
+}
+
+// credit grants credit to the handler, once the caller has received half of
+// the window.
+func (s *Stream) credit() {
+	s.received++
+	if s.received < (s.window+1)/2 {
+		return
+	}
+	s.hive.SendToBee(StreamCredit{SyncID: s.id, Credit: s.received}, s.from)
+	s.received = 0
+}
+
+// SyncStream processes a streaming sync request. The handler of req should
+// defer its reply and use the Send method of the Repliable to stream the
+// responses, and close the stream using its Close method. If the handler
+// simply replies to the request, the stream has a single response.
+func (h *hive) SyncStream(ctx context.Context, req interface{},
+	window int) *Stream {
+
+	if window <= 0 {
+		window = DefaultStreamWindow
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	s := &Stream{
+		hive:   h,
+		id:     uint64(rand.Int63()),
+		ctx:    ctx,
+		cancel: cancel,
+		// The window plus the response that closes the stream.
+		ch:     make(chan syncRes, window+1),
+		window: window,
+	}
+	h.sendSync(ctx, syncReq{ID: s.id, Data: req, Window: window}, s.ch)
+	return s
+}
+
+func init() {
+	gob.Register(StreamCredit{})
+}
@@ -0,0 +1,114 @@
+package beehive
+
+import (
+	"io"
+	"testing"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+type streamTestReq int
+
+type streamTestCursor struct {
+	Repliable
+	Next int
+	Last int
+}
+
+// streamTestHandler streams the integers in [0, streamTestReq).
+type streamTestHandler struct{}
+
+func (h streamTestHandler) Map(msg Msg, ctx MapContext) MappedCells {
+	return MappedCells{{"S", "0"}}
+}
+
+func (h streamTestHandler) Rcv(msg Msg, ctx RcvContext) error {
+	var c streamTestCursor
+	switch d := msg.Data().(type) {
+	case streamTestReq:
+		c = streamTestCursor{Repliable: ctx.DeferReply(msg), Last: int(d)}
+	case StreamCredit:
+		v, err := ctx.Dict("S").Get(formatBeeID(d.SyncID))
+		if err != nil {
+			return err
+		}
+		c = v.(streamTestCursor)
+		if d.Closed {
+			return ctx.Dict("S").Del(formatBeeID(d.SyncID))
+		}
+		c.Grant(d)
+	}
+
+	for ; c.Next < c.Last; c.Next++ {
+		if err := c.Send(ctx, c.Next); err == ErrStreamNoCredit {
+			return ctx.Dict("S").Put(formatBeeID(c.SyncID), c)
+		} else if err != nil {
+			return err
+		}
+	}
+	c.Close(ctx, nil)
+	return ctx.Dict("S").Del(formatBeeID(c.SyncID))
+}
+
+func TestSyncStream(t *testing.T) {
+	h := newHiveForTest()
+	app := h.NewApp("stream")
+	app.Handle(streamTestReq(0), streamTestHandler{})
+	app.Handle(StreamCredit{}, streamTestHandler{})
+
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	n := 10
+	s := h.SyncStream(context.Background(), streamTestReq(n), 3)
+	for i := 0; i < n; i++ {
+		res, err := s.Recv()
+		if err != nil {
+			t.Fatalf("error in receiving response %v: %v", i, err)
+		}
+		if res.(int) != i {
+			t.Errorf("invalid response: actual=%v want=%v", res, i)
+		}
+	}
+	if _, err := s.Recv(); err != io.EOF {
+		t.Errorf("invalid error at the end of the stream: %v", err)
+	}
+
+	s = h.SyncStream(context.Background(), streamTestReq(n), 2)
+	if _, err := s.Recv(); err != nil {
+		t.Fatalf("error in receiving response: %v", err)
+	}
+	s.Close()
+	if _, err := s.Recv(); err != ErrStreamClosed {
+		t.Errorf("invalid error after closing the stream: %v", err)
+	}
+}
+
+func TestSyncStreamReply(t *testing.T) {
+	h := newHiveForTest()
+	app := h.NewApp("streamReply")
+	app.HandleFunc(streamTestReq(0),
+		func(msg Msg, ctx MapContext) MappedCells {
+			return ctx.LocalMappedCells()
+		},
+		func(msg Msg, ctx RcvContext) error {
+			return ctx.Reply(msg, int(msg.Data().(streamTestReq)))
+		})
+
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	s := h.SyncStream(context.Background(), streamTestReq(1), 0)
+	res, err := s.Recv()
+	if err != nil {
+		t.Fatalf("error in receiving the response: %v", err)
+	}
+	if res.(int) != 1 {
+		t.Errorf("invalid response: actual=%v want=1", res)
+	}
+	if _, err := s.Recv(); err != io.EOF {
+		t.Errorf("invalid error at the end of the stream: %v", err)
+	}
+}
@@ -3,7 +3,9 @@ package beehive
 import (
 	"encoding/gob"
 	"sync"
+	"time"
 
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
 	bhgob "github.com/kandoo/beehive/gob"
 )
 
@@ -21,8 +23,9 @@ var (
 
 // syncReq represents a generic sync request.
 type syncReq struct {
-	ID   uint64
-	Data interface{} // Data of the request. Must be registered in gob.
+	ID     uint64
+	Data   interface{} // Data of the request. Must be registered in gob.
+	Window int         // Window of a streaming request. 0 if not streaming.
 }
 
 // Type returns the type of this request. It is unique for each data type.
@@ -38,6 +41,9 @@ type syncRes struct {
 	ID   uint64      // ID is the request ID.
 	Data interface{} // Data of the response. Must be registered in gob.
 	Err  error       // Err is error, if any.
+	More bool        // More is true if more responses follow on the stream.
+
+	from uint64 // The bee that sent the response.
 }
 
 // Type returns the type of this response. It is unique for each data type.
@@ -49,15 +55,24 @@ func (r syncRes) Type() string {
 }
 
 type syncReqAndChan struct {
-	req syncReq
-	ch  chan syncRes
+	req      syncReq
+	to       uint64 // The bee to send the request to. 0 to emit the request.
+	ch       chan syncRes
+	done     <-chan struct{} // Closed when the caller is no longer waiting.
+	deadline time.Time       // Deadline of the request, if any.
+}
+
+// syncPending is a sync request waiting for its responses.
+type syncPending struct {
+	ch   chan syncRes
+	done <-chan struct{}
 }
 
 // syncDetached is a generic DetachedHandler for sync request processing, and
 // also provides Handle, HandleFunc, and Process for the clients.
 type syncDetached struct {
 	sync.Mutex
-	reqs map[uint64]chan syncRes
+	reqs map[uint64]syncPending
 
 	reqch chan syncReqAndChan
 	done  chan chan struct{}
@@ -67,7 +82,7 @@ type syncDetached struct {
 // requests from ch.
 func newSync(a App, ch chan syncReqAndChan) *syncDetached {
 	s := &syncDetached{
-		reqs:  make(map[uint64]chan syncRes),
+		reqs:  make(map[uint64]syncPending),
 		reqch: ch,
 		done:  make(chan chan struct{}),
 	}
@@ -83,12 +98,32 @@ func (s *syncDetached) Start(ctx RcvContext) {
 			s.drain()
 			ch <- struct{}{}
 		case rnc := <-s.reqch:
-			s.enque(rnc.req.ID, rnc.ch)
-			ctx.Emit(rnc.req)
+			s.enque(rnc.req.ID, syncPending{ch: rnc.ch, done: rnc.done})
+			if !rnc.deadline.IsZero() {
+				// The caller gives up on the request after the deadline, and the
+				// response may never arrive if the request is dropped.
+				id := rnc.req.ID
+				time.AfterFunc(rnc.deadline.Sub(time.Now()), func() {
+					s.deque(id)
+				})
+			}
+			s.send(rnc, ctx)
 		}
 	}
 }
 
+// send sends the request of rnc to its bee, or emits the request if it is not
+// destined to a specific bee.
+func (s *syncDetached) send(rnc syncReqAndChan, ctx RcvContext) {
+	opts := []EmitOption{Deadline(rnc.deadline)}
+	b, ok := ctx.(*bee)
+	if rnc.to == 0 || !ok {
+		ctx.Emit(rnc.req, opts...)
+		return
+	}
+	b.bufferOrEmit(b.newMsg(rnc.req, b.ID(), rnc.to, opts))
+}
+
 // Stop is to implement DetachedHandler.
 func (s *syncDetached) Stop(ctx RcvContext) {
 	ack := make(chan struct{})
@@ -99,47 +134,71 @@ func (s *syncDetached) Stop(ctx RcvContext) {
 // Rcv is to implement DetachedHandler.
 func (s *syncDetached) Rcv(msg Msg, ctx RcvContext) error {
 	res := msg.Data().(syncRes)
-	ch, err := s.deque(res.ID)
+	var p syncPending
+	var err error
+	if res.More {
+		p, err = s.pending(res.ID)
+	} else {
+		p, err = s.deque(res.ID)
+	}
 	if err != nil {
 		return err
 	}
-	ch <- res
+	res.from = msg.From()
+	select {
+	case p.ch <- res:
+	case <-p.done:
+		s.deque(res.ID)
+	}
 	return nil
 }
 
 func (s *syncDetached) drain() {
-	for id, ch := range s.reqs {
-		s.Lock()
-		ch <- syncRes{
-			ID:  id,
-			Err: ErrSyncStopped,
+	s.Lock()
+	defer s.Unlock()
+	for id, p := range s.reqs {
+		select {
+		case p.ch <- syncRes{ID: id, Err: ErrSyncStopped}:
+		default:
+			glog.Errorf("cannot notify sync request %v that sync is stopped", id)
 		}
 		delete(s.reqs, id)
 	}
-	s.Unlock()
 }
 
-func (s *syncDetached) enque(id uint64, ch chan syncRes) {
+func (s *syncDetached) enque(id uint64, p syncPending) {
 	s.Lock()
-	s.reqs[id] = ch
+	s.reqs[id] = p
 	s.Unlock()
 }
 
-func (s *syncDetached) deque(id uint64) (chan syncRes, error) {
+func (s *syncDetached) deque(id uint64) (syncPending, error) {
 	s.Lock()
-	ch, ok := s.reqs[id]
-	s.Unlock()
+	defer s.Unlock()
+	p, ok := s.reqs[id]
 	if !ok {
-		return nil, ErrSyncNoSuchRequest
+		return p, ErrSyncNoSuchRequest
 	}
 	delete(s.reqs, id)
-	return ch, nil
+	return p, nil
+}
+
+// pending returns the pending request of id, without removing it.
+func (s *syncDetached) pending(id uint64) (syncPending, error) {
+	s.Lock()
+	defer s.Unlock()
+	p, ok := s.reqs[id]
+	if !ok {
+		return p, ErrSyncNoSuchRequest
+	}
+	return p, nil
 }
 
 type syncRcvContext struct {
 	RcvContext
 	id      uint64
 	from    uint64
+	window  int
 	replied bool
 }
 
@@ -165,6 +224,8 @@ func (ctx *syncRcvContext) DeferReply(msg Msg) Repliable {
 	return Repliable{
 		From:   msg.From(),
 		SyncID: ctx.id,
+		Stream: ctx.window != 0,
+		Credit: ctx.window,
 	}
 }
 
@@ -175,14 +236,16 @@ type syncHandler struct {
 func (h syncHandler) Rcv(m Msg, ctx RcvContext) error {
 	req := m.Data().(syncReq)
 	sm := msg{
-		MsgData: req.Data,
-		MsgFrom: m.From(),
-		MsgTo:   m.To(),
+		MsgData:     req.Data,
+		MsgFrom:     m.From(),
+		MsgTo:       m.To(),
+		MsgDeadline: m.Deadline(),
 	}
 	sc := syncRcvContext{
 		RcvContext: ctx,
 		id:         req.ID,
 		from:       m.From(),
+		window:     req.Window,
 	}
 	err := h.handler.Rcv(sm, &sc)
 	if err != nil {
@@ -205,9 +268,10 @@ func (h syncHandler) Rcv(m Msg, ctx RcvContext) error {
 
 func (h syncHandler) Map(m Msg, ctx MapContext) MappedCells {
 	s := msg{
-		MsgData: m.Data().(syncReq).Data,
-		MsgFrom: m.From(),
-		MsgTo:   m.To(),
+		MsgData:     m.Data().(syncReq).Data,
+		MsgFrom:     m.From(),
+		MsgTo:       m.To(),
+		MsgDeadline: m.Deadline(),
 	}
 	return h.handler.Map(s, ctx)
 }
@@ -0,0 +1,181 @@
+package beehive
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
+)
+
+// Topics are names of the form "orders.eu.created" that messages can be
+// emitted on, in addition to their type. Applications subscribe to the topics
+// that match a pattern, where "*" matches exactly one segment of the topic and
+// "#", as the last segment of the pattern, matches one or more segments. For
+// example, "orders.*.created" matches "orders.eu.created" and "orders.#"
+// matches all the topics of orders.
+//
+// Messages emitted on a topic are mapped and received by the subscribed
+// handlers, the same way as the messages handled by their type.
+
+var (
+	ErrInvalidTopic      = errors.New("topic: invalid topic")
+	ErrInvalidPattern    = errors.New("topic: invalid pattern")
+	ErrDuplicatedPattern = errors.New("topic: app is already subscribed")
+)
+
+const (
+	topicSep       = "."
+	topicWildcard  = "*"
+	topicMultiWild = "#"
+)
+
+// validTopic returns whether topic is a valid topic that messages can be
+// emitted on.
+func validTopic(topic string) bool {
+	if topic == "" {
+		return false
+	}
+	for _, s := range strings.Split(topic, topicSep) {
+		if s == "" || s == topicWildcard || s == topicMultiWild {
+			return false
+		}
+	}
+	return true
+}
+
+// validPattern returns whether p is a valid subscription pattern.
+func validPattern(p string) bool {
+	if p == "" {
+		return false
+	}
+	segs := strings.Split(p, topicSep)
+	for i, s := range segs {
+		if s == "" || (s == topicMultiWild && i != len(segs)-1) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchTopic returns whether the topic matches the pattern.
+func matchTopic(pattern, topic string) bool {
+	psegs := strings.Split(pattern, topicSep)
+	tsegs := strings.Split(topic, topicSep)
+	for i, p := range psegs {
+		if p == topicMultiWild {
+			return len(tsegs) > i
+		}
+		if i >= len(tsegs) || (p != topicWildcard && p != tsegs[i]) {
+			return false
+		}
+	}
+	return len(psegs) == len(tsegs)
+}
+
+// topicSub is a subscription of an application to a topic pattern.
+type topicSub struct {
+	pattern string
+	q       *qee
+	h       Handler
+}
+
+func (a *app) Subscribe(pattern string, h Handler, msgs ...interface{}) error {
+	if a.qee == nil {
+		glog.Fatalf("app's qee is nil!")
+	}
+
+	if !validPattern(pattern) {
+		return ErrInvalidPattern
+	}
+
+	for _, m := range msgs {
+		a.hive.RegisterMsg(m)
+	}
+
+	for i, s := range a.subs {
+		if s.pattern == pattern {
+			a.subs[i].h = h
+			a.hive.subscribe(pattern, a.qee, h)
+			return ErrDuplicatedPattern
+		}
+	}
+
+	a.subs = append(a.subs, topicSub{pattern: pattern, q: a.qee, h: h})
+	a.hive.subscribe(pattern, a.qee, h)
+	return nil
+}
+
+func (a *app) SubscribeFunc(pattern string, m MapFunc, r RcvFunc,
+	msgs ...interface{}) error {
+
+	return a.Subscribe(pattern, &funcHandler{m, r}, msgs...)
+}
+
+// topicHandler returns the handler of the first subscription of the app that
+// matches topic.
+func (a *app) topicHandler(topic string) Handler {
+	for _, s := range a.subs {
+		if matchTopic(s.pattern, topic) {
+			return s.h
+		}
+	}
+	return nil
+}
+
+// msgHandler returns the handler of the app for m.
+func (a *app) msgHandler(m *msg) Handler {
+	if m.MsgTopic != "" {
+		return a.topicHandler(m.MsgTopic)
+	}
+	return a.handler(m.Type())
+}
+
+func (h *hive) subscribe(pattern string, q *qee, l Handler) {
+	h.appsM.Lock()
+	defer h.appsM.Unlock()
+	for i, s := range h.subs {
+		if s.pattern == pattern && s.q == q {
+			h.subs[i].h = l
+			return
+		}
+	}
+
+	h.subs = append(h.subs, topicSub{pattern: pattern, q: q, h: l})
+}
+
+// publish enqueues m in the qees of the applications subscribed to its topic.
+// Each application receives the message at most once, using its first
+// matching subscription.
+func (h *hive) publish(m *msg) {
+	qs := make(map[*qee]bool)
+	h.appsM.RLock()
+	for _, s := range h.subs {
+		if qs[s.q] || !matchTopic(s.pattern, m.MsgTopic) {
+			continue
+		}
+		qs[s.q] = true
+		s.q.enqueMsg(msgAndHandler{msg: m, handler: s.h})
+	}
+	h.appsM.RUnlock()
+}
+
+func (h *hive) EmitTo(topic string, msgData interface{}, opts ...EmitOption) {
+	if !validTopic(topic) {
+		glog.Errorf("%v cannot emit on invalid topic %q", h, topic)
+		return
+	}
+	m := newMsgFromData(msgData, 0, 0)
+	m.MsgTopic = topic
+	m.applyOptions(opts)
+	h.emitMsg(m)
+}
+
+func (b *bee) EmitTo(topic string, msgData interface{}, opts ...EmitOption) {
+	if !validTopic(topic) {
+		glog.Errorf("%v cannot emit on invalid topic %q", b, topic)
+		return
+	}
+	m := b.newMsg(msgData, b.ID(), 0, opts)
+	m.MsgTopic = topic
+	b.bufferOrEmit(m)
+}
@@ -0,0 +1,129 @@
+package beehive
+
+import (
+	"bytes"
+	"encoding/gob"
+	"testing"
+	"time"
+)
+
+func TestMatchTopic(t *testing.T) {
+	tests := []struct {
+		pattern string
+		topic   string
+		match   bool
+	}{
+		{"orders.eu.created", "orders.eu.created", true},
+		{"orders.eu.created", "orders.us.created", false},
+		{"orders.*.created", "orders.eu.created", true},
+		{"orders.*.created", "orders.eu.deleted", false},
+		{"orders.*.created", "orders.created", false},
+		{"orders.*", "orders.eu.created", false},
+		{"orders.#", "orders.eu.created", true},
+		{"orders.#", "orders.eu", true},
+		{"orders.#", "orders", false},
+		{"*.#", "orders.eu", true},
+		{"#", "orders", true},
+	}
+	for _, test := range tests {
+		if m := matchTopic(test.pattern, test.topic); m != test.match {
+			t.Errorf("invalid match of %q for %q: actual=%v want=%v", test.pattern,
+				test.topic, m, test.match)
+		}
+	}
+
+	for _, p := range []string{"", "orders..created", "orders.#.created"} {
+		if validPattern(p) {
+			t.Errorf("pattern %q is valid", p)
+		}
+	}
+	for _, topic := range []string{"", "orders.*", "orders.#", "orders."} {
+		if validTopic(topic) {
+			t.Errorf("topic %q is valid", topic)
+		}
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	h := newHiveForTest()
+	type rcvd struct {
+		app   string
+		topic string
+	}
+	ch := make(chan rcvd, 10)
+	mf := func(msg Msg, ctx MapContext) MappedCells {
+		return MappedCells{{"D", msg.Topic()}}
+	}
+	rf := func(msg Msg, ctx RcvContext) error {
+		ch <- rcvd{app: ctx.App(), topic: msg.Topic()}
+		return nil
+	}
+
+	created := h.NewApp("created")
+	created.SubscribeFunc("orders.*.created", mf, rf)
+	all := h.NewApp("all")
+	all.SubscribeFunc("orders.#", mf, rf)
+	if err := all.SubscribeFunc("orders.#", mf, rf); err != ErrDuplicatedPattern {
+		t.Errorf("invalid error for duplicate subscription: %v", err)
+	}
+	if err := all.SubscribeFunc("orders.#.eu", mf, rf); err != ErrInvalidPattern {
+		t.Errorf("invalid error for invalid pattern: %v", err)
+	}
+
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	h.EmitTo("orders.eu.created", AppTestMsg(0))
+	h.EmitTo("orders.eu.deleted", AppTestMsg(0))
+	h.EmitTo("users.eu.created", AppTestMsg(0))
+
+	want := map[rcvd]bool{
+		{"created", "orders.eu.created"}: true,
+		{"all", "orders.eu.created"}:     true,
+		{"all", "orders.eu.deleted"}:     true,
+	}
+	for len(want) != 0 {
+		select {
+		case r := <-ch:
+			if !want[r] {
+				t.Fatalf("unexpected message: %v", r)
+			}
+			delete(want, r)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("messages not received: %v", want)
+		}
+	}
+	select {
+	case r := <-ch:
+		t.Errorf("unexpected message: %v", r)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+type topicTestMsg struct {
+	Order string
+}
+
+func TestSubscribeRegistersMsgs(t *testing.T) {
+	h := newHiveForTest()
+	a := h.NewApp("orders")
+	mf := func(msg Msg, ctx MapContext) MappedCells { return nil }
+	rf := func(msg Msg, ctx RcvContext) error { return nil }
+	a.SubscribeFunc("orders.#", mf, rf, topicTestMsg{})
+
+	m := newMsgFromData(topicTestMsg{Order: "o1"}, 0, 0)
+	m.MsgTopic = "orders.eu.created"
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(m); err != nil {
+		t.Fatalf("cannot encode the message: %v", err)
+	}
+	var d msg
+	if err := gob.NewDecoder(&buf).Decode(&d); err != nil {
+		t.Fatalf("cannot decode the message: %v", err)
+	}
+	if d.Data() != (topicTestMsg{Order: "o1"}) {
+		t.Errorf("invalid data: actual=%v want=%v", d.Data(),
+			topicTestMsg{Order: "o1"})
+	}
+}
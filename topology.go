@@ -0,0 +1,162 @@
+package beehive
+
+import (
+	"encoding/gob"
+	"errors"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/soheilhy/args"
+)
+
+// Well-known labels of hives.
+const (
+	LabelZone = "zone" // The zone of the hive.
+	LabelRack = "rack" // The rack of the hive.
+)
+
+var zone = args.NewString(args.Flag("zone", "", "the zone of the hive"))
+
+// Zone represents the zone of the hive, which is stored as its LabelZone label.
+func Zone(z string) HiveOption { return HiveOption(zone(z)) }
+
+var rack = args.NewString(args.Flag("rack", "", "the rack of the hive"))
+
+// Rack represents the rack of the hive, which is stored as its LabelRack label.
+func Rack(r string) HiveOption { return HiveOption(rack(r)) }
+
+var labels = args.NewString(args.Flag("labels", "",
+	"labels of the hive as comma-separated key=value pairs (e.g., gpu=true)"))
+
+// Labels represents the labels of the hive. Labels describe the failure domain
+// and the capabilities of hives, and applications can use them to constrain
+// where their bees are placed and replicated.
+func Labels(l map[string]string) HiveOption {
+	kvs := make([]string, 0, len(l))
+	for k, v := range l {
+		kvs = append(kvs, k+"="+v)
+	}
+	sort.Strings(kvs)
+	return HiveOption(labels(strings.Join(kvs, ",")))
+}
+
+// hiveLabels returns the labels of the hive in the options.
+func hiveLabels(opts []HiveOption) map[string]string {
+	l := make(map[string]string)
+	for _, kv := range strings.Split(labels.Get(opts), ",") {
+		if kv == "" {
+			continue
+		}
+		i := strings.Index(kv, "=")
+		if i < 0 {
+			glog.Errorf("invalid hive label %q", kv)
+			continue
+		}
+		l[kv[:i]] = kv[i+1:]
+	}
+	if z := zone.Get(opts); z != "" {
+		l[LabelZone] = z
+	}
+	if r := rack.Get(opts); r != "" {
+		l[LabelRack] = r
+	}
+	return l
+}
+
+// updateHiveLabels is a registry request to update the labels of a hive.
+type updateHiveLabels struct {
+	Hive   uint64
+	Labels map[string]string
+}
+
+func (r *registry) updateLabels(u updateHiveLabels) error {
+	i, ok := r.Hives[u.Hive]
+	if !ok {
+		return ErrNoSuchHive
+	}
+	i.Labels = u.Labels
+	r.Hives[u.Hive] = i
+	return nil
+}
+
+// syncLabels updates the labels of the hive in the registry, if they are
+// changed.
+func (h *hive) syncLabels() error {
+	i, err := h.registry.hive(h.ID())
+	if err == nil && (reflect.DeepEqual(i.Labels, h.config.Labels) ||
+		len(i.Labels) == 0 && len(h.config.Labels) == 0) {
+		return nil
+	}
+	_, err = h.node.ProposeRetry(hiveGroup,
+		updateHiveLabels{Hive: h.ID(), Labels: h.config.Labels},
+		h.config.RaftElectTimeout(), -1)
+	return err
+}
+
+// ErrNoMatchingHive is returned when no live hive has the labels required by
+// an application. The messages that need a new bee on such a hive are
+// dead-lettered.
+var ErrNoMatchingHive = errors.New("beehive: no hive has the required labels")
+
+// constraints restrict the hives on which the bees of an application are
+// placed and replicated.
+type constraints struct {
+	require map[string]string
+	spread  string
+}
+
+// RequireLabels is an application option that places and replicates the bees
+// of the application only on the hives that have all the given labels. For
+// example, RequireLabels(map[string]string{"gpu": "false"}) pins the
+// application to the hives labeled gpu=false.
+func RequireLabels(l map[string]string) AppOption {
+	return func(a *app) {
+		if a.constraints.require == nil {
+			a.constraints.require = make(map[string]string)
+		}
+		for k, v := range l {
+			a.constraints.require[k] = v
+		}
+	}
+}
+
+// SpreadReplicas is an application option that spreads the replicas of each
+// bee of the application across the hives with different values for the given
+// label. For example, SpreadReplicas(LabelZone) places the followers of a bee
+// in zones other than the zone of its leader, as long as there are enough
+// zones.
+func SpreadReplicas(label string) AppOption {
+	return func(a *app) {
+		a.constraints.spread = label
+	}
+}
+
+// allows returns whether the hive satisfies the required labels.
+func (c constraints) allows(h HiveInfo) bool {
+	for k, v := range c.require {
+		if h.Labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// filter returns the hives that satisfy the required labels.
+func (c constraints) filter(hives []HiveInfo) []HiveInfo {
+	if len(c.require) == 0 {
+		return hives
+	}
+	var allowed []HiveInfo
+	for _, h := range hives {
+		if c.allows(h) {
+			allowed = append(allowed, h)
+		}
+	}
+	return allowed
+}
+
+func init() {
+	gob.Register(updateHiveLabels{})
+}
@@ -0,0 +1,123 @@
+package beehive
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestHiveLabels(t *testing.T) {
+	cfg := hiveConfig(Labels(map[string]string{"gpu": "false", LabelZone: "z0"}),
+		Zone("z1"), Rack("r1"))
+	want := map[string]string{"gpu": "false", LabelZone: "z1", LabelRack: "r1"}
+	if !reflect.DeepEqual(cfg.Labels, want) {
+		t.Errorf("invalid labels: actual=%v want=%v", cfg.Labels, want)
+	}
+}
+
+func newLabeledHivesForTest(labels ...map[string]string) *hive {
+	h := newHiveForTest(Labels(labels[0])).(*hive)
+	h.registry.Hives[h.ID()] = h.info()
+	for i, l := range labels[1:] {
+		id := h.ID() + uint64(i) + 1
+		h.registry.Hives[id] = HiveInfo{ID: id, Labels: l}
+	}
+	return h
+}
+
+func TestSelectHivesSpread(t *testing.T) {
+	h := newLabeledHivesForTest(
+		map[string]string{LabelZone: "a"},
+		map[string]string{LabelZone: "a"},
+		map[string]string{LabelZone: "a"},
+		map[string]string{LabelZone: "b"},
+		map[string]string{LabelZone: "c", "gpu": "true"},
+	)
+	id := h.ID()
+
+	c := constraints{spread: LabelZone}
+	for i := 0; i < 10; i++ {
+		hives := h.replStrategy.selectHives(c, []uint64{id}, nil, 2)
+		if hives[0] > hives[1] {
+			hives[0], hives[1] = hives[1], hives[0]
+		}
+		if want := []uint64{id + 3, id + 4}; !reflect.DeepEqual(hives, want) {
+			t.Errorf("replicas are not spread: actual=%v want=%v", hives, want)
+		}
+	}
+
+	hives := h.replStrategy.selectHives(c, []uint64{id, id + 4}, nil, 2)
+	if len(hives) != 2 || hives[0] != id+3 {
+		t.Errorf("replicas are not spread: actual=%v want=[%v ...]", hives, id+3)
+	}
+
+	c.require = map[string]string{"gpu": "true"}
+	hives = h.replStrategy.selectHives(c, []uint64{id}, nil, 2)
+	if want := []uint64{id + 4}; !reflect.DeepEqual(hives, want) {
+		t.Errorf("invalid replicas with labels: actual=%v want=%v", hives, want)
+	}
+}
+
+func TestSelectHivesSpreadBlacklist(t *testing.T) {
+	h := newLabeledHivesForTest(
+		map[string]string{LabelZone: "a"},
+		map[string]string{LabelZone: "b"},
+		map[string]string{LabelZone: "b"},
+		map[string]string{LabelZone: "a"},
+	)
+	id := h.ID()
+
+	// The blacklisted hive does not hold a replica, and its zone is not used.
+	c := constraints{spread: LabelZone}
+	for i := 0; i < 10; i++ {
+		hives := h.replStrategy.selectHives(c, []uint64{id}, []uint64{id + 1}, 1)
+		if want := []uint64{id + 2}; !reflect.DeepEqual(hives, want) {
+			t.Errorf("replicas are not spread: actual=%v want=%v", hives, want)
+		}
+	}
+}
+
+func TestPlaceBeeRequiredLabels(t *testing.T) {
+	h := newLabeledHivesForTest(
+		map[string]string{"gpu": "true"},
+		map[string]string{"gpu": "true"},
+		map[string]string{"gpu": "false"},
+	)
+	a := h.NewApp("labeled", RequireLabels(map[string]string{"gpu": "false"}))
+	q := a.(*app).qee
+	for i := 0; i < 10; i++ {
+		id, err := q.placeBee(MappedCells{{"D", "k"}})
+		if err != nil || id != h.ID()+2 {
+			t.Errorf("bee placed on hive %v instead of %v: %v", id, h.ID()+2, err)
+		}
+	}
+
+	a = h.NewApp("unlabeled", RequireLabels(map[string]string{"gpu": "maybe"}))
+	q = a.(*app).qee
+	if id, err := q.placeBee(MappedCells{{"D", "k"}}); err != ErrNoMatchingHive {
+		t.Errorf("bee placed on hive %v without the required labels: %v", id, err)
+	}
+}
+
+func TestRequiredLabelsDeadLetter(t *testing.T) {
+	h := newHiveForTest(DeadLetters(true),
+		Labels(map[string]string{"gpu": "false"}))
+	a := h.NewApp("unlabeled", RequireLabels(map[string]string{"gpu": "true"}))
+	a.HandleFunc(AppTestMsg(0),
+		func(msg Msg, ctx MapContext) MappedCells {
+			return MappedCells{{"D", "0"}}
+		},
+		func(msg Msg, ctx RcvContext) error {
+			t.Errorf("message received on a hive without the required labels")
+			return nil
+		})
+
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	h.Emit(AppTestMsg(1))
+	letters := deadLettersForTest(t, h, 1)
+	if l := letters[0]; l.App != "unlabeled" || l.Err != ErrNoMatchingHive.Error() {
+		t.Errorf("invalid dead letter: %v", l)
+	}
+}
@@ -0,0 +1,52 @@
+package beehive
+
+import (
+	"encoding/gob"
+
+	"github.com/kandoo/beehive/state"
+)
+
+// DictChanged is the message sent to the bee that owns a watched dictionary,
+// after the bee commits a transaction that modifies the dictionary. There is
+// one message for each modified key. Dictionaries are watched using the Watch
+// option, and applications should handle this message to receive changes.
+//
+// Note that the changes made in the handler of DictChanged are watched as
+// well.
+type DictChanged struct {
+	Dict string       // The modified dictionary.
+	Key  string       // The modified key.
+	Old  interface{}  // The value before the transaction, or nil.
+	New  interface{}  // The value after the transaction, or nil if deleted.
+	Op   state.OpType // The type of the modification.
+}
+
+// dictChanges returns the changes of the watched dictionaries in ops. It must
+// be called before ops are applied on the L1 state.
+func (b *bee) dictChanges(ops []state.Op) (msgs []*msg) {
+	if len(b.app.watches) == 0 || b.app.handler(MsgType(DictChanged{})) == nil {
+		return nil
+	}
+
+	for _, o := range ops {
+		if !b.app.watches[o.D] {
+			continue
+		}
+		old, _ := b.stateL1.State.Dict(o.D).Get(o.K)
+		ch := DictChanged{
+			Dict: o.D,
+			Key:  o.K,
+			Old:  old,
+			Op:   o.T,
+		}
+		if o.T == state.Put {
+			ch.New = o.V
+		}
+		msgs = append(msgs, newMsgFromData(ch, b.ID(), b.ID()))
+	}
+	return msgs
+}
+
+func init() {
+	gob.Register(DictChanged{})
+}
@@ -0,0 +1,63 @@
+package beehive
+
+import (
+	"testing"
+
+	"github.com/kandoo/beehive/state"
+)
+
+func testWatch(t *testing.T, opts ...AppOption) {
+	h := newHiveForTest()
+	app := h.NewApp("watch", opts...)
+	mf := func(msg Msg, ctx MapContext) MappedCells {
+		return MappedCells{{"D", "0"}}
+	}
+	rf := func(msg Msg, ctx RcvContext) error {
+		n := int(msg.Data().(AppTestMsg))
+		ctx.Dict("Unwatched").Put("K", n)
+		if n == 0 {
+			return ctx.Dict("D").Del("K")
+		}
+		return ctx.Dict("D").Put("K", n)
+	}
+	app.HandleFunc(AppTestMsg(0), mf, rf)
+
+	ch := make(chan DictChanged)
+	crf := func(msg Msg, ctx RcvContext) error {
+		ch <- msg.Data().(DictChanged)
+		return nil
+	}
+	app.HandleFunc(DictChanged{}, mf, crf)
+
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	h.Emit(AppTestMsg(1))
+	c := <-ch
+	if c.Dict != "D" || c.Key != "K" || c.Old != nil || c.New.(int) != 1 ||
+		c.Op != state.Put {
+
+		t.Errorf("invalid change: actual=%#v want={D K nil 1 put}", c)
+	}
+
+	h.Emit(AppTestMsg(2))
+	c = <-ch
+	if c.Old.(int) != 1 || c.New.(int) != 2 || c.Op != state.Put {
+		t.Errorf("invalid change: actual=%#v want={D K 1 2 put}", c)
+	}
+
+	h.Emit(AppTestMsg(0))
+	c = <-ch
+	if c.Old.(int) != 2 || c.New != nil || c.Op != state.Del {
+		t.Errorf("invalid change: actual=%#v want={D K 2 nil del}", c)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	testWatch(t, Watch("D"))
+}
+
+func TestWatchPersistent(t *testing.T) {
+	testWatch(t, Persistent(1), Watch("D"))
+}